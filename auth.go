@@ -2,54 +2,262 @@ package piot
 
 import (
     "context"
-    "github.com/mnezerka/go-piot/model"
-    /*
+    "errors"
     "fmt"
+    "time"
+    "github.com/dgrijalva/jwt-go"
     "github.com/op/go-logging"
-    "go.mongodb.org/mongo-driver/mongo"
-    "go.mongodb.org/mongo-driver/bson"
+    "github.com/mnezerka/go-piot/config"
     "github.com/mnezerka/go-piot/model"
+    "go.mongodb.org/mongo-driver/bson/primitive"
     "golang.org/x/crypto/bcrypt"
-    */
 )
 
+// Error returned by services if context is not allowed to access the
+// requested resource
+type ForbiddenError struct {
+    Msg string
+}
+
+func (e *ForbiddenError) Error() string {
+    return e.Msg
+}
+
+func NewForbiddenError(format string, a ...interface{}) error {
+    return &ForbiddenError{Msg: fmt.Sprintf(format, a...)}
+}
+
+// Check if error was caused by insufficient permissions
+func IsForbidden(err error) bool {
+    _, ok := err.(*ForbiddenError)
+    return ok
+}
+
 type AuthContext struct {
     context.Context
     User *model.User
+
+    // context of internal processing (e.g. MQTT subscription), it is not
+    // restricted by org membership
+    System bool
+
+    // roles of the user in orgs the user is member of
+    OrgRoles map[primitive.ObjectID]string
 }
 
+// Create context of the user, membership is taken from user orgs with
+// viewer role since roles are not known here, see Users.GetAuthContext for
+// context with membership and roles fetched from database
 func NewAuthContext(user *model.User) *AuthContext {
-    return &AuthContext{User: user}
+    ctx := &AuthContext{Context: context.Background(), User: user, OrgRoles: make(map[primitive.ObjectID]string)}
+    if user != nil {
+        for _, org := range user.Orgs {
+            ctx.OrgRoles[org.Id] = model.ORG_ROLE_VIEWER
+        }
+    }
+    return ctx
+}
+
+// Create context for internal processing
+func NewSystemContext() *AuthContext {
+    return &AuthContext{Context: context.Background(), System: true}
+}
+
+// Check if context has access to things of all orgs
+func (ctx *AuthContext) IsUnrestricted() bool {
+    return ctx.System || (ctx.User != nil && ctx.User.IsAdmin)
+}
+
+// Check if context is allowed to access things of given org. Context without
+// user and not flagged as system context has no access at all
+func (ctx *AuthContext) IsOrgMember(orgId primitive.ObjectID) bool {
+    return ctx.HasOrgRole(orgId, model.ORG_ROLE_VIEWER)
+}
+
+// Check if context has at least given role in the org
+func (ctx *AuthContext) HasOrgRole(orgId primitive.ObjectID, role string) bool {
+    if ctx.IsUnrestricted() {
+        return true
+    }
+
+    if ctx.User == nil || orgId == primitive.NilObjectID {
+        return false
+    }
+
+    userRole, ok := ctx.OrgRoles[orgId]
+    if !ok {
+        return false
+    }
+
+    return model.GetOrgRoleLevel(userRole) >= model.GetOrgRoleLevel(role)
+}
+
+// Check if context is allowed to modify things of given org
+func (ctx *AuthContext) CanModifyOrg(orgId primitive.ObjectID) bool {
+    return ctx.HasOrgRole(orgId, model.ORG_ROLE_EDITOR)
+}
+
+// Restrict filter to orgs accessible by the context, filter is not modified
+// and restricted copy is returned
+func (ctx *AuthContext) OrgFilter(filter *ThingFilter) *ThingFilter {
+    restricted := ThingFilter{}
+    if filter != nil {
+        restricted = *filter
+    }
+
+    if ctx.IsUnrestricted() {
+        return &restricted
+    }
+
+    orgIds := []primitive.ObjectID{}
+    if ctx.User != nil {
+        for orgId := range ctx.OrgRoles {
+            if restricted.OrgIds == nil || containsObjectId(restricted.OrgIds, orgId) {
+                orgIds = append(orgIds, orgId)
+            }
+        }
+    }
+    restricted.OrgIds = orgIds
+
+    return &restricted
+}
+
+func containsObjectId(ids []primitive.ObjectID, id primitive.ObjectID) bool {
+    for _, item := range ids {
+        if item == id {
+            return true
+        }
+    }
+    return false
 }
 
-/*
-type Auth struct { }
+// Error returned if token is malformed, expired or not signed by us
+var ErrInvalidToken = errors.New("Invalid token")
 
-func (a *Auth) AuthUser(ctx context.Context, email, password string) (error) {
-    ctx.Value("log").(*logging.Logger).Debugf("Authenticate user: %s", email)
+// Claims of tokens issued by Auth service
+type Claims struct {
+    UserId string `json:"user_id"`
+    ActiveOrgId string `json:"active_org_id"`
+    IsAdmin bool `json:"is_admin"`
+    jwt.StandardClaims
+}
+
+// Authentication of users and issuing of JWT tokens
+type Auth struct {
+    log *logging.Logger
+    users *Users
+    params *config.Parameters
+}
+
+func NewAuth(log *logging.Logger, users *Users, params *config.Parameters) *Auth {
+    return &Auth{log: log, users: users, params: params}
+}
 
-    db := ctx.Value("db").(*mongo.Database)
+// Verify user credentials
+func (a *Auth) AuthUser(email, password string) (*model.User, error) {
+    a.log.Debugf("Authenticate user: %s", email)
 
     // try to find user in database
-    var user model.User
-    collection := db.Collection("users")
-    err := collection.FindOne(ctx, bson.D{{"email", email}}).Decode(&user)
+    user, err := a.users.FindByEmail(email)
     if err != nil {
-        ctx.Value("log").(*logging.Logger).Errorf(err.Error())
-        return fmt.Errorf("User identified by email %s does not exist or provided credentials are wrong.", email)
+        return nil, fmt.Errorf("User identified by email %s does not exist or provided credentials are wrong.", email)
     }
 
-    ctx.Value("log").(*logging.Logger).Debugf("User %s exists", email)
+    a.log.Debugf("User %s exists", email)
 
     // check if password is correct
     err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
     if err != nil {
-        ctx.Value("log").(*logging.Logger).Errorf(err.Error())
-        return fmt.Errorf("User identified by email %s does not exist or provided credentials are wrong.", email)
+        a.log.Errorf("Password check for %s failed (%v)", email, err)
+        return nil, fmt.Errorf("User identified by email %s does not exist or provided credentials are wrong.", email)
+    }
+
+    a.log.Debugf("Authentication for user %s passed", email)
+
+    return user, nil
+}
+
+// Verify user credentials and issue token for the user
+func (a *Auth) Login(email, password string) (string, error) {
+    user, err := a.AuthUser(email, password)
+    if err != nil {
+        return "", err
+    }
+
+    return a.IssueToken(user)
+}
+
+// Issue signed token for the user
+func (a *Auth) IssueToken(user *model.User) (string, error) {
+    now := time.Now()
+
+    claims := &Claims{
+        UserId: user.Id.Hex(),
+        ActiveOrgId: user.ActiveOrgId.Hex(),
+        IsAdmin: user.IsAdmin,
+        StandardClaims: jwt.StandardClaims{
+            Subject: user.Email,
+            IssuedAt: now.Unix(),
+            ExpiresAt: now.Add(a.params.JwtTokenExpiration).Unix(),
+        },
+    }
+
+    token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(a.params.JwtPassword))
+    if err != nil {
+        a.log.Errorf("Token for user %s cannot be signed (%v)", user.Email, err)
+        return "", errors.New("Error while issuing token")
     }
 
-    ctx.Value("log").(*logging.Logger).Debugf("Authentication for user %s passed", email)
+    return token, nil
+}
+
+// Validate token and create context of the user identified by token. User
+// is fetched from database, so changes of user (e.g. org membership) take
+// effect immediately
+func (a *Auth) ValidateToken(tokenString string) (*AuthContext, error) {
+    claims, err := a.parseToken(tokenString)
+    if err != nil {
+        return nil, err
+    }
+
+    userId, err := primitive.ObjectIDFromHex(claims.UserId)
+    if err != nil {
+        a.log.Warningf("Token contains invalid user id %s", claims.UserId)
+        return nil, ErrInvalidToken
+    }
+
+    user, err := a.users.Get(userId)
+    if err != nil {
+        a.log.Warningf("User %s identified by token not found (%v)", claims.UserId, err)
+        return nil, ErrInvalidToken
+    }
+
+    return a.users.GetAuthContext(user)
+}
+
+// Issue new token for the user identified by valid token
+func (a *Auth) RefreshToken(tokenString string) (string, error) {
+    ctx, err := a.ValidateToken(tokenString)
+    if err != nil {
+        return "", err
+    }
+
+    return a.IssueToken(ctx.User)
+}
+
+func (a *Auth) parseToken(tokenString string) (*Claims, error) {
+    claims := &Claims{}
+
+    token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+        if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+            return nil, fmt.Errorf("Unexpected signing method %v", token.Header["alg"])
+        }
+        return []byte(a.params.JwtPassword), nil
+    })
+    if err != nil || !token.Valid {
+        a.log.Warningf("Token validation failed (%v)", err)
+        return nil, ErrInvalidToken
+    }
 
-    return nil
+    return claims, nil
 }
-*/
@@ -0,0 +1,80 @@
+package piot_test
+
+import (
+    "testing"
+    "time"
+    "github.com/mnezerka/go-piot"
+    "github.com/mnezerka/go-piot/test"
+)
+
+func getAuth(t *testing.T) *piot.Auth {
+    log := test.GetLogger(t)
+    return piot.NewAuth(log, piot.NewUsers(log, test.GetDb(t)), test.GetConfig())
+}
+
+func TestAuthUser(t *testing.T) {
+    db := test.GetDb(t)
+    test.CleanDb(t, db)
+    auth := getAuth(t)
+
+    test.CreateUser(t, db, "test1@com", "pass")
+
+    user, err := auth.AuthUser("test1@com", "pass")
+    test.Ok(t, err)
+    test.Equals(t, "test1@com", user.Email)
+
+    _, err = auth.AuthUser("test1@com", "wrong")
+    test.Assert(t, err != nil, "Wrong password shall be rejected")
+
+    _, err = auth.AuthUser("xx@com", "pass")
+    test.Assert(t, err != nil, "Unknown user shall be rejected")
+}
+
+func TestAuthToken(t *testing.T) {
+    db := test.GetDb(t)
+    test.CleanDb(t, db)
+    auth := getAuth(t)
+
+    userId := test.CreateUser(t, db, "test1@com", "pass")
+    orgId := test.CreateOrg(t, db, "org1")
+    test.AddOrgUser(t, db, orgId, userId)
+
+    token, err := auth.Login("test1@com", "pass")
+    test.Ok(t, err)
+
+    ctx, err := auth.ValidateToken(token)
+    test.Ok(t, err)
+    test.Equals(t, userId, ctx.User.Id)
+    test.Assert(t, ctx.IsOrgMember(orgId), "User shall be member of org")
+
+    refreshed, err := auth.RefreshToken(token)
+    test.Ok(t, err)
+    _, err = auth.ValidateToken(refreshed)
+    test.Ok(t, err)
+
+    _, err = auth.ValidateToken(token + "x")
+    test.Equals(t, piot.ErrInvalidToken, err)
+
+    _, err = auth.Login("test1@com", "wrong")
+    test.Assert(t, err != nil, "Token shall not be issued for wrong password")
+}
+
+func TestAuthExpiredToken(t *testing.T) {
+    db := test.GetDb(t)
+    test.CleanDb(t, db)
+    log := test.GetLogger(t)
+    params := test.GetConfig()
+    params.JwtTokenExpiration = -1 * time.Minute
+    auth := piot.NewAuth(log, piot.NewUsers(log, db), params)
+
+    test.CreateUser(t, db, "test1@com", "pass")
+
+    token, err := auth.Login("test1@com", "pass")
+    test.Ok(t, err)
+
+    _, err = auth.ValidateToken(token)
+    test.Equals(t, piot.ErrInvalidToken, err)
+
+    _, err = auth.RefreshToken(token)
+    test.Equals(t, piot.ErrInvalidToken, err)
+}
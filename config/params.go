@@ -11,6 +11,47 @@ type Parameters struct {
     JwtPassword string
     DbUri string
     DbName string
+    SwitchSyncTimeout time.Duration
+    SwitchSyncRetries int32
+    InfluxDbBatchSize int
+    InfluxDbFlushInterval time.Duration
+    InfluxDbRetryInterval time.Duration
+    InfluxDbMaxRetryInterval time.Duration
+    InfluxDbMaxRetries int
+    InfluxDbMaxBufferedRows int
+    InfluxDbDropPolicy string
+    WriteQueueDir string
+    WriteQueueSegmentSize int64
+    WriteQueueReplayInterval time.Duration
+    MqttWorkers int
+    MqttQueueSize int
+    MqttDrainTimeout time.Duration
+    RepositoryCacheTtl time.Duration
+    MqttCaFile string
+    MqttCertFile string
+    MqttKeyFile string
+    MqttInsecureSkipVerify bool
+    MqttKeepAlive time.Duration
+    MqttConnectTimeout time.Duration
+    MqttAutoReconnect bool
+    MqttMaxReconnectInterval time.Duration
+    MqttCleanSession bool
+    MqttStoreDir string
+    MqttStatus bool
+    MqttStatusTopic string
+    MqttSubscribeQos int
+    MqttRoutesTtl time.Duration
+    MqttPublishTimeout time.Duration
+    MqttAvailabilityQos int
+    MqttAvailabilityRetain bool
+    MqttMeasurementQos int
+    MqttMeasurementRetain bool
+    MqttUnitQos int
+    MqttUnitRetain bool
+    MqttNetQos int
+    MqttNetRetain bool
+    MqttCommandsQos int
+    MqttCommandsRetain bool
 }
 
 func NewParameters() *Parameters {
@@ -21,6 +62,47 @@ func NewParameters() *Parameters {
         JwtPassword: "jwt-secret",
         DbUri: "",
         DbName: "",
+        SwitchSyncTimeout: 30 * time.Second,
+        SwitchSyncRetries: 3,
+        InfluxDbBatchSize: 500,
+        InfluxDbFlushInterval: 1 * time.Second,
+        InfluxDbRetryInterval: 1 * time.Second,
+        InfluxDbMaxRetryInterval: 1 * time.Minute,
+        InfluxDbMaxRetries: 10,
+        InfluxDbMaxBufferedRows: 100000,
+        InfluxDbDropPolicy: "oldest",
+        WriteQueueDir: "",
+        WriteQueueSegmentSize: 4 * 1024 * 1024,
+        WriteQueueReplayInterval: 10 * time.Second,
+        MqttWorkers: 4,
+        MqttQueueSize: 1000,
+        MqttDrainTimeout: 10 * time.Second,
+        RepositoryCacheTtl: 30 * time.Second,
+        MqttCaFile: "",
+        MqttCertFile: "",
+        MqttKeyFile: "",
+        MqttInsecureSkipVerify: false,
+        MqttKeepAlive: 30 * time.Second,
+        MqttConnectTimeout: 30 * time.Second,
+        MqttAutoReconnect: true,
+        MqttMaxReconnectInterval: 1 * time.Minute,
+        MqttCleanSession: true,
+        MqttStoreDir: "",
+        MqttStatus: true,
+        MqttStatusTopic: "",
+        MqttSubscribeQos: 0,
+        MqttRoutesTtl: 1 * time.Minute,
+        MqttPublishTimeout: 10 * time.Second,
+        MqttAvailabilityQos: 1,
+        MqttAvailabilityRetain: true,
+        MqttMeasurementQos: 0,
+        MqttMeasurementRetain: false,
+        MqttUnitQos: 0,
+        MqttUnitRetain: true,
+        MqttNetQos: 0,
+        MqttNetRetain: true,
+        MqttCommandsQos: 1,
+        MqttCommandsRetain: false,
     }
     return p
 }
@@ -0,0 +1,52 @@
+package piot
+
+import (
+    "sync"
+    "github.com/op/go-logging"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// availability of thing changed, value is VALUE_YES or VALUE_NO
+const EVENT_AVAILABILITY_CHANGED = "availability_changed"
+
+// configuration of thing changed (incl. creation and deletion of thing)
+const EVENT_THING_CHANGED = "thing_changed"
+
+// Represents change of thing state
+type Event struct {
+    Type string
+    ThingId primitive.ObjectID
+    Time int32
+    Value string
+}
+
+type EventHandler func(event *Event)
+
+// Simple synchronous event bus, handlers are called in order of
+// subscription from goroutine emitting the event
+type Events struct {
+    log *logging.Logger
+    mutex sync.RWMutex
+    handlers []EventHandler
+}
+
+func NewEvents(log *logging.Logger) *Events {
+    return &Events{log: log}
+}
+
+func (e *Events) Subscribe(handler EventHandler) {
+    e.mutex.Lock()
+    defer e.mutex.Unlock()
+    e.handlers = append(e.handlers, handler)
+}
+
+func (e *Events) Emit(event *Event) {
+    e.log.Debugf("Emitting event %s for thing <%s>", event.Type, event.ThingId.Hex())
+
+    e.mutex.RLock()
+    defer e.mutex.RUnlock()
+
+    for _, handler := range e.handlers {
+        handler(event)
+    }
+}
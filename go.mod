@@ -7,6 +7,8 @@ require (
 	github.com/eclipse/paho.mqtt.golang v1.2.0
 	github.com/go-sql-driver/mysql v1.5.0
 	github.com/influxdata/line-protocol v0.0.0-20190509173118-5712a8124a9a
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/op/go-logging v0.0.0-20160315200505-970db520ece7
 	github.com/tidwall/gjson v1.6.0
 	go.mongodb.org/mongo-driver v1.3.1
@@ -0,0 +1,154 @@
+package piot
+
+import (
+    "errors"
+    "fmt"
+    "math"
+    "time"
+    "github.com/op/go-logging"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "github.com/mnezerka/go-piot/model"
+)
+
+// aggregations of values within single step
+const HISTORY_AGGREGATION_NONE = ""
+const HISTORY_AGGREGATION_MIN = "min"
+const HISTORY_AGGREGATION_MAX = "max"
+const HISTORY_AGGREGATION_MEAN = "mean"
+
+// Error returned if none of sinks enabled for the thing can be queried
+var ErrNoHistorySource = errors.New("No sink with history is enabled for thing")
+
+// Sink history of thing values can be read from, values in time range
+// <from, to) are returned ordered by time
+type HistorySource interface {
+    GetSensorValues(thing *model.Thing, from, to time.Time) ([]model.HistoryValue, error)
+    GetSwitchStates(thing *model.Thing, from, to time.Time) ([]model.HistoryValue, error)
+}
+
+// Reading of historical values of things. History is read from first sink
+// enabled for the thing (see model.Thing.GetSinks) which implements
+// HistorySource (influxdb, mysqldb, postgresdb, sqlitedb)
+type History struct {
+    log *logging.Logger
+    things *Things
+    sinks *Sinks
+}
+
+func NewHistory(log *logging.Logger, things *Things, sinks *Sinks) *History {
+    return &History{log: log, things: things, sinks: sinks}
+}
+
+// Get measurements of sensor in time range <from, to), values are
+// aggregated to steps aligned to unix epoch, step 0 means raw values
+func (h *History) QuerySensor(ctx *AuthContext, thingId primitive.ObjectID, from, to time.Time, aggregation string, step time.Duration) ([]model.HistoryValue, error) {
+    return h.query(ctx, thingId, from, to, aggregation, step, HistorySource.GetSensorValues)
+}
+
+// Get states of switch in time range <from, to), see QuerySensor
+func (h *History) QuerySwitch(ctx *AuthContext, thingId primitive.ObjectID, from, to time.Time, aggregation string, step time.Duration) ([]model.HistoryValue, error) {
+    return h.query(ctx, thingId, from, to, aggregation, step, HistorySource.GetSwitchStates)
+}
+
+func (h *History) query(
+        ctx *AuthContext,
+        thingId primitive.ObjectID,
+        from, to time.Time,
+        aggregation string,
+        step time.Duration,
+        get func(HistorySource, *model.Thing, time.Time, time.Time) ([]model.HistoryValue, error)) ([]model.HistoryValue, error) {
+
+    h.log.Debugf("Querying history of thing <%s> from %v to %v (aggregation: %s, step: %v)", thingId.Hex(), from, to, aggregation, step)
+
+    if !isValidHistoryAggregation(aggregation) {
+        return nil, fmt.Errorf("Unknown aggregation %s", aggregation)
+    }
+    if aggregation != HISTORY_AGGREGATION_NONE && step < time.Second {
+        return nil, fmt.Errorf("Step of aggregation %s must be at least 1s", aggregation)
+    }
+
+    // access of user to thing is verified here
+    thing, err := h.things.Get(ctx, thingId)
+    if err != nil {
+        return nil, err
+    }
+
+    source := h.getSource(thing)
+    if source == nil {
+        return nil, ErrNoHistorySource
+    }
+
+    values, err := get(source, thing, from, to)
+    if err != nil {
+        h.log.Errorf("History of thing %s cannot be read (%v)", thing.Name, err)
+        return nil, err
+    }
+
+    if aggregation == HISTORY_AGGREGATION_NONE {
+        return values, nil
+    }
+
+    return aggregateHistory(values, aggregation, step), nil
+}
+
+func (h *History) getSource(thing *model.Thing) HistorySource {
+    for _, name := range thing.GetSinks() {
+        sink, ok := h.sinks.Get(name)
+        if !ok {
+            continue
+        }
+        if source, ok := sink.(HistorySource); ok {
+            return source
+        }
+    }
+
+    return nil
+}
+
+func isValidHistoryAggregation(aggregation string) bool {
+    switch aggregation {
+    case HISTORY_AGGREGATION_NONE, HISTORY_AGGREGATION_MIN, HISTORY_AGGREGATION_MAX, HISTORY_AGGREGATION_MEAN:
+        return true
+    }
+    return false
+}
+
+// Aggregate values ordered by time to steps, steps without values are
+// omitted
+func aggregateHistory(values []model.HistoryValue, aggregation string, step time.Duration) []model.HistoryValue {
+    result := []model.HistoryValue{}
+    seconds := int32(step / time.Second)
+
+    var current *model.HistoryValue
+    var count int
+
+    for _, value := range values {
+        start := value.Time - value.Time % seconds
+
+        if current == nil || current.Time != start {
+            if current != nil && aggregation == HISTORY_AGGREGATION_MEAN {
+                current.Value /= float64(count)
+            }
+            result = append(result, model.HistoryValue{Time: start, Value: value.Value})
+            current = &result[len(result) - 1]
+            count = 1
+            continue
+        }
+
+        count++
+        switch aggregation {
+        case HISTORY_AGGREGATION_MIN:
+            current.Value = math.Min(current.Value, value.Value)
+        case HISTORY_AGGREGATION_MAX:
+            current.Value = math.Max(current.Value, value.Value)
+        case HISTORY_AGGREGATION_MEAN:
+            current.Value += value.Value
+        }
+    }
+
+    if current != nil && aggregation == HISTORY_AGGREGATION_MEAN {
+        current.Value /= float64(count)
+    }
+
+    return result
+}
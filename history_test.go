@@ -0,0 +1,99 @@
+package piot_test
+
+import (
+    "testing"
+    "time"
+    "github.com/mnezerka/go-piot"
+    "github.com/mnezerka/go-piot/model"
+    "github.com/mnezerka/go-piot/test"
+)
+
+func TestHistoryQuerySensor(t *testing.T) {
+    const SENSOR = "sensor"
+    const USER = "user@test.com"
+
+    db := test.GetDb(t)
+    log := test.GetLogger(t)
+    test.CleanDb(t, db)
+    ctx := test.GetContext(t)
+    sensorId := test.CreateThing(t, db, SENSOR)
+    test.CreateUser(t, db, USER, "pass")
+    things := test.GetThings(t, log, db)
+
+    sinks := test.GetSinks(t, log, test.GetInfluxDb(t, log), test.GetMysqlDb(t, log))
+    history := piot.NewHistory(log, things, sinks)
+    from := time.Unix(0, 0)
+    to := time.Unix(1000, 0)
+
+    // none of sinks enabled for thing provides history
+    _, err := history.QuerySensor(ctx, sensorId, from, to, piot.HISTORY_AGGREGATION_NONE, 0)
+    test.Equals(t, piot.ErrNoHistorySource, err)
+
+    historySink := test.GetHistorySink(t, log)
+    sinks.Register(model.SINK_SQLITEDB, historySink)
+    test.SetThingSinks(t, db, sensorId, []string{model.SINK_SQLITEDB})
+
+    thing, err := things.Get(ctx, sensorId)
+    test.Ok(t, err)
+    for i, value := range []string{"1", "5", "3", "10", "20"} {
+        test.Ok(t, historySink.StoreMeasurement(thing, value, time.Unix(int64(100 + i * 30), 0)))
+    }
+
+    // raw values
+    values, err := history.QuerySensor(ctx, sensorId, from, to, piot.HISTORY_AGGREGATION_NONE, 0)
+    test.Ok(t, err)
+    test.Equals(t, 5, len(values))
+
+    // values at 100, 130, 160 and 190, 220 fall into two steps
+    values, err = history.QuerySensor(ctx, sensorId, from, to, piot.HISTORY_AGGREGATION_MIN, time.Minute * 3)
+    test.Ok(t, err)
+    test.Equals(t, []model.HistoryValue{{Time: 0, Value: 1}, {Time: 180, Value: 10}}, values)
+
+    values, err = history.QuerySensor(ctx, sensorId, from, to, piot.HISTORY_AGGREGATION_MAX, time.Minute * 3)
+    test.Ok(t, err)
+    test.Equals(t, []model.HistoryValue{{Time: 0, Value: 5}, {Time: 180, Value: 20}}, values)
+
+    values, err = history.QuerySensor(ctx, sensorId, from, to, piot.HISTORY_AGGREGATION_MEAN, time.Minute * 3)
+    test.Ok(t, err)
+    test.Equals(t, []model.HistoryValue{{Time: 0, Value: 3}, {Time: 180, Value: 15}}, values)
+
+    // invalid aggregation
+    _, err = history.QuerySensor(ctx, sensorId, from, to, "xxx", time.Minute)
+    test.Assert(t, err != nil, "Unknown aggregation accepted")
+    _, err = history.QuerySensor(ctx, sensorId, from, to, piot.HISTORY_AGGREGATION_MEAN, 0)
+    test.Assert(t, err != nil, "Aggregation without step accepted")
+
+    // user not assigned to org of thing
+    _, err = history.QuerySensor(getUserContext(t, db, USER), sensorId, from, to, piot.HISTORY_AGGREGATION_NONE, 0)
+    test.Assert(t, piot.IsForbidden(err), "History of foreign thing is available")
+
+    // switch history
+    values, err = history.QuerySwitch(ctx, sensorId, from, to, piot.HISTORY_AGGREGATION_NONE, 0)
+    test.Ok(t, err)
+    test.Equals(t, 0, len(values))
+}
+
+// Things with deprecated StoreInfluxDb flag get history from InfluxDB
+func TestHistoryQueryInfluxDb(t *testing.T) {
+    const SENSOR = "sensor"
+
+    db := test.GetDb(t)
+    log := test.GetLogger(t)
+    test.CleanDb(t, db)
+    ctx := test.GetContext(t)
+    sensorId := test.CreateThing(t, db, SENSOR)
+    orgId := test.CreateOrg(t, db, "org1")
+    test.AddOrgThing(t, db, orgId, SENSOR)
+    things := test.GetThings(t, log, db)
+
+    httpClient := test.GetHttpClient(t, log)
+    httpClient.Response = `{"results":[{"statement_id":0,"series":[{"name":"sensor","columns":["time","value"],"values":[[100,1],[130,5]]}]}]}`
+    influxDb := piot.NewInfluxDb(log, test.GetOrgs(t, log, db), httpClient, "http://uri", "user", "pass")
+
+    sinks := test.GetSinks(t, log, influxDb, test.GetMysqlDb(t, log))
+    history := piot.NewHistory(log, things, sinks)
+
+    values, err := history.QuerySensor(ctx, sensorId, time.Unix(0, 0), time.Unix(1000, 0), piot.HISTORY_AGGREGATION_MEAN, time.Minute * 3)
+    test.Ok(t, err)
+    test.Equals(t, []model.HistoryValue{{Time: 0, Value: 3}}, values)
+}
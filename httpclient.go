@@ -2,16 +2,32 @@ package piot
 
 import (
     "bytes"
+    "errors"
     "io/ioutil"
     "net/http"
+    "time"
     "github.com/op/go-logging"
 )
 
 type IHttpClient interface {
     //PostMeasurement(ctx context.Context, thing *model.Thing, value string)
-    PostString(url, body string, username *string, password *string)
+    // post body to url, status code of response is returned
+    PostString(url, body string, username *string, password *string) (int, error)
+    PostStringWithHeaders(url, body string, headers map[string]string) (int, error)
 }
 
+// Client sending requests with response body (e.g. queries), status code
+// and body of response are returned
+type IHttpQueryClient interface {
+    Query(method, url, body string, headers map[string]string) (int, []byte, error)
+}
+
+// Error returned by clients which cannot send queries
+var ErrHttpQueryNotSupported = errors.New("Http client doesn't support queries")
+
+// Timeout of whole request incl. reading of response
+const HTTP_CLIENT_TIMEOUT = 30 * time.Second
+
 type HttpClient struct {
     log *logging.Logger
     client *http.Client
@@ -20,22 +36,76 @@ type HttpClient struct {
 func NewHttpClient(log *logging.Logger) IHttpClient {
 
     httpClient := &HttpClient{log: log}
-    httpClient.client = &http.Client{}
+    httpClient.client = &http.Client{Timeout: HTTP_CLIENT_TIMEOUT}
 
     return httpClient
 }
 
-func (c *HttpClient) PostString(url, body string, username *string, password *string) {
+func (c *HttpClient) PostString(url, body string, username *string, password *string) (int, error) {
     c.log.Debugf("Http POST to %s", url)
 
     req, err := http.NewRequest("POST", url, bytes.NewReader([]byte(body)))
+    if err != nil {
+        c.log.Errorf("Http Post failed (%s)", err.Error())
+        return 0, err
+    }
     if username != nil && password != nil {
         req.SetBasicAuth(*username, *password)
     }
+
+    return c.do(req)
+}
+
+func (c *HttpClient) PostStringWithHeaders(url, body string, headers map[string]string) (int, error) {
+    c.log.Debugf("Http POST to %s", url)
+
+    req, err := http.NewRequest("POST", url, bytes.NewReader([]byte(body)))
+    if err != nil {
+        c.log.Errorf("Http Post failed (%s)", err.Error())
+        return 0, err
+    }
+    for name, value := range headers {
+        req.Header.Set(name, value)
+    }
+
+    return c.do(req)
+}
+
+func (c *HttpClient) Query(method, url, body string, headers map[string]string) (int, []byte, error) {
+    c.log.Debugf("Http %s query to %s", method, url)
+
+    req, err := http.NewRequest(method, url, bytes.NewReader([]byte(body)))
+    if err != nil {
+        c.log.Errorf("Http query failed (%s)", err.Error())
+        return 0, nil, err
+    }
+    for name, value := range headers {
+        req.Header.Set(name, value)
+    }
+
+    res, err := c.client.Do(req)
+    if err != nil {
+        c.log.Errorf("Http query failed (%s)", err.Error())
+        return 0, nil, err
+    }
+    defer res.Body.Close()
+
+    response, err := ioutil.ReadAll(res.Body)
+    if err != nil {
+        c.log.Errorf("Http query failed (%s)", err.Error())
+        return 0, nil, err
+    }
+
+    c.log.Debugf("Http query response status code: %d", res.StatusCode)
+
+    return res.StatusCode, response, nil
+}
+
+func (c *HttpClient) do(req *http.Request) (int, error) {
     res, err := c.client.Do(req)
     if err != nil {
         c.log.Errorf("Http Post failed (%s)", err.Error())
-        return
+        return 0, err
     }
     response, err := ioutil.ReadAll(res.Body)
     if err != nil {
@@ -46,4 +116,6 @@ func (c *HttpClient) PostString(url, body string, username *string, password *st
 
     c.log.Debugf("Http post response status code: %d", res.StatusCode)
     c.log.Debugf("Http post response body: %s", response)
+
+    return res.StatusCode, nil
 }
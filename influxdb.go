@@ -7,6 +7,10 @@ dlfjsdlfjkkkaaaajjjkkkttps://github.com/influxdata/influxdb-client-go/blob/devel
 
 import (
     "bytes"
+    "encoding/base64"
+    "encoding/csv"
+    "encoding/json"
+    "io"
     "path"
     "fmt"
     "net/url"
@@ -18,10 +22,13 @@ import (
     proto "github.com/influxdata/line-protocol"
 )
 
+// Storage of thing values in InfluxDB. Error is returned only if data
+// could not be delivered due to issue that could be temporary (e.g.
+// unavailable server), data rejected for good are just logged
 type IInfluxDb interface {
-    PostMeasurement(thing *model.Thing, value string)
-    PostSwitchState(thing *model.Thing, value string)
-    PostLocation(thing *model.Thing, lat, lng float64, sat, ts int32)
+    PostMeasurement(thing *model.Thing, value string, ts time.Time) error
+    PostSwitchState(thing *model.Thing, value string, ts time.Time) error
+    PostLocation(thing *model.Thing, lat, lng float64, sat, ts int32) error
 }
 
 type InfluxDb struct {
@@ -63,20 +70,18 @@ func paramToString(name string, value interface{}) (string, error) {
     return result, nil
 }
 
-func (db *InfluxDb) PostMeasurement(thing *model.Thing, value string) {
+func (db *InfluxDb) PostMeasurement(thing *model.Thing, value string, ts time.Time) error {
     db.log.Debugf("Posting measurement to InfluxDB, thing: %s, val: %s", thing.Name, value)
 
     // get thing org -> get influxdb assigned to org
-    org, err := db.orgs.Get(thing.OrgId)
-    if err != nil {
-        return
+    org, err := db.getOrg(thing)
+    if org == nil {
+        return err
     }
 
-    db.log.Debugf("Going to post to InfluxDB %s as %s", org.InfluxDb, org.InfluxDbUsername)
-
     if thing.Type != model.THING_TYPE_SENSOR {
         // ignore things which don't represent sensor
-        return
+        return nil
     }
 
     // get thing name, use alias if set
@@ -88,44 +93,34 @@ func (db *InfluxDb) PostMeasurement(thing *model.Thing, value string) {
     valueFloat, err := strconv.ParseFloat(value, 64)
     if err != nil {
         db.log.Warningf("Ignoring write measurement to influxdb for device %s due to invalid float value %s", thing.Id.Hex(), value)
-        return
+        return nil
     }
     fields := map[string]interface{}{ "value": valueFloat}
     tags := map[string]string{"id": thing.Id.Hex(), "name": name, "class": thing.Sensor.Class}
-    rm := NewRowMetric("sensor", tags, fields, time.Now())
+    rm := NewRowMetric("sensor", tags, fields, ts)
     body, err := rm.Encode()
-
-    //body := fmt.Sprintf("sensor,id=%s,name=%s,class=%s value=%s", thing.Id.Hex(), name, thing.Sensor.Class, value)
-
-    url, err := url.Parse(db.Uri)
     if err != nil {
-        db.log.Errorf("Cannot decode InfluxDB url from %s (%s)", db.Uri, err.Error())
-        return
+        db.log.Errorf("Cannot encode tags and fields into InfluxDB line protocol format: %s", err.Error())
+        return nil
     }
 
-    url.Path = path.Join(url.Path, "write")
-
-    params := url.Query()
-    params.Add("db", org.InfluxDb)
-    url.RawQuery = params.Encode()
+    //body := fmt.Sprintf("sensor,id=%s,name=%s,class=%s value=%s", thing.Id.Hex(), name, thing.Sensor.Class, value)
 
-    db.httpClient.PostString(url.String(), body.String(), &db.Username, &db.Password)
+    return db.post(org, body.String())
 }
 
-func (db *InfluxDb) PostSwitchState(thing *model.Thing, value string) {
+func (db *InfluxDb) PostSwitchState(thing *model.Thing, value string, ts time.Time) error {
     db.log.Debugf("Posting switch state to InfluxDB, thing: %s, val: %s", thing.Name, value)
 
     // get thing org -> get influxdb assigned to org
-    org, err := db.orgs.Get(thing.OrgId)
-    if err != nil {
-        return
+    org, err := db.getOrg(thing)
+    if org == nil {
+        return err
     }
 
-    db.log.Debugf("Going to post to InfluxDB %s as %s", org.InfluxDb, org.InfluxDbUsername)
-
     if thing.Type != model.THING_TYPE_SWITCH {
         // ignore things which don't represent switch
-        return
+        return nil
     }
 
     // get thing name, use alias if set
@@ -136,37 +131,27 @@ func (db *InfluxDb) PostSwitchState(thing *model.Thing, value string) {
 
     fields := map[string]interface{}{ "value": value}
     tags := map[string]string{"id": thing.Id.Hex(), "name": name}
-    rm := NewRowMetric("switch", tags, fields, time.Now())
+    rm := NewRowMetric("switch", tags, fields, ts)
     body, err := rm.Encode()
-
-    //body := fmt.Sprintf("switch,id=%s,name=%s value=%s", thing.Id.Hex(), name, value)
-
-    url, err := url.Parse(db.Uri)
     if err != nil {
-        db.log.Errorf("Cannot decode InfluxDB url from %s (%s)", db.Uri, err.Error())
-        return
+        db.log.Errorf("Cannot encode tags and fields into InfluxDB line protocol format: %s", err.Error())
+        return nil
     }
 
-    url.Path = path.Join(url.Path, "write")
-
-    params := url.Query()
-    params.Add("db", org.InfluxDb)
-    url.RawQuery = params.Encode()
+    //body := fmt.Sprintf("switch,id=%s,name=%s value=%s", thing.Id.Hex(), name, value)
 
-    db.httpClient.PostString(url.String(), body.String(), &db.Username, &db.Password)
+    return db.post(org, body.String())
 }
 
-func (db *InfluxDb) PostLocation(thing *model.Thing, lat, lng float64, sat, ts int32) {
+func (db *InfluxDb) PostLocation(thing *model.Thing, lat, lng float64, sat, ts int32) error {
     db.log.Debugf("Posting thing location to InfluxDB, thing: %s, lat: %f, lng: %f, sat: %d, ts: %d", thing.Name, lat, lng, sat, ts)
 
     // get thing org -> get influxdb assigned to org
-    org, err := db.orgs.Get(thing.OrgId)
-    if err != nil {
-        return
+    org, err := db.getOrg(thing)
+    if org == nil {
+        return err
     }
 
-    db.log.Debugf("Going to post location to InfluxDB %s as %s", org.InfluxDb, org.InfluxDbUsername)
-
     // get thing name, use alias if set
     name := thing.Name
     if thing.Alias != "" {
@@ -187,23 +172,294 @@ func (db *InfluxDb) PostLocation(thing *model.Thing, lat, lng float64, sat, ts i
     buf, err := rm.Encode()
     if err != nil {
         db.log.Errorf("Cannot encode tags and fields into InfluxDB line protocol format: %s", err.Error())
-        return
+        return nil
     }
 
 
+    return db.post(org, buf.String())
+}
+
+// Post data in line protocol format to InfluxDB assigned to the org, API
+// version and credentials are taken from org, global credentials are used
+// for 1.x databases if org has no credentials
+func (db *InfluxDb) post(org *model.Org, body string) (error) {
     url, err := url.Parse(db.Uri)
     if err != nil {
         db.log.Errorf("Cannot decode InfluxDB url from %s (%s)", db.Uri, err.Error())
-        return
+        return nil
+    }
+
+    params := url.Query()
+
+    if org.InfluxDbVersion == 2 {
+        db.log.Debugf("Going to post to InfluxDB 2.x org %s, bucket %s", org.InfluxDbOrg, org.InfluxDbBucket)
+
+        url.Path = path.Join(url.Path, "api/v2/write")
+        params.Add("org", org.InfluxDbOrg)
+        params.Add("bucket", org.InfluxDbBucket)
+        params.Add("precision", "ns")
+        url.RawQuery = params.Encode()
+
+        headers := map[string]string{
+            "Authorization": "Token " + org.InfluxDbToken,
+            "Content-Type": "text/plain; charset=utf-8",
+        }
+
+        if client, ok := db.httpClient.(IInfluxDbOrgClient); ok {
+            return db.checkResponse(client.PostOrgStringWithHeaders(org.Id, url.String(), body, headers))
+        }
+        return db.checkResponse(db.httpClient.PostStringWithHeaders(url.String(), body, headers))
     }
 
+    username := db.Username
+    password := db.Password
+    if org.InfluxDbUsername != "" {
+        username = org.InfluxDbUsername
+        password = org.InfluxDbPassword
+    }
+
+    db.log.Debugf("Going to post to InfluxDB %s as %s", org.InfluxDb, username)
+
     url.Path = path.Join(url.Path, "write")
+    params.Add("db", org.InfluxDb)
+    url.RawQuery = params.Encode()
+
+    if client, ok := db.httpClient.(IInfluxDbOrgClient); ok {
+        return db.checkResponse(client.PostOrgString(org.Id, url.String(), body, &username, &password))
+    }
+    return db.checkResponse(db.httpClient.PostString(url.String(), body, &username, &password))
+}
+
+// Network errors and server side errors are reported to caller, data
+// rejected by InfluxDB are dropped since sending them again would fail again
+func (db *InfluxDb) checkResponse(status int, err error) (error) {
+    if err != nil {
+        db.log.Errorf("Post to InfluxDB failed (%s)", err.Error())
+        return err
+    }
+
+    if status >= 500 || status == 429 {
+        db.log.Errorf("Post to InfluxDB failed with status code %d", status)
+        return fmt.Errorf("InfluxDB responded with status code %d", status)
+    }
+
+    if status >= 300 {
+        db.log.Errorf("Data rejected by InfluxDB with status code %d", status)
+    }
+
+    return nil
+}
+
+// Get measurements of sensor stored in time range <from, to)
+func (db *InfluxDb) GetSensorValues(thing *model.Thing, from, to time.Time) ([]model.HistoryValue, error) {
+    return db.getValues("sensor", thing, from, to)
+}
+
+// Get states of switch stored in time range <from, to)
+func (db *InfluxDb) GetSwitchStates(thing *model.Thing, from, to time.Time) ([]model.HistoryValue, error) {
+    return db.getValues("switch", thing, from, to)
+}
+
+// Read values of thing from InfluxDB assigned to the org, InfluxQL is used
+// for 1.x databases, Flux for 2.x
+func (db *InfluxDb) getValues(measurement string, thing *model.Thing, from, to time.Time) ([]model.HistoryValue, error) {
+    // values of things which cannot be stored are not available
+    org, err := db.getOrg(thing)
+    if org == nil {
+        return []model.HistoryValue{}, err
+    }
+
+    client, ok := db.httpClient.(IHttpQueryClient)
+    if !ok {
+        return nil, ErrHttpQueryNotSupported
+    }
+
+    url, err := url.Parse(db.Uri)
+    if err != nil {
+        return nil, fmt.Errorf("Cannot decode InfluxDB url from %s (%s)", db.Uri, err.Error())
+    }
 
     params := url.Query()
+
+    if org.InfluxDbVersion == 2 {
+        url.Path = path.Join(url.Path, "api/v2/query")
+        params.Add("org", org.InfluxDbOrg)
+        url.RawQuery = params.Encode()
+
+        query := fmt.Sprintf(
+            `from(bucket: %s) |> range(start: %s, stop: %s) |> filter(fn: (r) => r._measurement == "%s" and r._field == "value" and r.id == "%s") |> keep(columns: ["_time", "_value"]) |> group() |> sort(columns: ["_time"])`,
+            strconv.Quote(org.InfluxDbBucket),
+            from.UTC().Format(time.RFC3339Nano),
+            to.UTC().Format(time.RFC3339Nano),
+            measurement,
+            thing.Id.Hex())
+
+        headers := map[string]string{
+            "Authorization": "Token " + org.InfluxDbToken,
+            "Content-Type": "application/vnd.flux",
+            "Accept": "application/csv",
+        }
+
+        status, body, err := client.Query("POST", url.String(), query, headers)
+        if err := db.checkQueryResponse(status, body, err); err != nil {
+            return nil, err
+        }
+        return parseFluxValues(body)
+    }
+
+    username := db.Username
+    password := db.Password
+    if org.InfluxDbUsername != "" {
+        username = org.InfluxDbUsername
+        password = org.InfluxDbPassword
+    }
+
+    query := fmt.Sprintf(
+        `SELECT "value" FROM "%s" WHERE "id" = '%s' AND time >= %d AND time < %d ORDER BY time`,
+        measurement,
+        thing.Id.Hex(),
+        from.UnixNano(),
+        to.UnixNano())
+
+    url.Path = path.Join(url.Path, "query")
     params.Add("db", org.InfluxDb)
+    params.Add("epoch", "s")
+    params.Add("q", query)
     url.RawQuery = params.Encode()
 
-    db.httpClient.PostString(url.String(), buf.String(), &db.Username, &db.Password)
+    headers := map[string]string{
+        "Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte(username + ":" + password)),
+    }
+
+    status, body, err := client.Query("GET", url.String(), "", headers)
+    if err := db.checkQueryResponse(status, body, err); err != nil {
+        return nil, err
+    }
+    return parseInfluxQlValues(body)
+}
+
+func (db *InfluxDb) checkQueryResponse(status int, body []byte, err error) (error) {
+    if err != nil {
+        db.log.Errorf("Query to InfluxDB failed (%s)", err.Error())
+        return err
+    }
+
+    if status >= 300 {
+        db.log.Errorf("Query to InfluxDB failed with status code %d (%s)", status, body)
+        return fmt.Errorf("InfluxDB responded to query with status code %d", status)
+    }
+
+    return nil
+}
+
+// Parse response of InfluxQL query (JSON with times in seconds)
+func parseInfluxQlValues(body []byte) ([]model.HistoryValue, error) {
+    var response struct {
+        Results []struct {
+            Series []struct {
+                Columns []string `json:"columns"`
+                Values [][]interface{} `json:"values"`
+            } `json:"series"`
+            Error string `json:"error"`
+        } `json:"results"`
+        Error string `json:"error"`
+    }
+
+    decoder := json.NewDecoder(bytes.NewReader(body))
+    decoder.UseNumber()
+    if err := decoder.Decode(&response); err != nil {
+        return nil, fmt.Errorf("Cannot decode InfluxDB response (%v)", err)
+    }
+    if response.Error != "" {
+        return nil, fmt.Errorf("InfluxDB query failed (%s)", response.Error)
+    }
+
+    result := []model.HistoryValue{}
+    for _, r := range response.Results {
+        if r.Error != "" {
+            return nil, fmt.Errorf("InfluxDB query failed (%s)", r.Error)
+        }
+        for _, series := range r.Series {
+            for _, row := range series.Values {
+                if len(row) != 2 {
+                    return nil, fmt.Errorf("Unexpected columns %v in InfluxDB response", series.Columns)
+                }
+                ts, err := strconv.ParseInt(fmt.Sprint(row[0]), 10, 32)
+                if err != nil {
+                    return nil, fmt.Errorf("Invalid time in InfluxDB response (%v)", err)
+                }
+                value, err := strconv.ParseFloat(fmt.Sprint(row[1]), 64)
+                if err != nil {
+                    // e.g. switch state which is not numeric
+                    continue
+                }
+                result = append(result, model.HistoryValue{Time: int32(ts), Value: value})
+            }
+        }
+    }
+
+    return result, nil
+}
+
+// Parse response of Flux query (CSV with header row per table)
+func parseFluxValues(body []byte) ([]model.HistoryValue, error) {
+    reader := csv.NewReader(bytes.NewReader(body))
+    reader.Comment = '#'
+    reader.FieldsPerRecord = -1
+
+    result := []model.HistoryValue{}
+    timeColumn, valueColumn := -1, -1
+
+    for {
+        record, err := reader.Read()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return nil, fmt.Errorf("Cannot decode InfluxDB response (%v)", err)
+        }
+
+        // each table starts with header
+        header := false
+        for i, column := range record {
+            switch column {
+            case "_time":
+                timeColumn, header = i, true
+            case "_value":
+                valueColumn, header = i, true
+            }
+        }
+        if header {
+            continue
+        }
+
+        if timeColumn < 0 || valueColumn < 0 || timeColumn >= len(record) || valueColumn >= len(record) {
+            return nil, fmt.Errorf("Unexpected row %v in InfluxDB response", record)
+        }
+
+        ts, err := time.Parse(time.RFC3339Nano, record[timeColumn])
+        if err != nil {
+            return nil, fmt.Errorf("Invalid time in InfluxDB response (%v)", err)
+        }
+        value, err := strconv.ParseFloat(record[valueColumn], 64)
+        if err != nil {
+            // e.g. switch state which is not numeric
+            continue
+        }
+        result = append(result, model.HistoryValue{Time: int32(ts.Unix()), Value: value})
+    }
+
+    return result, nil
+}
+
+// Get org of the thing, only failure of org lookup is reported as error,
+// things without org are ignored
+func (db *InfluxDb) getOrg(thing *model.Thing) (*model.Org, error) {
+    org, err := db.orgs.Get(thing.OrgId)
+    if err == ErrNotFound {
+        return nil, nil
+    }
+    return org, err
 }
 
 func NewRowMetric(
@@ -7,10 +7,9 @@ import (
     "github.com/mnezerka/go-piot"
     "github.com/mnezerka/go-piot/model"
     "github.com/mnezerka/go-piot/test"
-    "go.mongodb.org/mongo-driver/mongo"
 )
 
-func getInfluxDb(t *testing.T, db *mongo.Database, httpClient piot.IHttpClient) piot.IInfluxDb {
+func getInfluxDb(t *testing.T, db *piot.Repositories, httpClient piot.IHttpClient) piot.IInfluxDb {
     log := test.GetLogger(t)
     orgs := test.GetOrgs(t, log, db)
     return piot.NewInfluxDb(log, orgs, httpClient, "http://uri", "user", "pass")
@@ -25,6 +24,7 @@ func TestInfluxDbPushMeasurementForSensor(t *testing.T) {
     db := test.GetDb(t)
     logger := test.GetLogger(t)
     test.CleanDb(t, db)
+    ctx := test.GetContext(t)
     test.CreateThing(t, db, DEVICE)
     sensorId := test.CreateThing(t, db, SENSOR)
     orgId := test.CreateOrg(t, db, "org1")
@@ -35,11 +35,11 @@ func TestInfluxDbPushMeasurementForSensor(t *testing.T) {
     things := test.GetThings(t, logger, db)
 
     // get thing instance
-    thing, err := things.Get(sensorId)
+    thing, err := things.Get(ctx, sensorId)
     test.Ok(t, err)
 
     // push measurement for thing
-    influxdb.PostMeasurement(thing, "23")
+    test.Ok(t, influxdb.PostMeasurement(thing, "23", time.Now()))
 
     // check if http client was called
     test.Equals(t, 1, len(httpClient.Calls))
@@ -54,8 +54,8 @@ func TestInfluxDbPushMeasurementForSensor(t *testing.T) {
     test.Assert(t, strings.Contains(httpClient.Calls[0].Body, "name=SensorAddr"), "Body doesn't contain device name")
     test.Assert(t, strings.Contains(httpClient.Calls[0].Body, "class=temperature"), "Body doesn't contain temperature")
 
-    test.Equals(t, "user", *httpClient.Calls[0].Username)
-    test.Equals(t, "pass", *httpClient.Calls[0].Password)
+    test.Equals(t, "db-username", *httpClient.Calls[0].Username)
+    test.Equals(t, "db-password", *httpClient.Calls[0].Password)
 }
 
 // Push measurement for thing
@@ -66,6 +66,7 @@ func TestInfluxDbPushMeasurementForDevice(t *testing.T) {
     db := test.GetDb(t)
     logger := test.GetLogger(t)
     test.CleanDb(t, db)
+    ctx := test.GetContext(t)
     thingId := test.CreateThing(t, db, DEVICE)
     orgId := test.CreateOrg(t, db, "org1")
     test.AddOrgThing(t, db, orgId, DEVICE)
@@ -74,14 +75,14 @@ func TestInfluxDbPushMeasurementForDevice(t *testing.T) {
     things := test.GetThings(t, logger, db)
 
     // get thing instance
-    thing, err := things.Get(thingId)
+    thing, err := things.Get(ctx, thingId)
     test.Ok(t, err)
 
     // change type of the thing to device
     thing.Type = model.THING_TYPE_DEVICE
 
     // push measurement for thing
-    influxdb.PostMeasurement(thing, "23")
+    test.Ok(t, influxdb.PostMeasurement(thing, "23", time.Now()))
 
     // check if http client was NOT called
     test.Equals(t, 0, len(httpClient.Calls))
@@ -95,6 +96,7 @@ func TestInfluxDbPushLocForThing(t *testing.T) {
     db := test.GetDb(t)
     logger := test.GetLogger(t)
     test.CleanDb(t, db)
+    ctx := test.GetContext(t)
     thingId := test.CreateThing(t, db, DEVICE)
     orgId := test.CreateOrg(t, db, "org1")
     test.AddOrgThing(t, db, orgId, DEVICE)
@@ -103,14 +105,14 @@ func TestInfluxDbPushLocForThing(t *testing.T) {
     things := test.GetThings(t, logger, db)
 
     // get thing instance
-    thing, err := things.Get(thingId)
+    thing, err := things.Get(ctx, thingId)
     test.Ok(t, err)
 
     // change type of the thing to thing
     thing.Type = model.THING_TYPE_DEVICE
 
     // push measurement for thing
-    influxdb.PostLocation(thing, 1.2, 56.8, 3, 4444)
+    test.Ok(t, influxdb.PostLocation(thing, 1.2, 56.8, 3, 4444))
 
     // check if http client was NOT called
     test.Equals(t, 1, len(httpClient.Calls))
@@ -125,10 +127,72 @@ func TestInfluxDbPushLocForThing(t *testing.T) {
     test.Contains(t, httpClient.Calls[0].Body, "lng=56.8")
     test.Contains(t, httpClient.Calls[0].Body, "sat=3")
     test.Contains(t, httpClient.Calls[0].Body, " 4444000000000")
+    test.Equals(t, "db-username", *httpClient.Calls[0].Username)
+    test.Equals(t, "db-password", *httpClient.Calls[0].Password)
+}
+
+// Push measurement to org without own credentials
+func TestInfluxDbPushMeasurementGlobalCredentials(t *testing.T) {
+    const SENSOR = "SensorAddr"
+
+    db := test.GetDb(t)
+    logger := test.GetLogger(t)
+    test.CleanDb(t, db)
+    ctx := test.GetContext(t)
+    sensorId := test.CreateThing(t, db, SENSOR)
+    orgId := test.CreateOrg(t, db, "org1")
+    test.AddOrgThing(t, db, orgId, SENSOR)
+    err := db.Orgs.SetFields(orgId, map[string]interface{}{"influxdb_username": "", "influxdb_password": ""})
+    test.Ok(t, err)
+    httpClient := test.GetHttpClient(t, logger)
+    influxdb := getInfluxDb(t, db, httpClient)
+    things := test.GetThings(t, logger, db)
+
+    thing, err := things.Get(ctx, sensorId)
+    test.Ok(t, err)
+
+    test.Ok(t, influxdb.PostMeasurement(thing, "23", time.Now()))
+
+    test.Equals(t, 1, len(httpClient.Calls))
+    test.Equals(t, "http://uri/write?db=db", httpClient.Calls[0].Url)
     test.Equals(t, "user", *httpClient.Calls[0].Username)
     test.Equals(t, "pass", *httpClient.Calls[0].Password)
 }
 
+// Push measurement to org using InfluxDB 2.x
+func TestInfluxDbPushMeasurementV2(t *testing.T) {
+    const SENSOR = "SensorAddr"
+
+    db := test.GetDb(t)
+    logger := test.GetLogger(t)
+    test.CleanDb(t, db)
+    ctx := test.GetContext(t)
+    sensorId := test.CreateThing(t, db, SENSOR)
+    orgId := test.CreateOrg(t, db, "org1")
+    test.AddOrgThing(t, db, orgId, SENSOR)
+    err := db.Orgs.SetFields(orgId, map[string]interface{}{
+        "influxdb_version": 2,
+        "influxdb_org": "org 1",
+        "influxdb_bucket": "bucket1",
+        "influxdb_token": "token1",
+    })
+    test.Ok(t, err)
+    httpClient := test.GetHttpClient(t, logger)
+    influxdb := getInfluxDb(t, db, httpClient)
+    things := test.GetThings(t, logger, db)
+
+    thing, err := things.Get(ctx, sensorId)
+    test.Ok(t, err)
+
+    test.Ok(t, influxdb.PostMeasurement(thing, "23", time.Now()))
+
+    test.Equals(t, 1, len(httpClient.Calls))
+    test.Equals(t, "http://uri/api/v2/write?bucket=bucket1&org=org+1&precision=ns", httpClient.Calls[0].Url)
+    test.Contains(t, httpClient.Calls[0].Body, "sensor")
+    test.Equals(t, "Token token1", httpClient.Calls[0].Headers["Authorization"])
+    test.Assert(t, httpClient.Calls[0].Username == nil, "Basic auth shall not be used")
+}
+
 func TestInfluxDbLineProtocolEncoding(t *testing.T) {
     fields := map[string]interface{}{"memory": 1000}
     tags := map[string]string{"hostname": "hal9000"}
@@ -150,3 +214,129 @@ func TestInfluxDbLineProtocolEncoding(t *testing.T) {
     test.Ok(t, err)
     test.Equals(t, "H\\ E\\ LLO,h\\ ost=h\\ al m\\ em=1000i 1520139967000000009\n", buf.String())
 }
+
+// Temporary failures are reported to caller, rejected data are not
+func TestInfluxDbPostErrors(t *testing.T) {
+    const SENSOR = "SensorAddr"
+
+    db := test.GetDb(t)
+    logger := test.GetLogger(t)
+    test.CleanDb(t, db)
+    ctx := test.GetContext(t)
+    sensorId := test.CreateThing(t, db, SENSOR)
+    orgId := test.CreateOrg(t, db, "org1")
+    test.AddOrgThing(t, db, orgId, SENSOR)
+    httpClient := test.GetHttpClient(t, logger)
+    influxdb := getInfluxDb(t, db, httpClient)
+    things := test.GetThings(t, logger, db)
+
+    thing, err := things.Get(ctx, sensorId)
+    test.Ok(t, err)
+
+    httpClient.StatusCode = 503
+    test.Assert(t, influxdb.PostMeasurement(thing, "23", time.Now()) != nil, "Server error shall be reported")
+
+    httpClient.StatusCode = 400
+    test.Ok(t, influxdb.PostMeasurement(thing, "23", time.Now()))
+}
+
+// Read history from InfluxDB 1.x by InfluxQL
+func TestInfluxDbHistory(t *testing.T) {
+    const SENSOR = "SensorAddr"
+
+    db := test.GetDb(t)
+    logger := test.GetLogger(t)
+    test.CleanDb(t, db)
+    ctx := test.GetContext(t)
+    sensorId := test.CreateThing(t, db, SENSOR)
+    orgId := test.CreateOrg(t, db, "org1")
+    test.AddOrgThing(t, db, orgId, SENSOR)
+    httpClient := test.GetHttpClient(t, logger)
+    influxdb := getInfluxDb(t, db, httpClient).(piot.HistorySource)
+    things := test.GetThings(t, logger, db)
+
+    thing, err := things.Get(ctx, sensorId)
+    test.Ok(t, err)
+
+    httpClient.Response = `{"results":[{"statement_id":0,"series":[{"name":"sensor","columns":["time","value"],"values":[[100,1.5],[130,2]]}]}]}`
+    values, err := influxdb.GetSensorValues(thing, time.Unix(0, 0), time.Unix(1000, 0))
+    test.Ok(t, err)
+    test.Equals(t, []model.HistoryValue{{Time: 100, Value: 1.5}, {Time: 130, Value: 2}}, values)
+
+    test.Equals(t, 1, len(httpClient.Calls))
+    test.Equals(t, "GET", httpClient.Calls[0].Method)
+    test.Contains(t, httpClient.Calls[0].Url, "http://uri/query?db=db&epoch=s&q=")
+    test.Contains(t, httpClient.Calls[0].Url, sensorId.Hex())
+    test.Equals(t, "Basic ZGItdXNlcm5hbWU6ZGItcGFzc3dvcmQ=", httpClient.Calls[0].Headers["Authorization"])
+
+    // switch states are stored as strings
+    httpClient.Response = `{"results":[{"statement_id":0,"series":[{"name":"switch","columns":["time","value"],"values":[[100,"1"],[130,"0"]]}]}]}`
+    values, err = influxdb.GetSwitchStates(thing, time.Unix(0, 0), time.Unix(1000, 0))
+    test.Ok(t, err)
+    test.Equals(t, []model.HistoryValue{{Time: 100, Value: 1}, {Time: 130, Value: 0}}, values)
+
+    // no values
+    httpClient.Response = `{"results":[{"statement_id":0}]}`
+    values, err = influxdb.GetSensorValues(thing, time.Unix(0, 0), time.Unix(1000, 0))
+    test.Ok(t, err)
+    test.Equals(t, 0, len(values))
+
+    // query errors
+    httpClient.Response = `{"results":[{"statement_id":0,"error":"database not found: db"}]}`
+    _, err = influxdb.GetSensorValues(thing, time.Unix(0, 0), time.Unix(1000, 0))
+    test.Assert(t, err != nil, "Query error shall be reported")
+
+    httpClient.StatusCode = 401
+    _, err = influxdb.GetSensorValues(thing, time.Unix(0, 0), time.Unix(1000, 0))
+    test.Assert(t, err != nil, "Rejected query shall be reported")
+}
+
+// Read history from InfluxDB 2.x by Flux
+func TestInfluxDbHistoryV2(t *testing.T) {
+    const SENSOR = "SensorAddr"
+
+    db := test.GetDb(t)
+    logger := test.GetLogger(t)
+    test.CleanDb(t, db)
+    ctx := test.GetContext(t)
+    sensorId := test.CreateThing(t, db, SENSOR)
+    orgId := test.CreateOrg(t, db, "org1")
+    test.AddOrgThing(t, db, orgId, SENSOR)
+    err := db.Orgs.SetFields(orgId, map[string]interface{}{
+        "influxdb_version": 2,
+        "influxdb_org": "org 1",
+        "influxdb_bucket": "bucket1",
+        "influxdb_token": "token1",
+    })
+    test.Ok(t, err)
+    httpClient := test.GetHttpClient(t, logger)
+    influxdb := getInfluxDb(t, db, httpClient).(piot.HistorySource)
+    things := test.GetThings(t, logger, db)
+
+    thing, err := things.Get(ctx, sensorId)
+    test.Ok(t, err)
+
+    httpClient.Response = ",result,table,_time,_value\r\n" +
+        ",_result,0,1970-01-01T00:01:40Z,1.5\r\n" +
+        ",_result,0,1970-01-01T00:02:10Z,2\r\n" +
+        "\r\n"
+    values, err := influxdb.GetSensorValues(thing, time.Unix(0, 0), time.Unix(1000, 0))
+    test.Ok(t, err)
+    test.Equals(t, []model.HistoryValue{{Time: 100, Value: 1.5}, {Time: 130, Value: 2}}, values)
+
+    test.Equals(t, 1, len(httpClient.Calls))
+    test.Equals(t, "POST", httpClient.Calls[0].Method)
+    test.Equals(t, "http://uri/api/v2/query?org=org+1", httpClient.Calls[0].Url)
+    test.Contains(t, httpClient.Calls[0].Body, `from(bucket: "bucket1")`)
+    test.Contains(t, httpClient.Calls[0].Body, "range(start: 1970-01-01T00:00:00Z, stop: 1970-01-01T00:16:40Z)")
+    test.Contains(t, httpClient.Calls[0].Body, `r._measurement == "sensor"`)
+    test.Contains(t, httpClient.Calls[0].Body, sensorId.Hex())
+    test.Equals(t, "Token token1", httpClient.Calls[0].Headers["Authorization"])
+
+    // empty result
+    httpClient.Response = "\r\n"
+    values, err = influxdb.GetSwitchStates(thing, time.Unix(0, 0), time.Unix(1000, 0))
+    test.Ok(t, err)
+    test.Equals(t, 0, len(values))
+    test.Contains(t, httpClient.Calls[1].Body, `r._measurement == "switch"`)
+}
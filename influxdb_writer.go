@@ -0,0 +1,353 @@
+package piot
+
+import (
+    "errors"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+    "github.com/op/go-logging"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "github.com/mnezerka/go-piot/config"
+)
+
+// policies applied when writer buffer is full
+const INFLUXDB_DROP_OLDEST = "oldest"
+const INFLUXDB_DROP_NEWEST = "newest"
+
+// Error returned if row cannot be buffered because buffer is full
+var ErrInfluxDbBufferFull = errors.New("InfluxDB write buffer is full")
+
+// Client posting rows of given org, InfluxDb service prefers it over plain
+// IHttpClient methods if http client implements it
+type IInfluxDbOrgClient interface {
+    PostOrgString(orgId primitive.ObjectID, url, body string, username *string, password *string) (int, error)
+    PostOrgStringWithHeaders(orgId primitive.ObjectID, url, body string, headers map[string]string) (int, error)
+}
+
+// Key of batch, credentials are not part of the key, rows of batch are
+// posted with credentials of latest write
+type influxDbBatchKey struct {
+    orgId primitive.ObjectID
+    url string
+}
+
+// Rows waiting for delivery to single target (url incl. database or org and
+// bucket)
+type influxDbBatch struct {
+    url string
+    username *string
+    password *string
+    headers map[string]string
+    rows []string
+
+    // number of failed attempts to deliver rows
+    retries int
+
+    // time of next attempt after failure
+    nextAttempt time.Time
+
+    // rows are being posted
+    posting bool
+}
+
+// Writer buffering rows posted to InfluxDB. Rows are grouped to batches by
+// org and url and flushed by background loop (see Start) periodically and
+// whenever any batch reaches configured size, so writers never wait for
+// InfluxDB. Batches failed due to network errors or 5xx responses are
+// retried with exponential backoff. Writer implements IHttpClient,
+// IInfluxDbOrgClient and IHttpQueryClient, so it can be passed to InfluxDb
+// service in place of http client
+type InfluxDbWriter struct {
+    log *logging.Logger
+    httpClient IHttpClient
+    params *config.Parameters
+
+    // protects batches and counters
+    mutex sync.Mutex
+
+    batches map[influxDbBatchKey]*influxDbBatch
+    keys []influxDbBatchKey
+    buffered int
+    dropped int64
+
+    // wakes up background loop to flush full batch
+    wakeup chan bool
+    quit chan bool
+    done chan bool
+}
+
+func NewInfluxDbWriter(log *logging.Logger, httpClient IHttpClient, params *config.Parameters) *InfluxDbWriter {
+    return &InfluxDbWriter{
+        log: log,
+        httpClient: httpClient,
+        params: params,
+        batches: make(map[influxDbBatchKey]*influxDbBatch),
+        wakeup: make(chan bool, 1),
+    }
+}
+
+// Buffer rows for target identified by url, rows are posted with basic auth
+// credentials
+func (w *InfluxDbWriter) PostString(url, body string, username *string, password *string) (int, error) {
+    return w.PostOrgString(primitive.NilObjectID, url, body, username, password)
+}
+
+// Buffer rows for target identified by url, rows are posted with headers
+// (e.g. token)
+func (w *InfluxDbWriter) PostStringWithHeaders(url, body string, headers map[string]string) (int, error) {
+    return w.PostOrgStringWithHeaders(primitive.NilObjectID, url, body, headers)
+}
+
+// Buffer rows of org for target identified by url, rows are posted with
+// basic auth credentials
+func (w *InfluxDbWriter) PostOrgString(orgId primitive.ObjectID, url, body string, username *string, password *string) (int, error) {
+    return w.write(influxDbBatchKey{orgId, url}, &influxDbBatch{url: url, username: username, password: password}, body)
+}
+
+// Buffer rows of org for target identified by url, rows are posted with
+// headers (e.g. token)
+func (w *InfluxDbWriter) PostOrgStringWithHeaders(orgId primitive.ObjectID, url, body string, headers map[string]string) (int, error) {
+    return w.write(influxDbBatchKey{orgId, url}, &influxDbBatch{url: url, headers: headers}, body)
+}
+
+// Queries are not buffered, they are sent by wrapped http client
+func (w *InfluxDbWriter) Query(method, url, body string, headers map[string]string) (int, []byte, error) {
+    client, ok := w.httpClient.(IHttpQueryClient)
+    if !ok {
+        return 0, nil, ErrHttpQueryNotSupported
+    }
+    return client.Query(method, url, body, headers)
+}
+
+// Start background flushing of batches
+func (w *InfluxDbWriter) Start() {
+    w.log.Infof("Starting InfluxDB writer (flush interval %v, batch size %d)", w.params.InfluxDbFlushInterval, w.params.InfluxDbBatchSize)
+
+    w.quit = make(chan bool)
+    w.done = make(chan bool)
+    ticker := time.NewTicker(w.params.InfluxDbFlushInterval)
+
+    go func(quit, done chan bool) {
+        defer close(done)
+        for {
+            select {
+            case <-ticker.C:
+                w.Flush()
+            case <-w.wakeup:
+                w.flush(w.params.InfluxDbBatchSize, false)
+            case <-quit:
+                ticker.Stop()
+                return
+            }
+        }
+    }(w.quit, w.done)
+}
+
+// Stop background flushing, last attempt to deliver buffered rows is made
+// regardless of backoff of failed batches, rows which cannot be delivered
+// are dropped
+func (w *InfluxDbWriter) Stop() {
+    if w.quit != nil {
+        w.log.Infof("Stopping InfluxDB writer")
+        close(w.quit)
+        <-w.done
+        w.quit = nil
+    }
+
+    w.flush(0, true)
+
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+
+    var dropped int
+    for _, batch := range w.batches {
+        dropped += len(batch.rows)
+        batch.rows = nil
+        batch.retries = 0
+        batch.nextAttempt = time.Time{}
+    }
+
+    if dropped > 0 {
+        w.log.Errorf("Dropping %d rows not delivered to InfluxDB before stop", dropped)
+        w.buffered -= dropped
+        w.dropped += int64(dropped)
+    }
+}
+
+// Flush all batches, batches waiting for retry are flushed only if backoff
+// interval elapsed, batches being posted by other goroutine are skipped
+func (w *InfluxDbWriter) Flush() {
+    w.flush(0, false)
+}
+
+// Get number of rows waiting for delivery
+func (w *InfluxDbWriter) Buffered() int {
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+    return w.buffered
+}
+
+// Get number of rows dropped due to full buffer or permanent failures
+func (w *InfluxDbWriter) Dropped() int64 {
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+    return w.dropped
+}
+
+func (w *InfluxDbWriter) write(key influxDbBatchKey, target *influxDbBatch, body string) (int, error) {
+    if !strings.HasSuffix(body, "\n") {
+        body += "\n"
+    }
+
+    w.mutex.Lock()
+
+    batch, ok := w.batches[key]
+    if !ok {
+        batch = target
+        w.batches[key] = batch
+        w.keys = append(w.keys, key)
+    } else {
+        // credentials could change (e.g. rotated token)
+        batch.username = target.username
+        batch.password = target.password
+        batch.headers = target.headers
+    }
+
+    if w.buffered >= w.params.InfluxDbMaxBufferedRows {
+        if w.params.InfluxDbDropPolicy == INFLUXDB_DROP_NEWEST || !w.dropOldest(batch) {
+            w.dropped++
+            w.mutex.Unlock()
+            w.log.Warningf("InfluxDB write buffer is full, dropping row for %s", target.url)
+            return 0, ErrInfluxDbBufferFull
+        }
+    }
+
+    batch.rows = append(batch.rows, body)
+    w.buffered++
+
+    // batches waiting for retry are not flushed before backoff elapses
+    full := len(batch.rows) >= w.params.InfluxDbBatchSize && batch.retries == 0
+
+    w.mutex.Unlock()
+
+    if full {
+        select {
+        case w.wakeup <- true:
+        default:
+            // loop is already woken up
+        }
+    }
+
+    return http.StatusAccepted, nil
+}
+
+// Drop oldest row of the batch, or of the largest batch if given batch
+// has no rows waiting (e.g. they are being posted)
+func (w *InfluxDbWriter) dropOldest(batch *influxDbBatch) bool {
+    victim := batch
+    if len(victim.rows) == 0 {
+        for _, b := range w.batches {
+            if len(b.rows) > len(victim.rows) {
+                victim = b
+            }
+        }
+    }
+
+    if len(victim.rows) == 0 {
+        return false
+    }
+
+    w.log.Warningf("InfluxDB write buffer is full, dropping oldest row for %s", victim.url)
+
+    victim.rows = victim.rows[1:]
+    w.buffered--
+    w.dropped++
+
+    return true
+}
+
+// Flush batches having at least given number of rows, backoff of failed
+// batches is ignored if forced
+func (w *InfluxDbWriter) flush(minRows int, force bool) {
+    w.mutex.Lock()
+    keys := append([]influxDbBatchKey(nil), w.keys...)
+    w.mutex.Unlock()
+
+    for _, key := range keys {
+        w.flushBatch(key, minRows, force, time.Now())
+    }
+}
+
+func (w *InfluxDbWriter) flushBatch(key influxDbBatchKey, minRows int, force bool, now time.Time) {
+    w.mutex.Lock()
+    batch := w.batches[key]
+    if batch == nil || batch.posting || len(batch.rows) == 0 || len(batch.rows) < minRows || (!force && now.Before(batch.nextAttempt)) {
+        w.mutex.Unlock()
+        return
+    }
+    rows := batch.rows
+    batch.rows = nil
+    batch.posting = true
+    username, password, headers := batch.username, batch.password, batch.headers
+    w.mutex.Unlock()
+
+    w.log.Debugf("Flushing %d rows to %s", len(rows), batch.url)
+
+    var status int
+    var err error
+    body := strings.Join(rows, "")
+    if headers != nil {
+        status, err = w.httpClient.PostStringWithHeaders(batch.url, body, headers)
+    } else {
+        status, err = w.httpClient.PostString(batch.url, body, username, password)
+    }
+
+    w.mutex.Lock()
+    defer w.mutex.Unlock()
+
+    batch.posting = false
+
+    switch {
+    case err == nil && status < 300:
+        w.buffered -= len(rows)
+        batch.retries = 0
+        batch.nextAttempt = time.Time{}
+
+    case err != nil || status >= 500 || status == http.StatusTooManyRequests:
+        batch.retries++
+        if batch.retries > w.params.InfluxDbMaxRetries {
+            w.log.Errorf("Dropping %d rows for %s after %d failed attempts", len(rows), batch.url, batch.retries)
+            w.buffered -= len(rows)
+            w.dropped += int64(len(rows))
+            batch.retries = 0
+            batch.nextAttempt = time.Time{}
+            return
+        }
+
+        // rows are returned in front of rows buffered meanwhile
+        batch.rows = append(rows, batch.rows...)
+        batch.nextAttempt = now.Add(w.getBackoff(batch.retries))
+        w.log.Warningf("Post of %d rows to %s failed (status: %d, error: %v), retry %d at %v", len(rows), batch.url, status, err, batch.retries, batch.nextAttempt)
+
+    default:
+        // rows were rejected by InfluxDB, retry would fail again
+        w.log.Errorf("Dropping %d rows rejected by %s with status code %d", len(rows), batch.url, status)
+        w.buffered -= len(rows)
+        w.dropped += int64(len(rows))
+        batch.retries = 0
+        batch.nextAttempt = time.Time{}
+    }
+}
+
+// Get delay before next attempt, delay doubles with each failed attempt
+func (w *InfluxDbWriter) getBackoff(retries int) time.Duration {
+    backoff := w.params.InfluxDbRetryInterval
+    for i := 1; i < retries && backoff < w.params.InfluxDbMaxRetryInterval; i++ {
+        backoff *= 2
+    }
+    if backoff > w.params.InfluxDbMaxRetryInterval {
+        backoff = w.params.InfluxDbMaxRetryInterval
+    }
+    return backoff
+}
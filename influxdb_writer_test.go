@@ -0,0 +1,198 @@
+package piot_test
+
+import (
+    "errors"
+    "testing"
+    "time"
+    "github.com/mnezerka/go-piot"
+    "github.com/mnezerka/go-piot/test"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func getInfluxDbWriter(t *testing.T, httpClient piot.IHttpClient) *piot.InfluxDbWriter {
+    params := test.GetConfig()
+    params.InfluxDbBatchSize = 3
+    params.InfluxDbRetryInterval = 10 * time.Millisecond
+    params.InfluxDbMaxRetryInterval = 20 * time.Millisecond
+    params.InfluxDbMaxRetries = 2
+    params.InfluxDbMaxBufferedRows = 5
+    return piot.NewInfluxDbWriter(test.GetLogger(t), httpClient, params)
+}
+
+// Wait until background loop of writer delivers rows
+func waitInfluxDbWriterBuffered(t *testing.T, writer *piot.InfluxDbWriter, buffered int) {
+    for i := 0; i < 100 && writer.Buffered() != buffered; i++ {
+        time.Sleep(time.Millisecond)
+    }
+    test.Equals(t, buffered, writer.Buffered())
+}
+
+func TestInfluxDbWriterBatches(t *testing.T) {
+    httpClient := test.GetHttpClient(t, test.GetLogger(t))
+    writer := getInfluxDbWriter(t, httpClient)
+    writer.Start()
+    defer writer.Stop()
+    username := "user"
+    password := "pass"
+
+    writer.PostString("http://uri/write?db=db1", "row1", &username, &password)
+    writer.PostString("http://uri/write?db=db2", "row2\n", &username, &password)
+    writer.PostString("http://uri/write?db=db1", "row3", &username, &password)
+    test.Equals(t, 0, len(httpClient.Calls))
+    test.Equals(t, 3, writer.Buffered())
+
+    // batch is flushed by background loop when it reaches configured size
+    writer.PostString("http://uri/write?db=db1", "row4", &username, &password)
+    waitInfluxDbWriterBuffered(t, writer, 1)
+    test.Equals(t, 1, len(httpClient.Calls))
+    test.Equals(t, "http://uri/write?db=db1", httpClient.Calls[0].Url)
+    test.Equals(t, "row1\nrow3\nrow4\n", httpClient.Calls[0].Body)
+    test.Equals(t, "user", *httpClient.Calls[0].Username)
+
+    // remaining batches are flushed on request
+    writer.Flush()
+    test.Equals(t, 2, len(httpClient.Calls))
+    test.Equals(t, "http://uri/write?db=db2", httpClient.Calls[1].Url)
+    test.Equals(t, "row2\n", httpClient.Calls[1].Body)
+    test.Equals(t, 0, writer.Buffered())
+}
+
+// Rows are batched by org, credentials of latest write are used
+func TestInfluxDbWriterOrgBatches(t *testing.T) {
+    httpClient := test.GetHttpClient(t, test.GetLogger(t))
+    writer := getInfluxDbWriter(t, httpClient)
+    orgId1 := primitive.NewObjectID()
+    orgId2 := primitive.NewObjectID()
+    username := "user"
+    password1 := "pass1"
+    password2 := "pass2"
+
+    writer.PostOrgString(orgId1, "http://uri/write?db=db1", "row1", &username, &password1)
+    writer.PostOrgString(orgId2, "http://uri/write?db=db1", "row2", &username, &password1)
+    writer.PostOrgString(orgId1, "http://uri/write?db=db1", "row3", &username, &password2)
+    writer.Flush()
+
+    test.Equals(t, 2, len(httpClient.Calls))
+    test.Equals(t, "row1\nrow3\n", httpClient.Calls[0].Body)
+    test.Equals(t, "pass2", *httpClient.Calls[0].Password)
+    test.Equals(t, "row2\n", httpClient.Calls[1].Body)
+    test.Equals(t, "pass1", *httpClient.Calls[1].Password)
+}
+
+func TestInfluxDbWriterRetry(t *testing.T) {
+    httpClient := test.GetHttpClient(t, test.GetLogger(t))
+    writer := getInfluxDbWriter(t, httpClient)
+    headers := map[string]string{"Authorization": "Token token1"}
+
+    httpClient.StatusCode = 503
+    writer.PostStringWithHeaders("http://uri/api/v2/write", "row1", headers)
+    writer.Flush()
+    test.Equals(t, 1, len(httpClient.Calls))
+    test.Equals(t, 1, writer.Buffered())
+
+    // next attempt is not made before backoff elapses
+    writer.Flush()
+    test.Equals(t, 1, len(httpClient.Calls))
+
+    time.Sleep(15 * time.Millisecond)
+    httpClient.StatusCode = 0
+    httpClient.Err = errors.New("connection refused")
+    writer.PostStringWithHeaders("http://uri/api/v2/write", "row2", headers)
+    writer.Flush()
+    test.Equals(t, 2, len(httpClient.Calls))
+    test.Equals(t, "row1\nrow2\n", httpClient.Calls[1].Body)
+    test.Equals(t, "Token token1", httpClient.Calls[1].Headers["Authorization"])
+    test.Equals(t, 2, writer.Buffered())
+
+    // successful attempt
+    time.Sleep(25 * time.Millisecond)
+    httpClient.Err = nil
+    writer.Flush()
+    test.Equals(t, 3, len(httpClient.Calls))
+    test.Equals(t, 0, writer.Buffered())
+    test.Equals(t, int64(0), writer.Dropped())
+}
+
+func TestInfluxDbWriterGiveUp(t *testing.T) {
+    httpClient := test.GetHttpClient(t, test.GetLogger(t))
+    writer := getInfluxDbWriter(t, httpClient)
+
+    // rows are dropped when max retries is exceeded
+    httpClient.StatusCode = 500
+    writer.PostString("http://uri/write?db=db1", "row1", nil, nil)
+    for i := 0; i < 3; i++ {
+        writer.Flush()
+        time.Sleep(25 * time.Millisecond)
+    }
+    test.Equals(t, 3, len(httpClient.Calls))
+    test.Equals(t, 0, writer.Buffered())
+    test.Equals(t, int64(1), writer.Dropped())
+
+    // rows rejected by server are not retried
+    httpClient.StatusCode = 400
+    writer.PostString("http://uri/write?db=db1", "row2", nil, nil)
+    writer.Flush()
+    test.Equals(t, 4, len(httpClient.Calls))
+    test.Equals(t, 0, writer.Buffered())
+    test.Equals(t, int64(2), writer.Dropped())
+}
+
+// Last attempt is made on stop regardless of backoff
+func TestInfluxDbWriterStop(t *testing.T) {
+    httpClient := test.GetHttpClient(t, test.GetLogger(t))
+    writer := getInfluxDbWriter(t, httpClient)
+    writer.Start()
+
+    httpClient.StatusCode = 503
+    writer.PostString("http://uri/write?db=db1", "row1", nil, nil)
+    writer.Flush()
+    test.Equals(t, 1, len(httpClient.Calls))
+
+    httpClient.StatusCode = 0
+    writer.Stop()
+    test.Equals(t, 2, len(httpClient.Calls))
+    test.Equals(t, "row1\n", httpClient.Calls[1].Body)
+    test.Equals(t, 0, writer.Buffered())
+    test.Equals(t, int64(0), writer.Dropped())
+
+    // rows which cannot be delivered are dropped
+    httpClient.StatusCode = 503
+    writer.PostString("http://uri/write?db=db1", "row2", nil, nil)
+    writer.Flush()
+    writer.Stop()
+    test.Equals(t, 4, len(httpClient.Calls))
+    test.Equals(t, 0, writer.Buffered())
+    test.Equals(t, int64(1), writer.Dropped())
+}
+
+func TestInfluxDbWriterDropPolicy(t *testing.T) {
+    httpClient := test.GetHttpClient(t, test.GetLogger(t))
+
+    // drop oldest rows
+    writer := getInfluxDbWriter(t, httpClient)
+    httpClient.StatusCode = 503
+    for _, row := range []string{"row1", "row2", "row3", "row4", "row5", "row6"} {
+        _, err := writer.PostString("http://uri/write?db=db1", row, nil, nil)
+        test.Ok(t, err)
+    }
+    test.Equals(t, 5, writer.Buffered())
+    test.Equals(t, int64(1), writer.Dropped())
+
+    time.Sleep(15 * time.Millisecond)
+    httpClient.StatusCode = 0
+    writer.Flush()
+    test.Equals(t, "row2\nrow3\nrow4\nrow5\nrow6\n", httpClient.Calls[len(httpClient.Calls) - 1].Body)
+
+    // drop newest rows
+    params := test.GetConfig()
+    params.InfluxDbBatchSize = 10
+    params.InfluxDbMaxBufferedRows = 2
+    params.InfluxDbDropPolicy = piot.INFLUXDB_DROP_NEWEST
+    writer = piot.NewInfluxDbWriter(test.GetLogger(t), httpClient, params)
+    writer.PostString("http://uri/write?db=db1", "row1", nil, nil)
+    writer.PostString("http://uri/write?db=db1", "row2", nil, nil)
+    _, err := writer.PostString("http://uri/write?db=db1", "row3", nil, nil)
+    test.Equals(t, piot.ErrInfluxDbBufferFull, err)
+    writer.Flush()
+    test.Equals(t, "row1\nrow2\n", httpClient.Calls[len(httpClient.Calls) - 1].Body)
+}
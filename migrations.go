@@ -0,0 +1,84 @@
+package piot
+
+import (
+    "database/sql"
+    "fmt"
+    "time"
+    "github.com/op/go-logging"
+)
+
+// table holding versions of applied migrations
+const SQL_SCHEMA_VERSION_TABLE = "piot_schema_version"
+
+// Single step of sql schema evolution. Statements of each migration are
+// executed in order, migration is recorded as applied when all statements
+// and upgrade function succeed
+type SqlMigration struct {
+    Version int
+    Description string
+    Statements []string
+
+    // optional function run after statements, for changes depending on
+    // current state of database (e.g. tables created by older versions)
+    Upgrade func(db *sql.DB) (error)
+}
+
+// Apply migrations not applied yet in order of versions, migrations must be
+// sorted by version. Version of schema after migration is returned
+func MigrateSqlDb(log *logging.Logger, db *sql.DB, migrations []SqlMigration) (int, error) {
+    // statements don't use placeholders, since their syntax differs
+    // between sql drivers
+    _, err := db.Exec("CREATE TABLE IF NOT EXISTS " + SQL_SCHEMA_VERSION_TABLE + " (version INT NOT NULL PRIMARY KEY, applied_at BIGINT NOT NULL)")
+    if err != nil {
+        return 0, fmt.Errorf("Schema version table cannot be created (%v)", err)
+    }
+
+    version, err := GetSqlDbSchemaVersion(db)
+    if err != nil {
+        return 0, err
+    }
+
+    for _, migration := range migrations {
+        if migration.Version <= version {
+            continue
+        }
+
+        log.Infof("Migrating database schema to version %d (%s)", migration.Version, migration.Description)
+
+        // DDL statements are not transactional in some databases (e.g.
+        // MySQL), so statements should be safe to run again if migration
+        // is interrupted
+        for _, statement := range migration.Statements {
+            if _, err := db.Exec(statement); err != nil {
+                return version, fmt.Errorf("Migration to schema version %d failed (%v)", migration.Version, err)
+            }
+        }
+
+        if migration.Upgrade != nil {
+            if err := migration.Upgrade(db); err != nil {
+                return version, fmt.Errorf("Migration to schema version %d failed (%v)", migration.Version, err)
+            }
+        }
+
+        _, err := db.Exec(fmt.Sprintf("INSERT INTO %s (version, applied_at) VALUES (%d, %d)", SQL_SCHEMA_VERSION_TABLE, migration.Version, time.Now().Unix()))
+        if err != nil {
+            return version, fmt.Errorf("Schema version %d cannot be recorded (%v)", migration.Version, err)
+        }
+
+        version = migration.Version
+    }
+
+    return version, nil
+}
+
+// Get version of last applied migration, 0 is returned for empty database
+func GetSqlDbSchemaVersion(db *sql.DB) (int, error) {
+    var version sql.NullInt64
+
+    err := db.QueryRow("SELECT MAX(version) FROM " + SQL_SCHEMA_VERSION_TABLE).Scan(&version)
+    if err != nil {
+        return 0, fmt.Errorf("Schema version cannot be read (%v)", err)
+    }
+
+    return int(version.Int64), nil
+}
@@ -0,0 +1,121 @@
+package piot_test
+
+import (
+    "testing"
+    "github.com/mnezerka/go-piot"
+    "github.com/mnezerka/go-piot/test"
+)
+
+func TestMigrateSqlDb(t *testing.T) {
+    log := test.GetLogger(t)
+    db, mock := test.GetSqlDb(t)
+    defer db.Close()
+
+    migrations := []piot.SqlMigration{
+        {Version: 1, Description: "values", Statements: []string{
+            "CREATE TABLE IF NOT EXISTS vals (id VARCHAR(24) NOT NULL, time INT NOT NULL, PRIMARY KEY (id, time))",
+        }},
+    }
+
+    // empty database
+    version, err := piot.MigrateSqlDb(log, db, migrations)
+    test.Ok(t, err)
+    test.Equals(t, 1, version)
+
+    // applied migrations are not run again
+    migrations = append(migrations, piot.SqlMigration{Version: 2, Description: "index", Statements: []string{
+        "CREATE INDEX vals_time ON vals (time)",
+    }})
+    version, err = piot.MigrateSqlDb(log, db, migrations)
+    test.Ok(t, err)
+    test.Equals(t, 2, version)
+
+    version, err = piot.MigrateSqlDb(log, db, migrations)
+    test.Ok(t, err)
+    test.Equals(t, 2, version)
+
+    test.Equals(t, []string{migrations[0].Statements[0], migrations[1].Statements[0]}, mock.Statements)
+}
+
+func TestMigrateSqlDbFailure(t *testing.T) {
+    log := test.GetLogger(t)
+    db, mock := test.GetSqlDb(t)
+    defer db.Close()
+    mock.FailOn = "TABLEX"
+
+    migrations := []piot.SqlMigration{
+        {Version: 1, Description: "values", Statements: []string{"CREATE TABLE vals (id INT)"}},
+        {Version: 2, Description: "invalid", Statements: []string{"CREATE TABLEX xxx"}},
+    }
+
+    // version of last successful migration is kept
+    version, err := piot.MigrateSqlDb(log, db, migrations)
+    test.Assert(t, err != nil, "Invalid migration was applied")
+    test.Equals(t, 1, version)
+
+    version, err = piot.GetSqlDbSchemaVersion(db)
+    test.Ok(t, err)
+    test.Equals(t, 1, version)
+}
+
+func TestMigrateMysqlDb(t *testing.T) {
+    log := test.GetLogger(t)
+    db, mock := test.GetSqlDb(t)
+    defer db.Close()
+
+    // empty database, tables are created with keys
+    version, err := piot.MigrateMysqlDb(log, db)
+    test.Ok(t, err)
+    test.Equals(t, 3, version)
+    test.Equals(t, 4, len(mock.Statements))
+    for _, statement := range mock.Statements {
+        test.Contains(t, statement, "CREATE TABLE IF NOT EXISTS")
+    }
+    test.Equals(t, []string{"PRIMARY", "org_id_time"}, mock.Tables["piot_sensors"])
+    test.Equals(t, []string{"PRIMARY", "org_id_time"}, mock.Tables["piot_switches"])
+
+    version, err = piot.MigrateMysqlDb(log, db)
+    test.Ok(t, err)
+    test.Equals(t, 3, version)
+    test.Equals(t, 4, len(mock.Statements))
+}
+
+func TestMigrateMysqlDbUpgrade(t *testing.T) {
+    log := test.GetLogger(t)
+    db, mock := test.GetSqlDb(t)
+    defer db.Close()
+
+    // tables created before schema versioning, without keys or with some
+    // of them
+    mock.Tables = map[string][]string{
+        "piot_sensors": {},
+        "piot_switches": {"PRIMARY"},
+    }
+
+    version, err := piot.MigrateMysqlDb(log, db)
+    test.Ok(t, err)
+    test.Equals(t, 3, version)
+    test.Equals(t, []string{
+        "ALTER TABLE `piot_sensors` ADD PRIMARY KEY (`id`, `time`)",
+        "ALTER TABLE `piot_sensors` ADD INDEX `org_id_time` (`org`, `id`, `time`)",
+        "ALTER TABLE `piot_switches` ADD INDEX `org_id_time` (`org`, `id`, `time`)",
+    }, mock.Statements[4:])
+    test.Equals(t, []string{"PRIMARY", "org_id_time"}, mock.Tables["piot_sensors"])
+    test.Equals(t, []string{"PRIMARY", "org_id_time"}, mock.Tables["piot_switches"])
+
+    // failed upgrade is run again
+    db, mock = test.GetSqlDb(t)
+    defer db.Close()
+    mock.Tables = map[string][]string{"piot_sensors": {}, "piot_switches": {}}
+    mock.FailOn = "ADD PRIMARY KEY"
+
+    version, err = piot.MigrateMysqlDb(log, db)
+    test.Assert(t, err != nil, "Failed upgrade was not reported")
+    test.Equals(t, 2, version)
+
+    mock.FailOn = ""
+    version, err = piot.MigrateMysqlDb(log, db)
+    test.Ok(t, err)
+    test.Equals(t, 3, version)
+    test.Equals(t, []string{"PRIMARY", "org_id_time"}, mock.Tables["piot_switches"])
+}
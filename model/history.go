@@ -0,0 +1,17 @@
+package model
+
+// Value of sensor or state of switch stored in history
+type HistoryValue struct {
+    // unix timestamp
+    Time int32 `json:"time"`
+    Value float64 `json:"value"`
+}
+
+// Location of thing stored in history
+type HistoryLocation struct {
+    // unix timestamp
+    Time int32 `json:"time"`
+    Lat float64 `json:"lat"`
+    Lng float64 `json:"lng"`
+    Sat int32 `json:"sat"`
+}
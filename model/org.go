@@ -13,6 +13,12 @@ type Org struct {
     InfluxDb    string `json:"influxdb"`
     InfluxDbUsername   string `json:"influxdb_username" bson:"influxdb_username"`
     InfluxDbPassword   string `json:"influxdb_password" bson:"influxdb_password"`
+    // version of InfluxDB API, 0 or 1 means 1.x (database and basic auth),
+    // 2 means 2.x (org, bucket and token)
+    InfluxDbVersion    int32  `json:"influxdb_version" bson:"influxdb_version"`
+    InfluxDbOrg        string `json:"influxdb_org" bson:"influxdb_org"`
+    InfluxDbBucket     string `json:"influxdb_bucket" bson:"influxdb_bucket"`
+    InfluxDbToken      string `json:"influxdb_token" bson:"influxdb_token"`
     MqttUsername   string `json:"mqtt_username" bson:"mqtt_username"`
     MqttPassword   string `json:"mqtt_password" bson:"mqtt_password"`
     MysqlDb    string `json:"mysqldb"`
@@ -20,9 +26,49 @@ type Org struct {
     MysqlDbPassword   string `json:"mysqldb_password" bson:"mysqldb_password"`
 }
 
+// Roles of org members, each role includes permissions of roles below it
+const ORG_ROLE_OWNER = "owner"
+const ORG_ROLE_ADMIN = "admin"
+const ORG_ROLE_EDITOR = "editor"
+const ORG_ROLE_VIEWER = "viewer"
+
 // Represents assignment of user to org
 type OrgUser struct {
     OrgId       primitive.ObjectID `json:"org_id" bson:"org_id,omitempty"`
     UserId      primitive.ObjectID `json:"user_id" bson:"user_id,omitempty"`
     Created     int32  `json:"created"`
+
+    // role of the user in org, assignments created before roles were
+    // introduced have empty role which is handled as editor
+    Role        string `json:"role" bson:"role"`
+}
+
+// Get role of the member, see Role attribute for handling of legacy
+// assignments
+func (o *OrgUser) GetRole() string {
+    if o.Role == "" {
+        return ORG_ROLE_EDITOR
+    }
+    return o.Role
+}
+
+// Check if role is one of known roles
+func IsValidOrgRole(role string) bool {
+    return GetOrgRoleLevel(role) > 0
+}
+
+// Get level of the role, higher level has more permissions, 0 means unknown
+// role
+func GetOrgRoleLevel(role string) int {
+    switch role {
+    case ORG_ROLE_VIEWER:
+        return 1
+    case ORG_ROLE_EDITOR:
+        return 2
+    case ORG_ROLE_ADMIN:
+        return 3
+    case ORG_ROLE_OWNER:
+        return 4
+    }
+    return 0
 }
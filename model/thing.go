@@ -12,6 +12,23 @@ const THING_CLASS_TEMPERATURE = "temperature"
 const THING_CLASS_HUMIDITY = "humidity"
 const THING_CLASS_PRESSURE = "pressure"
 
+// names of built-in sinks
+const SINK_INFLUXDB = "influxdb"
+const SINK_MYSQLDB = "mysqldb"
+const SINK_POSTGRESDB = "postgresdb"
+const SINK_SQLITEDB = "sqlitedb"
+
+// classes of MQTT topics things data are published to
+const PUBLISH_AVAILABILITY = "availability"
+const PUBLISH_MEASUREMENT = "measurement"
+const PUBLISH_UNIT = "unit"
+const PUBLISH_NET = "net"
+const PUBLISH_COMMANDS = "commands"
+
+const SWITCH_SYNC_IN_SYNC = "in_sync"
+const SWITCH_SYNC_PENDING = "pending"
+const SWITCH_SYNC_OUT_OF_SYNC = "out_of_sync"
+
 // Represents any device or app
 type Thing struct {
 
@@ -53,6 +70,9 @@ type Thing struct {
     // is thing available
     Available   bool   `json:"available" bson:"available"`
 
+    // time of last change of availability
+    AvailableChanged int32 `json:"available_changed" bson:"available_changed"`
+
     // time the thing was seen last time
     LastSeen    int32  `json:"last_seen" bson:"last_seen"`
 
@@ -72,17 +92,32 @@ type Thing struct {
     // time the thing was seen last time
     Telemetry           string `json:"telemetry" bson:"telemetry"`
 
+    // Names of sinks the thing data (measurements, switch states, locations,
+    // telemetry) are stored to
+    Sinks []string `json:"sinks" bson:"sinks"`
+
     // Enable or Disable pushing values to organization assigned Influx database
+    // Deprecated: use SINK_INFLUXDB in Sinks
     StoreInfluxDb bool `json:"store_influxdb" bson:"store_influxdb"`
 
     // Enable or Disable storing values to mysql db assigned to organization
+    // Deprecated: use SINK_MYSQLDB in Sinks
     StoreMysqlDb bool `json:"store_mysqldb" bson:"store_mysqldb"`
 
     // minimal interval (in seconds) for storing values to mysql db,
     // more values to be stored in same inteval will be ignored, only
     // first one will be stored
+    // Deprecated: use SINK_MYSQLDB in SinkIntervals
     StoreMysqlDbInterval int32 `json:"store_mysqldb_interval" bson:"store_mysqldb_interval"`
 
+    // minimal intervals (in seconds) for storing values by name of sink,
+    // see StoreMysqlDbInterval and GetSinkInterval
+    SinkIntervals map[string]int32 `json:"sink_intervals" bson:"sink_intervals"`
+
+    // Policies of publishing to MQTT topics (by class of topic, see
+    // PUBLISH_*), global policies are used for classes not present
+    PublishPolicies map[string]PublishPolicy `json:"publish_policies" bson:"publish_policies"`
+
      // The latitude in degrees. It must be in the range [-90.0, +90.0].
     LocationLatitude float64 `json:"loc_lat" bson:"loc_lat"`
 
@@ -112,6 +147,65 @@ type Thing struct {
     Switch SwitchData `json:"switch" bson:"switch"`
 }
 
+// QoS and retain flag used for publishing of MQTT messages
+type PublishPolicy struct {
+    Qos byte `json:"qos" bson:"qos"`
+    Retain bool `json:"retain" bson:"retain"`
+}
+
+// Get names of sinks enabled for the thing, deprecated flags are honoured
+// in addition to Sinks
+func (t *Thing) GetSinks() []string {
+    result := append([]string(nil), t.Sinks...)
+
+    contains := func(name string) bool {
+        for _, sink := range result {
+            if sink == name {
+                return true
+            }
+        }
+        return false
+    }
+
+    if t.StoreInfluxDb && !contains(SINK_INFLUXDB) {
+        result = append(result, SINK_INFLUXDB)
+    }
+    if t.StoreMysqlDb && !contains(SINK_MYSQLDB) {
+        result = append(result, SINK_MYSQLDB)
+    }
+
+    return result
+}
+
+// Get minimal interval (in seconds) for storing values to sink, interval of
+// mysqldb sink is taken from StoreMysqlDbInterval if it is not set in
+// SinkIntervals
+func (t *Thing) GetSinkInterval(sink string) int32 {
+    if interval, ok := t.SinkIntervals[sink]; ok {
+        return interval
+    }
+    if sink == SINK_MYSQLDB {
+        return t.StoreMysqlDbInterval
+    }
+    return 0
+}
+
+// Get names of sinks locations of the thing are stored to. Before sinks were
+// introduced, tracked locations were always stored to InfluxDB, so InfluxDB
+// is added for things which don't have sinks configured explicitly
+func (t *Thing) GetLocationSinks() []string {
+    result := t.GetSinks()
+    if len(t.Sinks) > 0 {
+        return result
+    }
+    for _, sink := range result {
+        if sink == SINK_INFLUXDB {
+            return result
+        }
+    }
+    return append(result, SINK_INFLUXDB)
+}
+
 // Represents measurements for things that are sensors
 type SensorData struct {
 
@@ -136,13 +230,17 @@ type SensorData struct {
     // measurement is valid
     Validity int32  `json:"validity" bson:"validity"`
 
+    // Value was flagged (or cleared) as stale since it is older than Validity
+    Stale bool `json:"stale" bson:"stale"`
+
     // The unit of measurement that the sensor is expressed in.
-    Unit string `json:"unit bson"unit""`
+    Unit string `json:"unit" bson:"unit"`
 }
 
 // Represents switch (e.g. high voltage power switch)
 type SwitchData struct {
 
+    // Last known state of the switch
     State bool `json:"state" bson:"state"`
 
     // Topic to send commands
@@ -162,4 +260,32 @@ type SwitchData struct {
 
     // Value that represents OFF state
     StateOff string `json:"state_off" bson:"state_off"`
+
+    // State requested by last command sent to the switch
+    DesiredState bool `json:"desired_state" bson:"desired_state"`
+
+    // Time when last command was sent (unix timestamp)
+    DesiredTs int32 `json:"desired_ts" bson:"desired_ts"`
+
+    // State reported by the switch via state topic
+    ReportedState bool `json:"reported_state" bson:"reported_state"`
+
+    // Time when state was reported last time (unix timestamp)
+    ReportedTs int32 `json:"reported_ts" bson:"reported_ts"`
+
+    // Synchronization of desired and reported state, see SWITCH_SYNC_*
+    // constants, empty value means no command was sent to the switch yet
+    SyncStatus string `json:"sync_status" bson:"sync_status"`
+
+    // Number of times the command was re-sent without confirmation
+    SyncRetries int32 `json:"sync_retries" bson:"sync_retries"`
+}
+
+// Check if last measurement is older than validity of the sensor. Sensors
+// without validity or without measurement never get stale
+func (s *SensorData) IsStale(now int32) bool {
+    if s.Validity <= 0 || s.MeasurementLast == 0 {
+        return false
+    }
+    return s.MeasurementLast + s.Validity < now
 }
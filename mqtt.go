@@ -5,10 +5,11 @@ import (
     "fmt"
     "strings"
     "strconv"
+    "sync"
     "time"
     "github.com/op/go-logging"
+    "github.com/mnezerka/go-piot/config"
     "github.com/mnezerka/go-piot/model"
-    "go.mongodb.org/mongo-driver/bson"
     "go.mongodb.org/mongo-driver/bson/primitive"
     mqtt "github.com/eclipse/paho.mqtt.golang"
     "github.com/tidwall/gjson"
@@ -35,29 +36,40 @@ const TOPIC_ROOT = "org"
 type IMqtt interface {
     PushThingData(thing *model.Thing, topic, value string) error
     ProcessMessage(ctx *AuthContext, topic, payload string)
+    SetSwitch(ctx *AuthContext, thingId primitive.ObjectID, on bool) error
     Connect(subscribe bool) error
     Disconnect() error
+    StartWorkers()
     SetUsername(username string)
     SetPassword(password string)
     SetClient(id string)
+    SetOptions(options *MqttOptions)
 }
 
 type Mqtt struct {
     log *logging.Logger
     things *Things
     orgs *Orgs
-    influxDb IInfluxDb
-    mysqlDb IMysqlDb
+    sinks *Sinks
+    routes *TopicRoutes
 
     Uri string
     Username *string
     Password *string
     Client *string
     client mqtt.Client
+    options *MqttOptions
+
+    // incoming messages are processed inline if not set, pool is replaced
+    // on each connect, so field is protected by mutex
+    workersMutex sync.RWMutex
+    workers *MqttWorkers
 }
 
-func NewMqtt(uri string, log *logging.Logger, things *Things, orgs *Orgs, influxDb IInfluxDb, mysqlDb IMysqlDb) IMqtt {
-    m := &Mqtt{log: log, Uri: uri, things: things, orgs: orgs, influxDb: influxDb, mysqlDb: mysqlDb}
+func NewMqtt(uri string, log *logging.Logger, things *Things, orgs *Orgs, sinks *Sinks) IMqtt {
+    m := &Mqtt{log: log, Uri: uri, things: things, orgs: orgs, sinks: sinks}
+    m.options = NewMqttOptions(config.NewParameters())
+    m.routes = NewTopicRoutes(log, things, m.options.RoutesTtl)
 
     return m
 }
@@ -74,11 +86,45 @@ func (t *Mqtt) SetClient(id string) {
     t.Client = &id
 }
 
-func (t *Mqtt) Connect(subscribe bool) error {
-    t.log.Infof("Connecting to MQTT broker %s", t.Uri)
+// Set options of connection, must be called before Connect
+func (t *Mqtt) SetOptions(options *MqttOptions) {
+    t.options = options
+    t.routes.SetTtl(options.RoutesTtl)
+}
+
+// Drop index of things by topics (see TopicRoutes), changes of things done
+// outside of Things service become visible to processing of incoming
+// messages without waiting for expiration of the index
+func (t *Mqtt) InvalidateRoutes() {
+    t.routes.Invalidate()
+}
+
+// Replace client used for communication with MQTT broker, this is useful
+// mainly for testing purposes
+func (t *Mqtt) SetBrokerClient(client mqtt.Client) {
+    t.client = client
+}
+
+// Process incoming messages by pool of workers (see MqttOptions.Workers)
+// instead of processing them inline in subscription callback, it is called
+// by Connect for subscribing clients. Queued messages are processed before
+// Disconnect completes
+func (t *Mqtt) StartWorkers() {
+    t.workersMutex.Lock()
+    defer t.workersMutex.Unlock()
+
+    if t.workers != nil || t.options.Workers <= 0 {
+        return
+    }
+
+    t.workers = NewMqttWorkers(t.log, t.options.Workers, t.options.QueueSize, func(topic, payload string) {
+        t.ProcessMessage(NewSystemContext(), topic, payload)
+    })
+}
 
-    // create a ClientOptions struct setting the broker address, clientid, turn
-    // off trace output and set the default message handler
+// Get options of client connecting to MQTT broker, incoming messages are
+// processed only if subscribe is set
+func (t *Mqtt) ClientOptions(subscribe bool) (*mqtt.ClientOptions, error) {
     opts := mqtt.NewClientOptions().AddBroker(t.Uri)
     opts.SetClientID(*t.Client)
     if t.Username != nil {
@@ -88,34 +134,54 @@ func (t *Mqtt) Connect(subscribe bool) error {
         opts.SetPassword(*t.Password)
     }
 
-    opts.OnConnect = func(client mqtt.Client) {
-
-        t.log.Infof("Connectedt to MQTT broker %s", t.Uri)
-        if subscribe {
+    tlsConfig, err := t.options.GetTlsConfig()
+    if err != nil {
+        return nil, err
+    }
+    if tlsConfig != nil {
+        opts.SetTLSConfig(tlsConfig)
+    }
 
-            topic := fmt.Sprintf("%s/#", TOPIC_ROOT)
+    opts.SetKeepAlive(t.options.KeepAlive)
+    opts.SetConnectTimeout(t.options.ConnectTimeout)
+    opts.SetAutoReconnect(t.options.AutoReconnect)
+    opts.SetMaxReconnectInterval(t.options.MaxReconnectInterval)
+    opts.SetCleanSession(t.options.CleanSession)
+    if t.options.StoreDir != "" {
+        opts.SetStore(mqtt.NewFileStore(t.options.StoreDir))
+    }
 
-            ctx := NewAuthContext(nil)
+    if t.options.Status {
+        opts.SetWill(t.options.GetStatusTopic(*t.Client), MQTT_STATUS_OFFLINE, 1, true)
+    }
 
-            // subscribe for all topcis
-            t.log.Infof("Subscribing to topic #")
-            token := client.Subscribe(topic, 0, func(_ mqtt.Client, msg mqtt.Message) {
-                //processUpdate(msg.Topic(), string(msg.Payload()))
-                t.ProcessMessage(ctx, msg.Topic(), string(msg.Payload()))
-            })
-            if !token.WaitTimeout(10 * time.Second) {
-                t.log.Errorf("Timeout subscribing to topic %s (%s)", topic, token.Error())
-            }
-            if err := token.Error(); err != nil {
-                t.log.Errorf("Failed to subscribe to topic %s (%s)", topic, err)
-            }
+    // called on initial connect and on each reconnect
+    opts.SetOnConnectHandler(func(client mqtt.Client) {
+        t.onConnect(client, subscribe)
+    })
 
-            t.log.Infof("Subscribed to topic %s", topic)
+    opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+        if t.options.AutoReconnect {
+            t.log.Errorf("Connection to MQTT broker %s lost, reconnecting (%s)", t.Uri, err.Error())
+        } else {
+            t.log.Errorf("Connection to MQTT broker %s lost (%s)", t.Uri, err.Error())
         }
+    })
+
+    return opts, nil
+}
+
+func (t *Mqtt) Connect(subscribe bool) error {
+    t.log.Infof("Connecting to MQTT broker %s", t.Uri)
+
+    opts, err := t.ClientOptions(subscribe)
+    if err != nil {
+        t.log.Errorf("Connection failed (%s)", err.Error())
+        return err
     }
 
-    opts.OnConnectionLost = func(client mqtt.Client, err error) {
-        t.log.Infof("Error: Connection to MQTT broker %s lost (%s)", t.Uri, err.Error())
+    if subscribe {
+        t.StartWorkers()
     }
 
     // create and start a client using the above ClientOptions
@@ -129,7 +195,130 @@ func (t *Mqtt) Connect(subscribe bool) error {
     return nil
 }
 
+// Subscriptions are not kept by broker for clean sessions, so they are
+// (re)established on each connect always in the same order, birth message
+// is published after subscriptions are ready
+func (t *Mqtt) onConnect(client mqtt.Client, subscribe bool) {
+    t.log.Infof("Connected to MQTT broker %s", t.Uri)
+
+    if subscribe {
+        for _, topic := range t.getSubscriptions() {
+            t.log.Infof("Subscribing to topic %s", topic)
+            token := client.Subscribe(topic, t.options.SubscribeQos, t.onMessage)
+            if !token.WaitTimeout(10 * time.Second) {
+                t.log.Errorf("Timeout subscribing to topic %s", topic)
+                continue
+            }
+            if err := token.Error(); err != nil {
+                t.log.Errorf("Failed to subscribe to topic %s (%s)", topic, err)
+                continue
+            }
+            t.log.Infof("Subscribed to topic %s", topic)
+        }
+    }
+
+    if t.options.Status {
+        t.publishStatus(client, MQTT_STATUS_ONLINE)
+    }
+}
+
+func (t *Mqtt) unsubscribe() {
+    topics := t.getSubscriptions()
+    t.log.Infof("Unsubscribing from topics %v", topics)
+    token := t.client.Unsubscribe(topics...)
+    if !token.WaitTimeout(10 * time.Second) {
+        t.log.Errorf("Timeout unsubscribing from topics %v", topics)
+        return
+    }
+    if err := token.Error(); err != nil {
+        t.log.Errorf("Failed to unsubscribe from topics %v (%s)", topics, err)
+    }
+}
+
+// Get topics the service subscribes to
+func (t *Mqtt) getSubscriptions() []string {
+    return []string{fmt.Sprintf("%s/#", TOPIC_ROOT)}
+}
+
+func (t *Mqtt) onMessage(_ mqtt.Client, msg mqtt.Message) {
+    t.workersMutex.RLock()
+    workers := t.workers
+    t.workersMutex.RUnlock()
+
+    if workers != nil {
+        // rejected messages are logged by workers
+        workers.Submit(t.getMessageKey(msg.Topic()), msg.Topic(), string(msg.Payload()))
+        return
+    }
+    t.ProcessMessage(NewSystemContext(), msg.Topic(), string(msg.Payload()))
+}
+
+// Get key assigning message to worker. Things subscribe to arbitrary topics
+// of their org, so thing is resolved by topic routes and messages of single
+// thing are keyed by its id. Topic routed to several things is keyed by
+// lowest id, so ordering is kept for things sharing all their topics.
+// Messages not routed to any thing are keyed by topic
+func (t *Mqtt) getMessageKey(topic string) string {
+    orgName, thingTopic, ok := parseOrgTopic(topic)
+    if !ok {
+        return topic
+    }
+
+    org, err := t.orgs.GetByName(orgName)
+    if err != nil {
+        return topic
+    }
+
+    things, err := t.routes.LookupTopic(org.Id, thingTopic)
+    if err != nil || len(things) == 0 {
+        return topic
+    }
+
+    key := things[0].Id.Hex()
+    for _, thing := range things[1:] {
+        if id := thing.Id.Hex(); id < key {
+            key = id
+        }
+    }
+
+    return key
+}
+
+func (t *Mqtt) publishStatus(client mqtt.Client, status string) {
+    topic := t.options.GetStatusTopic(*t.Client)
+    token := client.Publish(topic, 1, true, status)
+    if !token.WaitTimeout(10 * time.Second) {
+        t.log.Errorf("Timeout publishing status to topic %s", topic)
+        return
+    }
+    if err := token.Error(); err != nil {
+        t.log.Errorf("Failed to publish status to topic %s (%s)", topic, err)
+    }
+}
+
 func (t *Mqtt) Disconnect() error {
+    t.workersMutex.RLock()
+    workers := t.workers
+    t.workersMutex.RUnlock()
+
+    if workers != nil {
+        // no more messages are delivered to workers while they are drained
+        t.unsubscribe()
+        if err := workers.Drain(t.options.DrainTimeout); err != nil {
+            t.log.Errorf("%s", err.Error())
+        }
+
+        // stopped pool is replaced by next Connect
+        t.workersMutex.Lock()
+        t.workers = nil
+        t.workersMutex.Unlock()
+    }
+
+    // last will is not published by broker for graceful disconnect
+    if t.options.Status {
+        t.publishStatus(t.client, MQTT_STATUS_OFFLINE)
+    }
+
     t.log.Infof("Disconnecting from MQTT broker")
     t.client.Disconnect(250)
     return nil
@@ -160,18 +349,96 @@ func (t *Mqtt) PushThingData(thing *model.Thing, topic, value string) (error) {
         return err
     }
 
-    t.log.Debugf("MQTT Publish, topic: \"%s\", value: \"%s\"", mqttTopic, value)
+    policy := t.options.GetPublishPolicy(thing, topic)
+
+    t.log.Debugf("MQTT Publish, topic: \"%s\", value: \"%s\", qos: %d, retain: %v", mqttTopic, value, policy.Qos, policy.Retain)
+
+    token := t.client.Publish(mqttTopic, policy.Qos, policy.Retain, value)
+    if !waitToken(token, t.options.PublishTimeout) {
+        err := fmt.Errorf("Timeout publishing to topic %s", mqttTopic)
+        t.log.Errorf(err.Error())
+        return err
+    }
+    if err := token.Error(); err != nil {
+        t.log.Errorf("Failed to publish to topic %s (%s)", mqttTopic, err)
+        return err
+    }
 
-    token := t.client.Publish(mqttTopic, 0, false, value)
-    token.Wait()
     return nil
 }
 
+// Wait for completion of token, 0 means no timeout
+func waitToken(token mqtt.Token, timeout time.Duration) bool {
+    if timeout <= 0 {
+        return token.Wait()
+    }
+    return token.WaitTimeout(timeout)
+}
+
+// Send command to switch thing. Requested state is stored as desired state of
+// the switch and stays pending until switch reports matching state
+func (t *Mqtt) SetSwitch(ctx *AuthContext, thingId primitive.ObjectID, on bool) error {
+    t.log.Debugf("Setting switch <%s> to <%v>", thingId.Hex(), on)
+
+    thing, err := t.things.Get(ctx, thingId)
+    if err != nil {
+        return err
+    }
+
+    if thing.Type != model.THING_TYPE_SWITCH {
+        return fmt.Errorf("Thing \"%s\" is not a switch", thing.Name)
+    }
+
+    if thing.OrgId == primitive.NilObjectID {
+        return fmt.Errorf("Rejecting switch command due to missing organization assignment of thing \"%s\"", thing.Name)
+    }
+
+    if !ctx.CanModifyOrg(thing.OrgId) {
+        return NewForbiddenError("Switch \"%s\" cannot be controlled", thing.Name)
+    }
+
+    if thing.Switch.CommandTopic == "" {
+        return fmt.Errorf("Switch \"%s\" has no command topic", thing.Name)
+    }
+
+    if err := t.PushThingData(thing, thing.Switch.CommandTopic, getSwitchCommand(thing, on)); err != nil {
+        return err
+    }
+
+    return t.things.SetSwitchDesiredState(ctx, thing.Id, on)
+}
+
+// Get payload of command that brings switch to given state
+func getSwitchCommand(thing *model.Thing, on bool) string {
+    if on {
+        return thing.Switch.CommandOn
+    }
+    return thing.Switch.CommandOff
+}
+
+// Get things of the org subscribed to topic in given role, records come
+// from topic routes, so runtime state of things is not valid (see
+// TopicRoutes.Lookup)
+func (t *Mqtt) getRoutedThings(ctx *AuthContext, org *model.Org, topic, role string) ([]*model.Thing, error) {
+    things, err := t.routes.Lookup(org.Id, topic, role)
+    if err != nil {
+        return nil, err
+    }
+
+    for _, thing := range things {
+        if err := t.things.checkAccess(ctx, thing); err != nil {
+            return nil, err
+        }
+    }
+
+    return things, nil
+}
+
 func (t *Mqtt) ProcessDevices(ctx *AuthContext, org *model.Org, topic, payload string) {
     t.log.Debugf("Processing MQTT message with topic \"%s\" for devices in org \"%s\"", topic, org.Name)
 
     // update availability
-    devices, err := t.things.GetFiltered(ctx, bson.M{"org_id": org.Id, "type": model.THING_TYPE_DEVICE, "availability_topic": topic})
+    devices, err := t.getRoutedThings(ctx, org, topic, ROUTE_AVAILABILITY)
     if err != nil {
         t.log.Errorf("MQTT processing error, falied fetching of org \"%s\" devices: %s", org.Name, err.Error())
         return
@@ -180,15 +447,36 @@ func (t *Mqtt) ProcessDevices(ctx *AuthContext, org *model.Org, topic, payload s
 
         thing := devices[i]
 
-        // update sensor last seen status
-        err = t.things.TouchThing(thing.Id)
+        // use default values if availability values are not configured
+        yes := thing.AvailabilityYes
+        if yes == "" {
+            yes = VALUE_YES
+        }
+        no := thing.AvailabilityNo
+        if no == "" {
+            no = VALUE_NO
+        }
+
+        switch(payload) {
+        case yes:
+            // update device last seen status
+            err = t.things.touchThing(ctx, thing)
+            if err != nil {
+                t.log.Errorf("MQTT processing error: %s", err.Error())
+            }
+            err = t.things.SetAvailable(ctx, thing.Id, true)
+        case no:
+            err = t.things.SetAvailable(ctx, thing.Id, false)
+        default:
+            err = fmt.Errorf("Unknown availability value \"%s\" for device %s", payload, thing.Name)
+        }
         if err != nil {
             t.log.Errorf("MQTT processing error: %s", err.Error())
         }
     }
 
     // update telemetry
-    devices, err = t.things.GetFiltered(ctx, bson.M{"org_id": org.Id, "type": model.THING_TYPE_DEVICE, "telemetry_topic": topic})
+    devices, err = t.getRoutedThings(ctx, org, topic, ROUTE_TELEMETRY)
     if err != nil {
         t.log.Errorf("MQTT processing error, falied fetching of org \"%s\" devices: %s", org.Name, err.Error())
         return
@@ -198,19 +486,23 @@ func (t *Mqtt) ProcessDevices(ctx *AuthContext, org *model.Org, topic, payload s
         thing := devices[i]
 
         // update sensor last seen status
-        err = t.things.TouchThing(thing.Id)
+        err = t.things.touchThing(ctx, thing)
         if err != nil {
             t.log.Errorf("MQTT processing error: %s", err.Error())
         }
 
-        err = t.things.SetTelemetry(thing.Id, payload)
+        err = t.things.SetTelemetry(ctx, thing.Id, payload)
         if err != nil {
             t.log.Errorf("MQTT processing error: %s", err.Error())
         }
+
+        if err := t.sinks.StoreTelemetry(thing, payload, time.Now()); err != nil {
+            t.log.Errorf("MQTT processing error: %s", err.Error())
+        }
     }
 
     // update location
-    devices, err = t.things.GetFiltered(ctx, bson.M{"org_id": org.Id, "type": model.THING_TYPE_DEVICE, "loc_mqtt_topic": topic})
+    devices, err = t.getRoutedThings(ctx, org, topic, ROUTE_LOCATION)
     if err != nil {
         t.log.Errorf("MQTT processing error, falied fetching of org \"%s\" devices: %s", org.Name, err.Error())
         return
@@ -220,7 +512,7 @@ func (t *Mqtt) ProcessDevices(ctx *AuthContext, org *model.Org, topic, payload s
         thing := devices[i]
 
         // update sensor last seen status
-        err = t.things.TouchThing(thing.Id)
+        err = t.things.touchThing(ctx, thing)
         if err != nil {
             t.log.Errorf("MQTT processing error: %s", err.Error())
         }
@@ -298,13 +590,15 @@ func (t *Mqtt) ProcessDevices(ctx *AuthContext, org *model.Org, topic, payload s
                 ts = int32(time.Now().Unix())
             }
 
-            err = t.things.SetLocation(thing.Id, lat, lng, sat, ts)
+            err = t.things.SetLocation(ctx, thing.Id, lat, lng, sat, ts)
             if err != nil {
                 t.log.Errorf("MQTT processing error: %s", err.Error())
             }
 
             if thing.LocationTracking {
-                t.influxDb.PostLocation(thing, lat, lng, sat, ts)
+                if err := t.sinks.StoreLocation(thing, lat, lng, sat, ts); err != nil {
+                    t.log.Errorf("MQTT processing error: %s", err.Error())
+                }
             }
         }
     }
@@ -314,7 +608,7 @@ func (t *Mqtt) ProcessSensors(ctx *AuthContext, org *model.Org, topic, payload s
     t.log.Debugf("Processing MQTT message with topic \"%s\" for sensors in org \"%s\"", topic, org.Name)
 
     // look for sensors attached to this topic from active org
-    sensors, err := t.things.GetFiltered(ctx, bson.M{"org_id": org.Id, "type": model.THING_TYPE_SENSOR, "sensor.measurement_topic": topic})
+    sensors, err := t.getRoutedThings(ctx, org, topic, ROUTE_MEASUREMENT)
     if err != nil {
         t.log.Errorf("MQTT processing error, falied fetching of org \"%s\" sensors: %s", org.Name, err.Error())
         return
@@ -339,26 +633,21 @@ func (t *Mqtt) ProcessSensors(ctx *AuthContext, org *model.Org, topic, payload s
         }
 
         // update sensor last seen status
-        err = t.things.TouchThing(thing.Id)
+        err = t.things.touchThing(ctx, thing)
         if err != nil {
             t.log.Errorf("MQTT processing error: %s", err.Error())
         }
 
         // set value to one from incoming payload
-        err = t.things.SetSensorValue(thing.Id, value)
+        err = t.things.SetSensorValue(ctx, thing.Id, value)
         if err != nil {
             // report error, but don't interrupt processing
             t.log.Errorf("MQTT processing error: %s", err.Error())
         }
 
-        // store it to influx db if configured
-        if thing.StoreInfluxDb  {
-            t.influxDb.PostMeasurement(thing, value)
-        }
-
-        // store it to mysql db if configured
-        if thing.StoreMysqlDb {
-            t.mysqlDb.StoreMeasurement(thing, value)
+        // store it to sinks enabled for the thing
+        if err := t.sinks.StoreMeasurement(thing, value, time.Now()); err != nil {
+            t.log.Errorf("MQTT processing error: %s", err.Error())
         }
 
     }
@@ -368,7 +657,7 @@ func (t *Mqtt) ProcessSwitches(ctx *AuthContext, org *model.Org, topic, payload
     t.log.Debugf("Processing MQTT message with topic \"%s\" for switches in org \"%s\"", topic, org.Name)
 
     // look for sensors attached to this topic from active org
-    switches, err := t.things.GetFiltered(ctx, bson.M{"org_id": org.Id, "type": model.THING_TYPE_SWITCH, "switch.state_topic": topic})
+    switches, err := t.getRoutedThings(ctx, org, topic, ROUTE_SWITCH_STATE)
     if err != nil {
         t.log.Errorf("MQTT processing error, falied fetching of org \"%s\" switches: %s", org.Name, err.Error())
         return
@@ -380,18 +669,20 @@ func (t *Mqtt) ProcessSwitches(ctx *AuthContext, org *model.Org, topic, payload
         thing := switches[i]
 
         // update sensor last seen status
-        err = t.things.TouchThing(thing.Id)
+        err = t.things.touchThing(ctx, thing)
         if err != nil {
             t.log.Errorf("MQTT processing error: %s", err.Error())
         }
 
         dbValue := ""
+        state := false
         switch(payload) {
         case thing.Switch.StateOn:
-            err = t.things.SetSwitchState(thing.Id, true)
+            state = true
+            err = t.things.SetSwitchState(ctx, thing.Id, state)
             dbValue = "1"
         case thing.Switch.StateOff:
-            err = t.things.SetSwitchState(thing.Id, false)
+            err = t.things.SetSwitchState(ctx, thing.Id, state)
             dbValue = "0"
         default:
             err = errors.New("Unknown switch state")
@@ -400,46 +691,86 @@ func (t *Mqtt) ProcessSwitches(ctx *AuthContext, org *model.Org, topic, payload
             t.log.Warningf("Issue with processing of switch %s MQTT state messsage: %s", thing.Name, err.Error())
         }
 
-        // store it to influx db if configured
-        if thing.StoreInfluxDb {
-            t.influxDb.PostSwitchState(thing, dbValue)
+        // switch that gave up synchronization is reachable again, try to
+        // bring it to desired state
+        if err == nil {
+            t.resyncSwitch(ctx, thing.Id, state)
         }
 
-        // store it to mysql db if configured
-        if thing.StoreMysqlDb {
-            t.mysqlDb.StoreSwitchState(thing, dbValue)
+        // store it to sinks enabled for the thing
+        if err := t.sinks.StoreSwitchState(thing, dbValue, time.Now()); err != nil {
+            t.log.Errorf("MQTT processing error: %s", err.Error())
         }
     }
 }
 
+// Re-send command for desired state to switch which is out of sync.
+// Synchronization state is not valid in routed records (see
+// getRoutedThings), so current record of the switch is fetched
+func (t *Mqtt) resyncSwitch(ctx *AuthContext, id primitive.ObjectID, state bool) {
+    thing, err := t.things.Get(ctx, id)
+    if err != nil {
+        t.log.Errorf("MQTT processing error: %s", err.Error())
+        return
+    }
+
+    if thing.Switch.SyncStatus != model.SWITCH_SYNC_OUT_OF_SYNC || state == thing.Switch.DesiredState {
+        return
+    }
+
+    t.log.Infof("Switch %s is back, re-sending command for desired state", thing.Name)
+    err = t.PushThingData(thing, thing.Switch.CommandTopic, getSwitchCommand(thing, thing.Switch.DesiredState))
+    if err == nil {
+        err = t.things.SetSwitchDesiredState(ctx, thing.Id, thing.Switch.DesiredState)
+    }
+    if err != nil {
+        t.log.Errorf("MQTT processing error: %s", err.Error())
+    }
+}
+
 // Process message received from MQTT broker for org subscription
 func (t *Mqtt) ProcessMessage(ctx *AuthContext, topic, payload string) {
     t.log.Debugf("Recieved MQTT message (topic: %s, val: %s)", topic, payload)
 
+    orgName, topicThing, ok := parseOrgTopic(topic)
+    if !ok {
+        return
+    }
+
+    // get org ID
+    org, err := t.orgs.GetByName(orgName)
+    if err != nil {
+        // unknown organization
+        t.log.Warningf("MQTT processing error, unknown org: %s (%s)", orgName, err.Error())
+        return
+    }
+
+    t.ProcessDevices(ctx, org, topicThing, payload);
+    t.ProcessSensors(ctx, org, topicThing, payload);
+    t.ProcessSwitches(ctx, org, topicThing, payload);
+}
+
+// Split topic of org subscription (org/<org>/<topic>) to name of org and
+// topic within org, system topics (e.g. status of piot services) and topics
+// outside of org root are not accepted
+func parseOrgTopic(topic string) (string, string, bool) {
     topicParts := strings.Split(topic, "/")
 
     // skip topics that don't contain org section (first two
     // parts
     if len(topicParts) < 3 {
-        return
+        return "", "", false
     }
 
     // skip topics that doesn't belong to organization root
     if topicParts[0] != TOPIC_ROOT {
-        return
+        return "", "", false
     }
 
-    topicThing := strings.Join(topicParts[2:], "/")
-
-    // get org ID
-    org, err := t.orgs.GetByName(topicParts[1])
-    if err != nil {
-        // unknown organization
-        t.log.Warningf("MQTT processing error, unknown org: %s (%s)", topicParts[1], err.Error())
-        return
+    // skip system topics (e.g. status of piot services)
+    if strings.HasPrefix(topicParts[2], "$") {
+        return "", "", false
     }
 
-    t.ProcessDevices(ctx, org, topicThing, payload);
-    t.ProcessSensors(ctx, org, topicThing, payload);
-    t.ProcessSwitches(ctx, org, topicThing, payload);
+    return topicParts[1], strings.Join(topicParts[2:], "/"), true
 }
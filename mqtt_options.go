@@ -0,0 +1,176 @@
+package piot
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "fmt"
+    "io/ioutil"
+    "time"
+    "strings"
+    "github.com/mnezerka/go-piot/config"
+    "github.com/mnezerka/go-piot/model"
+)
+
+// topic (relative to org) of service status, see MqttOptions.Status
+const TOPIC_PIOT_STATUS = "$piot/status"
+
+const MQTT_STATUS_ONLINE = "online"
+const MQTT_STATUS_OFFLINE = "offline"
+
+// Options of connection to MQTT broker
+type MqttOptions struct {
+    // TLS is used if any of these is set (broker uri should use ssl://
+    // scheme), client certificate is used only if both cert and key are set
+    CaFile string
+    CertFile string
+    KeyFile string
+    InsecureSkipVerify bool
+
+    KeepAlive time.Duration
+    ConnectTimeout time.Duration
+
+    // lost connection is re-established with exponential backoff limited
+    // by max reconnect interval
+    AutoReconnect bool
+    MaxReconnectInterval time.Duration
+
+    // messages in flight are kept in directory of persistent store if set,
+    // it makes sense for sessions which are not clean only
+    CleanSession bool
+    StoreDir string
+
+    // birth message is published (retained) to status topic on each
+    // connect, broker publishes last will when connection is lost, topic
+    // org/<client id>/$piot/status is used if status topic is not set
+    Status bool
+    StatusTopic string
+
+    // QoS of subscription for incoming messages
+    SubscribeQos byte
+
+    // expiration of index of things by topics (see TopicRoutes)
+    RoutesTtl time.Duration
+
+    // incoming messages are processed by pool of workers (see MqttWorkers)
+    // with queues of given size, 0 workers means inline processing in
+    // subscription callback. Queued messages are processed on disconnect
+    // within drain timeout
+    Workers int
+    QueueSize int
+    DrainTimeout time.Duration
+
+    // publishing fails if message is not delivered to broker within
+    // timeout, messages with QoS > 0 would wait for reconnect otherwise
+    // (0 means no timeout)
+    PublishTimeout time.Duration
+
+    // policies of publishing by class of topic (see model.PUBLISH_*), can
+    // be overridden by thing (see Thing.PublishPolicies)
+    PublishPolicies map[string]model.PublishPolicy
+}
+
+func NewMqttOptions(params *config.Parameters) *MqttOptions {
+    return &MqttOptions{
+        CaFile: params.MqttCaFile,
+        CertFile: params.MqttCertFile,
+        KeyFile: params.MqttKeyFile,
+        InsecureSkipVerify: params.MqttInsecureSkipVerify,
+        KeepAlive: params.MqttKeepAlive,
+        ConnectTimeout: params.MqttConnectTimeout,
+        AutoReconnect: params.MqttAutoReconnect,
+        MaxReconnectInterval: params.MqttMaxReconnectInterval,
+        CleanSession: params.MqttCleanSession,
+        StoreDir: params.MqttStoreDir,
+        Status: params.MqttStatus,
+        StatusTopic: params.MqttStatusTopic,
+        SubscribeQos: byte(params.MqttSubscribeQos),
+        RoutesTtl: params.MqttRoutesTtl,
+        Workers: params.MqttWorkers,
+        QueueSize: params.MqttQueueSize,
+        DrainTimeout: params.MqttDrainTimeout,
+        PublishTimeout: params.MqttPublishTimeout,
+        PublishPolicies: map[string]model.PublishPolicy{
+            model.PUBLISH_AVAILABILITY: {Qos: byte(params.MqttAvailabilityQos), Retain: params.MqttAvailabilityRetain},
+            model.PUBLISH_MEASUREMENT: {Qos: byte(params.MqttMeasurementQos), Retain: params.MqttMeasurementRetain},
+            model.PUBLISH_UNIT: {Qos: byte(params.MqttUnitQos), Retain: params.MqttUnitRetain},
+            model.PUBLISH_NET: {Qos: byte(params.MqttNetQos), Retain: params.MqttNetRetain},
+            model.PUBLISH_COMMANDS: {Qos: byte(params.MqttCommandsQos), Retain: params.MqttCommandsRetain},
+        },
+    }
+}
+
+// Check if class of topics is known
+func IsPublishClass(class string) bool {
+    switch class {
+    case model.PUBLISH_AVAILABILITY, model.PUBLISH_MEASUREMENT, model.PUBLISH_UNIT, model.PUBLISH_NET, model.PUBLISH_COMMANDS:
+        return true
+    }
+    return false
+}
+
+// Get class of thing topic (relative to thing), topics which are not
+// recognized are considered to be measurements
+func GetPublishClass(thing *model.Thing, topic string) string {
+    switch {
+    case topic == TOPIC_AVAILABLE:
+        return model.PUBLISH_AVAILABILITY
+    case topic == TOPIC_NET || strings.HasPrefix(topic, TOPIC_NET + "/"):
+        return model.PUBLISH_NET
+    case topic == TOPIC_UNIT || strings.HasSuffix(topic, "/" + TOPIC_UNIT):
+        return model.PUBLISH_UNIT
+    case thing.Type == model.THING_TYPE_SWITCH && topic == thing.Switch.CommandTopic:
+        return model.PUBLISH_COMMANDS
+    }
+    return model.PUBLISH_MEASUREMENT
+}
+
+// Get policy of publishing to thing topic, policy of thing takes precedence
+// over global one
+func (o *MqttOptions) GetPublishPolicy(thing *model.Thing, topic string) model.PublishPolicy {
+    class := GetPublishClass(thing, topic)
+    if policy, ok := thing.PublishPolicies[class]; ok {
+        return policy
+    }
+    return o.PublishPolicies[class]
+}
+
+// Get topic of service status for given client
+func (o *MqttOptions) GetStatusTopic(client string) string {
+    if o.StatusTopic != "" {
+        return o.StatusTopic
+    }
+    return fmt.Sprintf("%s/%s/%s", TOPIC_ROOT, client, TOPIC_PIOT_STATUS)
+}
+
+// Get TLS configuration, nil is returned if TLS is not configured
+func (o *MqttOptions) GetTlsConfig() (*tls.Config, error) {
+    if o.CaFile == "" && o.CertFile == "" && o.KeyFile == "" && !o.InsecureSkipVerify {
+        return nil, nil
+    }
+
+    cfg := &tls.Config{InsecureSkipVerify: o.InsecureSkipVerify}
+
+    if o.CaFile != "" {
+        pem, err := ioutil.ReadFile(o.CaFile)
+        if err != nil {
+            return nil, fmt.Errorf("Cannot read MQTT CA file (%v)", err)
+        }
+        cfg.RootCAs = x509.NewCertPool()
+        if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+            return nil, fmt.Errorf("No certificates found in MQTT CA file %s", o.CaFile)
+        }
+    }
+
+    if o.CertFile != "" || o.KeyFile != "" {
+        if o.CertFile == "" || o.KeyFile == "" {
+            return nil, fmt.Errorf("Both MQTT client certificate and key must be set")
+        }
+        cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+        if err != nil {
+            return nil, fmt.Errorf("Cannot load MQTT client certificate (%v)", err)
+        }
+        cfg.Certificates = []tls.Certificate{cert}
+    }
+
+    return cfg, nil
+}
@@ -0,0 +1,240 @@
+package piot_test
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/pem"
+    "fmt"
+    "io/ioutil"
+    "math/big"
+    "path/filepath"
+    "testing"
+    "time"
+    "github.com/mnezerka/go-piot"
+    "github.com/mnezerka/go-piot/config"
+    "github.com/mnezerka/go-piot/model"
+    "github.com/mnezerka/go-piot/test"
+)
+
+// Create self signed certificate and its key, paths of both files are returned
+func createCertificate(t *testing.T, dir string) (string, string) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    test.Ok(t, err)
+
+    template := &x509.Certificate{
+        SerialNumber: big.NewInt(1),
+        Subject: pkix.Name{CommonName: "piot"},
+        NotBefore: time.Now(),
+        NotAfter: time.Now().Add(time.Hour),
+        IsCA: true,
+        BasicConstraintsValid: true,
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+    test.Ok(t, err)
+    keyDer, err := x509.MarshalECPrivateKey(key)
+    test.Ok(t, err)
+
+    certFile := filepath.Join(dir, "cert.pem")
+    keyFile := filepath.Join(dir, "key.pem")
+    test.Ok(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+    test.Ok(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+
+    return certFile, keyFile
+}
+
+func TestMqttOptionsTls(t *testing.T) {
+    dir, err := ioutil.TempDir("", "piot-mqtt")
+    test.Ok(t, err)
+    certFile, keyFile := createCertificate(t, dir)
+
+    options := piot.NewMqttOptions(config.NewParameters())
+
+    // tls is not used by default
+    tlsConfig, err := options.GetTlsConfig()
+    test.Ok(t, err)
+    test.Assert(t, tlsConfig == nil, "TLS configured by default")
+
+    options.CaFile = certFile
+    options.CertFile = certFile
+    options.KeyFile = keyFile
+    tlsConfig, err = options.GetTlsConfig()
+    test.Ok(t, err)
+    test.Assert(t, tlsConfig.RootCAs != nil, "CA not loaded")
+    test.Equals(t, 1, len(tlsConfig.Certificates))
+    test.Equals(t, false, tlsConfig.InsecureSkipVerify)
+
+    // key without certificate
+    options.CertFile = ""
+    _, err = options.GetTlsConfig()
+    test.Assert(t, err != nil, "Key without certificate accepted")
+
+    // CA file without certificates
+    options.CaFile = keyFile
+    options.KeyFile = ""
+    _, err = options.GetTlsConfig()
+    test.Assert(t, err != nil, "Invalid CA file accepted")
+
+    options.CaFile = filepath.Join(dir, "missing.pem")
+    _, err = options.GetTlsConfig()
+    test.Assert(t, err != nil, "Missing CA file accepted")
+}
+
+func TestMqttClientOptions(t *testing.T) {
+    log := test.GetLogger(t)
+    db := test.GetDb(t)
+    mqtt := getMqtt(t, log, db, test.GetInfluxDb(t, log), test.GetMysqlDb(t, log))
+    client := test.GetMqttClient(t, log)
+    mqtt.(*piot.Mqtt).SetBrokerClient(client)
+    mqtt.SetClient("piot-test")
+
+    params := config.NewParameters()
+    params.MqttKeepAlive = 20 * time.Second
+    params.MqttCleanSession = false
+    mqtt.SetOptions(piot.NewMqttOptions(params))
+
+    opts, err := mqtt.(*piot.Mqtt).ClientOptions(true)
+    test.Ok(t, err)
+    test.Equals(t, int64(20), opts.KeepAlive)
+    test.Equals(t, false, opts.CleanSession)
+    test.Equals(t, true, opts.AutoReconnect)
+    test.Equals(t, true, opts.WillEnabled)
+    test.Equals(t, "org/piot-test/$piot/status", opts.WillTopic)
+    test.Equals(t, piot.MQTT_STATUS_OFFLINE, string(opts.WillPayload))
+    test.Equals(t, true, opts.WillRetained)
+
+    // subscriptions and birth message are repeated on reconnect
+    opts.OnConnect(client)
+    opts.OnConnect(client)
+    test.Equals(t, []string{"org/#", "org/#"}, client.Subscriptions)
+    test.Equals(t, 2, len(client.Calls))
+    for _, call := range client.Calls {
+        test.Equals(t, "org/piot-test/$piot/status", call.Topic)
+        test.Equals(t, piot.MQTT_STATUS_ONLINE, call.Payload)
+        test.Equals(t, byte(1), call.Qos)
+        test.Equals(t, true, call.Retained)
+    }
+
+    // graceful disconnect stops delivery of messages before queued messages
+    // are processed and publishes last will explicitly
+    mqtt.StartWorkers()
+    test.Ok(t, mqtt.Disconnect())
+    test.Equals(t, []string{"org/#"}, client.Unsubscriptions)
+    test.Equals(t, 3, len(client.Calls))
+    test.Equals(t, piot.MQTT_STATUS_OFFLINE, client.Calls[2].Payload)
+}
+
+func TestMqttPublishPolicies(t *testing.T) {
+    const THING = "THING1"
+    const ORG = "org1"
+
+    log := test.GetLogger(t)
+    db := test.GetDb(t)
+    mqtt := getMqtt(t, log, db, test.GetInfluxDb(t, log), test.GetMysqlDb(t, log))
+    ctx := test.GetContext(t)
+    client := test.GetMqttClient(t, log)
+    mqtt.(*piot.Mqtt).SetBrokerClient(client)
+    things := test.GetThings(t, log, db)
+
+    test.CleanDb(t, db)
+    switchId := test.CreateSwitch(t, db, THING)
+    orgId := test.CreateOrg(t, db, ORG)
+    test.AddOrgThing(t, db, orgId, THING)
+
+    push := func(topic string) (byte, bool) {
+        thing, err := things.Get(ctx, switchId)
+        test.Ok(t, err)
+        test.Ok(t, mqtt.PushThingData(thing, topic, "x"))
+        call := client.Calls[len(client.Calls) - 1]
+        return call.Qos, call.Retained
+    }
+
+    // global policies
+    qos, retain := push(piot.TOPIC_AVAILABLE)
+    test.Equals(t, byte(1), qos)
+    test.Equals(t, true, retain)
+    qos, retain = push(piot.TOPIC_WIFI_SSID)
+    test.Equals(t, byte(0), qos)
+    test.Equals(t, true, retain)
+    qos, retain = push("value/unit")
+    test.Equals(t, byte(0), qos)
+    test.Equals(t, true, retain)
+    qos, retain = push("value")
+    test.Equals(t, byte(0), qos)
+    test.Equals(t, false, retain)
+    qos, retain = push("cmnd")
+    test.Equals(t, byte(1), qos)
+    test.Equals(t, false, retain)
+
+    // policies of thing take precedence
+    _, err := things.Update(ctx, switchId, map[string]interface{}{
+        "publish_policies": map[string]interface{}{
+            "measurement": map[string]interface{}{"qos": float64(1), "retain": true},
+            "commands": map[string]interface{}{"qos": float64(2)},
+        },
+    })
+    test.Ok(t, err)
+    qos, retain = push("value")
+    test.Equals(t, byte(1), qos)
+    test.Equals(t, true, retain)
+    qos, retain = push("cmnd")
+    test.Equals(t, byte(2), qos)
+    test.Equals(t, false, retain)
+    qos, retain = push(piot.TOPIC_AVAILABLE)
+    test.Equals(t, byte(1), qos)
+    test.Equals(t, true, retain)
+
+    // invalid policies are rejected
+    _, err = things.Update(ctx, switchId, map[string]interface{}{
+        "publish_policies": map[string]interface{}{"measurement": map[string]interface{}{"qos": float64(3)}},
+    })
+    test.Assert(t, err != nil, "Invalid QoS accepted")
+    _, err = things.Update(ctx, switchId, map[string]interface{}{
+        "publish_policies": map[string]model.PublishPolicy{"unknown": {Qos: 1}},
+    })
+    test.Assert(t, err != nil, "Unknown class accepted")
+
+    // policies of thing can be removed
+    _, err = things.Update(ctx, switchId, map[string]interface{}{"publish_policies": nil})
+    test.Ok(t, err)
+    qos, retain = push("value")
+    test.Equals(t, byte(0), qos)
+    test.Equals(t, false, retain)
+}
+
+// Workers stopped by disconnect are replaced on next connect
+func TestMqttReconnectWorkers(t *testing.T) {
+    const SENSOR = "sensor1"
+    const ORG = "org1"
+
+    log := test.GetLogger(t)
+    db := test.GetDb(t)
+    influxDb := test.GetInfluxDb(t, log)
+    mqtt := getMqtt(t, log, db, influxDb, test.GetMysqlDb(t, log))
+    client := test.GetMqttClient(t, log)
+    mqtt.(*piot.Mqtt).SetBrokerClient(client)
+    mqtt.SetClient("piot-test")
+
+    test.CleanDb(t, db)
+    sensorId := test.CreateThing(t, db, SENSOR)
+    test.SetSensorMeasurementTopic(t, db, sensorId, SENSOR + "/value")
+    orgId := test.CreateOrg(t, db, ORG)
+    test.AddOrgThing(t, db, orgId, SENSOR)
+    test.SetThingSinks(t, db, sensorId, []string{model.SINK_INFLUXDB})
+
+    opts, err := mqtt.(*piot.Mqtt).ClientOptions(true)
+    test.Ok(t, err)
+
+    for i := 0; i < 2; i++ {
+        mqtt.StartWorkers()
+        opts.OnConnect(client)
+        client.Deliver("org/org1/sensor1/value", fmt.Sprintf("%d", i))
+
+        // queued messages are processed by disconnect
+        test.Ok(t, mqtt.Disconnect())
+        test.Equals(t, i + 1, len(influxDb.Calls))
+        test.Equals(t, fmt.Sprintf("%d", i), influxDb.Calls[i].Value)
+    }
+}
@@ -1,21 +1,20 @@
 package piot_test
 
 import (
-    "context"
+    "errors"
     "fmt"
     "testing"
     "time"
     "github.com/op/go-logging"
-    "go.mongodb.org/mongo-driver/mongo"
-    "go.mongodb.org/mongo-driver/bson"
     "github.com/mnezerka/go-piot"
+    "github.com/mnezerka/go-piot/model"
     "github.com/mnezerka/go-piot/test"
 )
 
-func getMqtt(t *testing.T, log *logging.Logger, db *mongo.Database, influxDb piot.IInfluxDb, mysqlDb piot.IMysqlDb) piot.IMqtt {
+func getMqtt(t *testing.T, log *logging.Logger, db *piot.Repositories, influxDb piot.IInfluxDb, mysqlDb piot.IMysqlDb) piot.IMqtt {
     orgs := test.GetOrgs(t, log, db)
     things := test.GetThings(t, log, db)
-    return piot.NewMqtt("uri", log, things, orgs, influxDb, mysqlDb)
+    return piot.NewMqtt("uri", log, things, orgs, test.GetSinks(t, log, influxDb, mysqlDb))
 }
 
 func TestMqttMsgNotSensor(t *testing.T) {
@@ -25,14 +24,15 @@ func TestMqttMsgNotSensor(t *testing.T) {
     influxDb := test.GetInfluxDb(t, log)
     mysqlDb := test.GetMysqlDb(t, log)
     mqtt := getMqtt(t, log, db, influxDb, mysqlDb)
+    ctx := test.GetContext(t)
 
     test.CleanDb(t, db)
 
     // send message to topic that is ignored
-    mqtt.ProcessMessage("xxx", "payload")
+    mqtt.ProcessMessage(ctx, "xxx", "payload")
 
     // send message to not registered thing
-    mqtt.ProcessMessage("org/hello/x", "payload")
+    mqtt.ProcessMessage(ctx, "org/hello/x", "payload")
 }
 
 func TestMqttThingTelemetry(t *testing.T) {
@@ -44,6 +44,7 @@ func TestMqttThingTelemetry(t *testing.T) {
     influxDb := test.GetInfluxDb(t, log)
     mysqlDb := test.GetMysqlDb(t, log)
     mqtt := getMqtt(t, log, db, influxDb, mysqlDb)
+    ctx := test.GetContext(t)
     things := test.GetThings(t, log, db)
 
     test.CleanDb(t, db)
@@ -53,12 +54,20 @@ func TestMqttThingTelemetry(t *testing.T) {
     test.AddOrgThing(t, db, orgId, THING)
 
     // send telemetry message
-    mqtt.ProcessMessage(fmt.Sprintf("org/%s/%s/telemetry", ORG, THING), "telemetry data")
+    mqtt.ProcessMessage(ctx, fmt.Sprintf("org/%s/%s/telemetry", ORG, THING), "telemetry data")
 
-    thing, err := things.Get(thingId)
+    thing, err := things.Get(ctx, thingId)
     test.Ok(t, err)
     test.Equals(t, THING, thing.Name)
     test.Equals(t, "telemetry data", thing.Telemetry)
+
+    // telemetry history is stored if enabled
+    test.Equals(t, 0, len(mysqlDb.Calls))
+    test.SetThingSinks(t, db, thingId, []string{model.SINK_MYSQLDB})
+    mqtt.(*piot.Mqtt).InvalidateRoutes()
+    mqtt.ProcessMessage(ctx, fmt.Sprintf("org/%s/%s/telemetry", ORG, THING), "telemetry data 2")
+    test.Equals(t, 1, len(mysqlDb.Calls))
+    test.Equals(t, "telemetry data 2", mysqlDb.Calls[0].Value)
 }
 
 func TestMqttThingLocation(t *testing.T) {
@@ -71,6 +80,7 @@ func TestMqttThingLocation(t *testing.T) {
     influxDb := test.GetInfluxDb(t, log)
     mysqlDb := test.GetMysqlDb(t, log)
     mqtt := getMqtt(t, log, db, influxDb, mysqlDb)
+    ctx := test.GetContext(t)
     things := test.GetThings(t, log, db)
 
     test.CleanDb(t, db)
@@ -87,9 +97,9 @@ func TestMqttThingLocation(t *testing.T) {
     test.SetThingLocationParams(t, db, thing2Id , THING2 + "/" + "loc", "lat", "lng", "sat", "", true)
 
     // THING1 send location message with timestamp -> timestamp is used
-    mqtt.ProcessMessage(fmt.Sprintf("org/%s/%s/loc", ORG, THING), "{\"lat\": 123.234, \"lng\": 678.789, \"ts\": 456}")
+    mqtt.ProcessMessage(ctx, fmt.Sprintf("org/%s/%s/loc", ORG, THING), "{\"lat\": 123.234, \"lng\": 678.789, \"ts\": 456}")
 
-    thing, err := things.Get(thingId)
+    thing, err := things.Get(ctx, thingId)
     test.Ok(t, err)
     test.Equals(t, THING, thing.Name)
     test.Equals(t, 123.234, thing.LocationLatitude)
@@ -97,9 +107,9 @@ func TestMqttThingLocation(t *testing.T) {
     test.Equals(t, int32(456), thing.LocationTs)
 
     // THING1 send location message without timestamp -> current time should be set
-    mqtt.ProcessMessage(fmt.Sprintf("org/%s/%s/loc", ORG, THING), "{\"lat\": 123.234, \"lng\": 678.789}")
+    mqtt.ProcessMessage(ctx, fmt.Sprintf("org/%s/%s/loc", ORG, THING), "{\"lat\": 123.234, \"lng\": 678.789}")
 
-    thing, err = things.Get(thingId)
+    thing, err = things.Get(ctx, thingId)
     test.Ok(t, err)
     test.Equals(t, THING, thing.Name)
     test.Equals(t, 123.234, thing.LocationLatitude)
@@ -110,8 +120,8 @@ func TestMqttThingLocation(t *testing.T) {
     test.Equals(t, 0, len(influxDb.Calls))
 
     // THING2 send location message with timestamp, -> current time should be set
-    mqtt.ProcessMessage(fmt.Sprintf("org/%s/%s/loc", ORG, THING2), "{\"lat\": 211.1, \"lng\": 222.19, \"sat\": 4, \"ts\": 600}")
-    thing, err = things.Get(thing2Id)
+    mqtt.ProcessMessage(ctx, fmt.Sprintf("org/%s/%s/loc", ORG, THING2), "{\"lat\": 211.1, \"lng\": 222.19, \"sat\": 4, \"ts\": 600}")
+    thing, err = things.Get(ctx, thing2Id)
     test.Ok(t, err)
     test.Equals(t, THING2, thing.Name)
     test.Equals(t, 211.1, thing.LocationLatitude)
@@ -123,6 +133,13 @@ func TestMqttThingLocation(t *testing.T) {
     test.Contains(t, influxDb.Calls[0].Value, "lat:211.1")
     test.Contains(t, influxDb.Calls[0].Value, "lng:222.1")
     test.Contains(t, influxDb.Calls[0].Value, "sat:4")
+
+    // THING2 with explicitly configured sinks -> influxdb is not used
+    test.SetThingSinks(t, db, thing2Id, []string{model.SINK_MYSQLDB})
+    mqtt.(*piot.Mqtt).InvalidateRoutes()
+    mqtt.ProcessMessage(ctx, fmt.Sprintf("org/%s/%s/loc", ORG, THING2), "{\"lat\": 211.2, \"lng\": 222.2}")
+    test.Equals(t, 1, len(influxDb.Calls))
+    test.Equals(t, 1, len(mysqlDb.Calls))
 }
 
 // incoming sensor MQTT message for registered sensor
@@ -135,6 +152,7 @@ func TestMqttMsgSensor(t *testing.T) {
     influxDb := test.GetInfluxDb(t, log)
     mysqlDb := test.GetMysqlDb(t, log)
     mqtt := getMqtt(t, log, db, influxDb, mysqlDb)
+    ctx := test.GetContext(t)
 
     test.CleanDb(t, db)
     sensorId := test.CreateThing(t, db, SENSOR)
@@ -143,10 +161,10 @@ func TestMqttMsgSensor(t *testing.T) {
     test.AddOrgThing(t, db, orgId, SENSOR)
 
     // send unit message to registered thing
-    mqtt.ProcessMessage(fmt.Sprintf("org/%s/%s/unit", ORG, SENSOR), "C")
+    mqtt.ProcessMessage(ctx, fmt.Sprintf("org/%s/%s/unit", ORG, SENSOR), "C")
 
     // send temperature message to registered thing
-    mqtt.ProcessMessage(fmt.Sprintf("org/%s/%s/value", ORG, SENSOR), "23")
+    mqtt.ProcessMessage(ctx, fmt.Sprintf("org/%s/%s/value", ORG, SENSOR), "23")
 
     // check if influxdb was called
     test.Equals(t, 1, len(influxDb.Calls))
@@ -159,8 +177,35 @@ func TestMqttMsgSensor(t *testing.T) {
     test.Equals(t, SENSOR, mysqlDb.Calls[0].Thing.Name)
 
     // second round of calls to check proper functionality for high load
-    mqtt.ProcessMessage(fmt.Sprintf("org/%s/%s/unit", ORG, SENSOR), "C")
-    mqtt.ProcessMessage(fmt.Sprintf("org/%s/%s/value", ORG, SENSOR), "23")
+    mqtt.ProcessMessage(ctx, fmt.Sprintf("org/%s/%s/unit", ORG, SENSOR), "C")
+    mqtt.ProcessMessage(ctx, fmt.Sprintf("org/%s/%s/value", ORG, SENSOR), "23")
+}
+
+// Things subscribed to topics are not fetched from database for each message
+func TestMqttMsgSensorRouted(t *testing.T) {
+    const SENSOR = "sensor1"
+    const ORG = "org1"
+
+    log := test.GetLogger(t)
+    db := test.GetDb(t)
+    test.CleanDb(t, db)
+    cachedDb := piot.NewCachedRepositories(db, time.Minute)
+    mysqlDb := test.GetMysqlDb(t, log)
+    mqtt := getMqtt(t, log, cachedDb, test.GetInfluxDb(t, log), mysqlDb)
+    ctx := test.GetContext(t)
+
+    sensorId := test.CreateThing(t, db, SENSOR)
+    test.SetSensorMeasurementTopic(t, db, sensorId, SENSOR + "/" + "value")
+    orgId := test.CreateOrg(t, db, ORG)
+    test.AddOrgThing(t, db, orgId, SENSOR)
+
+    for i := 0; i < 3; i++ {
+        mqtt.ProcessMessage(ctx, fmt.Sprintf("org/%s/%s/value", ORG, SENSOR), "23")
+    }
+
+    test.Equals(t, 3, len(mysqlDb.Calls))
+    stats := cachedDb.Cache.ThingStats()
+    test.Equals(t, int64(0), stats.Hits + stats.Misses)
 }
 
 // this verifies that parsing json payloads works well
@@ -173,6 +218,7 @@ func TestMqttMsgSensorWithComplexValue(t *testing.T) {
     influxDb := test.GetInfluxDb(t, log)
     mysqlDb := test.GetMysqlDb(t, log)
     mqtt := getMqtt(t, log, db, influxDb, mysqlDb)
+    ctx := test.GetContext(t)
 
     test.CleanDb(t, db)
     sensorId := test.CreateThing(t, db, SENSOR)
@@ -181,11 +227,11 @@ func TestMqttMsgSensorWithComplexValue(t *testing.T) {
     test.AddOrgThing(t, db, orgId, SENSOR)
 
     // modify sensor thing - set value template
-    _, err := db.Collection("things").UpdateOne(context.TODO(), bson.M{"_id": sensorId}, bson.M{"$set": bson.M{"sensor.measurement_value": "temp"}})
+    err := db.Things.SetFields(sensorId, map[string]interface{}{"sensor.measurement_value": "temp"})
     test.Ok(t, err)
 
     // send temperature message to registered thing
-    mqtt.ProcessMessage(fmt.Sprintf("org/%s/%s/value", ORG, SENSOR), "{\"temp\": \"23\"}")
+    mqtt.ProcessMessage(ctx, fmt.Sprintf("org/%s/%s/value", ORG, SENSOR), "{\"temp\": \"23\"}")
 
     // check if persistent storages were called
     test.Equals(t, 1, len(influxDb.Calls))
@@ -196,11 +242,12 @@ func TestMqttMsgSensorWithComplexValue(t *testing.T) {
     test.Equals(t, SENSOR, mysqlDb.Calls[0].Thing.Name)
 
     // more complex structure
-    _, err = db.Collection("things").UpdateOne(context.TODO(), bson.M{"_id": sensorId}, bson.M{"$set": bson.M{"sensor.measurement_value": "DS18B20.Temperature"}})
+    err = db.Things.SetFields(sensorId, map[string]interface{}{"sensor.measurement_value": "DS18B20.Temperature"})
     test.Ok(t, err)
+    mqtt.(*piot.Mqtt).InvalidateRoutes()
 
     payload := "{\"Time\":\"2020-01-24T22:52:58\",\"DS18B20\":{\"Id\":\"0416C18091FF\",\"Temperature\":23.0}"
-    mqtt.ProcessMessage(fmt.Sprintf("org/%s/%s/value", ORG, SENSOR), payload)
+    mqtt.ProcessMessage(ctx, fmt.Sprintf("org/%s/%s/value", ORG, SENSOR), payload)
 
     // check if persistent storages were called
     test.Equals(t, 2, len(influxDb.Calls))
@@ -222,6 +269,7 @@ func TestMqttMsgMultipleSensors(t *testing.T) {
     influxDb := test.GetInfluxDb(t, log)
     mysqlDb := test.GetMysqlDb(t, log)
     mqtt := getMqtt(t, log, db, influxDb, mysqlDb)
+    ctx := test.GetContext(t)
 
     test.CleanDb(t, db)
     sensor1Id := test.CreateThing(t, db, SENSOR1)
@@ -234,7 +282,7 @@ func TestMqttMsgMultipleSensors(t *testing.T) {
     test.AddOrgThing(t, db, orgId, SENSOR2)
 
     // send temperature message to registered thing
-    mqtt.ProcessMessage(fmt.Sprintf("org/%s/xyz/value", ORG), "23")
+    mqtt.ProcessMessage(ctx, fmt.Sprintf("org/%s/xyz/value", ORG), "23")
 
     // check if persistent storages were called
     test.Equals(t, 2, len(influxDb.Calls))
@@ -259,6 +307,7 @@ func TestMqttMsgSwitch(t *testing.T) {
     influxDb := test.GetInfluxDb(t, log)
     mysqlDb := test.GetMysqlDb(t, log)
     mqtt := getMqtt(t, log, db, influxDb, mysqlDb)
+    ctx := test.GetContext(t)
 
     test.CleanDb(t, db)
     sensorId := test.CreateSwitch(t, db, THING)
@@ -267,10 +316,10 @@ func TestMqttMsgSwitch(t *testing.T) {
     test.AddOrgThing(t, db, orgId, THING)
 
     // send state change to ON
-    mqtt.ProcessMessage(fmt.Sprintf("org/%s/%s/state", ORG, THING), "ON")
+    mqtt.ProcessMessage(ctx, fmt.Sprintf("org/%s/%s/state", ORG, THING), "ON")
 
     // send state change to OFF
-    mqtt.ProcessMessage(fmt.Sprintf("org/%s/%s/state", ORG, THING), "OFF")
+    mqtt.ProcessMessage(ctx, fmt.Sprintf("org/%s/%s/state", ORG, THING), "OFF")
 
     // check if mqtt was called
     test.Equals(t, 2, len(influxDb.Calls))
@@ -281,3 +330,166 @@ func TestMqttMsgSwitch(t *testing.T) {
     test.Equals(t, "0", influxDb.Calls[1].Value)
     test.Equals(t, THING, influxDb.Calls[1].Thing.Name)
 }
+
+func TestMqttSetSwitch(t *testing.T) {
+    const THING = "THING1"
+    const ORG = "org1"
+
+    log := test.GetLogger(t)
+    db := test.GetDb(t)
+    influxDb := test.GetInfluxDb(t, log)
+    mysqlDb := test.GetMysqlDb(t, log)
+    mqtt := getMqtt(t, log, db, influxDb, mysqlDb)
+    ctx := test.GetContext(t)
+    client := test.GetMqttClient(t, log)
+    mqtt.(*piot.Mqtt).SetBrokerClient(client)
+    things := test.GetThings(t, log, db)
+
+    test.CleanDb(t, db)
+    switchId := test.CreateSwitch(t, db, THING)
+    test.SetSwitchStateTopic(t, db, switchId, THING + "/" + "state", "ON", "OFF")
+    orgId := test.CreateOrg(t, db, ORG)
+    test.AddOrgThing(t, db, orgId, THING)
+
+    // send command to switch on
+    err := mqtt.SetSwitch(ctx, switchId, true)
+    test.Ok(t, err)
+
+    test.Equals(t, 1, len(client.Calls))
+    test.Equals(t, fmt.Sprintf("org/%s/%s/cmnd", ORG, THING), client.Calls[0].Topic)
+    test.Equals(t, "ON", client.Calls[0].Payload)
+
+    thing, err := things.Get(ctx, switchId)
+    test.Ok(t, err)
+    test.Equals(t, true, thing.Switch.DesiredState)
+    test.Equals(t, model.SWITCH_SYNC_PENDING, thing.Switch.SyncStatus)
+
+    // switch reports different state -> command is still pending
+    mqtt.ProcessMessage(ctx, fmt.Sprintf("org/%s/%s/state", ORG, THING), "OFF")
+    thing, err = things.Get(ctx, switchId)
+    test.Ok(t, err)
+    test.Equals(t, model.SWITCH_SYNC_PENDING, thing.Switch.SyncStatus)
+
+    // switch reports desired state -> command is confirmed
+    mqtt.ProcessMessage(ctx, fmt.Sprintf("org/%s/%s/state", ORG, THING), "ON")
+    thing, err = things.Get(ctx, switchId)
+    test.Ok(t, err)
+    test.Equals(t, true, thing.Switch.State)
+    test.Equals(t, model.SWITCH_SYNC_IN_SYNC, thing.Switch.SyncStatus)
+    test.Equals(t, true, thing.Switch.ReportedState)
+
+    // send command to switch off
+    err = mqtt.SetSwitch(ctx, switchId, false)
+    test.Ok(t, err)
+    test.Equals(t, 2, len(client.Calls))
+    test.Equals(t, "OFF", client.Calls[1].Payload)
+
+    // failed or timed out publish is reported, desired state is kept
+    client.PublishErr = errors.New("connection lost")
+    err = mqtt.SetSwitch(ctx, switchId, true)
+    test.Assert(t, err != nil, "Failed publish shall be reported")
+    client.PublishErr = nil
+    client.PublishTimeout = true
+    err = mqtt.SetSwitch(ctx, switchId, true)
+    test.Assert(t, err != nil, "Timed out publish shall be reported")
+    thing, err = things.Get(ctx, switchId)
+    test.Ok(t, err)
+    test.Equals(t, false, thing.Switch.DesiredState)
+}
+
+func TestMqttSetSwitchForeignOrg(t *testing.T) {
+    const THING = "THING1"
+    const ORG = "org1"
+
+    log := test.GetLogger(t)
+    db := test.GetDb(t)
+    influxDb := test.GetInfluxDb(t, log)
+    mysqlDb := test.GetMysqlDb(t, log)
+    mqtt := getMqtt(t, log, db, influxDb, mysqlDb)
+    client := test.GetMqttClient(t, log)
+    mqtt.(*piot.Mqtt).SetBrokerClient(client)
+
+    test.CleanDb(t, db)
+    switchId := test.CreateSwitch(t, db, THING)
+    orgId := test.CreateOrg(t, db, ORG)
+    test.AddOrgThing(t, db, orgId, THING)
+
+    // user which is not member of switch org
+    user := &model.User{Email: "user@test.com"}
+
+    err := mqtt.SetSwitch(piot.NewAuthContext(user), switchId, true)
+    test.Assert(t, err != nil, "Switch of foreign org shall not be controlled")
+    test.Equals(t, 0, len(client.Calls))
+
+    // user which is member of switch org, membership taken from user orgs
+    // gives viewer role only
+    user.Orgs = append(user.Orgs, model.Org{Id: orgId, Name: ORG})
+    ctx := piot.NewAuthContext(user)
+
+    err = mqtt.SetSwitch(ctx, switchId, true)
+    test.Assert(t, piot.IsForbidden(err), "Viewer shall not control switch")
+    test.Equals(t, 0, len(client.Calls))
+
+    ctx.OrgRoles[orgId] = model.ORG_ROLE_EDITOR
+    err = mqtt.SetSwitch(ctx, switchId, true)
+    test.Ok(t, err)
+    test.Equals(t, 1, len(client.Calls))
+}
+
+func TestMqttThingAvailability(t *testing.T) {
+    const THING = "device1"
+    const ORG = "org1"
+
+    log := test.GetLogger(t)
+    db := test.GetDb(t)
+    influxDb := test.GetInfluxDb(t, log)
+    mysqlDb := test.GetMysqlDb(t, log)
+    things := test.GetThings(t, log, db)
+    mqtt := piot.NewMqtt("uri", log, things, test.GetOrgs(t, log, db), test.GetSinks(t, log, influxDb, mysqlDb))
+    ctx := test.GetContext(t)
+
+    var events []*piot.Event
+    things.Events.Subscribe(func(event *piot.Event) {
+        if event.Type == piot.EVENT_AVAILABILITY_CHANGED {
+            events = append(events, event)
+        }
+    })
+
+    test.CleanDb(t, db)
+    thingId := test.CreateDevice(t, db, THING)
+    orgId := test.CreateOrg(t, db, ORG)
+    test.AddOrgThing(t, db, orgId, THING)
+    test.Ok(t, things.SetAvailabilityTopic(ctx, thingId, "available"))
+    test.Ok(t, things.SetAvailabilityYesNo(ctx, thingId, "online", "offline"))
+
+    // device is online
+    mqtt.ProcessMessage(ctx, fmt.Sprintf("org/%s/%s", ORG, "available"), "online")
+
+    thing, err := things.Get(ctx, thingId)
+    test.Ok(t, err)
+    test.Equals(t, true, thing.Available)
+    test.Assert(t, thing.AvailableChanged > 0, "Time of availability change not set")
+    test.Equals(t, 1, len(events))
+    test.Equals(t, piot.EVENT_AVAILABILITY_CHANGED, events[0].Type)
+    test.Equals(t, thingId, events[0].ThingId)
+    test.Equals(t, "yes", events[0].Value)
+
+    // repeated message doesn't change availability
+    mqtt.ProcessMessage(ctx, fmt.Sprintf("org/%s/%s", ORG, "available"), "online")
+    test.Equals(t, 1, len(events))
+
+    // unknown value is ignored
+    mqtt.ProcessMessage(ctx, fmt.Sprintf("org/%s/%s", ORG, "available"), "xyz")
+    thing, err = things.Get(ctx, thingId)
+    test.Ok(t, err)
+    test.Equals(t, true, thing.Available)
+
+    // device is offline
+    mqtt.ProcessMessage(ctx, fmt.Sprintf("org/%s/%s", ORG, "available"), "offline")
+
+    thing, err = things.Get(ctx, thingId)
+    test.Ok(t, err)
+    test.Equals(t, false, thing.Available)
+    test.Equals(t, 2, len(events))
+    test.Equals(t, "no", events[1].Value)
+}
@@ -0,0 +1,177 @@
+package piot
+
+import (
+    "errors"
+    "fmt"
+    "hash/fnv"
+    "sync"
+    "time"
+    "github.com/op/go-logging"
+)
+
+// Error returned if message cannot be queued because queue of worker is full
+var ErrMqttQueueFull = errors.New("MQTT message queue is full")
+
+// Error returned if message is submitted to stopped workers
+var ErrMqttWorkersStopped = errors.New("MQTT workers are stopped")
+
+type mqttMessage struct {
+    topic string
+    payload string
+}
+
+// Pool of workers processing incoming MQTT messages concurrently. Messages
+// are assigned to workers by key given by caller (e.g. id of thing the
+// message is routed to), so messages with the same key are processed in
+// order of arrival, while messages with different keys are processed in
+// parallel. Each worker has bounded queue, messages for full queue are
+// dropped
+type MqttWorkers struct {
+    log *logging.Logger
+    handler func(topic, payload string)
+
+    // protects stopped flag and closing of queues
+    mutex sync.RWMutex
+    stopped bool
+
+    queues []chan mqttMessage
+    wg sync.WaitGroup
+
+    // protects counters
+    countersMutex sync.Mutex
+    processed int64
+    dropped int64
+}
+
+// Start workers, each with its own queue of given size
+func NewMqttWorkers(log *logging.Logger, workers, queueSize int, handler func(topic, payload string)) *MqttWorkers {
+    if workers < 1 {
+        workers = 1
+    }
+
+    log.Infof("Starting %d MQTT workers (queue size %d)", workers, queueSize)
+
+    w := &MqttWorkers{log: log, handler: handler}
+
+    for i := 0; i < workers; i++ {
+        queue := make(chan mqttMessage, queueSize)
+        w.queues = append(w.queues, queue)
+        w.wg.Add(1)
+        go w.run(queue)
+    }
+
+    return w
+}
+
+// Queue message for processing by worker assigned to key, message is
+// rejected if queue of the worker is full or workers are stopped
+func (w *MqttWorkers) Submit(key, topic, payload string) (error) {
+    w.mutex.RLock()
+    defer w.mutex.RUnlock()
+
+    if w.stopped {
+        w.log.Warningf("MQTT workers are stopped, rejecting message with topic %s", topic)
+        return ErrMqttWorkersStopped
+    }
+
+    queue := w.queues[getMqttWorkerIndex(key, len(w.queues))]
+
+    select {
+    case queue <- mqttMessage{topic, payload}:
+        return nil
+    default:
+        w.countersMutex.Lock()
+        w.dropped++
+        w.countersMutex.Unlock()
+        w.log.Warningf("MQTT message queue is full, dropping message with topic %s", topic)
+        return ErrMqttQueueFull
+    }
+}
+
+// Stop accepting messages and wait until all queued messages are
+// processed, error is returned if queues are not drained within timeout
+// (0 means no timeout)
+func (w *MqttWorkers) Drain(timeout time.Duration) (error) {
+    w.mutex.Lock()
+    if !w.stopped {
+        w.log.Infof("Draining MQTT workers (%d messages queued)", w.Pending())
+        w.stopped = true
+        for _, queue := range w.queues {
+            close(queue)
+        }
+    }
+    w.mutex.Unlock()
+
+    done := make(chan bool)
+    go func() {
+        w.wg.Wait()
+        close(done)
+    }()
+
+    if timeout <= 0 {
+        <-done
+        return nil
+    }
+
+    select {
+    case <-done:
+        return nil
+    case <-time.After(timeout):
+        return fmt.Errorf("MQTT workers not drained within %v (%d messages queued)", timeout, w.Pending())
+    }
+}
+
+// Get number of messages waiting in queues
+func (w *MqttWorkers) Pending() int {
+    pending := 0
+    for _, queue := range w.queues {
+        pending += len(queue)
+    }
+    return pending
+}
+
+// Get number of processed messages
+func (w *MqttWorkers) Processed() int64 {
+    w.countersMutex.Lock()
+    defer w.countersMutex.Unlock()
+    return w.processed
+}
+
+// Get number of messages dropped due to full queue
+func (w *MqttWorkers) Dropped() int64 {
+    w.countersMutex.Lock()
+    defer w.countersMutex.Unlock()
+    return w.dropped
+}
+
+func (w *MqttWorkers) run(queue chan mqttMessage) {
+    defer w.wg.Done()
+
+    for msg := range queue {
+        w.process(msg)
+    }
+}
+
+func (w *MqttWorkers) process(msg mqttMessage) {
+    // failure of single message shall not stop the worker
+    defer func() {
+        if r := recover(); r != nil {
+            w.log.Errorf("MQTT processing of message with topic %s failed (%v)", msg.topic, r)
+        }
+    }()
+
+    w.handler(msg.topic, msg.payload)
+
+    w.countersMutex.Lock()
+    w.processed++
+    w.countersMutex.Unlock()
+}
+
+// Get worker for key, messages with the same key are always assigned to
+// the same worker
+func getMqttWorkerIndex(key string, workers int) int {
+    h := fnv.New32a()
+    h.Write([]byte(key))
+
+    return int(h.Sum32() % uint32(workers))
+}
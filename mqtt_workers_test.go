@@ -0,0 +1,123 @@
+package piot_test
+
+import (
+    "fmt"
+    "sync"
+    "testing"
+    "time"
+    "github.com/mnezerka/go-piot"
+    "github.com/mnezerka/go-piot/test"
+)
+
+// Messages with the same key are processed in order of arrival
+func TestMqttWorkersOrdering(t *testing.T) {
+    log := test.GetLogger(t)
+
+    var mutex sync.Mutex
+    received := make(map[string][]string)
+
+    workers := piot.NewMqttWorkers(log, 4, 1000, func(topic, payload string) {
+        mutex.Lock()
+        defer mutex.Unlock()
+        received[topic] = append(received[topic], payload)
+    })
+
+    for i := 0; i < 100; i++ {
+        for thing := 0; thing < 10; thing++ {
+            test.Ok(t, workers.Submit(fmt.Sprintf("thing%d", thing), fmt.Sprintf("org/org1/thing%d/value", thing), fmt.Sprintf("%d", i)))
+        }
+    }
+
+    test.Ok(t, workers.Drain(time.Second))
+    test.Equals(t, int64(1000), workers.Processed())
+    test.Equals(t, 0, workers.Pending())
+
+    for thing := 0; thing < 10; thing++ {
+        payloads := received[fmt.Sprintf("org/org1/thing%d/value", thing)]
+        test.Equals(t, 100, len(payloads))
+        for i, payload := range payloads {
+            test.Equals(t, fmt.Sprintf("%d", i), payload)
+        }
+    }
+
+    // drained workers don't accept messages
+    test.Equals(t, piot.ErrMqttWorkersStopped, workers.Submit("thing1", "org/org1/thing1/value", "x"))
+}
+
+// Thing can be subscribed to topics of any structure within its org,
+// messages keyed by thing keep their order whatever their topics are
+func TestMqttWorkersThingTopicsOrdering(t *testing.T) {
+    log := test.GetLogger(t)
+
+    var mutex sync.Mutex
+    received := []string{}
+
+    workers := piot.NewMqttWorkers(log, 16, 1000, func(topic, payload string) {
+        if topic == "org/org1/dev1/available" {
+            // give other workers chance to overtake
+            time.Sleep(time.Millisecond)
+        }
+        mutex.Lock()
+        defer mutex.Unlock()
+        received = append(received, topic)
+    })
+
+    for i := 0; i < 20; i++ {
+        test.Ok(t, workers.Submit("dev1", "org/org1/dev1/available", "yes"))
+        test.Ok(t, workers.Submit("dev1", "org/org1/sensors/dev1/value", fmt.Sprintf("%d", i)))
+    }
+
+    test.Ok(t, workers.Drain(time.Second))
+    test.Equals(t, 40, len(received))
+    for i := 0; i < 40; i += 2 {
+        test.Equals(t, "org/org1/dev1/available", received[i])
+        test.Equals(t, "org/org1/sensors/dev1/value", received[i + 1])
+    }
+}
+
+// Messages for full queue are dropped, processing of one thing doesn't
+// block other workers
+func TestMqttWorkersQueueFull(t *testing.T) {
+    log := test.GetLogger(t)
+
+    release := make(chan bool)
+    workers := piot.NewMqttWorkers(log, 1, 1, func(topic, payload string) {
+        if payload == "block" {
+            <-release
+        }
+    })
+
+    test.Ok(t, workers.Submit("thing1", "org/org1/thing1/value", "block"))
+
+    // wait until worker takes blocking message from queue
+    for i := 0; i < 100 && workers.Pending() > 0; i++ {
+        time.Sleep(time.Millisecond)
+    }
+
+    test.Ok(t, workers.Submit("thing1", "org/org1/thing1/value", "1"))
+    test.Equals(t, piot.ErrMqttQueueFull, workers.Submit("thing1", "org/org1/thing1/value", "2"))
+    test.Equals(t, int64(1), workers.Dropped())
+
+    // drain times out while worker is blocked
+    test.Assert(t, workers.Drain(10 * time.Millisecond) != nil, "Blocked worker drained")
+
+    close(release)
+    test.Ok(t, workers.Drain(time.Second))
+    test.Equals(t, int64(2), workers.Processed())
+}
+
+// Panic in processing of message doesn't stop worker
+func TestMqttWorkersPanic(t *testing.T) {
+    log := test.GetLogger(t)
+
+    workers := piot.NewMqttWorkers(log, 1, 10, func(topic, payload string) {
+        if payload == "panic" {
+            panic("processing failed")
+        }
+    })
+
+    test.Ok(t, workers.Submit("thing1", "org/org1/thing1/value", "panic"))
+    test.Ok(t, workers.Submit("thing1", "org/org1/thing1/value", "1"))
+    test.Ok(t, workers.Drain(time.Second))
+    test.Equals(t, int64(1), workers.Processed())
+}
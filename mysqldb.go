@@ -3,18 +3,153 @@ package piot
 import (
     "fmt"
     "strconv"
+    "sync"
     "time"
     "github.com/op/go-logging"
+    "go.mongodb.org/mongo-driver/bson/primitive"
     "github.com/mnezerka/go-piot/model"
     "database/sql"
     _"github.com/go-sql-driver/mysql"
 )
 
+// Storage of thing values in MySQL. Error is returned only if data could not
+// be stored due to issue that could be temporary (e.g. lost connection),
+// data rejected for good are just logged
 type IMysqlDb interface {
     Open() error
     Close()
-    StoreMeasurement(thing *model.Thing, value string)
-    StoreSwitchState(thing *model.Thing, value string)
+    StoreMeasurement(thing *model.Thing, value string, ts time.Time) error
+    StoreSwitchState(thing *model.Thing, value string, ts time.Time) error
+    StoreLocation(thing *model.Thing, lat, lng float64, sat, ts int32) error
+    StoreTelemetry(thing *model.Thing, telemetry string, ts time.Time) error
+}
+
+// Schema of the database, new migrations are appended to the end of the list
+var mysqlDbMigrations = []SqlMigration{
+    {
+        Version: 1,
+        Description: "tables for sensor measurements and switch states",
+        Statements: []string{
+            // primary keys make INSERT IGNORE skip values of the same thing
+            // within single storage interval (see StoreMysqlDbInterval)
+            "CREATE TABLE IF NOT EXISTS piot_sensors (" +
+                "`id` VARCHAR(24) NOT NULL, " +
+                "`org` VARCHAR(255) NOT NULL, " +
+                "`class` VARCHAR(64) NOT NULL DEFAULT '', " +
+                "`value` FLOAT NOT NULL, " +
+                "`time` INT NOT NULL, " +
+                "PRIMARY KEY (`id`, `time`), " +
+                "INDEX `org_id_time` (`org`, `id`, `time`)" +
+                ") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+            "CREATE TABLE IF NOT EXISTS piot_switches (" +
+                "`id` VARCHAR(24) NOT NULL, " +
+                "`org` VARCHAR(255) NOT NULL, " +
+                "`value` TINYINT NOT NULL, " +
+                "`time` INT NOT NULL, " +
+                "PRIMARY KEY (`id`, `time`), " +
+                "INDEX `org_id_time` (`org`, `id`, `time`)" +
+                ") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+        },
+    },
+    {
+        Version: 2,
+        Description: "tables for locations and telemetry",
+        Statements: []string{
+            "CREATE TABLE IF NOT EXISTS piot_locations (" +
+                "`id` VARCHAR(24) NOT NULL, " +
+                "`org` VARCHAR(255) NOT NULL, " +
+                "`lat` DOUBLE NOT NULL, " +
+                "`lng` DOUBLE NOT NULL, " +
+                "`sat` INT NOT NULL DEFAULT 0, " +
+                "`time` INT NOT NULL, " +
+                "PRIMARY KEY (`id`, `time`), " +
+                "INDEX `org_id_time` (`org`, `id`, `time`)" +
+                ") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+            "CREATE TABLE IF NOT EXISTS piot_telemetry (" +
+                "`id` VARCHAR(24) NOT NULL, " +
+                "`org` VARCHAR(255) NOT NULL, " +
+                "`telemetry` TEXT NOT NULL, " +
+                "`time` INT NOT NULL, " +
+                "PRIMARY KEY (`id`, `time`), " +
+                "INDEX `org_id_time` (`org`, `id`, `time`)" +
+                ") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+        },
+    },
+    {
+        Version: 3,
+        Description: "keys of sensor and switch tables created before schema versioning",
+        Upgrade: upgradeMysqlDbKeys,
+    },
+}
+
+// Tables of sensors and switches existing before schema versioning were
+// created without keys, CREATE TABLE IF NOT EXISTS of first migration
+// didn't touch them. Missing keys are added, adding of primary key fails if
+// table contains duplicate values of the same thing and time, such values
+// have to be removed manually
+func upgradeMysqlDbKeys(d *sql.DB) (error) {
+    for _, table := range []string{"piot_sensors", "piot_switches"} {
+        primary, err := hasMysqlDbIndex(d, table, "PRIMARY")
+        if err != nil {
+            return err
+        }
+        if !primary {
+            if _, err := d.Exec("ALTER TABLE `" + table + "` ADD PRIMARY KEY (`id`, `time`)"); err != nil {
+                return err
+            }
+        }
+
+        index, err := hasMysqlDbIndex(d, table, "org_id_time")
+        if err != nil {
+            return err
+        }
+        if !index {
+            if _, err := d.Exec("ALTER TABLE `" + table + "` ADD INDEX `org_id_time` (`org`, `id`, `time`)"); err != nil {
+                return err
+            }
+        }
+    }
+
+    return nil
+}
+
+func hasMysqlDbIndex(d *sql.DB, table, index string) (bool, error) {
+    var count int
+
+    query := fmt.Sprintf(
+        "SELECT COUNT(*) FROM information_schema.STATISTICS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = '%s' AND INDEX_NAME = '%s'",
+        table,
+        index)
+
+    if err := d.QueryRow(query).Scan(&count); err != nil {
+        return false, fmt.Errorf("Indexes of table %s cannot be read (%v)", table, err)
+    }
+
+    return count > 0, nil
+}
+
+// Create or upgrade schema of PIOT tables in MySQL database, version of
+// schema after migration is returned
+func MigrateMysqlDb(log *logging.Logger, d *sql.DB) (int, error) {
+    return MigrateSqlDb(log, d, mysqlDbMigrations)
+}
+
+// Connection to database of single org (see NewMysqlDbPerOrg), db is nil
+// until connection is established
+type mysqlOrgDb struct {
+    username string
+    password string
+    name string
+    db *sql.DB
+
+    // closed when pending connection attempt is finished
+    connecting chan bool
+
+    // failed connection attempts, next attempt is not made before
+    // nextAttempt
+    failures int
+    err error
+    nextAttempt time.Time
 }
 
 type MysqlDb struct {
@@ -25,6 +160,20 @@ type MysqlDb struct {
     Password string
     Name string
     Db *sql.DB
+
+    // each org has its own database and credentials
+    PerOrg bool
+
+    // delay between failed connection attempts to org database doubles
+    // with each failure up to max interval
+    ReconnectInterval time.Duration
+    MaxReconnectInterval time.Duration
+
+    // protects orgDbs, connections are established without holding it
+    mutex sync.Mutex
+
+    // lazily opened connections to org databases
+    orgDbs map[primitive.ObjectID]*mysqlOrgDb
 }
 
 func NewMysqlDb(log *logging.Logger, orgs *Orgs, host, username, password, name string) IMysqlDb {
@@ -38,7 +187,29 @@ func NewMysqlDb(log *logging.Logger, orgs *Orgs, host, username, password, name
     return db
 }
 
+// Create storage where each org is stored to its own database (org.MysqlDb)
+// using org credentials (org.MysqlDbUsername, org.MysqlDbPassword), so orgs
+// are isolated on level of database server. Connections are opened on
+// first write for the org and reopened when org credentials change
+func NewMysqlDbPerOrg(log *logging.Logger, orgs *Orgs, host string) IMysqlDb {
+    db := &MysqlDb{log: log, orgs: orgs}
+    db.Host = host
+    db.PerOrg = true
+    db.ReconnectInterval = 1 * time.Second
+    db.MaxReconnectInterval = 1 * time.Minute
+    db.orgDbs = make(map[primitive.ObjectID]*mysqlOrgDb)
+
+    return db
+}
+
 func (db *MysqlDb) Open() error {
+    if db.PerOrg {
+        if db.Host == "" {
+            db.log.Warningf("Refusing to use mysql databases, host not specified")
+        }
+        return nil
+    }
+
     db.log.Infof("Connecting to mysql database %s", db.Host)
 
     // open database if host is specified
@@ -47,125 +218,334 @@ func (db *MysqlDb) Open() error {
         return nil
     }
 
-    dsn := fmt.Sprintf("%s:%s@tcp(%s)/%s", db.Username, db.Password, db.Host, db.Name)
-    db.log.Debugf("Mysql DSN: %s", dsn)
+    d, err := db.connect(db.Username, db.Password, db.Name)
+    if err != nil {
+        return err
+    }
+    db.Db = d
+
+    return nil
+}
+
+func (db *MysqlDb) Close() {
+    if db.Db != nil {
+        db.Db.Close()
+    }
+
+    db.mutex.Lock()
+    defer db.mutex.Unlock()
+
+    for orgId, orgDb := range db.orgDbs {
+        // connection being established is closed when attempt finishes
+        if orgDb.db != nil {
+            orgDb.db.Close()
+        }
+        delete(db.orgDbs, orgId)
+    }
+}
+
+// Open connection pool to database, schema is created or upgraded
+func (db *MysqlDb) connect(username, password, name string) (*sql.DB, error) {
+    dsn := fmt.Sprintf("%s:%s@tcp(%s)/%s", username, password, db.Host, name)
+    db.log.Debugf("Mysql DSN: %s:***@tcp(%s)/%s", username, db.Host, name)
 
     d, err := sql.Open("mysql", dsn)
     if err != nil {
-        return err
+        return nil, err
     }
     // Open doesn't open a connection. Validate DSN data:
     err = d.Ping()
     if err != nil {
-        return err
+        d.Close()
+        return nil, err
     }
-    db.Db = d
 
-    db.log.Infof("Connected to mysql database")
+    // create or upgrade schema
+    version, err := MigrateMysqlDb(db.log, d)
+    if err != nil {
+        d.Close()
+        return nil, err
+    }
 
-    return nil
+    db.log.Infof("Connected to mysql database %s (schema version %d)", name, version)
+
+    return d, nil
 }
 
-func (db *MysqlDb) Close() {
-    if db.Db != nil {
-        db.Db.Close()
+// Get connection to database of the org, connection is opened if it
+// doesn't exist yet or if org credentials changed since it was opened.
+// Only one connection attempt per org is made at a time, other callers wait
+// for its result, attempts after failure are delayed (see ReconnectInterval)
+func (db *MysqlDb) getOrgDb(org *model.Org) (*sql.DB, error) {
+    db.mutex.Lock()
+
+    for {
+        orgDb, ok := db.orgDbs[org.Id]
+        if ok && (orgDb.username != org.MysqlDbUsername || orgDb.password != org.MysqlDbPassword || orgDb.name != org.MysqlDb) {
+            db.log.Infof("Mysql configuration of org %s changed, closing connection", org.Name)
+            if orgDb.db != nil {
+                orgDb.db.Close()
+            }
+            delete(db.orgDbs, org.Id)
+            ok = false
+        }
+
+        if !ok {
+            orgDb = &mysqlOrgDb{username: org.MysqlDbUsername, password: org.MysqlDbPassword, name: org.MysqlDb}
+            db.orgDbs[org.Id] = orgDb
+        }
+
+        if orgDb.db != nil {
+            db.mutex.Unlock()
+            return orgDb.db, nil
+        }
+
+        // wait for result of attempt made by other caller
+        if orgDb.connecting != nil {
+            connecting := orgDb.connecting
+            db.mutex.Unlock()
+            <-connecting
+            db.mutex.Lock()
+            continue
+        }
+
+        if time.Now().Before(orgDb.nextAttempt) {
+            db.mutex.Unlock()
+            return nil, fmt.Errorf("Connection to mysql database failed %d times, next attempt at %v (%v)", orgDb.failures, orgDb.nextAttempt, orgDb.err)
+        }
+
+        orgDb.connecting = make(chan bool)
+        db.mutex.Unlock()
+
+        d, err := db.connect(org.MysqlDbUsername, org.MysqlDbPassword, org.MysqlDb)
+
+        db.mutex.Lock()
+        defer db.mutex.Unlock()
+
+        close(orgDb.connecting)
+        orgDb.connecting = nil
+
+        if err != nil {
+            orgDb.failures++
+            orgDb.err = err
+            orgDb.nextAttempt = time.Now().Add(db.getReconnectBackoff(orgDb.failures))
+            return nil, err
+        }
+
+        // org configuration changed or storage was closed meanwhile
+        if db.orgDbs[org.Id] != orgDb {
+            d.Close()
+            return nil, fmt.Errorf("Connection to mysql database of org %s was dropped while being opened", org.Name)
+        }
+
+        orgDb.db = d
+        orgDb.failures = 0
+        orgDb.err = nil
+
+        return d, nil
+    }
+}
+
+// Get delay before next connection attempt, delay doubles with each failure
+func (db *MysqlDb) getReconnectBackoff(failures int) time.Duration {
+    backoff := db.ReconnectInterval
+    for i := 1; i < failures && backoff < db.MaxReconnectInterval; i++ {
+        backoff *= 2
+    }
+    if backoff > db.MaxReconnectInterval {
+        backoff = db.MaxReconnectInterval
     }
+    return backoff
 }
 
-func (db *MysqlDb) verifyOrg(thing *model.Thing) *model.Org {
-    if db.Db == nil {
+// Get org of the thing and database the values are stored to if all
+// preconditions for storing are met, only failures of org lookup and
+// connection to org database are reported as error
+func (db *MysqlDb) verifyOrg(thing *model.Thing) (*model.Org, *sql.DB, error) {
+    if (db.PerOrg && db.Host == "") || (!db.PerOrg && db.Db == nil) {
         db.log.Warningf("Mysql database is not initialized")
-        return nil
+        return nil, nil, nil
     }
 
     // get thing org
     org, err := db.orgs.Get(thing.OrgId)
-    if err != nil {
+    if err == ErrNotFound {
         db.log.Warningf("Store to database rejected for thing (%s) that is not assigned to org", thing.Id.Hex())
-        return nil
+        return nil, nil, nil
+    }
+    if err != nil {
+        return nil, nil, err
     }
 
     // mysql name needs to be configured
     if org.MysqlDb == "" {
         db.log.Warningf("Store to database rejected for thing (%s), where org (%s) has no mysql configuration", thing.Id.Hex(), org.Name)
-        return nil
+        return nil, nil, nil
     }
 
-    return org
-}
-
-func (db *MysqlDb) getTimestamp(thing *model.Thing) int32 {
-    // generate unix timestamp
-    ts := int32(time.Now().Unix())
+    if !db.PerOrg {
+        return org, db.Db, nil
+    }
 
-    // alter timestamp to match low boundary of configured interval
-    if thing.StoreMysqlDbInterval > 0 {
-        ts = ts - (ts % thing.StoreMysqlDbInterval)
+    d, err := db.getOrgDb(org)
+    if err != nil {
+        db.log.Errorf("Mysql database of org %s cannot be opened (%v)", org.Name, err)
+        return nil, nil, err
     }
 
-    return ts
+    return org, d, nil
 }
 
-func (db *MysqlDb) StoreMeasurement(thing *model.Thing, value string) {
+func (db *MysqlDb) getTimestamp(thing *model.Thing, at time.Time) int32 {
+    // alter timestamp to match low boundary of configured interval
+    return int32(GetIntervalStart(at, thing.GetSinkInterval(model.SINK_MYSQLDB)).Unix())
+}
+
+func (db *MysqlDb) StoreMeasurement(thing *model.Thing, value string, at time.Time) error {
     db.log.Debugf("Storing measurement to mysql db, thing: %s, val: %s", thing.Name, value)
 
     // verify if all preconditions are met
-    org := db.verifyOrg(thing)
+    org, d, err := db.verifyOrg(thing)
     if org == nil {
-        return
+        return err
     }
 
     // convert value to float
     valueFloat, err := strconv.ParseFloat(value, 32)
     if err != nil {
         db.log.Errorf("Mysql database storage - float conversion error for value %s", value)
-        return
+        return nil
     }
 
-    ts := db.getTimestamp(thing)
+    ts := db.getTimestamp(thing, at)
 
     query := "INSERT IGNORE INTO piot_sensors (`id`, `org`, `class`, `value`, `time`) VALUES (?, ?, ?, ?, ?)"
 
-    r, err := db.Db.Query(query, thing.Id.Hex(), org.MysqlDb, thing.Sensor.Class, valueFloat, ts)
+    _, err = d.Exec(query, thing.Id.Hex(), org.MysqlDb, thing.Sensor.Class, valueFloat, ts)
 
     // Failure when trying to store data
     if err != nil {
         db.log.Errorf("Mysql database operation failed: %s", err.Error())
+        return err
     }
 
-    r.Close() // Always do this or you will leak connections
+    return nil
 }
 
-func (db *MysqlDb) StoreSwitchState(thing *model.Thing, value string) {
+func (db *MysqlDb) StoreSwitchState(thing *model.Thing, value string, at time.Time) error {
     db.log.Debugf("Storing switch state to MysqlDb, thing: %s, val: %s", thing.Name, value)
 
     // verify if all preconditions are met
-    org := db.verifyOrg(thing)
+    org, d, err := db.verifyOrg(thing)
     if org == nil {
-        return
+        return err
     }
 
     if thing.Type != model.THING_TYPE_SWITCH {
         // ignore things which don't represent switch
-        return
+        return nil
     }
 
     // convert value to int 
     valueInt, err := strconv.Atoi(value)
     if err != nil {
         db.log.Errorf("Mysql database storage - int conversion error for value %s", value)
-        return
+        return nil
     }
 
-    ts := db.getTimestamp(thing)
+    ts := db.getTimestamp(thing, at)
 
     query := "INSERT IGNORE INTO piot_switches (`id`, `org`, `value`, `time`) VALUES (?, ?, ?, ?)"
 
-    r, err := db.Db.Query(query, thing.Id.Hex(), org.MysqlDb, valueInt, ts)
+    _, err = d.Exec(query, thing.Id.Hex(), org.MysqlDb, valueInt, ts)
+
+    if err != nil {
+        db.log.Errorf("Mysql database operation failed: %s", err.Error())
+        return err
+    }
+
+    return nil
+}
+
+func (db *MysqlDb) StoreLocation(thing *model.Thing, lat, lng float64, sat, ts int32) error {
+    db.log.Debugf("Storing location to MysqlDb, thing: %s, val: %f %f", thing.Name, lat, lng)
+
+    // verify if all preconditions are met
+    org, d, err := db.verifyOrg(thing)
+    if org == nil {
+        return err
+    }
+
+    // location carries its own timestamp
+    locationTs := db.getTimestamp(thing, time.Unix(int64(ts), 0))
+
+    query := "INSERT IGNORE INTO piot_locations (`id`, `org`, `lat`, `lng`, `sat`, `time`) VALUES (?, ?, ?, ?, ?, ?)"
+
+    _, err = d.Exec(query, thing.Id.Hex(), org.MysqlDb, lat, lng, sat, locationTs)
+
+    if err != nil {
+        db.log.Errorf("Mysql database operation failed: %s", err.Error())
+        return err
+    }
+
+    return nil
+}
+
+func (db *MysqlDb) StoreTelemetry(thing *model.Thing, telemetry string, at time.Time) error {
+    db.log.Debugf("Storing telemetry to MysqlDb, thing: %s, val: %s", thing.Name, telemetry)
+
+    // verify if all preconditions are met
+    org, d, err := db.verifyOrg(thing)
+    if org == nil {
+        return err
+    }
+
+    ts := db.getTimestamp(thing, at)
+
+    query := "INSERT IGNORE INTO piot_telemetry (`id`, `org`, `telemetry`, `time`) VALUES (?, ?, ?, ?)"
+
+    _, err = d.Exec(query, thing.Id.Hex(), org.MysqlDb, telemetry, ts)
 
     if err != nil {
         db.log.Errorf("Mysql database operation failed: %s", err.Error())
+        return err
+    }
+
+    return nil
+}
+
+func (db *MysqlDb) GetSensorValues(thing *model.Thing, from, to time.Time) ([]model.HistoryValue, error) {
+    return db.getValues("piot_sensors", thing, from, to)
+}
+
+func (db *MysqlDb) GetSwitchStates(thing *model.Thing, from, to time.Time) ([]model.HistoryValue, error) {
+    return db.getValues("piot_switches", thing, from, to)
+}
+
+func (db *MysqlDb) getValues(table string, thing *model.Thing, from, to time.Time) ([]model.HistoryValue, error) {
+    // values of things which cannot be stored are not available
+    org, d, err := db.verifyOrg(thing)
+    if org == nil {
+        return []model.HistoryValue{}, err
+    }
+
+    query := "SELECT `time`, `value` FROM " + table + " WHERE `id` = ? AND `org` = ? AND `time` >= ? AND `time` < ? ORDER BY `time`"
+
+    rows, err := d.Query(query, thing.Id.Hex(), org.MysqlDb, from.Unix(), to.Unix())
+    if err != nil {
+        db.log.Errorf("Mysql database operation failed: %s", err.Error())
+        return nil, err
+    }
+    defer rows.Close()
+
+    result := []model.HistoryValue{}
+    for rows.Next() {
+        var value model.HistoryValue
+        if err := rows.Scan(&value.Time, &value.Value); err != nil {
+            return nil, err
+        }
+        result = append(result, value)
     }
 
-    r.Close() // Always do this or you will leak connections
+    return result, rows.Err()
 }
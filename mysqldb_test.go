@@ -0,0 +1,48 @@
+package piot_test
+
+import (
+    "testing"
+    "time"
+    "github.com/mnezerka/go-piot"
+    "github.com/mnezerka/go-piot/test"
+)
+
+// Values of things without org or of orgs without mysql configuration are
+// not stored, unavailable org database is reported as error
+func TestMysqlDbPerOrg(t *testing.T) {
+    const SENSOR = "sensor"
+    const ORG = "org"
+
+    db := test.GetDb(t)
+    log := test.GetLogger(t)
+    test.CleanDb(t, db)
+    ctx := test.GetContext(t)
+    sensorId := test.CreateThing(t, db, SENSOR)
+    things := test.GetThings(t, log, db)
+
+    // nothing listens on port 1
+    mysqlDb := piot.NewMysqlDbPerOrg(log, test.GetOrgs(t, log, db), "127.0.0.1:1")
+    test.Ok(t, mysqlDb.Open())
+    defer mysqlDb.Close()
+
+    thing, err := things.Get(ctx, sensorId)
+    test.Ok(t, err)
+    test.Ok(t, mysqlDb.StoreMeasurement(thing, "23", time.Now()))
+
+    orgId := test.CreateOrg(t, db, ORG)
+    test.AddOrgThing(t, db, orgId, SENSOR)
+    thing, err = things.Get(ctx, sensorId)
+    test.Ok(t, err)
+
+    err = mysqlDb.StoreMeasurement(thing, "23", time.Now())
+    test.Assert(t, err != nil, "Unavailable org database shall be reported")
+
+    // next attempt is not made before reconnect interval elapses
+    err = mysqlDb.StoreMeasurement(thing, "23", time.Now())
+    test.Assert(t, err != nil, "Unavailable org database shall be reported")
+    test.Contains(t, err.Error(), "next attempt")
+
+    err = db.Orgs.SetFields(orgId, map[string]interface{}{"mysqldb": ""})
+    test.Ok(t, err)
+    test.Ok(t, mysqlDb.StoreMeasurement(thing, "23", time.Now()))
+}
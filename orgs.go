@@ -1,49 +1,206 @@
 package piot
 
 import (
-    "context"
     "errors"
+    "fmt"
+    "time"
     "github.com/op/go-logging"
-    "go.mongodb.org/mongo-driver/mongo"
-    "go.mongodb.org/mongo-driver/bson"
     "go.mongodb.org/mongo-driver/bson/primitive"
     "github.com/mnezerka/go-piot/model"
 )
 
 type Orgs struct {
     log *logging.Logger
-    db *mongo.Database
+    repos *Repositories
 }
 
-func NewOrgs(log *logging.Logger, db *mongo.Database) *Orgs {
-    return &Orgs{log: log, db: db}
+func NewOrgs(log *logging.Logger, repos *Repositories) *Orgs {
+    return &Orgs{log: log, repos: repos}
 }
 
 func (t *Orgs) Get(id primitive.ObjectID) (*model.Org, error) {
     t.log.Debugf("Get org: %s", id.Hex())
 
-    var org model.Org
-
-    collection := t.db.Collection("orgs")
-    err := collection.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&org)
+    org, err := t.repos.Orgs.Get(id)
     if err != nil {
         t.log.Errorf("Org service error : %v", err)
         return nil, err
     }
 
-    return &org, nil
+    return org, nil
 }
 
 func (t *Orgs) GetByName(name string) (*model.Org, error) {
     t.log.Debugf("Finding org by name <%s>", name)
 
-    var org model.Org
-
     // try to find thing in DB by its name
-    err := t.db.Collection("orgs").FindOne(context.TODO(), bson.M{"name": name}).Decode(&org)
+    org, err := t.repos.Orgs.GetByName(name)
     if err != nil {
         return nil, errors.New("Org not found")
     }
 
-    return &org, nil
+    return org, nil
+}
+
+// Add user to org with given role
+func (t *Orgs) AddUser(ctx *AuthContext, orgId, userId primitive.ObjectID, role string) (error) {
+    t.log.Debugf("Adding user <%s> to org <%s> as %s", userId.Hex(), orgId.Hex(), role)
+
+    if err := t.checkRoleChange(ctx, orgId, role); err != nil {
+        return err
+    }
+
+    if _, err := t.repos.Orgs.Get(orgId); err != nil {
+        return errors.New("Org not found")
+    }
+
+    if _, err := t.repos.Users.Get(userId); err != nil {
+        return errors.New("User not found")
+    }
+
+    _, err := t.repos.OrgUsers.Get(orgId, userId)
+    if err == nil {
+        return fmt.Errorf("User %s is already member of org %s", userId.Hex(), orgId.Hex())
+    }
+    if err != ErrNotFound {
+        t.log.Errorf("Org %s members cannot be fetched (%v)", orgId.Hex(), err)
+        return errors.New("Error while adding org member")
+    }
+
+    err = t.repos.OrgUsers.Insert(&model.OrgUser{
+        OrgId: orgId,
+        UserId: userId,
+        Role: role,
+        Created: int32(time.Now().Unix()),
+    })
+    if err != nil {
+        t.log.Errorf("User %s cannot be added to org %s (%v)", userId.Hex(), orgId.Hex(), err)
+        return errors.New("Error while adding org member")
+    }
+
+    return nil
+}
+
+// Remove user from org, last owner of the org cannot be removed
+func (t *Orgs) RemoveUser(ctx *AuthContext, orgId, userId primitive.ObjectID) (error) {
+    t.log.Debugf("Removing user <%s> from org <%s>", userId.Hex(), orgId.Hex())
+
+    member, err := t.getMember(orgId, userId)
+    if err != nil {
+        return err
+    }
+
+    if err := t.checkRoleChange(ctx, orgId, member.GetRole()); err != nil {
+        return err
+    }
+
+    if err := t.checkLastOwner(member); err != nil {
+        return err
+    }
+
+    err = t.repos.OrgUsers.Delete(orgId, userId)
+    if err != nil {
+        t.log.Errorf("User %s cannot be removed from org %s (%v)", userId.Hex(), orgId.Hex(), err)
+        return errors.New("Error while removing org member")
+    }
+
+    return nil
+}
+
+// Change role of org member, last owner of the org cannot be degraded
+func (t *Orgs) SetRole(ctx *AuthContext, orgId, userId primitive.ObjectID, role string) (error) {
+    t.log.Debugf("Setting role of user <%s> in org <%s> to %s", userId.Hex(), orgId.Hex(), role)
+
+    member, err := t.getMember(orgId, userId)
+    if err != nil {
+        return err
+    }
+
+    // both current and new role have to be manageable by the context
+    if err := t.checkRoleChange(ctx, orgId, member.GetRole()); err != nil {
+        return err
+    }
+    if err := t.checkRoleChange(ctx, orgId, role); err != nil {
+        return err
+    }
+
+    if role != model.ORG_ROLE_OWNER {
+        if err := t.checkLastOwner(member); err != nil {
+            return err
+        }
+    }
+
+    err = t.repos.OrgUsers.SetRole(orgId, userId, role)
+    if err != nil {
+        t.log.Errorf("Role of user %s in org %s cannot be updated (%v)", userId.Hex(), orgId.Hex(), err)
+        return errors.New("Error while updating org member")
+    }
+
+    return nil
+}
+
+// Get members of the org, members are visible to all members of the org
+func (t *Orgs) ListMembers(ctx *AuthContext, orgId primitive.ObjectID) ([]*model.OrgUser, error) {
+    t.log.Debugf("Listing members of org <%s>", orgId.Hex())
+
+    if !ctx.IsOrgMember(orgId) {
+        return nil, NewForbiddenError("Members of org %s cannot be listed", orgId.Hex())
+    }
+
+    members, err := t.repos.OrgUsers.FindByOrg(orgId)
+    if err != nil {
+        t.log.Errorf("Org %s members cannot be fetched (%v)", orgId.Hex(), err)
+        return nil, errors.New("Error while listing org members")
+    }
+
+    for _, member := range members {
+        member.Role = member.GetRole()
+    }
+
+    return members, nil
+}
+
+func (t *Orgs) getMember(orgId, userId primitive.ObjectID) (*model.OrgUser, error) {
+    member, err := t.repos.OrgUsers.Get(orgId, userId)
+    if err != nil {
+        return nil, fmt.Errorf("User %s is not member of org %s", userId.Hex(), orgId.Hex())
+    }
+    return member, nil
+}
+
+// Check if context is allowed to assign (or revoke) role, org admins manage
+// members up to admin role, only owners manage owners
+func (t *Orgs) checkRoleChange(ctx *AuthContext, orgId primitive.ObjectID, role string) (error) {
+    if !model.IsValidOrgRole(role) {
+        return fmt.Errorf("Unknown org role %s", role)
+    }
+
+    required := model.ORG_ROLE_ADMIN
+    if role == model.ORG_ROLE_OWNER {
+        required = model.ORG_ROLE_OWNER
+    }
+
+    if !ctx.HasOrgRole(orgId, required) {
+        return NewForbiddenError("Members of org %s with role %s cannot be managed", orgId.Hex(), role)
+    }
+
+    return nil
+}
+
+// Check that member is not the last owner of the org
+func (t *Orgs) checkLastOwner(member *model.OrgUser) (error) {
+    if member.GetRole() != model.ORG_ROLE_OWNER {
+        return nil
+    }
+
+    count, err := t.repos.OrgUsers.CountByRole(member.OrgId, model.ORG_ROLE_OWNER)
+    if err != nil {
+        t.log.Errorf("Org %s members cannot be fetched (%v)", member.OrgId.Hex(), err)
+        return errors.New("Error while updating org member")
+    }
+    if count <= 1 {
+        return fmt.Errorf("Last owner of org %s cannot be removed", member.OrgId.Hex())
+    }
+
+    return nil
 }
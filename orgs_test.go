@@ -0,0 +1,96 @@
+package piot_test
+
+import (
+    "testing"
+    "github.com/mnezerka/go-piot"
+    "github.com/mnezerka/go-piot/model"
+    "github.com/mnezerka/go-piot/test"
+)
+
+func getUserContext(t *testing.T, db *piot.Repositories, email string) *piot.AuthContext {
+    users := piot.NewUsers(test.GetLogger(t), db)
+    user, err := users.FindByEmail(email)
+    test.Ok(t, err)
+    ctx, err := users.GetAuthContext(user)
+    test.Ok(t, err)
+    return ctx
+}
+
+func TestOrgMembers(t *testing.T) {
+    db := test.GetDb(t)
+    test.CleanDb(t, db)
+    orgs := test.GetOrgs(t, test.GetLogger(t), db)
+
+    orgId := test.CreateOrg(t, db, "org1")
+    ownerId := test.CreateUser(t, db, "owner@com", "pass")
+    userId := test.CreateUser(t, db, "user@com", "pass")
+    test.AddOrgUserRole(t, db, orgId, ownerId, model.ORG_ROLE_OWNER)
+
+    ctx := getUserContext(t, db, "owner@com")
+
+    test.Ok(t, orgs.AddUser(ctx, orgId, userId, model.ORG_ROLE_VIEWER))
+
+    err := orgs.AddUser(ctx, orgId, userId, model.ORG_ROLE_VIEWER)
+    test.Assert(t, err != nil, "User shall not be added twice")
+
+    err = orgs.AddUser(ctx, orgId, test.CreateUser(t, db, "other@com", "pass"), "xx")
+    test.Assert(t, err != nil, "Unknown role shall be rejected")
+
+    members, err := orgs.ListMembers(ctx, orgId)
+    test.Ok(t, err)
+    test.Equals(t, 2, len(members))
+    test.Equals(t, model.ORG_ROLE_VIEWER, members[1].Role)
+
+    test.Ok(t, orgs.SetRole(ctx, orgId, userId, model.ORG_ROLE_ADMIN))
+    members, err = orgs.ListMembers(ctx, orgId)
+    test.Ok(t, err)
+    test.Equals(t, model.ORG_ROLE_ADMIN, members[1].Role)
+
+    // last owner cannot be removed or degraded
+    err = orgs.RemoveUser(ctx, orgId, ownerId)
+    test.Assert(t, err != nil, "Last owner shall not be removed")
+    err = orgs.SetRole(ctx, orgId, ownerId, model.ORG_ROLE_ADMIN)
+    test.Assert(t, err != nil, "Last owner shall not be degraded")
+
+    test.Ok(t, orgs.RemoveUser(ctx, orgId, userId))
+    members, err = orgs.ListMembers(ctx, orgId)
+    test.Ok(t, err)
+    test.Equals(t, 1, len(members))
+}
+
+func TestOrgMembersPermissions(t *testing.T) {
+    db := test.GetDb(t)
+    test.CleanDb(t, db)
+    orgs := test.GetOrgs(t, test.GetLogger(t), db)
+
+    orgId := test.CreateOrg(t, db, "org1")
+    foreignOrgId := test.CreateOrg(t, db, "org2")
+    ownerId := test.CreateUser(t, db, "owner@com", "pass")
+    adminId := test.CreateUser(t, db, "admin@com", "pass")
+    viewerId := test.CreateUser(t, db, "viewer@com", "pass")
+    userId := test.CreateUser(t, db, "user@com", "pass")
+    test.AddOrgUserRole(t, db, orgId, ownerId, model.ORG_ROLE_OWNER)
+    test.AddOrgUserRole(t, db, orgId, adminId, model.ORG_ROLE_ADMIN)
+    test.AddOrgUserRole(t, db, orgId, viewerId, model.ORG_ROLE_VIEWER)
+
+    // viewers can list members only
+    ctx := getUserContext(t, db, "viewer@com")
+    _, err := orgs.ListMembers(ctx, orgId)
+    test.Ok(t, err)
+    err = orgs.AddUser(ctx, orgId, userId, model.ORG_ROLE_VIEWER)
+    test.Assert(t, piot.IsForbidden(err), "Viewer shall not add members")
+
+    // admins manage members up to admin role
+    ctx = getUserContext(t, db, "admin@com")
+    test.Ok(t, orgs.AddUser(ctx, orgId, userId, model.ORG_ROLE_EDITOR))
+    err = orgs.SetRole(ctx, orgId, userId, model.ORG_ROLE_OWNER)
+    test.Assert(t, piot.IsForbidden(err), "Admin shall not grant owner role")
+    err = orgs.RemoveUser(ctx, orgId, ownerId)
+    test.Assert(t, piot.IsForbidden(err), "Admin shall not remove owner")
+
+    // foreign orgs
+    _, err = orgs.ListMembers(ctx, foreignOrgId)
+    test.Assert(t, piot.IsForbidden(err), "Members of foreign org shall not be listed")
+    err = orgs.AddUser(ctx, foreignOrgId, userId, model.ORG_ROLE_VIEWER)
+    test.Assert(t, piot.IsForbidden(err), "Members of foreign org shall not be managed")
+}
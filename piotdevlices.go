@@ -56,21 +56,25 @@ func (p *PiotDevices) ProcessPacket(packet model.PiotDevicePacket) (error) {
     // store device name to cache together with date it was seen
     p.cache[packet.Device] = time.Now()
 
+    // packets are processed on behalf of system, things are registered
+    // before they are assigned to any org
+    ctx := NewSystemContext()
+
     // get instance of Things service and look for the device (chip),
     // register it if it doesn't exist
-    thing, err := p.things.FindPiot(packet.Device)
+    thing, err := p.things.FindPiot(ctx, packet.Device)
     if err != nil {
         // register device
-        thing, err = p.things.RegisterPiot(packet.Device, model.THING_TYPE_DEVICE)
+        thing, err = p.things.RegisterPiot(ctx, packet.Device, model.THING_TYPE_DEVICE)
         if err != nil {
             return err
         }
 
         // configure availability topic
-        if err := p.things.SetAvailabilityTopic(thing.Id, "available"); err != nil {
+        if err := p.things.SetAvailabilityTopic(ctx, thing.Id, "available"); err != nil {
             return err
         }
-        if err := p.things.SetAvailabilityYesNo(thing.Id, "yes", "no"); err != nil {
+        if err := p.things.SetAvailabilityYesNo(ctx, thing.Id, "yes", "no"); err != nil {
             return err
         }
     }
@@ -78,7 +82,7 @@ func (p *PiotDevices) ProcessPacket(packet model.PiotDevicePacket) (error) {
     // if thing is assigned to org
     if thing.OrgId != primitive.NilObjectID {
         // try to push data to mqtt
-        if err = p.processDevice(thing, packet); err != nil {
+        if err = p.processDevice(ctx, thing, packet); err != nil {
             return err
         }
     } else {
@@ -93,21 +97,21 @@ func (p *PiotDevices) ProcessPacket(packet model.PiotDevicePacket) (error) {
 
         if reading.Temperature != nil {
             class := model.THING_CLASS_TEMPERATURE
-            if err = p.processReading(class, thing, reading); err != nil {
+            if err = p.processReading(ctx, class, thing, reading); err != nil {
                 p.log.Debugf("Failed to process reading data for thing <%s>", thing.Name)
             }
         }
 
         if reading.Humidity != nil {
             class := model.THING_CLASS_HUMIDITY
-            if err = p.processReading(class, thing, reading); err != nil {
+            if err = p.processReading(ctx, class, thing, reading); err != nil {
                 p.log.Debugf("Failed to process humidity reading data for thing <%s>", thing.Name)
             }
         }
 
         if reading.Pressure != nil {
             class := model.THING_CLASS_PRESSURE
-            if err = p.processReading(class, thing, reading); err != nil {
+            if err = p.processReading(ctx, class, thing, reading); err != nil {
                 p.log.Debugf("Failed to process pressure reading data for thing <%s>", thing.Name)
             }
         }
@@ -116,7 +120,7 @@ func (p *PiotDevices) ProcessPacket(packet model.PiotDevicePacket) (error) {
     return nil
 }
 
-func (p *PiotDevices) processDevice(thing *model.Thing, packet model.PiotDevicePacket) error {
+func (p *PiotDevices) processDevice(ctx *AuthContext, thing *model.Thing, packet model.PiotDevicePacket) error {
 
     p.log.Debugf("Process PIOT device data: %v", packet)
 
@@ -154,7 +158,7 @@ func (p *PiotDevices) processDevice(thing *model.Thing, packet model.PiotDeviceP
     return nil
 }
 
-func (p *PiotDevices) processReading(class string, thing *model.Thing, reading model.PiotSensorReading) error {
+func (p *PiotDevices) processReading(ctx *AuthContext, class string, thing *model.Thing, reading model.PiotSensorReading) error {
     p.log.Debugf("Process PIOT device reading data of class \"%s\": %v", class, reading)
 
     var address string = reading.Address
@@ -185,24 +189,24 @@ func (p *PiotDevices) processReading(class string, thing *model.Thing, reading m
     }
 
     // look for thing representing sensor
-    sensor_thing, err := p.things.Find(address)
+    sensor_thing, err := p.things.Find(ctx, address)
 
     // if thing not found
     if err != nil {
 
         // register register device
-        sensor_thing, err = p.things.RegisterPiot(address, model.THING_TYPE_SENSOR)
+        sensor_thing, err = p.things.RegisterPiot(ctx, address, model.THING_TYPE_SENSOR)
         if err != nil {
             return err
         }
 
         // register topics for measurements (if presetn)
-        if p.things.SetSensorMeasurementTopic(sensor_thing.Id, PIOT_MEASUREMENT_TOPIC); err != nil {
+        if p.things.SetSensorMeasurementTopic(ctx, sensor_thing.Id, PIOT_MEASUREMENT_TOPIC); err != nil {
             return err
         }
 
         // set proper device class according to received measurement type
-        if err := p.things.SetSensorClass(sensor_thing.Id, class); err != nil {
+        if err := p.things.SetSensorClass(ctx, sensor_thing.Id, class); err != nil {
             return err
         }
     }
@@ -210,7 +214,7 @@ func (p *PiotDevices) processReading(class string, thing *model.Thing, reading m
     // update parent thing (this can happen any time since sensor can be
     // re-connected to another device
     if (sensor_thing.ParentId != thing.Id) {
-        err = p.things.SetParent(sensor_thing.Id, thing.Id);
+        err = p.things.SetParent(ctx, sensor_thing.Id, thing.Id);
         if err != nil {
             return err
         }
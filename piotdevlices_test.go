@@ -1,10 +1,7 @@
 package piot_test
 
 import (
-    "context"
     "testing"
-    "go.mongodb.org/mongo-driver/mongo"
-    "go.mongodb.org/mongo-driver/bson"
     "github.com/op/go-logging"
     "github.com/mnezerka/go-piot"
     "github.com/mnezerka/go-piot/test"
@@ -13,7 +10,7 @@ import (
 
 type services struct {
     log *logging.Logger
-    db *mongo.Database
+    db *piot.Repositories
     orgs *piot.Orgs
     things *piot.Things
     influxDb piot.IInfluxDb
@@ -59,15 +56,15 @@ func TestPacketDeviceReg(t *testing.T) {
     test.Ok(t, err)
 
     // Check if device is registered
-    var thing model.Thing
-    err = s.db.Collection("things").FindOne(context.TODO(), bson.M{"name": DEVICE}).Decode(&thing)
+    var thing *model.Thing
+    thing, err = s.db.Things.GetByName(DEVICE)
     test.Ok(t, err)
     test.Equals(t, DEVICE, thing.Name)
     test.Equals(t, model.THING_TYPE_DEVICE, thing.Type)
     test.Equals(t, "available", thing.AvailabilityTopic)
 
-    var thing_sensor model.Thing
-    err = s.db.Collection("things").FindOne(context.TODO(), bson.M{"name": "T" + SENSOR}).Decode(&thing_sensor)
+    var thing_sensor *model.Thing
+    thing_sensor, err = s.db.Things.GetByName("T" + SENSOR)
     test.Ok(t, err)
     test.Equals(t, "T" + SENSOR, thing_sensor.Name)
     test.Equals(t, model.THING_TYPE_SENSOR, thing_sensor.Type)
@@ -109,29 +106,29 @@ func TestPacketDeviceRegMultiple(t *testing.T) {
     test.Ok(t, err)
 
     // Check if device is registered
-    var thing model.Thing
-    err = s.db.Collection("things").FindOne(context.TODO(), bson.M{"name": DEVICE}).Decode(&thing)
+    var thing *model.Thing
+    thing, err = s.db.Things.GetByName(DEVICE)
     test.Ok(t, err)
     test.Equals(t, DEVICE, thing.Name)
     test.Equals(t, model.THING_TYPE_DEVICE, thing.Type)
     test.Equals(t, "available", thing.AvailabilityTopic)
 
-    var thing_sensor model.Thing
-    err = s.db.Collection("things").FindOne(context.TODO(), bson.M{"name": "T" + SENSOR}).Decode(&thing_sensor)
+    var thing_sensor *model.Thing
+    thing_sensor, err = s.db.Things.GetByName("T" + SENSOR)
     test.Ok(t, err)
     test.Equals(t, "T" + SENSOR, thing_sensor.Name)
     test.Equals(t, model.THING_TYPE_SENSOR, thing_sensor.Type)
     test.Equals(t, "temperature", thing_sensor.Sensor.Class)
     test.Equals(t, "value", thing_sensor.Sensor.MeasurementTopic)
 
-    err = s.db.Collection("things").FindOne(context.TODO(), bson.M{"name": "P" + SENSOR}).Decode(&thing_sensor)
+    thing_sensor, err = s.db.Things.GetByName("P" + SENSOR)
     test.Ok(t, err)
     test.Equals(t, "P" + SENSOR, thing_sensor.Name)
     test.Equals(t, model.THING_TYPE_SENSOR, thing_sensor.Type)
     test.Equals(t, "pressure", thing_sensor.Sensor.Class)
     test.Equals(t, "value", thing_sensor.Sensor.MeasurementTopic)
 
-    err = s.db.Collection("things").FindOne(context.TODO(), bson.M{"name": "H" + SENSOR}).Decode(&thing_sensor)
+    thing_sensor, err = s.db.Things.GetByName("H" + SENSOR)
     test.Ok(t, err)
     test.Equals(t, "H" + SENSOR, thing_sensor.Name)
     test.Equals(t, model.THING_TYPE_SENSOR, thing_sensor.Type)
@@ -170,15 +167,15 @@ func TestPacketDeviceUpdateParent(t *testing.T) {
     test.Ok(t, err)
 
     // Check if device is registered
-    var thing model.Thing
-    err = s.db.Collection("things").FindOne(context.TODO(), bson.M{"name": DEVICE}).Decode(&thing)
+    var thing *model.Thing
+    thing, err = s.db.Things.GetByName(DEVICE)
     test.Ok(t, err)
     test.Equals(t, DEVICE, thing.Name)
     test.Equals(t, model.THING_TYPE_DEVICE, thing.Type)
     test.Equals(t, "available", thing.AvailabilityTopic)
 
-    var thing_sensor model.Thing
-    err = s.db.Collection("things").FindOne(context.TODO(), bson.M{"name": "T" + SENSOR}).Decode(&thing_sensor)
+    var thing_sensor *model.Thing
+    thing_sensor, err = s.db.Things.GetByName("T" + SENSOR)
     test.Ok(t, err)
     test.Equals(t, "T" + SENSOR, thing_sensor.Name)
     test.Equals(t, model.THING_TYPE_SENSOR, thing_sensor.Type)
@@ -194,12 +191,12 @@ func TestPacketDeviceUpdateParent(t *testing.T) {
     test.Ok(t, err)
 
     // Check if second device is registered
-    var thing2 model.Thing
-    err = s.db.Collection("things").FindOne(context.TODO(), bson.M{"name": DEVICE2}).Decode(&thing2)
+    var thing2 *model.Thing
+    thing2, err = s.db.Things.GetByName(DEVICE2)
     test.Ok(t, err)
     test.Equals(t, DEVICE2, thing2.Name)
 
-    err = s.db.Collection("things").FindOne(context.TODO(), bson.M{"name": "T" + SENSOR}).Decode(&thing_sensor)
+    thing_sensor, err = s.db.Things.GetByName("T" + SENSOR)
     test.Ok(t, err)
     test.Equals(t, "T" + SENSOR, thing_sensor.Name)
 
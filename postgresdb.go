@@ -0,0 +1,319 @@
+package piot
+
+import (
+    "fmt"
+    "net/url"
+    "strconv"
+    "time"
+    "database/sql"
+    "github.com/op/go-logging"
+    "github.com/mnezerka/go-piot/model"
+    _"github.com/lib/pq"
+)
+
+// Storage of thing values in PostgreSQL (optionally with TimescaleDB
+// extension), values of all orgs are stored to the same tables and
+// distinguished by org id. Storage is used as sink (see SINK_POSTGRESDB)
+type IPostgresDb interface {
+    Sink
+    HistorySource
+    Open() error
+    Close()
+}
+
+// Schema of the database, new migrations are appended to the end of the list
+var postgresDbMigrations = []SqlMigration{
+    {
+        Version: 1,
+        Description: "tables for sensor measurements, switch states, locations and telemetry",
+        Statements: []string{
+            // primary keys make ON CONFLICT DO NOTHING skip values of the
+            // same thing within single storage interval (see
+            // Thing.GetSinkInterval), hypertables require time to be part
+            // of unique indexes
+            "CREATE TABLE IF NOT EXISTS piot_sensors (" +
+                "id VARCHAR(24) NOT NULL, " +
+                "org VARCHAR(24) NOT NULL, " +
+                "class VARCHAR(64) NOT NULL DEFAULT '', " +
+                "value DOUBLE PRECISION NOT NULL, " +
+                "time TIMESTAMPTZ NOT NULL, " +
+                "PRIMARY KEY (id, time))",
+            "CREATE INDEX IF NOT EXISTS piot_sensors_org_id_time ON piot_sensors (org, id, time)",
+            "CREATE TABLE IF NOT EXISTS piot_switches (" +
+                "id VARCHAR(24) NOT NULL, " +
+                "org VARCHAR(24) NOT NULL, " +
+                "value SMALLINT NOT NULL, " +
+                "time TIMESTAMPTZ NOT NULL, " +
+                "PRIMARY KEY (id, time))",
+            "CREATE INDEX IF NOT EXISTS piot_switches_org_id_time ON piot_switches (org, id, time)",
+            "CREATE TABLE IF NOT EXISTS piot_locations (" +
+                "id VARCHAR(24) NOT NULL, " +
+                "org VARCHAR(24) NOT NULL, " +
+                "lat DOUBLE PRECISION NOT NULL, " +
+                "lng DOUBLE PRECISION NOT NULL, " +
+                "sat INTEGER NOT NULL DEFAULT 0, " +
+                "time TIMESTAMPTZ NOT NULL, " +
+                "PRIMARY KEY (id, time))",
+            "CREATE INDEX IF NOT EXISTS piot_locations_org_id_time ON piot_locations (org, id, time)",
+            "CREATE TABLE IF NOT EXISTS piot_telemetry (" +
+                "id VARCHAR(24) NOT NULL, " +
+                "org VARCHAR(24) NOT NULL, " +
+                "telemetry TEXT NOT NULL, " +
+                "time TIMESTAMPTZ NOT NULL, " +
+                "PRIMARY KEY (id, time))",
+            "CREATE INDEX IF NOT EXISTS piot_telemetry_org_id_time ON piot_telemetry (org, id, time)",
+        },
+    },
+}
+
+// tables converted to hypertables if TimescaleDB is enabled
+var postgresDbHypertables = []string{"piot_sensors", "piot_switches", "piot_locations"}
+
+type PostgresDb struct {
+    log *logging.Logger
+    orgs *Orgs
+    Host string
+    Username string
+    Password string
+    Name string
+
+    // convert series tables to TimescaleDB hypertables
+    Timescale bool
+
+    // ssl mode of connection (e.g. disable, require), driver default
+    // is used if empty
+    SslMode string
+
+    Db *sql.DB
+}
+
+func NewPostgresDb(log *logging.Logger, orgs *Orgs, host, username, password, name string, timescale bool) IPostgresDb {
+    db := &PostgresDb{log: log, orgs: orgs}
+    db.Host = host
+    db.Username = username
+    db.Password = password
+    db.Name = name
+    db.Timescale = timescale
+
+    return db
+}
+
+func (db *PostgresDb) Open() error {
+    db.log.Infof("Connecting to postgres database %s", db.Host)
+
+    // open database if host is specified
+    if db.Host == "" || db.Name == "" {
+        db.log.Warningf("Refusing to open postgres database, host or db name not specified")
+        return nil
+    }
+
+    dsn := fmt.Sprintf("postgres://%s@%s/%s", url.UserPassword(db.Username, db.Password).String(), db.Host, url.PathEscape(db.Name))
+    if db.SslMode != "" {
+        dsn += "?sslmode=" + url.QueryEscape(db.SslMode)
+    }
+    db.log.Debugf("Postgres DSN: postgres://%s:***@%s/%s", db.Username, db.Host, db.Name)
+
+    d, err := sql.Open("postgres", dsn)
+    if err != nil {
+        return err
+    }
+    // Open doesn't open a connection. Validate DSN data:
+    err = d.Ping()
+    if err != nil {
+        d.Close()
+        return err
+    }
+
+    // create or upgrade schema
+    version, err := MigrateSqlDb(db.log, d, postgresDbMigrations)
+    if err != nil {
+        d.Close()
+        return err
+    }
+
+    if db.Timescale {
+        if err := db.createHypertables(d); err != nil {
+            d.Close()
+            return err
+        }
+    }
+
+    db.Db = d
+
+    db.log.Infof("Connected to postgres database (schema version %d)", version)
+
+    return nil
+}
+
+func (db *PostgresDb) Close() {
+    if db.Db != nil {
+        db.Db.Close()
+    }
+}
+
+// Convert series tables to hypertables, tables which are hypertables
+// already are skipped, so it is safe to run on each start
+func (db *PostgresDb) createHypertables(d *sql.DB) (error) {
+    if _, err := d.Exec("CREATE EXTENSION IF NOT EXISTS timescaledb"); err != nil {
+        return fmt.Errorf("TimescaleDB extension cannot be created (%v)", err)
+    }
+
+    for _, table := range postgresDbHypertables {
+        _, err := d.Exec(fmt.Sprintf("SELECT create_hypertable('%s', 'time', if_not_exists => TRUE, migrate_data => TRUE)", table))
+        if err != nil {
+            return fmt.Errorf("Hypertable %s cannot be created (%v)", table, err)
+        }
+    }
+
+    return nil
+}
+
+// Get org of the thing if all preconditions for storing are met, only
+// failure of org lookup is reported as error
+func (db *PostgresDb) verifyOrg(thing *model.Thing) (*model.Org, error) {
+    if db.Db == nil {
+        db.log.Warningf("Postgres database is not initialized")
+        return nil, nil
+    }
+
+    // get thing org
+    org, err := db.orgs.Get(thing.OrgId)
+    if err == ErrNotFound {
+        db.log.Warningf("Store to database rejected for thing (%s) that is not assigned to org", thing.Id.Hex())
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    return org, nil
+}
+
+func (db *PostgresDb) getTimestamp(thing *model.Thing, at time.Time) time.Time {
+    // alter timestamp to match low boundary of configured interval
+    return GetIntervalStart(at, thing.GetSinkInterval(model.SINK_POSTGRESDB))
+}
+
+func (db *PostgresDb) exec(query string, args ...interface{}) (error) {
+    _, err := db.Db.Exec(query, args...)
+
+    // Failure when trying to store data
+    if err != nil {
+        db.log.Errorf("Postgres database operation failed: %s", err.Error())
+        return err
+    }
+
+    return nil
+}
+
+func (db *PostgresDb) StoreMeasurement(thing *model.Thing, value string, at time.Time) error {
+    db.log.Debugf("Storing measurement to postgres db, thing: %s, val: %s", thing.Name, value)
+
+    // verify if all preconditions are met
+    org, err := db.verifyOrg(thing)
+    if org == nil {
+        return err
+    }
+
+    // convert value to float
+    valueFloat, err := strconv.ParseFloat(value, 64)
+    if err != nil {
+        db.log.Errorf("Postgres database storage - float conversion error for value %s", value)
+        return nil
+    }
+
+    query := "INSERT INTO piot_sensors (id, org, class, value, time) VALUES ($1, $2, $3, $4, $5) ON CONFLICT DO NOTHING"
+
+    return db.exec(query, thing.Id.Hex(), org.Id.Hex(), thing.Sensor.Class, valueFloat, db.getTimestamp(thing, at))
+}
+
+func (db *PostgresDb) StoreSwitchState(thing *model.Thing, value string, at time.Time) error {
+    db.log.Debugf("Storing switch state to postgres db, thing: %s, val: %s", thing.Name, value)
+
+    // verify if all preconditions are met
+    org, err := db.verifyOrg(thing)
+    if org == nil {
+        return err
+    }
+
+    if thing.Type != model.THING_TYPE_SWITCH {
+        // ignore things which don't represent switch
+        return nil
+    }
+
+    // convert value to int
+    valueInt, err := strconv.Atoi(value)
+    if err != nil {
+        db.log.Errorf("Postgres database storage - int conversion error for value %s", value)
+        return nil
+    }
+
+    query := "INSERT INTO piot_switches (id, org, value, time) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING"
+
+    return db.exec(query, thing.Id.Hex(), org.Id.Hex(), valueInt, db.getTimestamp(thing, at))
+}
+
+func (db *PostgresDb) StoreLocation(thing *model.Thing, lat, lng float64, sat, ts int32) error {
+    db.log.Debugf("Storing location to postgres db, thing: %s, val: %f %f", thing.Name, lat, lng)
+
+    // verify if all preconditions are met
+    org, err := db.verifyOrg(thing)
+    if org == nil {
+        return err
+    }
+
+    query := "INSERT INTO piot_locations (id, org, lat, lng, sat, time) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT DO NOTHING"
+
+    // location carries its own timestamp
+    return db.exec(query, thing.Id.Hex(), org.Id.Hex(), lat, lng, sat, db.getTimestamp(thing, time.Unix(int64(ts), 0)))
+}
+
+func (db *PostgresDb) StoreTelemetry(thing *model.Thing, telemetry string, at time.Time) error {
+    db.log.Debugf("Storing telemetry to postgres db, thing: %s, val: %s", thing.Name, telemetry)
+
+    // verify if all preconditions are met
+    org, err := db.verifyOrg(thing)
+    if org == nil {
+        return err
+    }
+
+    query := "INSERT INTO piot_telemetry (id, org, telemetry, time) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING"
+
+    return db.exec(query, thing.Id.Hex(), org.Id.Hex(), telemetry, db.getTimestamp(thing, at))
+}
+
+func (db *PostgresDb) GetSensorValues(thing *model.Thing, from, to time.Time) ([]model.HistoryValue, error) {
+    return db.getValues("piot_sensors", thing, from, to)
+}
+
+func (db *PostgresDb) GetSwitchStates(thing *model.Thing, from, to time.Time) ([]model.HistoryValue, error) {
+    return db.getValues("piot_switches", thing, from, to)
+}
+
+func (db *PostgresDb) getValues(table string, thing *model.Thing, from, to time.Time) ([]model.HistoryValue, error) {
+    // values of things which cannot be stored are not available
+    org, err := db.verifyOrg(thing)
+    if org == nil {
+        return []model.HistoryValue{}, err
+    }
+
+    query := "SELECT EXTRACT(EPOCH FROM time)::INTEGER, value FROM " + table + " WHERE id = $1 AND org = $2 AND time >= $3 AND time < $4 ORDER BY time"
+
+    rows, err := db.Db.Query(query, thing.Id.Hex(), org.Id.Hex(), from, to)
+    if err != nil {
+        db.log.Errorf("Postgres database operation failed: %s", err.Error())
+        return nil, err
+    }
+    defer rows.Close()
+
+    result := []model.HistoryValue{}
+    for rows.Next() {
+        var value model.HistoryValue
+        if err := rows.Scan(&value.Time, &value.Value); err != nil {
+            return nil, err
+        }
+        result = append(result, value)
+    }
+
+    return result, rows.Err()
+}
@@ -0,0 +1,29 @@
+package piot_test
+
+import (
+    "testing"
+    "time"
+    "github.com/mnezerka/go-piot"
+    "github.com/mnezerka/go-piot/model"
+    "github.com/mnezerka/go-piot/test"
+)
+
+// Values are not stored if database is not configured, unavailable
+// database is reported on open
+func TestPostgresDbNotAvailable(t *testing.T) {
+    db := test.GetDb(t)
+    log := test.GetLogger(t)
+    orgs := test.GetOrgs(t, log, db)
+
+    postgresDb := piot.NewPostgresDb(log, orgs, "", "user", "pass", "piot", false)
+    test.Ok(t, postgresDb.Open())
+    defer postgresDb.Close()
+
+    thing := &model.Thing{Name: "sensor", Type: model.THING_TYPE_SENSOR}
+    test.Ok(t, postgresDb.StoreMeasurement(thing, "23", time.Now()))
+    test.Ok(t, postgresDb.StoreLocation(thing, 1.1, 2.2, 3, 4))
+
+    // nothing listens on port 1
+    postgresDb = piot.NewPostgresDb(log, orgs, "127.0.0.1:1", "user", "pass", "piot", true)
+    test.Assert(t, postgresDb.Open() != nil, "Unavailable database shall be reported")
+}
@@ -0,0 +1,99 @@
+package piot
+
+import (
+    "time"
+    "github.com/op/go-logging"
+    "github.com/mnezerka/go-piot/config"
+    "github.com/mnezerka/go-piot/model"
+)
+
+// Reconciler of switch desired and reported states. Commands which were not
+// confirmed by switch within configured timeout are re-sent, switch is
+// marked as out of sync after configured number of retries
+type SwitchReconciler struct {
+    log *logging.Logger
+    things *Things
+    mqtt IMqtt
+    params *config.Parameters
+    quit chan struct{}
+}
+
+func NewSwitchReconciler(log *logging.Logger, things *Things, mqtt IMqtt, params *config.Parameters) *SwitchReconciler {
+    return &SwitchReconciler{log: log, things: things, mqtt: mqtt, params: params}
+}
+
+// Start periodic reconciliation in background
+func (r *SwitchReconciler) Start(interval time.Duration) {
+    r.log.Infof("Starting switch reconciler (interval %v)", interval)
+
+    r.quit = make(chan struct{})
+    ticker := time.NewTicker(interval)
+
+    go func(quit chan struct{}) {
+        for {
+            select {
+            case <-ticker.C:
+                r.Reconcile()
+            case <-quit:
+                ticker.Stop()
+                return
+            }
+        }
+    }(r.quit)
+}
+
+// Stop periodic reconciliation
+func (r *SwitchReconciler) Stop() {
+    if r.quit != nil {
+        r.log.Infof("Stopping switch reconciler")
+        close(r.quit)
+        r.quit = nil
+    }
+}
+
+// Process all switches with pending commands
+func (r *SwitchReconciler) Reconcile() {
+    r.log.Debugf("Reconciling switch states")
+
+    ctx := NewSystemContext()
+
+    switches, err := r.things.GetFiltered(ctx, &ThingFilter{
+        Type: model.THING_TYPE_SWITCH,
+        Assigned: true,
+        SyncStatus: model.SWITCH_SYNC_PENDING,
+    })
+    if err != nil {
+        r.log.Errorf("Switch reconciliation failed, fetching of switches failed: %s", err.Error())
+        return
+    }
+
+    now := int32(time.Now().Unix())
+    timeout := int32(r.params.SwitchSyncTimeout.Seconds())
+
+    for _, thing := range switches {
+
+        // wait for confirmation from the switch
+        if now - thing.Switch.DesiredTs < timeout {
+            continue
+        }
+
+        if thing.Switch.SyncRetries >= r.params.SwitchSyncRetries {
+            r.log.Warningf("Switch %s didn't reach desired state after %d retries", thing.Name, thing.Switch.SyncRetries)
+            if err := r.things.SetSwitchSyncStatus(ctx, thing.Id, model.SWITCH_SYNC_OUT_OF_SYNC); err != nil {
+                r.log.Errorf("Switch reconciliation error: %s", err.Error())
+            }
+            continue
+        }
+
+        r.log.Debugf("Re-sending command to switch %s", thing.Name)
+
+        if err := r.mqtt.PushThingData(thing, thing.Switch.CommandTopic, getSwitchCommand(thing, thing.Switch.DesiredState)); err != nil {
+            r.log.Errorf("Switch reconciliation error: %s", err.Error())
+            continue
+        }
+
+        if err := r.things.SetSwitchRetry(ctx, thing.Id); err != nil {
+            r.log.Errorf("Switch reconciliation error: %s", err.Error())
+        }
+    }
+}
@@ -0,0 +1,78 @@
+package piot_test
+
+import (
+    "fmt"
+    "testing"
+    "github.com/mnezerka/go-piot"
+    "github.com/mnezerka/go-piot/model"
+    "github.com/mnezerka/go-piot/test"
+)
+
+// command not confirmed by switch is re-sent, switch is marked as out of
+// sync when retries are exhausted and synchronized again when it is back
+func TestSwitchReconcile(t *testing.T) {
+    const THING = "THING1"
+    const ORG = "org1"
+
+    log := test.GetLogger(t)
+    db := test.GetDb(t)
+    influxDb := test.GetInfluxDb(t, log)
+    mysqlDb := test.GetMysqlDb(t, log)
+    mqtt := getMqtt(t, log, db, influxDb, mysqlDb)
+    ctx := test.GetContext(t)
+    client := test.GetMqttClient(t, log)
+    mqtt.(*piot.Mqtt).SetBrokerClient(client)
+    things := test.GetThings(t, log, db)
+
+    params := test.GetConfig()
+    params.SwitchSyncTimeout = 0
+    params.SwitchSyncRetries = 2
+    reconciler := piot.NewSwitchReconciler(log, things, mqtt, params)
+
+    test.CleanDb(t, db)
+    switchId := test.CreateSwitch(t, db, THING)
+    test.SetSwitchStateTopic(t, db, switchId, THING + "/" + "state", "ON", "OFF")
+    orgId := test.CreateOrg(t, db, ORG)
+    test.AddOrgThing(t, db, orgId, THING)
+
+    err := mqtt.SetSwitch(ctx, switchId, true)
+    test.Ok(t, err)
+    test.Equals(t, 1, len(client.Calls))
+
+    // two retries are allowed
+    reconciler.Reconcile()
+    reconciler.Reconcile()
+    test.Equals(t, 3, len(client.Calls))
+    test.Equals(t, "ON", client.Calls[2].Payload)
+
+    thing, err := things.Get(ctx, switchId)
+    test.Ok(t, err)
+    test.Equals(t, model.SWITCH_SYNC_PENDING, thing.Switch.SyncStatus)
+    test.Equals(t, int32(2), thing.Switch.SyncRetries)
+
+    // no more retries
+    reconciler.Reconcile()
+    test.Equals(t, 3, len(client.Calls))
+
+    thing, err = things.Get(ctx, switchId)
+    test.Ok(t, err)
+    test.Equals(t, model.SWITCH_SYNC_OUT_OF_SYNC, thing.Switch.SyncStatus)
+
+    // switch is back with wrong state -> command is re-sent
+    mqtt.ProcessMessage(ctx, fmt.Sprintf("org/%s/%s/state", ORG, THING), "OFF")
+    test.Equals(t, 4, len(client.Calls))
+    test.Equals(t, "ON", client.Calls[3].Payload)
+
+    thing, err = things.Get(ctx, switchId)
+    test.Ok(t, err)
+    test.Equals(t, model.SWITCH_SYNC_PENDING, thing.Switch.SyncStatus)
+    test.Equals(t, int32(0), thing.Switch.SyncRetries)
+
+    // switch confirms desired state
+    mqtt.ProcessMessage(ctx, fmt.Sprintf("org/%s/%s/state", ORG, THING), "ON")
+
+    thing, err = things.Get(ctx, switchId)
+    test.Ok(t, err)
+    test.Equals(t, model.SWITCH_SYNC_IN_SYNC, thing.Switch.SyncStatus)
+    test.Equals(t, true, thing.Switch.State)
+}
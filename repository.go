@@ -0,0 +1,135 @@
+package piot
+
+import (
+    "errors"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "github.com/mnezerka/go-piot/model"
+)
+
+// Error returned by repositories if requested record doesn't exist
+var ErrNotFound = errors.New("Record not found")
+
+// Error returned by repositories if record with same id already exists
+var ErrDuplicate = errors.New("Record already exists")
+
+// Options for fetching of multiple records
+type FindOptions struct {
+    // name of attribute used for sorting, prefix "-" means descending order
+    Sort string
+
+    // number of records to be skipped
+    Skip int64
+
+    // maximal number of records to be returned, 0 means no limit
+    Limit int64
+}
+
+// Criteria for selecting things, criteria which are not set (zero values)
+// are not applied, all set criteria have to match
+type ThingFilter struct {
+    // things of given orgs only, nil means any org (incl. no org), empty
+    // list matches nothing
+    OrgIds []primitive.ObjectID
+
+    // things assigned to any org
+    Assigned bool
+
+    // children of the thing
+    ParentId *primitive.ObjectID
+
+    Type string
+    Available *bool
+
+    // things with configured last seen interval
+    HasLastSeenInterval bool
+
+    // sensors with configured validity of measurement
+    HasValidity bool
+
+    // sensors with value flagged (or not flagged) as stale
+    Stale *bool
+
+    // switches in given sync status
+    SyncStatus string
+
+    // case insensitive substring of name, alias or description
+    Query string
+}
+
+// Storage of things. Attributes are identified by names used in database
+// (nested attributes in dot notation, e.g. "sensor.class")
+type ThingRepository interface {
+    Get(id primitive.ObjectID) (*model.Thing, error)
+    GetByName(name string) (*model.Thing, error)
+    GetByPiotId(piotId string) (*model.Thing, error)
+    Find(filter *ThingFilter, opts *FindOptions) ([]*model.Thing, error)
+    Count(filter *ThingFilter) (int64, error)
+    Insert(thing *model.Thing) (primitive.ObjectID, error)
+    SetFields(id primitive.ObjectID, fields map[string]interface{}) (error)
+
+    // Set availability, returns true if availability really changed
+    SetAvailable(id primitive.ObjectID, available bool, ts int32) (bool, error)
+
+    // Set location unless newer location is already stored
+    SetLocation(id primitive.ObjectID, lat, lng float64, sat, ts int32) (error)
+
+    // Mark pending (or out of sync) switch as in sync if state matches
+    // desired state
+    ConfirmSwitchState(id primitive.ObjectID, state bool) (error)
+
+    // Increment number of command retries of the switch
+    IncSwitchSyncRetries(id primitive.ObjectID, ts int32) (error)
+
+    // Move children of parent to new parent
+    ReplaceParent(parentId, newParentId primitive.ObjectID) (error)
+
+    Delete(id primitive.ObjectID) (error)
+    DeleteAll() (error)
+}
+
+// Storage of orgs
+type OrgRepository interface {
+    Get(id primitive.ObjectID) (*model.Org, error)
+    GetByName(name string) (*model.Org, error)
+    Insert(org *model.Org) (primitive.ObjectID, error)
+    SetFields(id primitive.ObjectID, fields map[string]interface{}) (error)
+    Delete(id primitive.ObjectID) (error)
+    DeleteAll() (error)
+}
+
+// Storage of users
+type UserRepository interface {
+    Get(id primitive.ObjectID) (*model.User, error)
+    GetByEmail(email string) (*model.User, error)
+    Insert(user *model.User) (primitive.ObjectID, error)
+    SetFields(id primitive.ObjectID, fields map[string]interface{}) (error)
+    Delete(id primitive.ObjectID) (error)
+    DeleteAll() (error)
+}
+
+// Storage of assignments of users to orgs
+type OrgUserRepository interface {
+    Get(orgId, userId primitive.ObjectID) (*model.OrgUser, error)
+
+    // Get members of the org ordered by time of assignment
+    FindByOrg(orgId primitive.ObjectID) ([]*model.OrgUser, error)
+
+    FindByUser(userId primitive.ObjectID) ([]*model.OrgUser, error)
+    CountByRole(orgId primitive.ObjectID, role string) (int64, error)
+    Insert(orgUser *model.OrgUser) (error)
+    SetRole(orgId, userId primitive.ObjectID, role string) (error)
+    Delete(orgId, userId primitive.ObjectID) (error)
+    DeleteAll() (error)
+}
+
+// Set of repositories used by services
+type Repositories struct {
+    Things ThingRepository
+    Orgs OrgRepository
+    Users UserRepository
+    OrgUsers OrgUserRepository
+
+    // cache of orgs and things, nil if repositories are not cached (see
+    // NewCachedRepositories)
+    Cache *RepositoryCache
+}
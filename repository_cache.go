@@ -0,0 +1,311 @@
+package piot
+
+import (
+    "sync"
+    "time"
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "github.com/mnezerka/go-piot/model"
+)
+
+// Statistics of cache usage
+type CacheStats struct {
+    Hits int64
+    Misses int64
+    Entries int
+}
+
+type ttlCacheEntry struct {
+    value interface{}
+    expires time.Time
+}
+
+// Map of values expiring after ttl
+type ttlCache struct {
+    mutex sync.Mutex
+    ttl time.Duration
+    entries map[string]ttlCacheEntry
+    lastPurge time.Time
+    hits int64
+    misses int64
+
+    // incremented by each invalidation, so values fetched before
+    // invalidation are not stored
+    generation int64
+}
+
+func newTtlCache(ttl time.Duration) *ttlCache {
+    return &ttlCache{ttl: ttl, entries: make(map[string]ttlCacheEntry), lastPurge: time.Now()}
+}
+
+func (c *ttlCache) get(key string) (interface{}, bool) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+
+    entry, ok := c.entries[key]
+    if ok && time.Now().After(entry.expires) {
+        delete(c.entries, key)
+        ok = false
+    }
+
+    if !ok {
+        c.misses++
+        return nil, false
+    }
+
+    c.hits++
+    return entry.value, true
+}
+
+// Get generation to be passed to set, it has to be read before value is
+// fetched
+func (c *ttlCache) getGeneration() int64 {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    return c.generation
+}
+
+// Store value unless cache was invalidated since given generation, value
+// could be fetched before concurrent write in such case
+func (c *ttlCache) set(key string, value interface{}, generation int64) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+
+    if c.generation != generation {
+        return
+    }
+
+    now := time.Now()
+
+    // entries which are never read again are removed periodically
+    if now.Sub(c.lastPurge) > c.ttl {
+        for k, entry := range c.entries {
+            if now.After(entry.expires) {
+                delete(c.entries, k)
+            }
+        }
+        c.lastPurge = now
+    }
+
+    c.entries[key] = ttlCacheEntry{value: value, expires: now.Add(c.ttl)}
+}
+
+func (c *ttlCache) remove(key string) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    delete(c.entries, key)
+    c.generation++
+}
+
+func (c *ttlCache) clear() {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    c.entries = make(map[string]ttlCacheEntry)
+    c.generation++
+}
+
+func (c *ttlCache) stats() CacheStats {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    return CacheStats{Hits: c.hits, Misses: c.misses, Entries: len(c.entries)}
+}
+
+// Cache of orgs and things placed in front of repositories. Orgs are cached
+// by id and name, things by id. Writes done through cached repositories
+// invalidate affected records, changes done by other means (e.g. other
+// process) are visible after ttl expires or after explicit invalidation
+type RepositoryCache struct {
+    orgs *ttlCache
+    things *ttlCache
+}
+
+// Get repositories with orgs and things cached (see Repositories.Cache),
+// other repositories are shared with given repositories
+func NewCachedRepositories(repos *Repositories, ttl time.Duration) *Repositories {
+    cache := &RepositoryCache{orgs: newTtlCache(ttl), things: newTtlCache(ttl)}
+
+    cached := *repos
+    cached.Orgs = &cachedOrgRepository{OrgRepository: repos.Orgs, cache: cache.orgs}
+    cached.Things = &cachedThingRepository{ThingRepository: repos.Things, cache: cache.things}
+    cached.Cache = cache
+
+    return &cached
+}
+
+// Drop all cached orgs, orgs are cached by multiple keys, so single org
+// cannot be dropped
+func (c *RepositoryCache) InvalidateOrgs() {
+    c.orgs.clear()
+}
+
+// Drop cached thing
+func (c *RepositoryCache) InvalidateThing(id primitive.ObjectID) {
+    c.things.remove(id.Hex())
+}
+
+// Drop all cached records
+func (c *RepositoryCache) Invalidate() {
+    c.orgs.clear()
+    c.things.clear()
+}
+
+func (c *RepositoryCache) OrgStats() CacheStats {
+    return c.orgs.stats()
+}
+
+func (c *RepositoryCache) ThingStats() CacheStats {
+    return c.things.stats()
+}
+
+// Copy record including nested maps and slices (e.g. sinks of thing), copy
+// is made by bson encoding, so it is same as record read from database
+func copyRecord(src, dst interface{}) (error) {
+    raw, err := bson.Marshal(src)
+    if err != nil {
+        return err
+    }
+    return bson.Unmarshal(raw, dst)
+}
+
+///////////////////////////////////////// orgs
+
+type cachedOrgRepository struct {
+    OrgRepository
+    cache *ttlCache
+}
+
+func (r *cachedOrgRepository) Get(id primitive.ObjectID) (*model.Org, error) {
+    return r.get("id:" + id.Hex(), func() (*model.Org, error) {
+        return r.OrgRepository.Get(id)
+    })
+}
+
+func (r *cachedOrgRepository) GetByName(name string) (*model.Org, error) {
+    return r.get("name:" + name, func() (*model.Org, error) {
+        return r.OrgRepository.GetByName(name)
+    })
+}
+
+func (r *cachedOrgRepository) Insert(org *model.Org) (primitive.ObjectID, error) {
+    // org could be cached as not found by other key
+    defer r.cache.clear()
+    return r.OrgRepository.Insert(org)
+}
+
+func (r *cachedOrgRepository) SetFields(id primitive.ObjectID, fields map[string]interface{}) (error) {
+    defer r.cache.clear()
+    return r.OrgRepository.SetFields(id, fields)
+}
+
+func (r *cachedOrgRepository) Delete(id primitive.ObjectID) (error) {
+    defer r.cache.clear()
+    return r.OrgRepository.Delete(id)
+}
+
+func (r *cachedOrgRepository) DeleteAll() (error) {
+    defer r.cache.clear()
+    return r.OrgRepository.DeleteAll()
+}
+
+func (r *cachedOrgRepository) get(key string, fetch func() (*model.Org, error)) (*model.Org, error) {
+    if value, ok := r.cache.get(key); ok {
+        // callers are free to modify returned record
+        var org model.Org
+        if err := copyRecord(value, &org); err != nil {
+            return nil, err
+        }
+        return &org, nil
+    }
+
+    generation := r.cache.getGeneration()
+    org, err := fetch()
+    if err != nil {
+        return nil, err
+    }
+
+    var cached model.Org
+    if err := copyRecord(org, &cached); err != nil {
+        return nil, err
+    }
+    r.cache.set(key, &cached, generation)
+
+    return org, nil
+}
+
+///////////////////////////////////////// things
+
+type cachedThingRepository struct {
+    ThingRepository
+    cache *ttlCache
+}
+
+func (r *cachedThingRepository) Get(id primitive.ObjectID) (*model.Thing, error) {
+    if value, ok := r.cache.get(id.Hex()); ok {
+        // callers are free to modify returned record
+        var thing model.Thing
+        if err := copyRecord(value, &thing); err != nil {
+            return nil, err
+        }
+        return &thing, nil
+    }
+
+    generation := r.cache.getGeneration()
+    thing, err := r.ThingRepository.Get(id)
+    if err != nil {
+        return nil, err
+    }
+
+    var cached model.Thing
+    if err := copyRecord(thing, &cached); err != nil {
+        return nil, err
+    }
+    r.cache.set(id.Hex(), &cached, generation)
+
+    return thing, nil
+}
+
+func (r *cachedThingRepository) SetFields(id primitive.ObjectID, fields map[string]interface{}) (error) {
+    defer r.cache.remove(id.Hex())
+    return r.ThingRepository.SetFields(id, fields)
+}
+
+// Availability is set on each message of some things, cached thing is
+// kept if availability was not changed
+func (r *cachedThingRepository) SetAvailable(id primitive.ObjectID, available bool, ts int32) (bool, error) {
+    changed, err := r.ThingRepository.SetAvailable(id, available, ts)
+    if changed || err != nil {
+        r.cache.remove(id.Hex())
+    }
+    return changed, err
+}
+
+func (r *cachedThingRepository) SetLocation(id primitive.ObjectID, lat, lng float64, sat, ts int32) (error) {
+    defer r.cache.remove(id.Hex())
+    return r.ThingRepository.SetLocation(id, lat, lng, sat, ts)
+}
+
+func (r *cachedThingRepository) ConfirmSwitchState(id primitive.ObjectID, state bool) (error) {
+    defer r.cache.remove(id.Hex())
+    return r.ThingRepository.ConfirmSwitchState(id, state)
+}
+
+func (r *cachedThingRepository) IncSwitchSyncRetries(id primitive.ObjectID, ts int32) (error) {
+    defer r.cache.remove(id.Hex())
+    return r.ThingRepository.IncSwitchSyncRetries(id, ts)
+}
+
+// Parent of unknown set of things is changed, all things are dropped
+func (r *cachedThingRepository) ReplaceParent(parentId, newParentId primitive.ObjectID) (error) {
+    defer r.cache.clear()
+    return r.ThingRepository.ReplaceParent(parentId, newParentId)
+}
+
+func (r *cachedThingRepository) Delete(id primitive.ObjectID) (error) {
+    defer r.cache.remove(id.Hex())
+    return r.ThingRepository.Delete(id)
+}
+
+func (r *cachedThingRepository) DeleteAll() (error) {
+    defer r.cache.clear()
+    return r.ThingRepository.DeleteAll()
+}
@@ -0,0 +1,184 @@
+package piot_test
+
+import (
+    "testing"
+    "time"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "github.com/mnezerka/go-piot"
+    "github.com/mnezerka/go-piot/model"
+    "github.com/mnezerka/go-piot/test"
+)
+
+func TestRepositoryCacheOrgs(t *testing.T) {
+    const ORG = "org"
+
+    db := test.GetDb(t)
+    log := test.GetLogger(t)
+    test.CleanDb(t, db)
+    cachedDb := piot.NewCachedRepositories(db, time.Minute)
+    cache := cachedDb.Cache
+    orgs := piot.NewOrgs(log, cachedDb)
+
+    orgId := test.CreateOrg(t, db, ORG)
+
+    org, err := orgs.Get(orgId)
+    test.Ok(t, err)
+    test.Equals(t, ORG, org.Name)
+    test.Equals(t, piot.CacheStats{Hits: 0, Misses: 1, Entries: 1}, cache.OrgStats())
+
+    // modification of returned record doesn't affect cache
+    org.Name = "modified"
+    org, err = orgs.Get(orgId)
+    test.Ok(t, err)
+    test.Equals(t, ORG, org.Name)
+    test.Equals(t, int64(1), cache.OrgStats().Hits)
+
+    org, err = orgs.GetByName(ORG)
+    test.Ok(t, err)
+    org, err = orgs.GetByName(ORG)
+    test.Ok(t, err)
+    test.Equals(t, orgId, org.Id)
+    test.Equals(t, piot.CacheStats{Hits: 2, Misses: 2, Entries: 2}, cache.OrgStats())
+
+    // change done directly in database is visible after invalidation
+    err = db.Orgs.SetFields(orgId, map[string]interface{}{"description": "desc"})
+    test.Ok(t, err)
+    org, err = orgs.Get(orgId)
+    test.Ok(t, err)
+    test.Equals(t, "", org.Description)
+    cache.InvalidateOrgs()
+    org, err = orgs.Get(orgId)
+    test.Ok(t, err)
+    test.Equals(t, "desc", org.Description)
+
+    // change done through cached repository invalidates cache
+    err = cachedDb.Orgs.SetFields(orgId, map[string]interface{}{"name": "renamed"})
+    test.Ok(t, err)
+    _, err = orgs.GetByName(ORG)
+    test.Assert(t, err != nil, "Renamed org found by old name")
+    org, err = orgs.Get(orgId)
+    test.Ok(t, err)
+    test.Equals(t, "renamed", org.Name)
+}
+
+func TestRepositoryCacheThings(t *testing.T) {
+    const SENSOR = "sensor"
+
+    db := test.GetDb(t)
+    log := test.GetLogger(t)
+    test.CleanDb(t, db)
+    ctx := test.GetContext(t)
+    cachedDb := piot.NewCachedRepositories(db, time.Minute)
+    cache := cachedDb.Cache
+    things := piot.NewThings(log, cachedDb)
+
+    sensorId := test.CreateThing(t, db, SENSOR)
+
+    _, err := things.Get(ctx, sensorId)
+    test.Ok(t, err)
+    thing, err := things.Get(ctx, sensorId)
+    test.Ok(t, err)
+    test.Equals(t, SENSOR, thing.Name)
+    test.Equals(t, piot.CacheStats{Hits: 1, Misses: 1, Entries: 1}, cache.ThingStats())
+
+    // modification of nested attributes of returned record doesn't affect
+    // cache
+    test.SetThingSinks(t, cachedDb, sensorId, []string{model.SINK_MYSQLDB})
+    thing, err = things.Get(ctx, sensorId)
+    test.Ok(t, err)
+    thing.Sinks[0] = model.SINK_INFLUXDB
+    thing.PublishPolicies = map[string]model.PublishPolicy{model.PUBLISH_MEASUREMENT: {Qos: 1}}
+    thing, err = things.Get(ctx, sensorId)
+    test.Ok(t, err)
+    test.Equals(t, []string{model.SINK_MYSQLDB}, thing.Sinks)
+    test.Equals(t, 0, len(thing.PublishPolicies))
+
+    // update of thing drops it from cache
+    test.Ok(t, things.SetSensorMeasurementTopic(ctx, sensorId, "temperature"))
+    test.Equals(t, 0, cache.ThingStats().Entries)
+    thing, err = things.Get(ctx, sensorId)
+    test.Ok(t, err)
+    test.Equals(t, "temperature", thing.Sensor.MeasurementTopic)
+
+    // change done directly in database is visible after invalidation
+    test.SetSensorMeasurementTopic(t, db, sensorId, "pressure")
+    thing, err = things.Get(ctx, sensorId)
+    test.Ok(t, err)
+    test.Equals(t, "temperature", thing.Sensor.MeasurementTopic)
+    cache.InvalidateThing(sensorId)
+    thing, err = things.Get(ctx, sensorId)
+    test.Ok(t, err)
+    test.Equals(t, "pressure", thing.Sensor.MeasurementTopic)
+
+    // deleted thing is not served from cache
+    test.Ok(t, things.Delete(ctx, sensorId, false))
+    _, err = things.Get(ctx, sensorId)
+    test.Assert(t, err != nil, "Deleted thing found")
+}
+
+func TestRepositoryCacheExpiration(t *testing.T) {
+    const SENSOR = "sensor"
+
+    db := test.GetDb(t)
+    log := test.GetLogger(t)
+    test.CleanDb(t, db)
+    ctx := test.GetContext(t)
+    cachedDb := piot.NewCachedRepositories(db, 10 * time.Millisecond)
+    cache := cachedDb.Cache
+    things := piot.NewThings(log, cachedDb)
+
+    sensorId := test.CreateThing(t, db, SENSOR)
+
+    _, err := things.Get(ctx, sensorId)
+    test.Ok(t, err)
+    time.Sleep(20 * time.Millisecond)
+    _, err = things.Get(ctx, sensorId)
+    test.Ok(t, err)
+    test.Equals(t, piot.CacheStats{Hits: 0, Misses: 2, Entries: 1}, cache.ThingStats())
+}
+
+// Repository simulating write done concurrently with fetch of thing
+type racingThingRepository struct {
+    piot.ThingRepository
+    write func()
+}
+
+func (r *racingThingRepository) Get(id primitive.ObjectID) (*model.Thing, error) {
+    thing, err := r.ThingRepository.Get(id)
+    if r.write != nil {
+        r.write()
+        r.write = nil
+    }
+    return thing, err
+}
+
+func TestRepositoryCacheConcurrentWrite(t *testing.T) {
+    const SENSOR = "sensor"
+
+    db := test.GetDb(t)
+    log := test.GetLogger(t)
+    test.CleanDb(t, db)
+    ctx := test.GetContext(t)
+
+    racing := &racingThingRepository{ThingRepository: db.Things}
+    repos := *db
+    repos.Things = racing
+    cachedDb := piot.NewCachedRepositories(&repos, time.Minute)
+    things := piot.NewThings(log, cachedDb)
+
+    sensorId := test.CreateThing(t, db, SENSOR)
+
+    // thing fetched before write is not cached
+    racing.write = func() {
+        test.Ok(t, cachedDb.Things.SetFields(sensorId, map[string]interface{}{"name": "renamed"}))
+    }
+    thing, err := things.Get(ctx, sensorId)
+    test.Ok(t, err)
+    test.Equals(t, SENSOR, thing.Name)
+    test.Equals(t, 0, cachedDb.Cache.ThingStats().Entries)
+
+    thing, err = things.Get(ctx, sensorId)
+    test.Ok(t, err)
+    test.Equals(t, "renamed", thing.Name)
+    test.Equals(t, 1, cachedDb.Cache.ThingStats().Entries)
+}
@@ -0,0 +1,688 @@
+package piot
+
+import (
+    "bytes"
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "github.com/mnezerka/go-piot/model"
+)
+
+// Create repositories stored in memory, data is lost when process ends
+func NewMemoryRepositories() *Repositories {
+    return &Repositories{
+        Things: &memoryThingRepository{},
+        Orgs: &memoryOrgRepository{},
+        Users: &memoryUserRepository{},
+        OrgUsers: &memoryOrgUserRepository{},
+    }
+}
+
+// Records stored in memory as documents (same as they would be stored in
+// MongoDB), so each read returns independent copy of the record. Records
+// are kept in insertion order which is also natural order of results
+type memoryCollection struct {
+    mutex sync.RWMutex
+    docs []primitive.M
+}
+
+// Get copies of documents matching the function
+func (c *memoryCollection) find(match func(doc primitive.M) bool, opts *FindOptions) []primitive.M {
+    c.mutex.RLock()
+    var docs []primitive.M
+    for _, doc := range c.docs {
+        if match(doc) {
+            docs = append(docs, doc)
+        }
+    }
+    c.mutex.RUnlock()
+
+    if opts != nil {
+        if opts.Sort != "" {
+            path := strings.TrimPrefix(opts.Sort, "-")
+            desc := strings.HasPrefix(opts.Sort, "-")
+            sort.SliceStable(docs, func(i, j int) bool {
+                a, aExists := getPath(docs[i], path)
+                b, bExists := getPath(docs[j], path)
+                if desc {
+                    return sortCompare(b, bExists, a, aExists) < 0
+                }
+                return sortCompare(a, aExists, b, bExists) < 0
+            })
+        }
+
+        if opts.Skip > 0 {
+            if opts.Skip >= int64(len(docs)) {
+                docs = nil
+            } else {
+                docs = docs[opts.Skip:]
+            }
+        }
+
+        if opts.Limit > 0 && opts.Limit < int64(len(docs)) {
+            docs = docs[:opts.Limit]
+        }
+    }
+
+    return docs
+}
+
+func (c *memoryCollection) count(match func(doc primitive.M) bool) int64 {
+    c.mutex.RLock()
+    defer c.mutex.RUnlock()
+
+    var count int64
+    for _, doc := range c.docs {
+        if match(doc) {
+            count++
+        }
+    }
+
+    return count
+}
+
+// Insert record, id is generated if record has no id
+func (c *memoryCollection) insert(record interface{}) (primitive.ObjectID, error) {
+    doc, err := toDocument(record)
+    if err != nil {
+        return primitive.NilObjectID, err
+    }
+
+    id, ok := doc["_id"].(primitive.ObjectID)
+    if !ok {
+        id = primitive.NewObjectID()
+        doc["_id"] = id
+    }
+
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+
+    for _, existing := range c.docs {
+        if existing["_id"] == id {
+            return primitive.NilObjectID, ErrDuplicate
+        }
+    }
+
+    c.docs = append(c.docs, doc)
+
+    return id, nil
+}
+
+// Modify documents matching the function, number of modified documents is
+// returned
+func (c *memoryCollection) update(match func(doc primitive.M) bool, modify func(doc primitive.M) error) (int64, error) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+
+    var modified int64
+    for i, doc := range c.docs {
+        if !match(doc) {
+            continue
+        }
+
+        // modify copy to keep document untouched if modification fails
+        updated, err := toDocument(doc)
+        if err != nil {
+            return modified, err
+        }
+        if err := modify(updated); err != nil {
+            return modified, err
+        }
+        c.docs[i] = updated
+        modified++
+    }
+
+    return modified, nil
+}
+
+// Set fields (identified by path) of documents matching the function
+func (c *memoryCollection) setFields(match func(doc primitive.M) bool, fields map[string]interface{}) (int64, error) {
+    values, err := toDocument(fields)
+    if err != nil {
+        return 0, err
+    }
+
+    return c.update(match, func(doc primitive.M) error {
+        for path, value := range values {
+            if err := setPath(doc, path, value); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+}
+
+func (c *memoryCollection) delete(match func(doc primitive.M) bool) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+
+    docs := c.docs[:0]
+    for _, doc := range c.docs {
+        if !match(doc) {
+            docs = append(docs, doc)
+        }
+    }
+    for i := len(docs); i < len(c.docs); i++ {
+        c.docs[i] = nil
+    }
+    c.docs = docs
+}
+
+// Decode first of documents into record, ErrNotFound is returned if there
+// are no documents
+func decodeFirst(docs []primitive.M, record interface{}) (error) {
+    if len(docs) == 0 {
+        return ErrNotFound
+    }
+    return decodeDocument(docs[0], record)
+}
+
+func decodeDocument(doc primitive.M, record interface{}) (error) {
+    raw, err := bson.Marshal(doc)
+    if err != nil {
+        return err
+    }
+    return bson.Unmarshal(raw, record)
+}
+
+func matchAll(doc primitive.M) bool {
+    return true
+}
+
+func matchId(id primitive.ObjectID) func(doc primitive.M) bool {
+    return func(doc primitive.M) bool {
+        return doc["_id"] == id
+    }
+}
+
+func matchField(name string, value interface{}) func(doc primitive.M) bool {
+    return func(doc primitive.M) bool {
+        return doc[name] == value
+    }
+}
+
+///////////////////////////////////////// things
+
+type memoryThingRepository struct {
+    c memoryCollection
+}
+
+func (r *memoryThingRepository) Get(id primitive.ObjectID) (*model.Thing, error) {
+    return r.findOne(matchId(id))
+}
+
+func (r *memoryThingRepository) GetByName(name string) (*model.Thing, error) {
+    return r.findOne(matchField("name", name))
+}
+
+func (r *memoryThingRepository) GetByPiotId(piotId string) (*model.Thing, error) {
+    return r.findOne(matchField("piot_id", piotId))
+}
+
+func (r *memoryThingRepository) findOne(match func(doc primitive.M) bool) (*model.Thing, error) {
+    var thing model.Thing
+    if err := decodeFirst(r.c.find(match, nil), &thing); err != nil {
+        return nil, err
+    }
+    return &thing, nil
+}
+
+func (r *memoryThingRepository) Find(filter *ThingFilter, opts *FindOptions) ([]*model.Thing, error) {
+    var result []*model.Thing
+    for _, doc := range r.c.find(matchThingFilter(filter), opts) {
+        thing := model.Thing{}
+        if err := decodeDocument(doc, &thing); err != nil {
+            return nil, err
+        }
+        result = append(result, &thing)
+    }
+    return result, nil
+}
+
+func (r *memoryThingRepository) Count(filter *ThingFilter) (int64, error) {
+    return r.c.count(matchThingFilter(filter)), nil
+}
+
+func (r *memoryThingRepository) Insert(thing *model.Thing) (primitive.ObjectID, error) {
+    return r.c.insert(thing)
+}
+
+func (r *memoryThingRepository) SetFields(id primitive.ObjectID, fields map[string]interface{}) (error) {
+    _, err := r.c.setFields(matchId(id), fields)
+    return err
+}
+
+func (r *memoryThingRepository) SetAvailable(id primitive.ObjectID, available bool, ts int32) (bool, error) {
+    match := func(doc primitive.M) bool {
+        return doc["_id"] == id && doc["available"] != available
+    }
+    modified, err := r.c.setFields(match, map[string]interface{}{"available": available, "available_changed": ts})
+    return modified > 0, err
+}
+
+func (r *memoryThingRepository) SetLocation(id primitive.ObjectID, lat, lng float64, sat, ts int32) (error) {
+    match := func(doc primitive.M) bool {
+        current, _ := doc["loc_ts"].(int32)
+        return doc["_id"] == id && current <= ts
+    }
+    _, err := r.c.setFields(match, map[string]interface{}{"loc_lat": lat, "loc_lng": lng, "loc_sat": sat, "loc_ts": ts})
+    return err
+}
+
+func (r *memoryThingRepository) ConfirmSwitchState(id primitive.ObjectID, state bool) (error) {
+    match := func(doc primitive.M) bool {
+        status, _ := getPath(doc, "switch.sync_status")
+        desired, _ := getPath(doc, "switch.desired_state")
+        return doc["_id"] == id &&
+            (status == model.SWITCH_SYNC_PENDING || status == model.SWITCH_SYNC_OUT_OF_SYNC) &&
+            desired == state
+    }
+    _, err := r.c.setFields(match, map[string]interface{}{"switch.sync_status": model.SWITCH_SYNC_IN_SYNC, "switch.sync_retries": 0})
+    return err
+}
+
+func (r *memoryThingRepository) IncSwitchSyncRetries(id primitive.ObjectID, ts int32) (error) {
+    _, err := r.c.update(matchId(id), func(doc primitive.M) error {
+        retries, _ := getPath(doc, "switch.sync_retries")
+        count, _ := retries.(int32)
+        if err := setPath(doc, "switch.sync_retries", count + 1); err != nil {
+            return err
+        }
+        return setPath(doc, "switch.desired_ts", ts)
+    })
+    return err
+}
+
+func (r *memoryThingRepository) ReplaceParent(parentId, newParentId primitive.ObjectID) (error) {
+    _, err := r.c.setFields(matchField("parent_id", parentId), map[string]interface{}{"parent_id": newParentId})
+    return err
+}
+
+func (r *memoryThingRepository) Delete(id primitive.ObjectID) (error) {
+    r.c.delete(matchId(id))
+    return nil
+}
+
+func (r *memoryThingRepository) DeleteAll() (error) {
+    r.c.delete(matchAll)
+    return nil
+}
+
+// Get function matching documents of things selected by filter
+func matchThingFilter(filter *ThingFilter) func(doc primitive.M) bool {
+    return func(doc primitive.M) bool {
+        if filter == nil {
+            return true
+        }
+
+        var thing model.Thing
+        if err := decodeDocument(doc, &thing); err != nil {
+            return false
+        }
+
+        if filter.OrgIds != nil {
+            found := false
+            for _, orgId := range filter.OrgIds {
+                if thing.OrgId == orgId {
+                    found = true
+                    break
+                }
+            }
+            if !found {
+                return false
+            }
+        }
+        if filter.Assigned && thing.OrgId == primitive.NilObjectID {
+            return false
+        }
+        if filter.ParentId != nil && thing.ParentId != *filter.ParentId {
+            return false
+        }
+        if filter.Type != "" && thing.Type != filter.Type {
+            return false
+        }
+        if filter.Available != nil && thing.Available != *filter.Available {
+            return false
+        }
+        if filter.HasLastSeenInterval && thing.LastSeenInterval <= 0 {
+            return false
+        }
+        if filter.HasValidity && thing.Sensor.Validity <= 0 {
+            return false
+        }
+        if filter.Stale != nil && thing.Sensor.Stale != *filter.Stale {
+            return false
+        }
+        if filter.SyncStatus != "" && thing.Switch.SyncStatus != filter.SyncStatus {
+            return false
+        }
+        if filter.Query != "" {
+            query := strings.ToLower(filter.Query)
+            if !strings.Contains(strings.ToLower(thing.Name), query) &&
+                !strings.Contains(strings.ToLower(thing.Alias), query) &&
+                !strings.Contains(strings.ToLower(thing.Description), query) {
+                return false
+            }
+        }
+
+        return true
+    }
+}
+
+///////////////////////////////////////// orgs
+
+type memoryOrgRepository struct {
+    c memoryCollection
+}
+
+func (r *memoryOrgRepository) Get(id primitive.ObjectID) (*model.Org, error) {
+    return r.findOne(matchId(id))
+}
+
+func (r *memoryOrgRepository) GetByName(name string) (*model.Org, error) {
+    return r.findOne(matchField("name", name))
+}
+
+func (r *memoryOrgRepository) findOne(match func(doc primitive.M) bool) (*model.Org, error) {
+    var org model.Org
+    if err := decodeFirst(r.c.find(match, nil), &org); err != nil {
+        return nil, err
+    }
+    return &org, nil
+}
+
+func (r *memoryOrgRepository) Insert(org *model.Org) (primitive.ObjectID, error) {
+    return r.c.insert(org)
+}
+
+func (r *memoryOrgRepository) SetFields(id primitive.ObjectID, fields map[string]interface{}) (error) {
+    _, err := r.c.setFields(matchId(id), fields)
+    return err
+}
+
+func (r *memoryOrgRepository) Delete(id primitive.ObjectID) (error) {
+    r.c.delete(matchId(id))
+    return nil
+}
+
+func (r *memoryOrgRepository) DeleteAll() (error) {
+    r.c.delete(matchAll)
+    return nil
+}
+
+///////////////////////////////////////// users
+
+type memoryUserRepository struct {
+    c memoryCollection
+}
+
+func (r *memoryUserRepository) Get(id primitive.ObjectID) (*model.User, error) {
+    return r.findOne(matchId(id))
+}
+
+func (r *memoryUserRepository) GetByEmail(email string) (*model.User, error) {
+    return r.findOne(matchField("email", email))
+}
+
+func (r *memoryUserRepository) findOne(match func(doc primitive.M) bool) (*model.User, error) {
+    var user model.User
+    if err := decodeFirst(r.c.find(match, nil), &user); err != nil {
+        return nil, err
+    }
+    return &user, nil
+}
+
+func (r *memoryUserRepository) Insert(user *model.User) (primitive.ObjectID, error) {
+    return r.c.insert(user)
+}
+
+func (r *memoryUserRepository) SetFields(id primitive.ObjectID, fields map[string]interface{}) (error) {
+    _, err := r.c.setFields(matchId(id), fields)
+    return err
+}
+
+func (r *memoryUserRepository) Delete(id primitive.ObjectID) (error) {
+    r.c.delete(matchId(id))
+    return nil
+}
+
+func (r *memoryUserRepository) DeleteAll() (error) {
+    r.c.delete(matchAll)
+    return nil
+}
+
+///////////////////////////////////////// org users
+
+type memoryOrgUserRepository struct {
+    c memoryCollection
+}
+
+func matchOrgUser(orgId, userId primitive.ObjectID) func(doc primitive.M) bool {
+    return func(doc primitive.M) bool {
+        return doc["org_id"] == orgId && doc["user_id"] == userId
+    }
+}
+
+func (r *memoryOrgUserRepository) Get(orgId, userId primitive.ObjectID) (*model.OrgUser, error) {
+    var orgUser model.OrgUser
+    if err := decodeFirst(r.c.find(matchOrgUser(orgId, userId), nil), &orgUser); err != nil {
+        return nil, err
+    }
+    return &orgUser, nil
+}
+
+func (r *memoryOrgUserRepository) FindByOrg(orgId primitive.ObjectID) ([]*model.OrgUser, error) {
+    return r.find(matchField("org_id", orgId), &FindOptions{Sort: "created"})
+}
+
+func (r *memoryOrgUserRepository) FindByUser(userId primitive.ObjectID) ([]*model.OrgUser, error) {
+    return r.find(matchField("user_id", userId), nil)
+}
+
+func (r *memoryOrgUserRepository) find(match func(doc primitive.M) bool, opts *FindOptions) ([]*model.OrgUser, error) {
+    var result []*model.OrgUser
+    for _, doc := range r.c.find(match, opts) {
+        orgUser := model.OrgUser{}
+        if err := decodeDocument(doc, &orgUser); err != nil {
+            return nil, err
+        }
+        result = append(result, &orgUser)
+    }
+    return result, nil
+}
+
+func (r *memoryOrgUserRepository) CountByRole(orgId primitive.ObjectID, role string) (int64, error) {
+    return r.c.count(func(doc primitive.M) bool {
+        return doc["org_id"] == orgId && doc["role"] == role
+    }), nil
+}
+
+// Assignments have no own id, they are identified by org and user
+func (r *memoryOrgUserRepository) Insert(orgUser *model.OrgUser) (error) {
+    doc, err := toDocument(orgUser)
+    if err != nil {
+        return err
+    }
+
+    r.c.mutex.Lock()
+    defer r.c.mutex.Unlock()
+    r.c.docs = append(r.c.docs, doc)
+
+    return nil
+}
+
+func (r *memoryOrgUserRepository) SetRole(orgId, userId primitive.ObjectID, role string) (error) {
+    _, err := r.c.setFields(matchOrgUser(orgId, userId), map[string]interface{}{"role": role})
+    return err
+}
+
+func (r *memoryOrgUserRepository) Delete(orgId, userId primitive.ObjectID) (error) {
+    r.c.delete(matchOrgUser(orgId, userId))
+    return nil
+}
+
+func (r *memoryOrgUserRepository) DeleteAll() (error) {
+    r.c.delete(matchAll)
+    return nil
+}
+
+///////////////////////////////////////// documents
+
+// Convert value to document with same types as it would have after
+// reading from database (e.g. nested documents are primitive.M, arrays
+// are primitive.A, int is int32)
+func toDocument(value interface{}) (primitive.M, error) {
+    if value == nil {
+        return primitive.M{}, nil
+    }
+
+    raw, err := bson.Marshal(value)
+    if err != nil {
+        return nil, err
+    }
+
+    var doc primitive.M
+    if err := bson.Unmarshal(raw, &doc); err != nil {
+        return nil, err
+    }
+
+    return doc, nil
+}
+
+// Get value identified by path (e.g. "sensor.value") from document
+func getPath(doc primitive.M, path string) (interface{}, bool) {
+    var current interface{} = doc
+
+    for _, part := range strings.Split(path, ".") {
+        switch v := current.(type) {
+        case primitive.M:
+            value, ok := v[part]
+            if !ok {
+                return nil, false
+            }
+            current = value
+        case primitive.A:
+            index, err := strconv.Atoi(part)
+            if err != nil || index < 0 || index >= len(v) {
+                return nil, false
+            }
+            current = v[index]
+        default:
+            return nil, false
+        }
+    }
+
+    return current, true
+}
+
+// Set value identified by path, missing nested documents are created
+func setPath(doc primitive.M, path string, value interface{}) error {
+    parts := strings.Split(path, ".")
+    current := doc
+
+    for _, part := range parts[:len(parts) - 1] {
+        next, ok := current[part]
+        if !ok || next == nil {
+            nested := primitive.M{}
+            current[part] = nested
+            current = nested
+            continue
+        }
+        nested, ok := next.(primitive.M)
+        if !ok {
+            return fmt.Errorf("Cannot set path %s, attribute %s is not a document", path, part)
+        }
+        current = nested
+    }
+
+    current[parts[len(parts) - 1]] = value
+
+    return nil
+}
+
+func toFloat(value interface{}) (float64, bool) {
+    switch v := value.(type) {
+    case int32:
+        return float64(v), true
+    case int64:
+        return float64(v), true
+    case float64:
+        return v, true
+    }
+    return 0, false
+}
+
+// Compare two values of compatible types, second return value is false
+// if values cannot be compared
+func compareValues(a, b interface{}) (int, bool) {
+    if fa, ok := toFloat(a); ok {
+        fb, ok := toFloat(b)
+        if !ok {
+            return 0, false
+        }
+        switch {
+        case fa < fb:
+            return -1, true
+        case fa > fb:
+            return 1, true
+        }
+        return 0, true
+    }
+
+    switch va := a.(type) {
+    case string:
+        if vb, ok := b.(string); ok {
+            return strings.Compare(va, vb), true
+        }
+    case bool:
+        if vb, ok := b.(bool); ok {
+            switch {
+            case va == vb:
+                return 0, true
+            case !va:
+                return -1, true
+            }
+            return 1, true
+        }
+    case primitive.ObjectID:
+        if vb, ok := b.(primitive.ObjectID); ok {
+            return bytes.Compare(va[:], vb[:]), true
+        }
+    }
+
+    return 0, false
+}
+
+// order of types used for sorting of values with different types
+func sortTypeOrder(value interface{}, exists bool) int {
+    if !exists || value == nil {
+        return 0
+    }
+    if _, ok := toFloat(value); ok {
+        return 1
+    }
+    switch value.(type) {
+    case string:
+        return 2
+    case primitive.ObjectID:
+        return 3
+    case bool:
+        return 4
+    }
+    return 5
+}
+
+func sortCompare(a interface{}, aExists bool, b interface{}, bExists bool) int {
+    ta := sortTypeOrder(a, aExists)
+    tb := sortTypeOrder(b, bExists)
+    if ta != tb {
+        return ta - tb
+    }
+
+    cmp, _ := compareValues(a, b)
+    return cmp
+}
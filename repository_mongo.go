@@ -0,0 +1,404 @@
+package piot
+
+import (
+    "context"
+    "regexp"
+    "strings"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "github.com/mnezerka/go-piot/config"
+    "github.com/mnezerka/go-piot/model"
+)
+
+// Create repositories stored in MongoDB database, orgs and things are cached
+// unless RepositoryCacheTtl parameter is 0
+func NewMongoRepositories(db *mongo.Database, params *config.Parameters) *Repositories {
+    repos := &Repositories{
+        Things: &mongoThingRepository{c: db.Collection("things")},
+        Orgs: &mongoOrgRepository{c: db.Collection("orgs")},
+        Users: &mongoUserRepository{c: db.Collection("users")},
+        OrgUsers: &mongoOrgUserRepository{c: db.Collection("orgusers")},
+    }
+
+    if params.RepositoryCacheTtl > 0 {
+        return NewCachedRepositories(repos, params.RepositoryCacheTtl)
+    }
+
+    return repos
+}
+
+///////////////////////////////////////// helpers
+
+func mongoFindOne(c *mongo.Collection, filter bson.M, result interface{}) (error) {
+    err := c.FindOne(context.TODO(), filter).Decode(result)
+    if err == mongo.ErrNoDocuments {
+        return ErrNotFound
+    }
+    return err
+}
+
+func mongoFindOptions(opts *FindOptions) *options.FindOptions {
+    findOptions := options.Find()
+    if opts != nil {
+        if opts.Sort != "" {
+            if strings.HasPrefix(opts.Sort, "-") {
+                findOptions.SetSort(bson.D{{Key: strings.TrimPrefix(opts.Sort, "-"), Value: -1}})
+            } else {
+                findOptions.SetSort(bson.D{{Key: opts.Sort, Value: 1}})
+            }
+        }
+        if opts.Skip > 0 {
+            findOptions.SetSkip(opts.Skip)
+        }
+        if opts.Limit > 0 {
+            findOptions.SetLimit(opts.Limit)
+        }
+    }
+    return findOptions
+}
+
+func mongoInsert(c *mongo.Collection, document interface{}) (primitive.ObjectID, error) {
+    res, err := c.InsertOne(context.TODO(), document)
+    if isDuplicateKeyError(err) {
+        return primitive.NilObjectID, ErrDuplicate
+    }
+    if err != nil {
+        return primitive.NilObjectID, err
+    }
+
+    id, _ := res.InsertedID.(primitive.ObjectID)
+    return id, nil
+}
+
+func isDuplicateKeyError(err error) bool {
+    if e, ok := err.(mongo.WriteException); ok {
+        for _, we := range e.WriteErrors {
+            if we.Code == 11000 {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+func mongoUpdate(c *mongo.Collection, filter bson.M, update bson.M) (error) {
+    _, err := c.UpdateOne(context.TODO(), filter, update)
+    return err
+}
+
+func mongoDelete(c *mongo.Collection, filter bson.M) (error) {
+    _, err := c.DeleteMany(context.TODO(), filter)
+    return err
+}
+
+///////////////////////////////////////// things
+
+type mongoThingRepository struct {
+    c *mongo.Collection
+}
+
+func (r *mongoThingRepository) Get(id primitive.ObjectID) (*model.Thing, error) {
+    return r.findOne(bson.M{"_id": id})
+}
+
+func (r *mongoThingRepository) GetByName(name string) (*model.Thing, error) {
+    return r.findOne(bson.M{"name": name})
+}
+
+func (r *mongoThingRepository) GetByPiotId(piotId string) (*model.Thing, error) {
+    return r.findOne(bson.M{"piot_id": piotId})
+}
+
+func (r *mongoThingRepository) findOne(filter bson.M) (*model.Thing, error) {
+    var thing model.Thing
+    if err := mongoFindOne(r.c, filter, &thing); err != nil {
+        return nil, err
+    }
+    return &thing, nil
+}
+
+func (r *mongoThingRepository) Find(filter *ThingFilter, opts *FindOptions) ([]*model.Thing, error) {
+    cur, err := r.c.Find(context.TODO(), getThingQuery(filter), mongoFindOptions(opts))
+    if err != nil {
+        return nil, err
+    }
+    defer cur.Close(context.TODO())
+
+    var result []*model.Thing
+    for cur.Next(context.TODO()) {
+        thing := model.Thing{}
+        if err := cur.Decode(&thing); err != nil {
+            return nil, err
+        }
+        result = append(result, &thing)
+    }
+
+    return result, cur.Err()
+}
+
+func (r *mongoThingRepository) Count(filter *ThingFilter) (int64, error) {
+    return r.c.CountDocuments(context.TODO(), getThingQuery(filter))
+}
+
+func (r *mongoThingRepository) Insert(thing *model.Thing) (primitive.ObjectID, error) {
+    return mongoInsert(r.c, thing)
+}
+
+func (r *mongoThingRepository) SetFields(id primitive.ObjectID, fields map[string]interface{}) (error) {
+    return mongoUpdate(r.c, bson.M{"_id": id}, bson.M{"$set": fields})
+}
+
+func (r *mongoThingRepository) SetAvailable(id primitive.ObjectID, available bool, ts int32) (bool, error) {
+    res, err := r.c.UpdateOne(
+        context.TODO(),
+        bson.M{"_id": id, "available": bson.M{"$ne": available}},
+        bson.M{"$set": bson.M{"available": available, "available_changed": ts}},
+    )
+    if err != nil {
+        return false, err
+    }
+    return res.ModifiedCount > 0, nil
+}
+
+func (r *mongoThingRepository) SetLocation(id primitive.ObjectID, lat, lng float64, sat, ts int32) (error) {
+    return mongoUpdate(
+        r.c,
+        bson.M{
+            "_id": id,
+            "$or": bson.A{
+                bson.M{"loc_ts": bson.M{"$exists": false}},
+                bson.M{"loc_ts": bson.M{"$lte": ts}},
+            },
+        },
+        bson.M{"$set": bson.M{"loc_lat": lat, "loc_lng": lng, "loc_sat": sat, "loc_ts": ts}},
+    )
+}
+
+func (r *mongoThingRepository) ConfirmSwitchState(id primitive.ObjectID, state bool) (error) {
+    return mongoUpdate(
+        r.c,
+        bson.M{
+            "_id": id,
+            "switch.sync_status": bson.M{"$in": bson.A{model.SWITCH_SYNC_PENDING, model.SWITCH_SYNC_OUT_OF_SYNC}},
+            "switch.desired_state": state,
+        },
+        bson.M{"$set": bson.M{"switch.sync_status": model.SWITCH_SYNC_IN_SYNC, "switch.sync_retries": 0}},
+    )
+}
+
+func (r *mongoThingRepository) IncSwitchSyncRetries(id primitive.ObjectID, ts int32) (error) {
+    return mongoUpdate(
+        r.c,
+        bson.M{"_id": id},
+        bson.M{"$set": bson.M{"switch.desired_ts": ts}, "$inc": bson.M{"switch.sync_retries": 1}},
+    )
+}
+
+func (r *mongoThingRepository) ReplaceParent(parentId, newParentId primitive.ObjectID) (error) {
+    _, err := r.c.UpdateMany(context.TODO(), bson.M{"parent_id": parentId}, bson.M{"$set": bson.M{"parent_id": newParentId}})
+    return err
+}
+
+func (r *mongoThingRepository) Delete(id primitive.ObjectID) (error) {
+    return mongoDelete(r.c, bson.M{"_id": id})
+}
+
+func (r *mongoThingRepository) DeleteAll() (error) {
+    return mongoDelete(r.c, bson.M{})
+}
+
+// Convert filter to MongoDB query
+func getThingQuery(filter *ThingFilter) bson.M {
+    query := bson.M{}
+    if filter == nil {
+        return query
+    }
+
+    var and bson.A
+
+    if filter.OrgIds != nil {
+        and = append(and, bson.M{"org_id": bson.M{"$in": filter.OrgIds}})
+    }
+    if filter.Assigned {
+        and = append(and, bson.M{"org_id": bson.M{"$ne": primitive.NilObjectID}})
+    }
+    if filter.ParentId != nil {
+        query["parent_id"] = *filter.ParentId
+    }
+    if filter.Type != "" {
+        query["type"] = filter.Type
+    }
+    if filter.Available != nil {
+        query["available"] = *filter.Available
+    }
+    if filter.HasLastSeenInterval {
+        query["last_seen_interval"] = bson.M{"$gt": 0}
+    }
+    if filter.HasValidity {
+        query["sensor.validity"] = bson.M{"$gt": 0}
+    }
+    if filter.Stale != nil {
+        if *filter.Stale {
+            query["sensor.stale"] = true
+        } else {
+            query["sensor.stale"] = bson.M{"$ne": true}
+        }
+    }
+    if filter.SyncStatus != "" {
+        query["switch.sync_status"] = filter.SyncStatus
+    }
+    if filter.Query != "" {
+        regex := bson.M{"$regex": regexp.QuoteMeta(filter.Query), "$options": "i"}
+        query["$or"] = bson.A{
+            bson.M{"name": regex},
+            bson.M{"alias": regex},
+            bson.M{"description": regex},
+        }
+    }
+
+    if len(and) > 0 {
+        query["$and"] = and
+    }
+
+    return query
+}
+
+///////////////////////////////////////// orgs
+
+type mongoOrgRepository struct {
+    c *mongo.Collection
+}
+
+func (r *mongoOrgRepository) Get(id primitive.ObjectID) (*model.Org, error) {
+    return r.findOne(bson.M{"_id": id})
+}
+
+func (r *mongoOrgRepository) GetByName(name string) (*model.Org, error) {
+    return r.findOne(bson.M{"name": name})
+}
+
+func (r *mongoOrgRepository) findOne(filter bson.M) (*model.Org, error) {
+    var org model.Org
+    if err := mongoFindOne(r.c, filter, &org); err != nil {
+        return nil, err
+    }
+    return &org, nil
+}
+
+func (r *mongoOrgRepository) Insert(org *model.Org) (primitive.ObjectID, error) {
+    return mongoInsert(r.c, org)
+}
+
+func (r *mongoOrgRepository) SetFields(id primitive.ObjectID, fields map[string]interface{}) (error) {
+    return mongoUpdate(r.c, bson.M{"_id": id}, bson.M{"$set": fields})
+}
+
+func (r *mongoOrgRepository) Delete(id primitive.ObjectID) (error) {
+    return mongoDelete(r.c, bson.M{"_id": id})
+}
+
+func (r *mongoOrgRepository) DeleteAll() (error) {
+    return mongoDelete(r.c, bson.M{})
+}
+
+///////////////////////////////////////// users
+
+type mongoUserRepository struct {
+    c *mongo.Collection
+}
+
+func (r *mongoUserRepository) Get(id primitive.ObjectID) (*model.User, error) {
+    return r.findOne(bson.M{"_id": id})
+}
+
+func (r *mongoUserRepository) GetByEmail(email string) (*model.User, error) {
+    return r.findOne(bson.M{"email": email})
+}
+
+func (r *mongoUserRepository) findOne(filter bson.M) (*model.User, error) {
+    var user model.User
+    if err := mongoFindOne(r.c, filter, &user); err != nil {
+        return nil, err
+    }
+    return &user, nil
+}
+
+func (r *mongoUserRepository) Insert(user *model.User) (primitive.ObjectID, error) {
+    return mongoInsert(r.c, user)
+}
+
+func (r *mongoUserRepository) SetFields(id primitive.ObjectID, fields map[string]interface{}) (error) {
+    return mongoUpdate(r.c, bson.M{"_id": id}, bson.M{"$set": fields})
+}
+
+func (r *mongoUserRepository) Delete(id primitive.ObjectID) (error) {
+    return mongoDelete(r.c, bson.M{"_id": id})
+}
+
+func (r *mongoUserRepository) DeleteAll() (error) {
+    return mongoDelete(r.c, bson.M{})
+}
+
+///////////////////////////////////////// org users
+
+type mongoOrgUserRepository struct {
+    c *mongo.Collection
+}
+
+func (r *mongoOrgUserRepository) Get(orgId, userId primitive.ObjectID) (*model.OrgUser, error) {
+    var orgUser model.OrgUser
+    if err := mongoFindOne(r.c, bson.M{"org_id": orgId, "user_id": userId}, &orgUser); err != nil {
+        return nil, err
+    }
+    return &orgUser, nil
+}
+
+func (r *mongoOrgUserRepository) FindByOrg(orgId primitive.ObjectID) ([]*model.OrgUser, error) {
+    return r.find(bson.M{"org_id": orgId}, &FindOptions{Sort: "created"})
+}
+
+func (r *mongoOrgUserRepository) FindByUser(userId primitive.ObjectID) ([]*model.OrgUser, error) {
+    return r.find(bson.M{"user_id": userId}, nil)
+}
+
+func (r *mongoOrgUserRepository) find(filter bson.M, opts *FindOptions) ([]*model.OrgUser, error) {
+    cur, err := r.c.Find(context.TODO(), filter, mongoFindOptions(opts))
+    if err != nil {
+        return nil, err
+    }
+    defer cur.Close(context.TODO())
+
+    var result []*model.OrgUser
+    for cur.Next(context.TODO()) {
+        orgUser := model.OrgUser{}
+        if err := cur.Decode(&orgUser); err != nil {
+            return nil, err
+        }
+        result = append(result, &orgUser)
+    }
+
+    return result, cur.Err()
+}
+
+func (r *mongoOrgUserRepository) CountByRole(orgId primitive.ObjectID, role string) (int64, error) {
+    return r.c.CountDocuments(context.TODO(), bson.M{"org_id": orgId, "role": role})
+}
+
+func (r *mongoOrgUserRepository) Insert(orgUser *model.OrgUser) (error) {
+    _, err := r.c.InsertOne(context.TODO(), orgUser)
+    return err
+}
+
+func (r *mongoOrgUserRepository) SetRole(orgId, userId primitive.ObjectID, role string) (error) {
+    return mongoUpdate(r.c, bson.M{"org_id": orgId, "user_id": userId}, bson.M{"$set": bson.M{"role": role}})
+}
+
+func (r *mongoOrgUserRepository) Delete(orgId, userId primitive.ObjectID) (error) {
+    return mongoDelete(r.c, bson.M{"org_id": orgId, "user_id": userId})
+}
+
+func (r *mongoOrgUserRepository) DeleteAll() (error) {
+    return mongoDelete(r.c, bson.M{})
+}
@@ -0,0 +1,173 @@
+package piot_test
+
+import (
+    "testing"
+    "github.com/mnezerka/go-piot"
+    "github.com/mnezerka/go-piot/model"
+    "github.com/mnezerka/go-piot/test"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMemoryRepositoryFilters(t *testing.T) {
+    repo := piot.NewMemoryRepositories().Things
+
+    orgId := primitive.NewObjectID()
+    id1, err := repo.Insert(&model.Thing{Name: "a", Type: "sensor", LastSeen: 10, OrgId: orgId, Alias: "Alpha"})
+    test.Ok(t, err)
+    _, err = repo.Insert(&model.Thing{Name: "b", Type: "sensor", LastSeen: 20, ParentId: id1})
+    test.Ok(t, err)
+    _, err = repo.Insert(&model.Thing{Name: "c", Type: "device", LastSeen: 30, Available: true, LastSeenInterval: 10})
+    test.Ok(t, err)
+
+    thing, err := repo.Get(id1)
+    test.Ok(t, err)
+    test.Equals(t, "a", thing.Name)
+
+    _, err = repo.Get(primitive.NewObjectID())
+    test.Equals(t, piot.ErrNotFound, err)
+
+    thing, err = repo.GetByName("b")
+    test.Ok(t, err)
+    test.Equals(t, id1, thing.ParentId)
+
+    count := func(filter *piot.ThingFilter) int64 {
+        c, err := repo.Count(filter)
+        test.Ok(t, err)
+        return c
+    }
+
+    yes := true
+    no := false
+
+    test.Equals(t, int64(3), count(nil))
+    test.Equals(t, int64(3), count(&piot.ThingFilter{}))
+    test.Equals(t, int64(2), count(&piot.ThingFilter{Type: "sensor"}))
+    test.Equals(t, int64(1), count(&piot.ThingFilter{OrgIds: []primitive.ObjectID{orgId}}))
+    test.Equals(t, int64(0), count(&piot.ThingFilter{OrgIds: []primitive.ObjectID{}}))
+    test.Equals(t, int64(1), count(&piot.ThingFilter{Assigned: true}))
+    test.Equals(t, int64(1), count(&piot.ThingFilter{ParentId: &id1}))
+    test.Equals(t, int64(2), count(&piot.ThingFilter{Available: &no}))
+    test.Equals(t, int64(1), count(&piot.ThingFilter{Available: &yes, HasLastSeenInterval: true}))
+    test.Equals(t, int64(1), count(&piot.ThingFilter{Query: "ALP"}))
+    test.Equals(t, int64(0), count(&piot.ThingFilter{Query: "a", Type: "device"}))
+    test.Equals(t, int64(3), count(&piot.ThingFilter{Stale: &no}))
+}
+
+func TestMemoryRepositoryUpdates(t *testing.T) {
+    repo := piot.NewMemoryRepositories().Things
+
+    id, err := repo.Insert(&model.Thing{Name: "a"})
+    test.Ok(t, err)
+
+    // duplicate ids are rejected
+    _, err = repo.Insert(&model.Thing{Id: id, Name: "b"})
+    test.Equals(t, piot.ErrDuplicate, err)
+
+    // nested attributes
+    test.Ok(t, repo.SetFields(id, map[string]interface{}{"sensor.value": "23", "sinks": []string{"mysqldb"}}))
+
+    changed, err := repo.SetAvailable(id, true, 10)
+    test.Ok(t, err)
+    test.Equals(t, true, changed)
+    changed, err = repo.SetAvailable(id, true, 20)
+    test.Ok(t, err)
+    test.Equals(t, false, changed)
+
+    test.Ok(t, repo.IncSwitchSyncRetries(id, 30))
+    test.Ok(t, repo.IncSwitchSyncRetries(id, 40))
+
+    // older location is ignored
+    test.Ok(t, repo.SetLocation(id, 1, 2, 3, 50))
+    test.Ok(t, repo.SetLocation(id, 4, 5, 6, 40))
+
+    thing, err := repo.Get(id)
+    test.Ok(t, err)
+    test.Equals(t, "23", thing.Sensor.Value)
+    test.Equals(t, []string{"mysqldb"}, thing.Sinks)
+    test.Equals(t, true, thing.Available)
+    test.Equals(t, int32(10), thing.AvailableChanged)
+    test.Equals(t, int32(2), thing.Switch.SyncRetries)
+    test.Equals(t, int32(40), thing.Switch.DesiredTs)
+    test.Equals(t, float64(1), thing.LocationLatitude)
+    test.Equals(t, int32(50), thing.LocationTs)
+
+    // returned records are copies
+    thing.Sinks[0] = "influxdb"
+    thing, err = repo.Get(id)
+    test.Ok(t, err)
+    test.Equals(t, []string{"mysqldb"}, thing.Sinks)
+
+    test.Ok(t, repo.Delete(id))
+    _, err = repo.Get(id)
+    test.Equals(t, piot.ErrNotFound, err)
+}
+
+func TestMemoryRepositorySwitchState(t *testing.T) {
+    repo := piot.NewMemoryRepositories().Things
+
+    id, err := repo.Insert(&model.Thing{Name: "a", Switch: model.SwitchData{
+        DesiredState: true,
+        SyncStatus: model.SWITCH_SYNC_PENDING,
+        SyncRetries: 2,
+    }})
+    test.Ok(t, err)
+
+    // state not matching desired state
+    test.Ok(t, repo.ConfirmSwitchState(id, false))
+    thing, err := repo.Get(id)
+    test.Ok(t, err)
+    test.Equals(t, model.SWITCH_SYNC_PENDING, thing.Switch.SyncStatus)
+
+    test.Ok(t, repo.ConfirmSwitchState(id, true))
+    thing, err = repo.Get(id)
+    test.Ok(t, err)
+    test.Equals(t, model.SWITCH_SYNC_IN_SYNC, thing.Switch.SyncStatus)
+    test.Equals(t, int32(0), thing.Switch.SyncRetries)
+}
+
+func TestMemoryRepositoryFindOptions(t *testing.T) {
+    repo := piot.NewMemoryRepositories().Things
+
+    for _, name := range []string{"c", "a", "d", "b"} {
+        _, err := repo.Insert(&model.Thing{Name: name})
+        test.Ok(t, err)
+    }
+
+    things, err := repo.Find(nil, &piot.FindOptions{Sort: "name", Skip: 1, Limit: 2})
+    test.Ok(t, err)
+    test.Equals(t, 2, len(things))
+    test.Equals(t, "b", things[0].Name)
+    test.Equals(t, "c", things[1].Name)
+
+    things, err = repo.Find(nil, &piot.FindOptions{Sort: "-name"})
+    test.Ok(t, err)
+    test.Equals(t, 4, len(things))
+    test.Equals(t, "d", things[0].Name)
+}
+
+func TestMemoryRepositoryOrgUsers(t *testing.T) {
+    repo := piot.NewMemoryRepositories().OrgUsers
+
+    orgId := primitive.NewObjectID()
+    userId1 := primitive.NewObjectID()
+    userId2 := primitive.NewObjectID()
+    test.Ok(t, repo.Insert(&model.OrgUser{OrgId: orgId, UserId: userId2, Created: 2, Role: model.ORG_ROLE_OWNER}))
+    test.Ok(t, repo.Insert(&model.OrgUser{OrgId: orgId, UserId: userId1, Created: 1, Role: model.ORG_ROLE_OWNER}))
+
+    members, err := repo.FindByOrg(orgId)
+    test.Ok(t, err)
+    test.Equals(t, 2, len(members))
+    test.Equals(t, userId1, members[0].UserId)
+
+    test.Ok(t, repo.SetRole(orgId, userId2, model.ORG_ROLE_VIEWER))
+    count, err := repo.CountByRole(orgId, model.ORG_ROLE_OWNER)
+    test.Ok(t, err)
+    test.Equals(t, int64(1), count)
+
+    test.Ok(t, repo.Delete(orgId, userId1))
+    _, err = repo.Get(orgId, userId1)
+    test.Equals(t, piot.ErrNotFound, err)
+    member, err := repo.Get(orgId, userId2)
+    test.Ok(t, err)
+    test.Equals(t, model.ORG_ROLE_VIEWER, member.Role)
+}
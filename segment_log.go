@@ -0,0 +1,367 @@
+package piot
+
+import (
+    "bufio"
+    "bytes"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "github.com/op/go-logging"
+)
+
+const segmentLogExt = ".log"
+const segmentLogAckFile = "ack"
+
+// Append-only log of records stored in segment files in a directory. Each
+// record gets sequence number and is stored as single line "<seq> <data>".
+// Records are replayed in order and acknowledged one by one, segments
+// with all records acknowledged are deleted
+type segmentLog struct {
+    log *logging.Logger
+    dir string
+
+    // maximal size of segment, new segment is started when reached
+    segmentSize int64
+
+    // protects writing
+    mutex sync.Mutex
+
+    // serializes replays
+    replayMutex sync.Mutex
+
+    writeFile *os.File
+    writeName string
+    writeSize int64
+    nextSeq uint64
+
+    // last acknowledged record
+    ackSeq uint64
+
+    // position of next record to be replayed
+    readName string
+    readOffset int64
+}
+
+func openSegmentLog(log *logging.Logger, dir string, segmentSize int64) (*segmentLog, error) {
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return nil, err
+    }
+
+    l := &segmentLog{log: log, dir: dir, segmentSize: segmentSize}
+
+    ack, err := ioutil.ReadFile(filepath.Join(dir, segmentLogAckFile))
+    if err != nil && !os.IsNotExist(err) {
+        return nil, err
+    }
+    if err == nil {
+        l.ackSeq, err = strconv.ParseUint(strings.TrimSpace(string(ack)), 10, 64)
+        if err != nil {
+            return nil, fmt.Errorf("Invalid acknowledgement file in %s (%v)", dir, err)
+        }
+    }
+    l.nextSeq = l.ackSeq + 1
+
+    segments, err := l.getSegments()
+    if err != nil {
+        return nil, err
+    }
+
+    if len(segments) > 0 {
+        l.readName = segments[0]
+
+        // continue in last segment
+        last := segments[len(segments) - 1]
+        lastSeq, size, err := l.repairSegment(last)
+        if err != nil {
+            return nil, err
+        }
+        if lastSeq >= l.nextSeq {
+            l.nextSeq = lastSeq + 1
+        }
+
+        l.writeFile, err = os.OpenFile(filepath.Join(dir, last), os.O_WRONLY | os.O_APPEND, 0644)
+        if err != nil {
+            return nil, err
+        }
+        l.writeName = last
+        l.writeSize = size
+    }
+
+    return l, nil
+}
+
+// Append record to the log, record is synced to disk before returning
+func (l *segmentLog) Append(data []byte) (uint64, error) {
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+
+    if l.writeFile == nil || l.writeSize >= l.segmentSize {
+        if err := l.rotate(); err != nil {
+            return 0, err
+        }
+    }
+
+    seq := l.nextSeq
+    line := append([]byte(strconv.FormatUint(seq, 10) + " "), data...)
+    line = append(line, '\n')
+
+    n, err := l.writeFile.Write(line)
+    l.writeSize += int64(n)
+    if err != nil {
+        return 0, err
+    }
+    if err := l.writeFile.Sync(); err != nil {
+        return 0, err
+    }
+
+    l.nextSeq++
+
+    return seq, nil
+}
+
+// Replay records which were not acknowledged yet. Each record is
+// acknowledged when handler succeeds, replay stops on first failure and
+// the record is replayed again next time
+func (l *segmentLog) Replay(handler func(data []byte) error) (int, error) {
+    l.replayMutex.Lock()
+    defer l.replayMutex.Unlock()
+
+    replayed := 0
+
+    for {
+        l.mutex.Lock()
+        readName := l.readName
+        if readName == "" {
+            readName = l.writeName
+        }
+        writeName := l.writeName
+        l.mutex.Unlock()
+
+        if readName == "" {
+            return replayed, nil
+        }
+
+        count, err := l.replaySegment(readName, handler)
+        replayed += count
+        if err != nil {
+            return replayed, err
+        }
+
+        // segment being written can get new records
+        if readName == writeName {
+            return replayed, nil
+        }
+
+        // all records of segment were acknowledged
+        next, err := l.getNextSegment(readName)
+        if err != nil {
+            return replayed, err
+        }
+        if err := os.Remove(filepath.Join(l.dir, readName)); err != nil {
+            l.log.Warningf("Segment %s cannot be removed (%v)", readName, err)
+        }
+
+        l.mutex.Lock()
+        l.readName = next
+        l.readOffset = 0
+        l.mutex.Unlock()
+    }
+}
+
+// Get number of records waiting for acknowledgement
+func (l *segmentLog) Pending() uint64 {
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+    return l.nextSeq - l.ackSeq - 1
+}
+
+func (l *segmentLog) Close() {
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+
+    if l.writeFile != nil {
+        l.writeFile.Close()
+        l.writeFile = nil
+    }
+}
+
+func (l *segmentLog) replaySegment(name string, handler func(data []byte) error) (int, error) {
+    f, err := os.Open(filepath.Join(l.dir, name))
+    if err != nil {
+        return 0, err
+    }
+    defer f.Close()
+
+    l.mutex.Lock()
+    offset := l.readOffset
+    l.mutex.Unlock()
+
+    if _, err := f.Seek(offset, io.SeekStart); err != nil {
+        return 0, err
+    }
+
+    replayed := 0
+    reader := bufio.NewReader(f)
+
+    for {
+        line, err := reader.ReadBytes('\n')
+        if err == io.EOF {
+            // incomplete line is record being written
+            return replayed, nil
+        }
+        if err != nil {
+            return replayed, err
+        }
+
+        seq, data, err := parseSegmentLogLine(line)
+        if err != nil {
+            return replayed, fmt.Errorf("Corrupted segment %s at offset %d (%v)", name, offset, err)
+        }
+
+        if seq > l.ackSeq {
+            if err := handler(data); err != nil {
+                return replayed, err
+            }
+            if err := l.ack(seq); err != nil {
+                return replayed, err
+            }
+            replayed++
+        }
+
+        offset += int64(len(line))
+        l.mutex.Lock()
+        l.readOffset = offset
+        l.mutex.Unlock()
+    }
+}
+
+// Store sequence number of last acknowledged record, file is replaced
+// atomically
+func (l *segmentLog) ack(seq uint64) (error) {
+    tmp := filepath.Join(l.dir, segmentLogAckFile + ".tmp")
+    if err := ioutil.WriteFile(tmp, []byte(strconv.FormatUint(seq, 10)), 0644); err != nil {
+        return err
+    }
+    if err := os.Rename(tmp, filepath.Join(l.dir, segmentLogAckFile)); err != nil {
+        return err
+    }
+
+    l.mutex.Lock()
+    l.ackSeq = seq
+    l.mutex.Unlock()
+
+    return nil
+}
+
+// Start new segment named by sequence number of its first record
+func (l *segmentLog) rotate() (error) {
+    if l.writeFile != nil {
+        l.writeFile.Close()
+        l.writeFile = nil
+    }
+
+    name := fmt.Sprintf("%020d%s", l.nextSeq, segmentLogExt)
+    f, err := os.OpenFile(filepath.Join(l.dir, name), os.O_WRONLY | os.O_CREATE | os.O_APPEND, 0644)
+    if err != nil {
+        return err
+    }
+
+    l.log.Debugf("Starting segment %s in %s", name, l.dir)
+
+    l.writeFile = f
+    l.writeName = name
+    l.writeSize = 0
+    if l.readName == "" {
+        l.readName = name
+        l.readOffset = 0
+    }
+
+    return nil
+}
+
+// Remove incomplete record written before crash, sequence number of last
+// record and size of the segment are returned
+func (l *segmentLog) repairSegment(name string) (uint64, int64, error) {
+    path := filepath.Join(l.dir, name)
+
+    content, err := ioutil.ReadFile(path)
+    if err != nil {
+        return 0, 0, err
+    }
+
+    end := bytes.LastIndexByte(content, '\n') + 1
+    if end < len(content) {
+        l.log.Warningf("Removing incomplete record at the end of segment %s", name)
+        if err := os.Truncate(path, int64(end)); err != nil {
+            return 0, 0, err
+        }
+        content = content[:end]
+    }
+
+    var lastSeq uint64
+    if end > 0 {
+        start := bytes.LastIndexByte(content[:end - 1], '\n') + 1
+        lastSeq, _, err = parseSegmentLogLine(content[start:end])
+        if err != nil {
+            return 0, 0, fmt.Errorf("Corrupted segment %s (%v)", name, err)
+        }
+    }
+
+    return lastSeq, int64(end), nil
+}
+
+func (l *segmentLog) getSegments() ([]string, error) {
+    files, err := ioutil.ReadDir(l.dir)
+    if err != nil {
+        return nil, err
+    }
+
+    var result []string
+    for _, file := range files {
+        if !file.IsDir() && strings.HasSuffix(file.Name(), segmentLogExt) {
+            result = append(result, file.Name())
+        }
+    }
+
+    // names are zero padded sequence numbers
+    sort.Strings(result)
+
+    return result, nil
+}
+
+func (l *segmentLog) getNextSegment(name string) (string, error) {
+    segments, err := l.getSegments()
+    if err != nil {
+        return "", err
+    }
+
+    for _, segment := range segments {
+        if segment > name {
+            return segment, nil
+        }
+    }
+
+    return "", nil
+}
+
+func parseSegmentLogLine(line []byte) (uint64, []byte, error) {
+    line = bytes.TrimSuffix(line, []byte("\n"))
+
+    sep := bytes.IndexByte(line, ' ')
+    if sep < 0 {
+        return 0, nil, fmt.Errorf("Missing sequence number")
+    }
+
+    seq, err := strconv.ParseUint(string(line[:sep]), 10, 64)
+    if err != nil {
+        return 0, nil, err
+    }
+
+    return seq, line[sep + 1:], nil
+}
@@ -0,0 +1,181 @@
+package piot
+
+import (
+    "sync"
+    "time"
+    "github.com/op/go-logging"
+    "github.com/mnezerka/go-piot/model"
+)
+
+// Storage of data received from things. Error is returned only if data could
+// not be stored due to issue that could be temporary (e.g. unavailable
+// server), data not supported by the sink are ignored
+type Sink interface {
+    StoreMeasurement(thing *model.Thing, value string, ts time.Time) error
+    StoreSwitchState(thing *model.Thing, value string, ts time.Time) error
+    StoreLocation(thing *model.Thing, lat, lng float64, sat, ts int32) error
+    StoreTelemetry(thing *model.Thing, telemetry string, ts time.Time) error
+}
+
+// Registry of named sinks, data of each thing are stored to sinks enabled
+// for the thing (see model.Thing.GetSinks)
+type Sinks struct {
+    log *logging.Logger
+    mutex sync.RWMutex
+    sinks map[string]Sink
+    names []string
+}
+
+func NewSinks(log *logging.Logger) *Sinks {
+    return &Sinks{log: log, sinks: make(map[string]Sink)}
+}
+
+// Register sink under given name, sink registered under same name before
+// is replaced
+func (s *Sinks) Register(name string, sink Sink) {
+    s.log.Infof("Registering sink %s", name)
+
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    if _, ok := s.sinks[name]; !ok {
+        s.names = append(s.names, name)
+    }
+    s.sinks[name] = sink
+}
+
+// Get sink registered under given name
+func (s *Sinks) Get(name string) (Sink, bool) {
+    s.mutex.RLock()
+    defer s.mutex.RUnlock()
+
+    sink, ok := s.sinks[name]
+    return sink, ok
+}
+
+// Get names of registered sinks in order of registration
+func (s *Sinks) Names() []string {
+    s.mutex.RLock()
+    defer s.mutex.RUnlock()
+
+    return append([]string(nil), s.names...)
+}
+
+func (s *Sinks) StoreMeasurement(thing *model.Thing, value string, ts time.Time) error {
+    return s.store(thing, thing.GetSinks(), func(sink Sink) error {
+        return sink.StoreMeasurement(thing, value, ts)
+    })
+}
+
+func (s *Sinks) StoreSwitchState(thing *model.Thing, value string, ts time.Time) error {
+    return s.store(thing, thing.GetSinks(), func(sink Sink) error {
+        return sink.StoreSwitchState(thing, value, ts)
+    })
+}
+
+func (s *Sinks) StoreLocation(thing *model.Thing, lat, lng float64, sat, ts int32) error {
+    return s.store(thing, thing.GetLocationSinks(), func(sink Sink) error {
+        return sink.StoreLocation(thing, lat, lng, sat, ts)
+    })
+}
+
+func (s *Sinks) StoreTelemetry(thing *model.Thing, telemetry string, ts time.Time) error {
+    return s.store(thing, thing.GetSinks(), func(sink Sink) error {
+        return sink.StoreTelemetry(thing, telemetry, ts)
+    })
+}
+
+// Store data to all given sinks, failure of one sink doesn't prevent storing
+// to other sinks, first error is returned
+func (s *Sinks) store(thing *model.Thing, names []string, store func(sink Sink) error) error {
+    var result error
+
+    for _, name := range names {
+        sink, ok := s.Get(name)
+        if !ok {
+            s.log.Warningf("Thing %s refers to unknown sink %s", thing.Name, name)
+            continue
+        }
+
+        if err := store(sink); err != nil {
+            s.log.Errorf("Storing data of thing %s to sink %s failed (%v)", thing.Name, name, err)
+            if result == nil {
+                result = err
+            }
+        }
+    }
+
+    return result
+}
+
+///////////////////////////////////////// adapters of built-in storages
+
+type influxDbSink struct {
+    db IInfluxDb
+}
+
+// InfluxDB sink providing history of values
+type influxDbHistorySink struct {
+    influxDbSink
+    HistorySource
+}
+
+// Create sink storing data to InfluxDB, telemetry is not stored. Sink
+// provides history if storage implements HistorySource
+func NewInfluxDbSink(db IInfluxDb) Sink {
+    if source, ok := db.(HistorySource); ok {
+        return &influxDbHistorySink{influxDbSink{db: db}, source}
+    }
+    return &influxDbSink{db: db}
+}
+
+func (s *influxDbSink) StoreMeasurement(thing *model.Thing, value string, ts time.Time) error {
+    return s.db.PostMeasurement(thing, value, ts)
+}
+
+func (s *influxDbSink) StoreSwitchState(thing *model.Thing, value string, ts time.Time) error {
+    return s.db.PostSwitchState(thing, value, ts)
+}
+
+func (s *influxDbSink) StoreLocation(thing *model.Thing, lat, lng float64, sat, ts int32) error {
+    return s.db.PostLocation(thing, lat, lng, sat, ts)
+}
+
+func (s *influxDbSink) StoreTelemetry(thing *model.Thing, telemetry string, ts time.Time) error {
+    return nil
+}
+
+type mysqlDbSink struct {
+    db IMysqlDb
+}
+
+// MySQL sink providing history of values
+type mysqlDbHistorySink struct {
+    mysqlDbSink
+    HistorySource
+}
+
+// Create sink storing data to MySQL, sink provides history if storage
+// implements HistorySource
+func NewMysqlDbSink(db IMysqlDb) Sink {
+    if source, ok := db.(HistorySource); ok {
+        return &mysqlDbHistorySink{mysqlDbSink{db: db}, source}
+    }
+    return &mysqlDbSink{db: db}
+}
+
+func (s *mysqlDbSink) StoreMeasurement(thing *model.Thing, value string, ts time.Time) error {
+    return s.db.StoreMeasurement(thing, value, ts)
+}
+
+func (s *mysqlDbSink) StoreSwitchState(thing *model.Thing, value string, ts time.Time) error {
+    return s.db.StoreSwitchState(thing, value, ts)
+}
+
+func (s *mysqlDbSink) StoreLocation(thing *model.Thing, lat, lng float64, sat, ts int32) error {
+    return s.db.StoreLocation(thing, lat, lng, sat, ts)
+}
+
+func (s *mysqlDbSink) StoreTelemetry(thing *model.Thing, telemetry string, ts time.Time) error {
+    return s.db.StoreTelemetry(thing, telemetry, ts)
+}
@@ -0,0 +1,83 @@
+package piot_test
+
+import (
+    "errors"
+    "testing"
+    "time"
+    "github.com/mnezerka/go-piot"
+    "github.com/mnezerka/go-piot/model"
+    "github.com/mnezerka/go-piot/test"
+)
+
+func TestThingGetSinks(t *testing.T) {
+    thing := model.Thing{}
+    test.Equals(t, 0, len(thing.GetSinks()))
+
+    // deprecated flags are mapped to built-in sinks
+    thing.StoreInfluxDb = true
+    thing.StoreMysqlDb = true
+    test.Equals(t, []string{model.SINK_INFLUXDB, model.SINK_MYSQLDB}, thing.GetSinks())
+
+    // no duplicates
+    thing.Sinks = []string{"custom", model.SINK_MYSQLDB}
+    test.Equals(t, []string{"custom", model.SINK_MYSQLDB, model.SINK_INFLUXDB}, thing.GetSinks())
+}
+
+func TestSinksRegistry(t *testing.T) {
+    log := test.GetLogger(t)
+    influxDb := test.GetInfluxDb(t, log)
+    mysqlDb := test.GetMysqlDb(t, log)
+
+    sinks := piot.NewSinks(log)
+    sinks.Register(model.SINK_INFLUXDB, piot.NewInfluxDbSink(influxDb))
+    sinks.Register(model.SINK_MYSQLDB, piot.NewMysqlDbSink(mysqlDb))
+
+    // registration under existing name replaces sink
+    sinks.Register(model.SINK_INFLUXDB, piot.NewInfluxDbSink(influxDb))
+
+    test.Equals(t, []string{model.SINK_INFLUXDB, model.SINK_MYSQLDB}, sinks.Names())
+
+    _, ok := sinks.Get(model.SINK_MYSQLDB)
+    test.Assert(t, ok, "Sink not registered")
+
+    _, ok = sinks.Get("xxx")
+    test.Assert(t, !ok, "Unknown sink found")
+}
+
+func TestSinksStore(t *testing.T) {
+    log := test.GetLogger(t)
+    influxDb := test.GetInfluxDb(t, log)
+    mysqlDb := test.GetMysqlDb(t, log)
+    sinks := test.GetSinks(t, log, influxDb, mysqlDb)
+    now := time.Now()
+
+    // data are stored to sinks enabled for the thing only, unknown sink is
+    // ignored
+    thing := &model.Thing{Name: "thing", Sinks: []string{model.SINK_MYSQLDB, "xxx"}}
+    test.Ok(t, sinks.StoreMeasurement(thing, "23", now))
+    test.Ok(t, sinks.StoreSwitchState(thing, "1", now))
+    test.Equals(t, 0, len(influxDb.Calls))
+    test.Equals(t, 2, len(mysqlDb.Calls))
+    test.Equals(t, "23", mysqlDb.Calls[0].Value)
+    test.Equals(t, now, mysqlDb.Calls[0].Time)
+
+    test.Ok(t, sinks.StoreTelemetry(thing, "telemetry", now))
+    test.Equals(t, 3, len(mysqlDb.Calls))
+    test.Equals(t, "telemetry", mysqlDb.Calls[2].Value)
+
+    // locations are stored to configured sinks only
+    test.Ok(t, sinks.StoreLocation(thing, 1.1, 2.2, 3, 4))
+    test.Equals(t, 4, len(mysqlDb.Calls))
+    test.Equals(t, 0, len(influxDb.Calls))
+
+    // locations of things without configured sinks are stored to influxdb
+    // for backward compatibility
+    test.Ok(t, sinks.StoreLocation(&model.Thing{Name: "legacy"}, 1.1, 2.2, 3, 4))
+    test.Equals(t, 1, len(influxDb.Calls))
+
+    // failure of one sink doesn't prevent storing to other sinks
+    thing.Sinks = []string{model.SINK_INFLUXDB, model.SINK_MYSQLDB}
+    influxDb.Err = errors.New("Influx down")
+    test.Equals(t, influxDb.Err, sinks.StoreMeasurement(thing, "24", now))
+    test.Equals(t, 5, len(mysqlDb.Calls))
+}
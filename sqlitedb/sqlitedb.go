@@ -0,0 +1,321 @@
+// Storage of thing values in local SQLite file. The package is separate
+// from piot, since SQLite driver requires cgo, applications not using
+// SQLite don't need it
+package sqlitedb
+
+import (
+    "fmt"
+    "strconv"
+    "time"
+    "database/sql"
+    "github.com/op/go-logging"
+    "github.com/mnezerka/go-piot"
+    "github.com/mnezerka/go-piot/model"
+    _"github.com/mattn/go-sqlite3"
+)
+
+// Storage of thing values in local SQLite file, intended for single node
+// deployments (e.g. gateways) without database server. Storage is used as
+// sink (see model.SINK_SQLITEDB), telemetry is not stored
+type ISqliteDb interface {
+    piot.Sink
+    Open() error
+    Close()
+
+    // Remove values older than retention period, periodically after Start
+    Prune(now time.Time) (int64, error)
+    Start(interval time.Duration)
+    Stop()
+
+    // Get history of thing values in time range <from, to)
+    piot.HistorySource
+    GetLocations(thing *model.Thing, from, to time.Time) ([]model.HistoryLocation, error)
+}
+
+// Schema of the database, new migrations are appended to the end of the list
+var sqliteDbMigrations = []piot.SqlMigration{
+    {
+        Version: 1,
+        Description: "tables for sensor measurements, switch states and locations",
+        Statements: []string{
+            // primary keys make INSERT OR IGNORE skip values of the same
+            // thing within single storage interval (see Thing.GetSinkInterval)
+            "CREATE TABLE IF NOT EXISTS piot_sensors (" +
+                "id TEXT NOT NULL, " +
+                "org TEXT NOT NULL, " +
+                "class TEXT NOT NULL DEFAULT '', " +
+                "value REAL NOT NULL, " +
+                "time INTEGER NOT NULL, " +
+                "PRIMARY KEY (id, time))",
+            "CREATE INDEX IF NOT EXISTS piot_sensors_time ON piot_sensors (time)",
+            "CREATE TABLE IF NOT EXISTS piot_switches (" +
+                "id TEXT NOT NULL, " +
+                "org TEXT NOT NULL, " +
+                "value INTEGER NOT NULL, " +
+                "time INTEGER NOT NULL, " +
+                "PRIMARY KEY (id, time))",
+            "CREATE INDEX IF NOT EXISTS piot_switches_time ON piot_switches (time)",
+            "CREATE TABLE IF NOT EXISTS piot_locations (" +
+                "id TEXT NOT NULL, " +
+                "org TEXT NOT NULL, " +
+                "lat REAL NOT NULL, " +
+                "lng REAL NOT NULL, " +
+                "sat INTEGER NOT NULL DEFAULT 0, " +
+                "time INTEGER NOT NULL, " +
+                "PRIMARY KEY (id, time))",
+            "CREATE INDEX IF NOT EXISTS piot_locations_time ON piot_locations (time)",
+        },
+    },
+}
+
+// tables pruned according to retention period
+var sqliteDbTables = []string{"piot_sensors", "piot_switches", "piot_locations"}
+
+type SqliteDb struct {
+    log *logging.Logger
+    Path string
+
+    // values older than retention are removed by Prune, 0 means values
+    // are kept forever
+    Retention time.Duration
+
+    Db *sql.DB
+    quit chan bool
+}
+
+func NewSqliteDb(log *logging.Logger, path string, retention time.Duration) ISqliteDb {
+    db := &SqliteDb{log: log}
+    db.Path = path
+    db.Retention = retention
+
+    return db
+}
+
+func (db *SqliteDb) Open() error {
+    db.log.Infof("Opening sqlite database %s", db.Path)
+
+    if db.Path == "" {
+        db.log.Warningf("Refusing to open sqlite database, path not specified")
+        return nil
+    }
+
+    d, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_busy_timeout=5000&_journal_mode=WAL", db.Path))
+    if err != nil {
+        return err
+    }
+
+    // sqlite allows single writer only
+    d.SetMaxOpenConns(1)
+
+    // Open doesn't open a file. Validate path:
+    err = d.Ping()
+    if err != nil {
+        d.Close()
+        return err
+    }
+
+    // create or upgrade schema
+    version, err := piot.MigrateSqlDb(db.log, d, sqliteDbMigrations)
+    if err != nil {
+        d.Close()
+        return err
+    }
+    db.Db = d
+
+    db.log.Infof("Opened sqlite database (schema version %d)", version)
+
+    return nil
+}
+
+func (db *SqliteDb) Close() {
+    db.Stop()
+
+    if db.Db != nil {
+        db.Db.Close()
+        db.Db = nil
+    }
+}
+
+// Start periodic pruning of old values
+func (db *SqliteDb) Start(interval time.Duration) {
+    db.log.Infof("Starting sqlite database pruning with interval %v (retention %v)", interval, db.Retention)
+
+    db.quit = make(chan bool)
+    ticker := time.NewTicker(interval)
+
+    go func(quit chan bool) {
+        for {
+            select {
+            case <-ticker.C:
+                db.Prune(time.Now())
+            case <-quit:
+                ticker.Stop()
+                return
+            }
+        }
+    }(db.quit)
+}
+
+// Stop periodic pruning
+func (db *SqliteDb) Stop() {
+    if db.quit != nil {
+        db.log.Infof("Stopping sqlite database pruning")
+        close(db.quit)
+        db.quit = nil
+    }
+}
+
+func (db *SqliteDb) Prune(now time.Time) (int64, error) {
+    if db.Db == nil || db.Retention <= 0 {
+        return 0, nil
+    }
+
+    before := now.Add(-db.Retention).Unix()
+
+    var pruned int64
+    for _, table := range sqliteDbTables {
+        result, err := db.Db.Exec("DELETE FROM " + table + " WHERE time < ?", before)
+        if err != nil {
+            db.log.Errorf("Pruning of sqlite table %s failed (%v)", table, err)
+            return pruned, err
+        }
+        count, err := result.RowsAffected()
+        if err == nil {
+            pruned += count
+        }
+    }
+
+    if pruned > 0 {
+        db.log.Debugf("Pruned %d values older than %v from sqlite database", pruned, time.Unix(before, 0))
+    }
+
+    return pruned, nil
+}
+
+func (db *SqliteDb) getTimestamp(thing *model.Thing, at time.Time) int64 {
+    // alter timestamp to match low boundary of configured interval
+    return piot.GetIntervalStart(at, thing.GetSinkInterval(model.SINK_SQLITEDB)).Unix()
+}
+
+func (db *SqliteDb) exec(query string, args ...interface{}) (error) {
+    if db.Db == nil {
+        db.log.Warningf("Sqlite database is not initialized")
+        return nil
+    }
+
+    _, err := db.Db.Exec(query, args...)
+
+    // Failure when trying to store data
+    if err != nil {
+        db.log.Errorf("Sqlite database operation failed: %s", err.Error())
+        return err
+    }
+
+    return nil
+}
+
+func (db *SqliteDb) StoreMeasurement(thing *model.Thing, value string, at time.Time) error {
+    db.log.Debugf("Storing measurement to sqlite db, thing: %s, val: %s", thing.Name, value)
+
+    // convert value to float
+    valueFloat, err := strconv.ParseFloat(value, 64)
+    if err != nil {
+        db.log.Errorf("Sqlite database storage - float conversion error for value %s", value)
+        return nil
+    }
+
+    query := "INSERT OR IGNORE INTO piot_sensors (id, org, class, value, time) VALUES (?, ?, ?, ?, ?)"
+
+    return db.exec(query, thing.Id.Hex(), thing.OrgId.Hex(), thing.Sensor.Class, valueFloat, db.getTimestamp(thing, at))
+}
+
+func (db *SqliteDb) StoreSwitchState(thing *model.Thing, value string, at time.Time) error {
+    db.log.Debugf("Storing switch state to sqlite db, thing: %s, val: %s", thing.Name, value)
+
+    if thing.Type != model.THING_TYPE_SWITCH {
+        // ignore things which don't represent switch
+        return nil
+    }
+
+    // convert value to int
+    valueInt, err := strconv.Atoi(value)
+    if err != nil {
+        db.log.Errorf("Sqlite database storage - int conversion error for value %s", value)
+        return nil
+    }
+
+    query := "INSERT OR IGNORE INTO piot_switches (id, org, value, time) VALUES (?, ?, ?, ?)"
+
+    return db.exec(query, thing.Id.Hex(), thing.OrgId.Hex(), valueInt, db.getTimestamp(thing, at))
+}
+
+func (db *SqliteDb) StoreLocation(thing *model.Thing, lat, lng float64, sat, ts int32) error {
+    db.log.Debugf("Storing location to sqlite db, thing: %s, val: %f %f", thing.Name, lat, lng)
+
+    query := "INSERT OR IGNORE INTO piot_locations (id, org, lat, lng, sat, time) VALUES (?, ?, ?, ?, ?, ?)"
+
+    // location carries its own timestamp
+    return db.exec(query, thing.Id.Hex(), thing.OrgId.Hex(), lat, lng, sat, db.getTimestamp(thing, time.Unix(int64(ts), 0)))
+}
+
+func (db *SqliteDb) StoreTelemetry(thing *model.Thing, telemetry string, at time.Time) error {
+    return nil
+}
+
+func (db *SqliteDb) GetSensorValues(thing *model.Thing, from, to time.Time) ([]model.HistoryValue, error) {
+    return db.getValues("piot_sensors", thing, from, to)
+}
+
+func (db *SqliteDb) GetSwitchStates(thing *model.Thing, from, to time.Time) ([]model.HistoryValue, error) {
+    return db.getValues("piot_switches", thing, from, to)
+}
+
+func (db *SqliteDb) GetLocations(thing *model.Thing, from, to time.Time) ([]model.HistoryLocation, error) {
+    if db.Db == nil {
+        return nil, fmt.Errorf("Sqlite database is not initialized")
+    }
+
+    query := "SELECT time, lat, lng, sat FROM piot_locations WHERE id = ? AND time >= ? AND time < ? ORDER BY time"
+
+    rows, err := db.Db.Query(query, thing.Id.Hex(), from.Unix(), to.Unix())
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    result := []model.HistoryLocation{}
+    for rows.Next() {
+        var location model.HistoryLocation
+        if err := rows.Scan(&location.Time, &location.Lat, &location.Lng, &location.Sat); err != nil {
+            return nil, err
+        }
+        result = append(result, location)
+    }
+
+    return result, rows.Err()
+}
+
+func (db *SqliteDb) getValues(table string, thing *model.Thing, from, to time.Time) ([]model.HistoryValue, error) {
+    if db.Db == nil {
+        return nil, fmt.Errorf("Sqlite database is not initialized")
+    }
+
+    query := "SELECT time, value FROM " + table + " WHERE id = ? AND time >= ? AND time < ? ORDER BY time"
+
+    rows, err := db.Db.Query(query, thing.Id.Hex(), from.Unix(), to.Unix())
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    result := []model.HistoryValue{}
+    for rows.Next() {
+        var value model.HistoryValue
+        if err := rows.Scan(&value.Time, &value.Value); err != nil {
+            return nil, err
+        }
+        result = append(result, value)
+    }
+
+    return result, rows.Err()
+}
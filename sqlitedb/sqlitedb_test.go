@@ -0,0 +1,90 @@
+package sqlitedb_test
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+    "github.com/mnezerka/go-piot/model"
+    "github.com/mnezerka/go-piot/sqlitedb"
+    "github.com/mnezerka/go-piot/test"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func getSqliteDb(t *testing.T, retention time.Duration) (sqlitedb.ISqliteDb, string) {
+    dir, err := ioutil.TempDir("", "piot-sqlite")
+    test.Ok(t, err)
+
+    db := sqlitedb.NewSqliteDb(test.GetLogger(t), filepath.Join(dir, "piot.db"), retention)
+    test.Ok(t, db.Open())
+
+    return db, dir
+}
+
+func TestSqliteDbStore(t *testing.T) {
+    db, dir := getSqliteDb(t, 0)
+    defer os.RemoveAll(dir)
+    defer db.Close()
+
+    sensor := &model.Thing{Id: primitive.NewObjectID(), Name: "sensor", Type: model.THING_TYPE_SENSOR}
+    sensor.SinkIntervals = map[string]int32{model.SINK_SQLITEDB: 60}
+    sw := &model.Thing{Id: primitive.NewObjectID(), Name: "switch", Type: model.THING_TYPE_SWITCH}
+
+    // second value in the same interval is ignored
+    test.Ok(t, db.StoreMeasurement(sensor, "23.5", time.Unix(1010, 0)))
+    test.Ok(t, db.StoreMeasurement(sensor, "24", time.Unix(1019, 0)))
+    test.Ok(t, db.StoreMeasurement(sensor, "25", time.Unix(1090, 0)))
+
+    // invalid value is ignored
+    test.Ok(t, db.StoreMeasurement(sensor, "xxx", time.Unix(2000, 0)))
+
+    values, err := db.GetSensorValues(sensor, time.Unix(0, 0), time.Unix(3000, 0))
+    test.Ok(t, err)
+    test.Equals(t, []model.HistoryValue{{Time: 960, Value: 23.5}, {Time: 1080, Value: 25}}, values)
+
+    // range is closed on the left, open on the right
+    values, err = db.GetSensorValues(sensor, time.Unix(1080, 0), time.Unix(3000, 0))
+    test.Ok(t, err)
+    test.Equals(t, 1, len(values))
+    values, err = db.GetSensorValues(sensor, time.Unix(0, 0), time.Unix(1080, 0))
+    test.Ok(t, err)
+    test.Equals(t, 1, len(values))
+
+    // switch states are stored for switches only
+    test.Ok(t, db.StoreSwitchState(sw, "1", time.Unix(1000, 0)))
+    test.Ok(t, db.StoreSwitchState(sensor, "1", time.Unix(1000, 0)))
+    values, err = db.GetSwitchStates(sw, time.Unix(0, 0), time.Unix(3000, 0))
+    test.Ok(t, err)
+    test.Equals(t, []model.HistoryValue{{Time: 1000, Value: 1}}, values)
+    values, err = db.GetSwitchStates(sensor, time.Unix(0, 0), time.Unix(3000, 0))
+    test.Ok(t, err)
+    test.Equals(t, 0, len(values))
+
+    test.Ok(t, db.StoreLocation(sw, 1.5, 2.5, 4, 1500))
+    locations, err := db.GetLocations(sw, time.Unix(0, 0), time.Unix(3000, 0))
+    test.Ok(t, err)
+    test.Equals(t, []model.HistoryLocation{{Time: 1500, Lat: 1.5, Lng: 2.5, Sat: 4}}, locations)
+}
+
+func TestSqliteDbPrune(t *testing.T) {
+    db, dir := getSqliteDb(t, time.Hour)
+    defer os.RemoveAll(dir)
+    defer db.Close()
+
+    sensor := &model.Thing{Id: primitive.NewObjectID(), Name: "sensor", Type: model.THING_TYPE_SENSOR}
+    now := time.Unix(100000, 0)
+
+    test.Ok(t, db.StoreMeasurement(sensor, "1", now.Add(-2 * time.Hour)))
+    test.Ok(t, db.StoreMeasurement(sensor, "2", now.Add(-30 * time.Minute)))
+    test.Ok(t, db.StoreLocation(sensor, 1, 2, 3, int32(now.Add(-2 * time.Hour).Unix())))
+
+    pruned, err := db.Prune(now)
+    test.Ok(t, err)
+    test.Equals(t, int64(2), pruned)
+
+    values, err := db.GetSensorValues(sensor, time.Unix(0, 0), now)
+    test.Ok(t, err)
+    test.Equals(t, 1, len(values))
+    test.Equals(t, float64(2), values[0].Value)
+}
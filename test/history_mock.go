@@ -0,0 +1,61 @@
+package test
+
+import (
+    "strconv"
+    "time"
+    "github.com/op/go-logging"
+    "github.com/mnezerka/go-piot/model"
+)
+
+// Sink keeping values in memory, implements piot.Sink and piot.HistorySource
+type HistorySinkMock struct {
+    Log *logging.Logger
+    Sensors map[string][]model.HistoryValue
+    Switches map[string][]model.HistoryValue
+}
+
+func (s *HistorySinkMock) StoreMeasurement(thing *model.Thing, value string, ts time.Time) error {
+    s.Log.Debugf("History sink mock - store measurement, thing: %s, val: %s", thing.Name, value)
+    return s.store(s.Sensors, thing, value, ts)
+}
+
+func (s *HistorySinkMock) StoreSwitchState(thing *model.Thing, value string, ts time.Time) error {
+    s.Log.Debugf("History sink mock - store switch state, thing: %s, val: %s", thing.Name, value)
+    return s.store(s.Switches, thing, value, ts)
+}
+
+func (s *HistorySinkMock) StoreLocation(thing *model.Thing, lat, lng float64, sat, ts int32) error {
+    return nil
+}
+
+func (s *HistorySinkMock) StoreTelemetry(thing *model.Thing, telemetry string, ts time.Time) error {
+    return nil
+}
+
+func (s *HistorySinkMock) GetSensorValues(thing *model.Thing, from, to time.Time) ([]model.HistoryValue, error) {
+    return s.get(s.Sensors, thing, from, to), nil
+}
+
+func (s *HistorySinkMock) GetSwitchStates(thing *model.Thing, from, to time.Time) ([]model.HistoryValue, error) {
+    return s.get(s.Switches, thing, from, to), nil
+}
+
+// values are expected to be stored in order of time
+func (s *HistorySinkMock) store(values map[string][]model.HistoryValue, thing *model.Thing, value string, ts time.Time) error {
+    v, err := strconv.ParseFloat(value, 64)
+    if err != nil {
+        return nil
+    }
+    values[thing.Id.Hex()] = append(values[thing.Id.Hex()], model.HistoryValue{Time: int32(ts.Unix()), Value: v})
+    return nil
+}
+
+func (s *HistorySinkMock) get(values map[string][]model.HistoryValue, thing *model.Thing, from, to time.Time) []model.HistoryValue {
+    result := []model.HistoryValue{}
+    for _, value := range values[thing.Id.Hex()] {
+        if int64(value.Time) >= from.Unix() && int64(value.Time) < to.Unix() {
+            result = append(result, value)
+        }
+    }
+    return result
+}
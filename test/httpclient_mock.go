@@ -9,16 +9,56 @@ type httpClientMockCall struct {
     Body string
     Username *string
     Password *string
+    Headers map[string]string
+    Method string
 }
 
 // implements IMqtt interface
 type HttpClientMock struct {
     Log *logging.Logger
     Calls []httpClientMockCall
+
+    // status code and error returned by all calls, 0 means 204
+    StatusCode int
+    Err error
+
+    // body of response to queries
+    Response string
+}
+
+func (c *HttpClientMock) PostString(url, body string, username *string, password *string) (int, error) {
+
+    c.Log.Debugf("Mock Http Client - POST to %s", url)
+    c.Calls = append(c.Calls, httpClientMockCall{url, body, username, password, nil, "POST"})
+    return c.response()
 }
 
-func (c *HttpClientMock) PostString(url, body string, username *string, password *string) {
+func (c *HttpClientMock) PostStringWithHeaders(url, body string, headers map[string]string) (int, error) {
 
     c.Log.Debugf("Mock Http Client - POST to %s", url)
-    c.Calls = append(c.Calls, httpClientMockCall{url, body, username, password})
+    c.Calls = append(c.Calls, httpClientMockCall{url, body, nil, nil, headers, "POST"})
+    return c.response()
+}
+
+func (c *HttpClientMock) Query(method, url, body string, headers map[string]string) (int, []byte, error) {
+
+    c.Log.Debugf("Mock Http Client - %s query to %s", method, url)
+    c.Calls = append(c.Calls, httpClientMockCall{url, body, nil, nil, headers, method})
+    if c.Err != nil {
+        return 0, nil, c.Err
+    }
+    if c.StatusCode == 0 {
+        return 200, []byte(c.Response), nil
+    }
+    return c.StatusCode, []byte(c.Response), nil
+}
+
+func (c *HttpClientMock) response() (int, error) {
+    if c.Err != nil {
+        return 0, c.Err
+    }
+    if c.StatusCode == 0 {
+        return 204, nil
+    }
+    return c.StatusCode, nil
 }
@@ -2,6 +2,7 @@ package test
 
 import (
     "fmt"
+    "time"
     "github.com/op/go-logging"
     "github.com/mnezerka/go-piot/model"
 )
@@ -9,25 +10,41 @@ import (
 type influxDbMockCall struct {
     Thing *model.Thing
     Value string
+    Time time.Time
 }
 
 // implements IMqtt interface
 type InfluxDbMock struct {
     Log *logging.Logger
     Calls []influxDbMockCall
+
+    // error returned by all calls (e.g. to simulate outage)
+    Err error
 }
 
-func (db *InfluxDbMock) PostMeasurement(thing *model.Thing, value string) {
+func (db *InfluxDbMock) PostMeasurement(thing *model.Thing, value string, ts time.Time) error {
     db.Log.Debugf("Influxdb - post measurement, thing: %s, val: %s", thing.Name, value)
-    db.Calls = append(db.Calls, influxDbMockCall{thing, value})
+    if db.Err != nil {
+        return db.Err
+    }
+    db.Calls = append(db.Calls, influxDbMockCall{thing, value, ts})
+    return nil
 }
 
-func (db *InfluxDbMock) PostSwitchState(thing *model.Thing, value string) {
+func (db *InfluxDbMock) PostSwitchState(thing *model.Thing, value string, ts time.Time) error {
     db.Log.Debugf("Influxdb - post switch state, thing: %s, val: %s", thing.Name, value)
-    db.Calls = append(db.Calls, influxDbMockCall{thing, value})
+    if db.Err != nil {
+        return db.Err
+    }
+    db.Calls = append(db.Calls, influxDbMockCall{thing, value, ts})
+    return nil
 }
 
-func (db *InfluxDbMock) PostLocation(thing *model.Thing, lat, lng float64, sat, ts int32) {
+func (db *InfluxDbMock) PostLocation(thing *model.Thing, lat, lng float64, sat, ts int32) error {
     db.Log.Debugf("Influxdb - post location, thing: %s, val: %f %f %d %d", thing.Name, lat, lng, sat, ts)
-    db.Calls = append(db.Calls, influxDbMockCall{thing, fmt.Sprintf("lat:%f-lng:%f-sat:%d-ts:%d", lat, lng, sat, ts)})
+    if db.Err != nil {
+        return db.Err
+    }
+    db.Calls = append(db.Calls, influxDbMockCall{thing, fmt.Sprintf("lat:%f-lng:%f-sat:%d-ts:%d", lat, lng, sat, ts), time.Unix(int64(ts), 0)})
+    return nil
 }
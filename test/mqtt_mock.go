@@ -2,7 +2,9 @@ package test
 
 import (
     "github.com/op/go-logging"
+    "github.com/mnezerka/go-piot"
     "github.com/mnezerka/go-piot/model"
+    "go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type call struct {
@@ -25,6 +27,9 @@ func (t *MqttMock) Disconnect() error {
     return nil
 }
 
+func (t *MqttMock) StartWorkers() {
+}
+
 func (t *MqttMock) SetUsername(username string) {
 }
 
@@ -34,6 +39,9 @@ func (t *MqttMock) SetPassword(password string) {
 func (t *MqttMock) SetClient(id string) {
 }
 
+func (t *MqttMock) SetOptions(options *piot.MqttOptions) {
+}
+
 func (t *MqttMock) PushThingData(thing *model.Thing, topic, value string) (error) {
     t.Log.Debugf("Push thing data: %s, topic: %s, value: %s", thing.Name, topic, value)
     t.Calls = append(t.Calls, call{topic, value, thing})
@@ -41,6 +49,10 @@ func (t *MqttMock) PushThingData(thing *model.Thing, topic, value string) (error
     return nil
 }
 
-func (t *MqttMock) ProcessMessage(topic, payload string) {
+func (t *MqttMock) ProcessMessage(ctx *piot.AuthContext, topic, payload string) {
 }
 
+func (t *MqttMock) SetSwitch(ctx *piot.AuthContext, thingId primitive.ObjectID, on bool) error {
+    t.Log.Debugf("Set switch: %s, value: %v", thingId.Hex(), on)
+    return nil
+}
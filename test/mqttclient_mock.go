@@ -0,0 +1,119 @@
+package test
+
+import (
+    "time"
+    "github.com/op/go-logging"
+    mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+type mqttClientMockCall struct {
+    Topic string
+    Qos byte
+    Retained bool
+    Payload string
+}
+
+// token returned by all client mock operations, it is complete unless it
+// simulates timeout
+type mqttTokenMock struct {
+    timeout bool
+    err error
+}
+
+func (t *mqttTokenMock) Wait() bool {
+    return true
+}
+
+func (t *mqttTokenMock) WaitTimeout(time.Duration) bool {
+    return !t.timeout
+}
+
+func (t *mqttTokenMock) Error() error {
+    return t.err
+}
+
+// implements mqtt.Message interface (paho)
+type mqttMessageMock struct {
+    topic string
+    payload string
+}
+
+func (m *mqttMessageMock) Duplicate() bool { return false }
+func (m *mqttMessageMock) Qos() byte { return 0 }
+func (m *mqttMessageMock) Retained() bool { return false }
+func (m *mqttMessageMock) Topic() string { return m.topic }
+func (m *mqttMessageMock) MessageID() uint16 { return 0 }
+func (m *mqttMessageMock) Payload() []byte { return []byte(m.payload) }
+func (m *mqttMessageMock) Ack() {}
+
+// implements mqtt.Client interface (paho)
+type MqttClientMock struct {
+    Log *logging.Logger
+    Calls []mqttClientMockCall
+    Subscriptions []string
+    Unsubscriptions []string
+
+    // result of publishing, messages are recorded anyway
+    PublishTimeout bool
+    PublishErr error
+
+    // callbacks of active subscriptions
+    handlers map[string]mqtt.MessageHandler
+}
+
+func (c *MqttClientMock) IsConnected() bool {
+    return true
+}
+
+func (c *MqttClientMock) IsConnectionOpen() bool {
+    return true
+}
+
+func (c *MqttClientMock) Connect() mqtt.Token {
+    return &mqttTokenMock{}
+}
+
+func (c *MqttClientMock) Disconnect(quiesce uint) {
+}
+
+func (c *MqttClientMock) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+    c.Log.Debugf("Mqtt client mock - publish to %s", topic)
+    c.Calls = append(c.Calls, mqttClientMockCall{topic, qos, retained, payload.(string)})
+    return &mqttTokenMock{timeout: c.PublishTimeout, err: c.PublishErr}
+}
+
+func (c *MqttClientMock) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+    c.Subscriptions = append(c.Subscriptions, topic)
+    if c.handlers == nil {
+        c.handlers = make(map[string]mqtt.MessageHandler)
+    }
+    c.handlers[topic] = callback
+    return &mqttTokenMock{}
+}
+
+func (c *MqttClientMock) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+    return &mqttTokenMock{}
+}
+
+func (c *MqttClientMock) Unsubscribe(topics ...string) mqtt.Token {
+    c.Unsubscriptions = append(c.Unsubscriptions, topics...)
+    for _, topic := range topics {
+        delete(c.handlers, topic)
+    }
+    return &mqttTokenMock{}
+}
+
+// Deliver message to callbacks of all active subscriptions, topic filters
+// are not matched
+func (c *MqttClientMock) Deliver(topic, payload string) {
+    for _, callback := range c.handlers {
+        callback(c, &mqttMessageMock{topic, payload})
+    }
+}
+
+func (c *MqttClientMock) AddRoute(topic string, callback mqtt.MessageHandler) {
+}
+
+func (c *MqttClientMock) OptionsReader() mqtt.ClientOptionsReader {
+    return mqtt.ClientOptionsReader{}
+}
@@ -1,6 +1,8 @@
 package test
 
 import (
+    "fmt"
+    "time"
     "github.com/op/go-logging"
     "github.com/mnezerka/go-piot/model"
 )
@@ -8,12 +10,16 @@ import (
 type mysqlDbMockCall struct {
     Thing *model.Thing
     Value string
+    Time time.Time
 }
 
 // implements IMysqlDb interface
 type MysqlDbMock struct {
     Log *logging.Logger
     Calls []mysqlDbMockCall
+
+    // error returned by all calls (e.g. to simulate outage)
+    Err error
 }
 
 func (db *MysqlDbMock) Open() error {
@@ -23,12 +29,38 @@ func (db *MysqlDbMock) Open() error {
 func (db *MysqlDbMock) Close() {
 }
 
-func (db *MysqlDbMock) StoreMeasurement(thing *model.Thing, value string) {
+func (db *MysqlDbMock) StoreMeasurement(thing *model.Thing, value string, ts time.Time) error {
     db.Log.Debugf("Mysqldb mock - store measurement, thing: %s, val: %s", thing.Name, value)
-    db.Calls = append(db.Calls, mysqlDbMockCall{thing, value})
+    if db.Err != nil {
+        return db.Err
+    }
+    db.Calls = append(db.Calls, mysqlDbMockCall{thing, value, ts})
+    return nil
 }
 
-func (db *MysqlDbMock) StoreSwitchState(thing *model.Thing, value string) {
+func (db *MysqlDbMock) StoreSwitchState(thing *model.Thing, value string, ts time.Time) error {
     db.Log.Debugf("Mysqldb mock - store switch state, thing: %s, val: %s", thing.Name, value)
-    db.Calls = append(db.Calls, mysqlDbMockCall{thing, value})
+    if db.Err != nil {
+        return db.Err
+    }
+    db.Calls = append(db.Calls, mysqlDbMockCall{thing, value, ts})
+    return nil
+}
+
+func (db *MysqlDbMock) StoreLocation(thing *model.Thing, lat, lng float64, sat, ts int32) error {
+    db.Log.Debugf("Mysqldb mock - store location, thing: %s, val: %f %f %d %d", thing.Name, lat, lng, sat, ts)
+    if db.Err != nil {
+        return db.Err
+    }
+    db.Calls = append(db.Calls, mysqlDbMockCall{thing, fmt.Sprintf("lat:%f-lng:%f-sat:%d-ts:%d", lat, lng, sat, ts), time.Unix(int64(ts), 0)})
+    return nil
+}
+
+func (db *MysqlDbMock) StoreTelemetry(thing *model.Thing, telemetry string, ts time.Time) error {
+    db.Log.Debugf("Mysqldb mock - store telemetry, thing: %s, val: %s", thing.Name, telemetry)
+    if db.Err != nil {
+        return db.Err
+    }
+    db.Calls = append(db.Calls, mysqlDbMockCall{thing, telemetry, ts})
+    return nil
 }
@@ -0,0 +1,228 @@
+package test
+
+import (
+    "database/sql"
+    "database/sql/driver"
+    "errors"
+    "fmt"
+    "io"
+    "regexp"
+    "strings"
+    "sync"
+    "testing"
+)
+
+// name of sql driver registered by this package
+const SQL_DRIVER_MOCK = "piot-mock"
+
+// In-memory database understanding statements used for schema versioning by
+// piot.MigrateSqlDb, all other statements are just recorded, so migrations
+// can be tested without database server or cgo drivers. Indexes of tables
+// created or altered by statements are tracked, so they can be looked up in
+// information_schema (MySQL)
+type SqlDbMock struct {
+    mutex sync.Mutex
+
+    // executed statements other than schema versioning
+    Statements []string
+
+    // statements containing this string fail
+    FailOn string
+
+    // names of indexes by table, primary key is named PRIMARY, tables can
+    // be added by tests to simulate existing database
+    Tables map[string][]string
+
+    versions []int64
+}
+
+var sqlCreateTableRe = regexp.MustCompile("^CREATE TABLE (?:IF NOT EXISTS )?`?(\\w+)`? \\(")
+var sqlAlterTableRe = regexp.MustCompile("^ALTER TABLE `?(\\w+)`? ")
+var sqlIndexRe = regexp.MustCompile("INDEX `?(\\w+)`? \\(")
+var sqlIndexQueryRe = regexp.MustCompile("^SELECT COUNT\\(\\*\\) FROM information_schema.STATISTICS WHERE .*TABLE_NAME = '(\\w+)' AND INDEX_NAME = '(\\w+)'$")
+
+var sqlDbMocksMutex sync.Mutex
+var sqlDbMocks = make(map[string]*SqlDbMock)
+
+func init() {
+    sql.Register(SQL_DRIVER_MOCK, &sqlDriverMock{})
+}
+
+// Get database backed by new mock
+func GetSqlDb(t *testing.T) (*sql.DB, *SqlDbMock) {
+    mock := &SqlDbMock{}
+
+    sqlDbMocksMutex.Lock()
+    name := fmt.Sprintf("db%d", len(sqlDbMocks))
+    sqlDbMocks[name] = mock
+    sqlDbMocksMutex.Unlock()
+
+    db, err := sql.Open(SQL_DRIVER_MOCK, name)
+    Ok(t, err)
+
+    return db, mock
+}
+
+func (m *SqlDbMock) exec(query string) (error) {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+
+    if m.FailOn != "" && strings.Contains(query, m.FailOn) {
+        return fmt.Errorf("Syntax error in statement: %s", query)
+    }
+
+    if strings.HasPrefix(query, "CREATE TABLE IF NOT EXISTS piot_schema_version ") {
+        return nil
+    }
+
+    if strings.HasPrefix(query, "INSERT INTO piot_schema_version ") {
+        var version, appliedAt int64
+        if _, err := fmt.Sscanf(query, "INSERT INTO piot_schema_version (version, applied_at) VALUES (%d, %d)", &version, &appliedAt); err != nil {
+            return err
+        }
+        for _, v := range m.versions {
+            if v == version {
+                return fmt.Errorf("Duplicate schema version %d", version)
+            }
+        }
+        m.versions = append(m.versions, version)
+        return nil
+    }
+
+    m.Statements = append(m.Statements, query)
+
+    if match := sqlCreateTableRe.FindStringSubmatch(query); match != nil {
+        if _, ok := m.Tables[match[1]]; !ok {
+            m.addIndexes(match[1], query)
+        }
+    } else if match := sqlAlterTableRe.FindStringSubmatch(query); match != nil {
+        m.addIndexes(match[1], query)
+    }
+
+    return nil
+}
+
+func (m *SqlDbMock) addIndexes(table, query string) {
+    if m.Tables == nil {
+        m.Tables = make(map[string][]string)
+    }
+
+    indexes := append([]string{}, m.Tables[table]...)
+    if strings.Contains(query, "PRIMARY KEY") {
+        indexes = append(indexes, "PRIMARY")
+    }
+    for _, match := range sqlIndexRe.FindAllStringSubmatch(query, -1) {
+        indexes = append(indexes, match[1])
+    }
+    m.Tables[table] = indexes
+}
+
+func (m *SqlDbMock) queryIndex(table, index string) (driver.Rows, error) {
+    var count int64
+    for _, name := range m.Tables[table] {
+        if name == index {
+            count++
+        }
+    }
+    return &sqlRowsMock{columns: []string{"count"}, rows: [][]driver.Value{{count}}}, nil
+}
+
+func (m *SqlDbMock) query(query string) (driver.Rows, error) {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+
+    if match := sqlIndexQueryRe.FindStringSubmatch(query); match != nil {
+        return m.queryIndex(match[1], match[2])
+    }
+
+    if query != "SELECT MAX(version) FROM piot_schema_version" {
+        return nil, fmt.Errorf("Unsupported query: %s", query)
+    }
+
+    var max interface{}
+    for _, version := range m.versions {
+        if max == nil || version > max.(int64) {
+            max = version
+        }
+    }
+
+    return &sqlRowsMock{columns: []string{"version"}, rows: [][]driver.Value{{max}}}, nil
+}
+
+///////////////////////////////////////// driver
+
+type sqlDriverMock struct{}
+
+func (d *sqlDriverMock) Open(name string) (driver.Conn, error) {
+    sqlDbMocksMutex.Lock()
+    defer sqlDbMocksMutex.Unlock()
+
+    mock, ok := sqlDbMocks[name]
+    if !ok {
+        return nil, fmt.Errorf("Unknown database %s", name)
+    }
+
+    return &sqlConnMock{mock: mock}, nil
+}
+
+type sqlConnMock struct {
+    mock *SqlDbMock
+}
+
+func (c *sqlConnMock) Prepare(query string) (driver.Stmt, error) {
+    return &sqlStmtMock{mock: c.mock, query: query}, nil
+}
+
+func (c *sqlConnMock) Close() error {
+    return nil
+}
+
+func (c *sqlConnMock) Begin() (driver.Tx, error) {
+    return nil, errors.New("Transactions are not supported")
+}
+
+type sqlStmtMock struct {
+    mock *SqlDbMock
+    query string
+}
+
+func (s *sqlStmtMock) Close() error {
+    return nil
+}
+
+func (s *sqlStmtMock) NumInput() int {
+    return 0
+}
+
+func (s *sqlStmtMock) Exec(args []driver.Value) (driver.Result, error) {
+    if err := s.mock.exec(s.query); err != nil {
+        return nil, err
+    }
+    return driver.RowsAffected(0), nil
+}
+
+func (s *sqlStmtMock) Query(args []driver.Value) (driver.Rows, error) {
+    return s.mock.query(s.query)
+}
+
+type sqlRowsMock struct {
+    columns []string
+    rows [][]driver.Value
+}
+
+func (r *sqlRowsMock) Columns() []string {
+    return r.columns
+}
+
+func (r *sqlRowsMock) Close() error {
+    return nil
+}
+
+func (r *sqlRowsMock) Next(dest []driver.Value) error {
+    if len(r.rows) == 0 {
+        return io.EOF
+    }
+    copy(dest, r.rows[0])
+    r.rows = r.rows[1:]
+    return nil
+}
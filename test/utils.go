@@ -13,15 +13,15 @@ import (
     "github.com/op/go-logging"
     "go.mongodb.org/mongo-driver/mongo"
     "go.mongodb.org/mongo-driver/mongo/options"
-    "go.mongodb.org/mongo-driver/bson"
     "go.mongodb.org/mongo-driver/bson/primitive"
     "github.com/mnezerka/go-piot"
     "github.com/mnezerka/go-piot/config"
+    "github.com/mnezerka/go-piot/model"
 )
 
 const LOG_FORMAT = "%{color}%{time:2006/01/02 15:04:05 -07:00 MST} [%{level:.6s}] %{shortfile} : %{color:reset}%{message}"
 
-var db *mongo.Database
+var db *piot.Repositories
 var logger *logging.Logger
 
 // assert fails the test if the condition is false.
@@ -55,139 +55,147 @@ func Contains(t *testing.T, str, pattern string) {
     Assert(t, strings.Contains(str, pattern), "String <" + str + "> doesn't contain <" + pattern + ">")
 }
 
-func CleanDb(t *testing.T, db *mongo.Database) {
-    db.Collection("orgs").DeleteMany(context.TODO(), bson.M{})
-    db.Collection("users").DeleteMany(context.TODO(), bson.M{})
-    db.Collection("orgusers").DeleteMany(context.TODO(), bson.M{})
-    db.Collection("things").DeleteMany(context.TODO(), bson.M{})
+func CleanDb(t *testing.T, db *piot.Repositories) {
+    Ok(t, db.Orgs.DeleteAll())
+    Ok(t, db.Users.DeleteAll())
+    Ok(t, db.OrgUsers.DeleteAll())
+    Ok(t, db.Things.DeleteAll())
     t.Log("DB is clean")
 }
 
-func CreateDevice(t *testing.T, db *mongo.Database, name string) (primitive.ObjectID) {
-    res, err := db.Collection("things").InsertOne(context.TODO(), bson.M{
-        "name": name,
-        "piot_id": name,
-        "type": "device",
-        "created": int32(time.Now().Unix()),
-        "enabled": true,
+func CreateDevice(t *testing.T, db *piot.Repositories, name string) (primitive.ObjectID) {
+    id, err := db.Things.Insert(&model.Thing{
+        Name: name,
+        PiotId: name,
+        Type: "device",
+        Created: int32(time.Now().Unix()),
+        Enabled: true,
     })
     Ok(t, err)
 
-    t.Logf("Created thing of type device: %v", res.InsertedID)
-
-    return res.InsertedID.(primitive.ObjectID)
-}
-
-func CreateSwitch(t *testing.T, db *mongo.Database, name string) (primitive.ObjectID) {
-    res, err := db.Collection("things").InsertOne(context.TODO(), bson.M{
-        "name": name,
-        "piot_id": name,
-        "type": "switch",
-        "created": int32(time.Now().Unix()),
-        "enabled": true,
-        "store_influxdb": true,
-        "switch": bson.M{
-            "state_topic": "state",
-            "state_on": "ON",
-            "state_off": "OFF",
-            "command_topic": "cmnd",
-            "command_on": "ON",
-            "command_off": "OFF",
+    t.Logf("Created thing of type device: %v", id)
+
+    return id
+}
+
+func CreateSwitch(t *testing.T, db *piot.Repositories, name string) (primitive.ObjectID) {
+    id, err := db.Things.Insert(&model.Thing{
+        Name: name,
+        PiotId: name,
+        Type: "switch",
+        Created: int32(time.Now().Unix()),
+        Enabled: true,
+        StoreInfluxDb: true,
+        Switch: model.SwitchData{
+            StateTopic: "state",
+            StateOn: "ON",
+            StateOff: "OFF",
+            CommandTopic: "cmnd",
+            CommandOn: "ON",
+            CommandOff: "OFF",
         },
     })
     Ok(t, err)
 
-    t.Logf("Created thing %v", res.InsertedID)
+    t.Logf("Created thing %v", id)
 
-    return res.InsertedID.(primitive.ObjectID)
+    return id
 }
 
-func CreateThing(t *testing.T, db *mongo.Database, name string) (primitive.ObjectID) {
-    res, err := db.Collection("things").InsertOne(context.TODO(), bson.M{
-        "name": name,
-        "piot_id": name,
-        "type": "sensor",
-        "created": int32(time.Now().Unix()),
-        "enabled": true,
-        "store_mysqldb": true,
-        "store_influxdb": true,
-        "sensor": bson.M{
-            "class": "temperature",
-            "measurement_topic": "value",
+func CreateThing(t *testing.T, db *piot.Repositories, name string) (primitive.ObjectID) {
+    id, err := db.Things.Insert(&model.Thing{
+        Name: name,
+        PiotId: name,
+        Type: "sensor",
+        Created: int32(time.Now().Unix()),
+        Enabled: true,
+        StoreMysqlDb: true,
+        StoreInfluxDb: true,
+        Sensor: model.SensorData{
+            Class: "temperature",
+            MeasurementTopic: "value",
         },
     })
     Ok(t, err)
 
-    t.Logf("Created thing %v", res.InsertedID)
+    t.Logf("Created thing %v", id)
 
-    return res.InsertedID.(primitive.ObjectID)
+    return id
 }
 
-func CreateUser(t *testing.T, db *mongo.Database, email, password string) (primitive.ObjectID) {
+func CreateUser(t *testing.T, db *piot.Repositories, email, password string) (primitive.ObjectID) {
     hash, err := piot.GetPasswordHash(password)
     Ok(t, err)
 
-    res, err := db.Collection("users").InsertOne(context.TODO(), bson.M{
-        "email": email,
-        "password": hash,
-        "created": int32(time.Now().Unix()),
+    id, err := db.Users.Insert(&model.User{
+        Email: email,
+        Password: hash,
+        Created: int32(time.Now().Unix()),
     })
     Ok(t, err)
 
-    t.Logf("Created user %v", res.InsertedID)
+    t.Logf("Created user %v", id)
 
-    return res.InsertedID.(primitive.ObjectID)
+    return id
 }
 
-func CreateOrg(t *testing.T, db *mongo.Database, name string) (primitive.ObjectID) {
-    res, err := db.Collection("orgs").InsertOne(context.TODO(), bson.M{
-        "name": name,
-        "created": int32(time.Now().Unix()),
-        "influxdb": "db",
-        "influxdb_username": "db-username",
-        "influxdb_password": "db-password",
-        "mysqldb": "mysqldb",
-        "mysqldb_username": "mysqldb-username",
-        "mysqldb_password": "mysqldb-password",
+func CreateOrg(t *testing.T, db *piot.Repositories, name string) (primitive.ObjectID) {
+    id, err := db.Orgs.Insert(&model.Org{
+        Name: name,
+        Created: int32(time.Now().Unix()),
+        InfluxDb: "db",
+        InfluxDbUsername: "db-username",
+        InfluxDbPassword: "db-password",
+        MysqlDb: "mysqldb",
+        MysqlDbUsername: "mysqldb-username",
+        MysqlDbPassword: "mysqldb-password",
     })
     Ok(t, err)
 
-    t.Logf("Created org %v", res.InsertedID)
+    t.Logf("Created org %v", id)
 
-    return res.InsertedID.(primitive.ObjectID)
+    return id
 }
 
-func AddOrgUser(t *testing.T, db *mongo.Database, orgId, userId primitive.ObjectID) {
-    _, err := db.Collection("orgusers").InsertOne(context.TODO(), bson.M{
-        "org_id": orgId,
-        "user_id": userId,
-        "created": int32(time.Now().Unix()),
+func AddOrgUser(t *testing.T, db *piot.Repositories, orgId, userId primitive.ObjectID) {
+    AddOrgUserRole(t, db, orgId, userId, model.ORG_ROLE_EDITOR)
+}
+
+func AddOrgUserRole(t *testing.T, db *piot.Repositories, orgId, userId primitive.ObjectID, role string) {
+    err := db.OrgUsers.Insert(&model.OrgUser{
+        OrgId: orgId,
+        UserId: userId,
+        Role: role,
+        Created: int32(time.Now().Unix()),
     })
     Ok(t, err)
 
-    t.Logf("User %v added to org %v", userId.Hex(), orgId.Hex())
+    t.Logf("User %v added to org %v as %s", userId.Hex(), orgId.Hex(), role)
 }
 
-func AddOrgThing(t *testing.T, db *mongo.Database, orgId primitive.ObjectID, thingName string) {
-    _, err := db.Collection("things").UpdateOne(context.TODO(), bson.M{"name": thingName}, bson.M{"$set": bson.M{"org_id": orgId}})
+func AddOrgThing(t *testing.T, db *piot.Repositories, orgId primitive.ObjectID, thingName string) {
+    thing, err := db.Things.GetByName(thingName)
     Ok(t, err)
+    Ok(t, db.Things.SetFields(thing.Id, map[string]interface{}{"org_id": orgId}))
 
     t.Logf("Thing %s assigned to org %s", thingName, orgId.Hex())
 }
 
-func SetSensorMeasurementTopic(t *testing.T, db *mongo.Database, thingId primitive.ObjectID, topic string) {
-    _, err := db.Collection("things").UpdateOne(context.TODO(), bson.M{"_id": thingId}, bson.M{"$set": bson.M{"sensor.measurement_topic": topic}})
-    Ok(t, err)
+func SetSensorMeasurementTopic(t *testing.T, db *piot.Repositories, thingId primitive.ObjectID, topic string) {
+    Ok(t, db.Things.SetFields(thingId, map[string]interface{}{"sensor.measurement_topic": topic}))
 }
 
-func SetThingTelemetryTopic(t *testing.T, db *mongo.Database, thingId primitive.ObjectID, topic string) {
-    _, err := db.Collection("things").UpdateOne(context.TODO(), bson.M{"_id": thingId}, bson.M{"$set": bson.M{"telemetry_topic": topic}})
-    Ok(t, err)
+func SetThingTelemetryTopic(t *testing.T, db *piot.Repositories, thingId primitive.ObjectID, topic string) {
+    Ok(t, db.Things.SetFields(thingId, map[string]interface{}{"telemetry_topic": topic}))
+}
+
+func SetThingSinks(t *testing.T, db *piot.Repositories, thingId primitive.ObjectID, sinks []string) {
+    Ok(t, db.Things.SetFields(thingId, map[string]interface{}{"sinks": sinks}))
 }
 
 func SetThingLocationParams(
         t *testing.T,
-        db *mongo.Database,
+        db *piot.Repositories,
         thingId primitive.ObjectID,
         topic string,
         lat_value string,
@@ -195,7 +203,7 @@ func SetThingLocationParams(
         sat_value string,
         ts_value string,
         tracking bool) {
-    update := bson.M{
+    update := map[string]interface{}{
         "loc_mqtt_topic": topic,
         "loc_mqtt_lat_value": lat_value,
         "loc_mqtt_lng_value": lng_value,
@@ -204,18 +212,32 @@ func SetThingLocationParams(
         "loc_tracking": tracking,
     }
 
-    _, err := db.Collection("things").UpdateOne(context.TODO(), bson.M{"_id": thingId}, bson.M{"$set": update})
-    Ok(t, err)
+    Ok(t, db.Things.SetFields(thingId, update))
 }
 
-func SetSwitchStateTopic(t *testing.T, db *mongo.Database, thingId primitive.ObjectID, topic, on, off string) {
-    update := bson.M{
+func SetSwitchStateTopic(t *testing.T, db *piot.Repositories, thingId primitive.ObjectID, topic, on, off string) {
+    update := map[string]interface{}{
         "switch.state_topic": topic,
         "switch.state_on": on,
         "switch.state_off": off,
     }
-    _, err := db.Collection("things").UpdateOne(context.TODO(), bson.M{"_id": thingId}, bson.M{"$set": update})
-    Ok(t, err)
+    Ok(t, db.Things.SetFields(thingId, update))
+}
+
+func SetThingLastSeen(t *testing.T, db *piot.Repositories, thingId primitive.ObjectID, lastSeen, interval int32) {
+    update := map[string]interface{}{
+        "last_seen": lastSeen,
+        "last_seen_interval": interval,
+    }
+    Ok(t, db.Things.SetFields(thingId, update))
+}
+
+func SetSensorValidity(t *testing.T, db *piot.Repositories, thingId primitive.ObjectID, validity, measurementLast int32) {
+    update := map[string]interface{}{
+        "sensor.validity": validity,
+        "sensor.measurement_last": measurementLast,
+    }
+    Ok(t, db.Things.SetFields(thingId, update))
 }
 
 func GetConfig() *config.Parameters{
@@ -224,6 +246,10 @@ func GetConfig() *config.Parameters{
     return cfg
 }
 
+func GetContext(t *testing.T) *piot.AuthContext {
+    return piot.NewSystemContext()
+}
+
 func GetLogger(t *testing.T) *logging.Logger {
 
     if logger == nil {
@@ -237,11 +263,18 @@ func GetLogger(t *testing.T) *logging.Logger {
     return logger
 }
 
-func GetDb(t *testing.T) *mongo.Database {
+// Get repositories used by tests. MongoDB is used if MONGODB_URI env
+// variable is set, in-memory repositories are used otherwise
+func GetDb(t *testing.T) *piot.Repositories {
 
     if db == nil {
 
         uri := os.Getenv("MONGODB_URI")
+        if uri == "" {
+            db = piot.NewMemoryRepositories()
+            return db
+        }
+
         // try to open database
         dbClient, err := mongo.Connect(context.TODO(), options.Client().ApplyURI(uri))
         Ok(t, err)
@@ -250,7 +283,10 @@ func GetDb(t *testing.T) *mongo.Database {
         err = dbClient.Ping(context.TODO(), nil)
         Ok(t, err)
 
-        db = dbClient.Database("piot-test")
+        // tests modify database directly, so records cannot be cached
+        params := GetConfig()
+        params.RepositoryCacheTtl = 0
+        db = piot.NewMongoRepositories(dbClient.Database("piot-test"), params)
     }
 
     return db
@@ -261,19 +297,19 @@ func GetPiotDevices(t *testing.T, logger *logging.Logger, things *piot.Things, m
     return piot.NewPiotDevices(logger, things, mqtt, cfg)
 }
 
-func GetThings(t *testing.T, logger *logging.Logger, db *mongo.Database) *piot.Things {
-    return piot.NewThings(db, logger)
+func GetThings(t *testing.T, logger *logging.Logger, db *piot.Repositories) *piot.Things {
+    return piot.NewThings(logger, db)
 }
 
 func GetMqtt(t *testing.T, logger *logging.Logger) *MqttMock {
     return &MqttMock{Log: logger}
 }
 
-func GetUsers(t *testing.T, logger *logging.Logger, db *mongo.Database) *piot.Users {
+func GetUsers(t *testing.T, logger *logging.Logger, db *piot.Repositories) *piot.Users {
     return piot.NewUsers(logger, db)
 }
 
-func GetOrgs(t *testing.T, logger *logging.Logger, db *mongo.Database) *piot.Orgs{
+func GetOrgs(t *testing.T, logger *logging.Logger, db *piot.Repositories) *piot.Orgs{
     return piot.NewOrgs(logger, db)
 }
 
@@ -289,4 +325,21 @@ func GetMysqlDb(t *testing.T, logger *logging.Logger) *MysqlDbMock {
     return &MysqlDbMock{Log: logger}
 }
 
+func GetHistorySink(t *testing.T, logger *logging.Logger) *HistorySinkMock {
+    return &HistorySinkMock{
+        Log: logger,
+        Sensors: make(map[string][]model.HistoryValue),
+        Switches: make(map[string][]model.HistoryValue),
+    }
+}
+
+func GetSinks(t *testing.T, logger *logging.Logger, influxDb piot.IInfluxDb, mysqlDb piot.IMysqlDb) *piot.Sinks {
+    sinks := piot.NewSinks(logger)
+    sinks.Register(model.SINK_INFLUXDB, piot.NewInfluxDbSink(influxDb))
+    sinks.Register(model.SINK_MYSQLDB, piot.NewMysqlDbSink(mysqlDb))
+    return sinks
+}
 
+func GetMqttClient(t *testing.T, logger *logging.Logger) *MqttClientMock {
+    return &MqttClientMock{Log: logger}
+}
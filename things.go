@@ -10,104 +10,170 @@ if res.ModifiedCount == 0 {
 */
 
 import (
-    "context"
     "errors"
     "fmt"
+    "strings"
     "time"
     "github.com/op/go-logging"
-    "go.mongodb.org/mongo-driver/mongo"
-    "go.mongodb.org/mongo-driver/bson"
     "go.mongodb.org/mongo-driver/bson/primitive"
     "github.com/mnezerka/go-piot/model"
 )
 
+// kinds of thing attributes which can be modified by Things.Update
+const (
+    fieldString = iota
+    fieldBool
+    fieldInt
+    fieldObjectId
+    fieldStringList
+    fieldPublishPolicies
+    fieldSinkIntervals
+)
+
+// attributes (bson names) which can be modified by Things.Update, runtime
+// state of things (values, last seen time, availability, etc.) is
+// maintained by processing of incoming data only
+var thingUpdatableFields = map[string]int{
+    "name": fieldString,
+    "description": fieldString,
+    "alias": fieldString,
+    "type": fieldString,
+    "enabled": fieldBool,
+    "org_id": fieldObjectId,
+    "parent_id": fieldObjectId,
+    "last_seen_interval": fieldInt,
+    "availability_topic": fieldString,
+    "availability_yes": fieldString,
+    "availability_no": fieldString,
+    "telemetry_topic": fieldString,
+    "sinks": fieldStringList,
+    "store_influxdb": fieldBool,
+    "store_mysqldb": fieldBool,
+    "store_mysqldb_interval": fieldInt,
+    "sink_intervals": fieldSinkIntervals,
+    "publish_policies": fieldPublishPolicies,
+    "loc_mqtt_topic": fieldString,
+    "loc_mqtt_lat_value": fieldString,
+    "loc_mqtt_lng_value": fieldString,
+    "loc_mqtt_ts_value": fieldString,
+    "loc_mqtt_sat_value": fieldString,
+    "loc_tracking": fieldBool,
+    "sensor.measurement_topic": fieldString,
+    "sensor.measurement_value": fieldString,
+    "sensor.class": fieldString,
+    "sensor.validity": fieldInt,
+    "sensor.unit": fieldString,
+    "switch.command_topic": fieldString,
+    "switch.command_on": fieldString,
+    "switch.command_off": fieldString,
+    "switch.state_topic": fieldString,
+    "switch.state_on": fieldString,
+    "switch.state_off": fieldString,
+}
+
+// attributes which can be used for sorting of things in Things.List
+var thingSortableFields = []string{"name", "alias", "type", "created", "last_seen"}
+
+// Page of listed records
+type Page struct {
+    Offset int64
+    Limit int64
+}
+
+// Result of listing of things
+type ThingList struct {
+    Things []*model.Thing
+    Total int64
+}
+
 type Things struct {
-    Db *mongo.Database
+    Repo ThingRepository
     Log *logging.Logger
+    Events *Events
 }
 
-func NewThings(db *mongo.Database, log *logging.Logger) *Things {
-    things := &Things{Db: db, Log: log}
+func NewThings(log *logging.Logger, repos *Repositories) *Things {
+    things := &Things{Repo: repos.Things, Log: log}
+    things.Events = NewEvents(log)
     return things
 }
 
-func (t *Things) Get(id primitive.ObjectID) (*model.Thing, error) {
-    t.Log.Debugf("Get thing: %s", id.Hex())
+// Notify subscribers (e.g. topic routes) that configuration of the thing
+// changed, runtime state changes are not reported this way
+func (t *Things) emitChanged(id primitive.ObjectID) {
+    t.Events.Emit(&Event{Type: EVENT_THING_CHANGED, ThingId: id, Time: int32(time.Now().Unix())})
+}
 
-    var thing model.Thing
+func (t *Things) Get(ctx *AuthContext, id primitive.ObjectID) (*model.Thing, error) {
+    t.Log.Debugf("Get thing: %s", id.Hex())
 
-    collection := t.Db.Collection("things")
-    err := collection.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&thing)
+    thing, err := t.Repo.Get(id)
     if err != nil {
         t.Log.Warningf("Things.Get failed for id <%s> (%v)", id.Hex(), err)
         return nil, err
     }
 
-    return &thing, nil
-}
-
-func (t *Things) GetFiltered(ctx *AuthContext, filter interface{}) ([]*model.Thing, error) {
-    collection := t.Db.Collection("things")
-
-    var result []*model.Thing
-
-    cur, err := collection.Find(ctx, filter)
-    if err != nil {
-        t.Log.Errorf("GQL: error : %v", err)
+    if err := t.checkAccess(ctx, thing); err != nil {
         return nil, err
     }
-    defer cur.Close(ctx.Context)
 
-    for cur.Next(ctx) {
-        // To decode into a struct, use cursor.Decode()
-        thing := model.Thing{}
-        err := cur.Decode(&thing)
-        if err != nil {
-            t.Log.Errorf("GQL: error : %v", err)
-            return nil, err
-        }
-        result = append(result, &thing)
-    }
+    return thing, nil
+}
 
-    if err := cur.Err(); err != nil {
+// Get things matching filter, result is restricted to things of orgs
+// accessible by the context
+func (t *Things) GetFiltered(ctx *AuthContext, filter *ThingFilter) ([]*model.Thing, error) {
+    result, err := t.Repo.Find(ctx.OrgFilter(filter), nil)
+    if err != nil {
+        t.Log.Errorf("GQL: error : %v", err)
         return nil, err
     }
 
     return result, nil
 }
 
-func (t *Things) Find(name string) (*model.Thing, error) {
+func (t *Things) Find(ctx *AuthContext, name string) (*model.Thing, error) {
     t.Log.Debugf("Finding thing by name <%s>", name)
 
-    var thing model.Thing
-
     // try to find thing in DB by its name
-    err := t.Db.Collection("things").FindOne(context.TODO(), bson.M{"name": name}).Decode(&thing)
+    thing, err := t.Repo.GetByName(name)
     if err != nil {
         return nil, errors.New("Thing not found")
     }
 
-    return &thing, nil
+    if err := t.checkAccess(ctx, thing); err != nil {
+        return nil, err
+    }
+
+    return thing, nil
 }
 
-func (t *Things) FindPiot(id string) (*model.Thing, error) {
+func (t *Things) FindPiot(ctx *AuthContext, id string) (*model.Thing, error) {
     t.Log.Debugf("Finding piot thing by id <%s>", id)
 
-    var thing model.Thing
-
     // try to find thing in DB by its name
-    err := t.Db.Collection("things").FindOne(context.TODO(), bson.M{"piot_id": id}).Decode(&thing)
+    thing, err := t.Repo.GetByPiotId(id)
     if err != nil {
         return nil, errors.New("Thing not found")
     }
 
-    return &thing, nil
+    if err := t.checkAccess(ctx, thing); err != nil {
+        return nil, err
+    }
+
+    return thing, nil
 }
 
-func (t *Things) RegisterPiot(id string, deviceType string) (*model.Thing, error) {
+func (t *Things) RegisterPiot(ctx *AuthContext, id string, deviceType string) (*model.Thing, error) {
     t.Log.Debugf("Registering new piot thing: %s of type %s", id, deviceType)
+
+    // piot things are not assigned to any org when registered
+    if !ctx.IsUnrestricted() {
+        return nil, NewForbiddenError("Piot things can be registered only by system or admin")
+    }
+
     // check if string of same name already exists
-    _, err := t.FindPiot(id)
+    _, err := t.FindPiot(ctx, id)
     if err == nil {
         return nil, errors.New(fmt.Sprintf("Piot Thing identified by %s already exists", id))
     }
@@ -120,69 +186,612 @@ func (t *Things) RegisterPiot(id string, deviceType string) (*model.Thing, error
     thing.Created = int32(time.Now().Unix())
     thing.LastSeen = int32(time.Now().Unix())
 
-    res, err := t.Db.Collection("things").InsertOne(context.TODO(), thing)
+    thing.Id, err = t.Repo.Insert(&thing)
     if err != nil {
         t.Log.Errorf("Thing %s cannot be stored (%v)", id, err)
         return nil, errors.New("Error while storing new thing")
     }
-
-    thing.Id = res.InsertedID.(primitive.ObjectID)
+    t.emitChanged(thing.Id)
 
     return &thing, nil
 }
 
-func (t *Things) SetParent(id primitive.ObjectID, id_parent primitive.ObjectID) (error) {
+// Create new thing, attributes of thing are validated and name has to be
+// unique
+func (t *Things) Create(ctx *AuthContext, thing *model.Thing) (*model.Thing, error) {
+    t.Log.Debugf("Creating thing <%s> of type %s", thing.Name, thing.Type)
+
+    if !ctx.CanModifyOrg(thing.OrgId) {
+        return nil, NewForbiddenError("Thing cannot be created in org %s", thing.OrgId.Hex())
+    }
+
+    if err := t.validateName(primitive.NilObjectID, thing.Name); err != nil {
+        return nil, err
+    }
+
+    if err := validateThingType(thing.Type); err != nil {
+        return nil, err
+    }
+
+    if thing.PiotId != "" {
+        if _, err := t.Repo.GetByPiotId(thing.PiotId); err == nil {
+            return nil, fmt.Errorf("Piot Thing identified by %s already exists", thing.PiotId)
+        }
+    }
+
+    if thing.ParentId != primitive.NilObjectID {
+        if _, err := t.Get(ctx, thing.ParentId); err != nil {
+            if IsForbidden(err) {
+                return nil, err
+            }
+            return nil, errors.New("Parent thing not found")
+        }
+    }
+
+    if thing.LastSeenInterval < 0 || thing.StoreMysqlDbInterval < 0 || thing.Sensor.Validity < 0 {
+        return nil, errors.New("Intervals cannot be negative")
+    }
+    if _, ok := convertSinkIntervals(thing.SinkIntervals); !ok {
+        return nil, errors.New("Intervals cannot be negative")
+    }
+
+    created := *thing
+    created.Id = primitive.NilObjectID
+    created.Created = int32(time.Now().Unix())
+
+    id, err := t.Repo.Insert(&created)
+    if err != nil {
+        t.Log.Errorf("Thing %s cannot be stored (%v)", thing.Name, err)
+        return nil, errors.New("Error while storing new thing")
+    }
+    created.Id = id
+    t.emitChanged(id)
+
+    return &created, nil
+}
+
+// Update attributes of the thing. Patch keys are attribute names as stored
+// in database (e.g. "sensor.class"), only configuration attributes can be
+// updated (see thingUpdatableFields)
+func (t *Things) Update(ctx *AuthContext, id primitive.ObjectID, patch map[string]interface{}) (*model.Thing, error) {
+    t.Log.Debugf("Updating thing <%s>: %v", id.Hex(), patch)
+
+    if err := t.authorize(ctx, id); err != nil {
+        return nil, err
+    }
+
+    update := map[string]interface{}{}
+    for name, value := range patch {
+        converted, err := convertThingField(name, value)
+        if err != nil {
+            return nil, err
+        }
+        update[name] = converted
+    }
+
+    // attributes with additional constraints
+    if name, ok := update["name"]; ok {
+        if err := t.validateName(id, name.(string)); err != nil {
+            return nil, err
+        }
+    }
+    if thingType, ok := update["type"]; ok {
+        if err := validateThingType(thingType.(string)); err != nil {
+            return nil, err
+        }
+    }
+    if orgId, ok := update["org_id"]; ok && !ctx.CanModifyOrg(orgId.(primitive.ObjectID)) {
+        return nil, NewForbiddenError("Thing cannot be moved to org %s", orgId.(primitive.ObjectID).Hex())
+    }
+    if parentId, ok := update["parent_id"]; ok && parentId.(primitive.ObjectID) != primitive.NilObjectID {
+        parent, err := t.Get(ctx, parentId.(primitive.ObjectID))
+        if err != nil {
+            if IsForbidden(err) {
+                return nil, err
+            }
+            return nil, errors.New("Parent thing not found")
+        }
+        if err := t.checkParentCycle(id, parent); err != nil {
+            return nil, err
+        }
+    }
+    // all integer attributes are intervals or durations
+    for name, value := range update {
+        if thingUpdatableFields[name] == fieldInt && value.(int32) < 0 {
+            return nil, fmt.Errorf("Attribute %s cannot be negative", name)
+        }
+    }
+
+    if len(update) > 0 {
+        if err := t.Repo.SetFields(id, update); err != nil {
+            t.Log.Errorf("Thing %s cannot be updated (%v)", id.Hex(), err)
+            return nil, errors.New("Error while updating thing attributes")
+        }
+        t.emitChanged(id)
+    }
+
+    return t.Get(ctx, id)
+}
+
+// Delete thing. Children of the thing are deleted too if cascade is set,
+// else they are re-assigned to parent of deleted thing
+func (t *Things) Delete(ctx *AuthContext, id primitive.ObjectID, cascade bool) (error) {
+    t.Log.Debugf("Deleting thing <%s> (cascade: %v)", id.Hex(), cascade)
+
+    thing, err := t.Get(ctx, id)
+    if err != nil {
+        return err
+    }
+
+    if !cascade {
+        if err := t.checkModifyAccess(ctx, thing); err != nil {
+            return err
+        }
+
+        err := t.Repo.ReplaceParent(thing.Id, thing.ParentId)
+        if err != nil {
+            t.Log.Errorf("Children of thing %s cannot be updated (%v)", thing.Id.Hex(), err)
+            return errors.New("Error while deleting thing")
+        }
+
+        return t.delete(thing)
+    }
+
+    things, err := t.getSubtree(thing)
+    if err != nil {
+        return err
+    }
+
+    // children could be assigned to other orgs, nothing is deleted if any
+    // of them cannot be modified
+    for _, thing := range things {
+        if err := t.checkModifyAccess(ctx, thing); err != nil {
+            return err
+        }
+    }
+
+    // children are deleted before their parents
+    for i := len(things) - 1; i >= 0; i-- {
+        if err := t.delete(things[i]); err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+func (t *Things) delete(thing *model.Thing) (error) {
+    if err := t.Repo.Delete(thing.Id); err != nil {
+        t.Log.Errorf("Thing %s cannot be deleted (%v)", thing.Id.Hex(), err)
+        return errors.New("Error while deleting thing")
+    }
+    t.emitChanged(thing.Id)
+
+    return nil
+}
+
+// Get thing and all its descendants, parents precede their children
+func (t *Things) getSubtree(thing *model.Thing) ([]*model.Thing, error) {
+    result := []*model.Thing{thing}
+
+    // protection against cycles in parent - child relations
+    visited := map[primitive.ObjectID]bool{thing.Id: true}
+
+    for i := 0; i < len(result); i++ {
+        children, err := t.Repo.Find(&ThingFilter{ParentId: &result[i].Id}, nil)
+        if err != nil {
+            t.Log.Errorf("Children of thing %s cannot be fetched (%v)", result[i].Id.Hex(), err)
+            return nil, errors.New("Error while deleting thing")
+        }
+        for _, child := range children {
+            if !visited[child.Id] {
+                visited[child.Id] = true
+                result = append(result, child)
+            }
+        }
+    }
+
+    return result, nil
+}
+
+// Check that parent is not the thing itself or its descendant, such parent
+// would create cycle in parent - child relations
+func (t *Things) checkParentCycle(id primitive.ObjectID, parent *model.Thing) (error) {
+    if parent.Id == id {
+        return errors.New("Thing cannot be parent of itself")
+    }
+
+    // ancestors could be assigned to other orgs, they are not checked for
+    // access
+    visited := map[primitive.ObjectID]bool{parent.Id: true}
+    for ancestorId := parent.ParentId; ancestorId != primitive.NilObjectID && !visited[ancestorId]; {
+        if ancestorId == id {
+            return errors.New("Descendant of thing cannot be its parent")
+        }
+        visited[ancestorId] = true
+
+        ancestor, err := t.Repo.Get(ancestorId)
+        if err == ErrNotFound {
+            break
+        }
+        if err != nil {
+            t.Log.Errorf("Ancestors of thing %s cannot be fetched (%v)", parent.Id.Hex(), err)
+            return errors.New("Error while checking parent of thing")
+        }
+        ancestorId = ancestor.ParentId
+    }
+
+    return nil
+}
+
+// List things of the org (NilObjectID lists things of all orgs). Query is
+// matched (case insensitive) against name, alias and description, sort is
+// name of sortable attribute optionally prefixed by "-" for descending order
+func (t *Things) List(ctx *AuthContext, orgId primitive.ObjectID, query string, page Page, sort string) (*ThingList, error) {
+    t.Log.Debugf("Listing things of org <%s>, query: <%s>, page: %v, sort: <%s>", orgId.Hex(), query, page, sort)
+
+    filter := &ThingFilter{Query: query}
+
+    if orgId != primitive.NilObjectID {
+        if !ctx.IsOrgMember(orgId) {
+            return nil, NewForbiddenError("Things of org %s cannot be listed", orgId.Hex())
+        }
+        filter.OrgIds = []primitive.ObjectID{orgId}
+    }
+
+    if sort == "" {
+        sort = "name"
+    }
+    if !isThingSortable(strings.TrimPrefix(sort, "-")) {
+        return nil, fmt.Errorf("Things cannot be sorted by %s", sort)
+    }
+
+    if page.Offset < 0 || page.Limit < 0 {
+        return nil, errors.New("Invalid page")
+    }
+
+    filter = ctx.OrgFilter(filter)
+
+    total, err := t.Repo.Count(filter)
+    if err != nil {
+        t.Log.Errorf("Things cannot be counted (%v)", err)
+        return nil, errors.New("Error while listing things")
+    }
+
+    things, err := t.Repo.Find(filter, &FindOptions{Sort: sort, Skip: page.Offset, Limit: page.Limit})
+    if err != nil {
+        t.Log.Errorf("Things cannot be listed (%v)", err)
+        return nil, errors.New("Error while listing things")
+    }
+
+    return &ThingList{Things: things, Total: total}, nil
+}
+
+// Check if context is allowed to access the thing
+func (t *Things) checkAccess(ctx *AuthContext, thing *model.Thing) (error) {
+    if !ctx.IsOrgMember(thing.OrgId) {
+        t.Log.Warningf("Access to thing <%s> denied", thing.Id.Hex())
+        return NewForbiddenError("Access to thing %s denied", thing.Id.Hex())
+    }
+    return nil
+}
+
+// Check if context is allowed to modify the thing (viewers can only read)
+func (t *Things) checkModifyAccess(ctx *AuthContext, thing *model.Thing) (error) {
+    if !ctx.CanModifyOrg(thing.OrgId) {
+        t.Log.Warningf("Modification of thing <%s> denied", thing.Id.Hex())
+        return NewForbiddenError("Modification of thing %s denied", thing.Id.Hex())
+    }
+    return nil
+}
+
+// Check if context is allowed to modify the thing identified by id, thing
+// is not fetched for unrestricted contexts (e.g. processing of MQTT data)
+func (t *Things) authorize(ctx *AuthContext, id primitive.ObjectID) (error) {
+    if ctx.IsUnrestricted() {
+        return nil
+    }
+
+    thing, err := t.Get(ctx, id)
+    if err != nil {
+        return err
+    }
+
+    return t.checkModifyAccess(ctx, thing)
+}
+
+func (t *Things) validateName(id primitive.ObjectID, name string) (error) {
+    if strings.TrimSpace(name) == "" {
+        return errors.New("Thing name cannot be empty")
+    }
+
+    existing, err := t.Repo.GetByName(name)
+    if err == nil && existing.Id != id {
+        return fmt.Errorf("Thing of name %s already exists", name)
+    }
+
+    return nil
+}
+
+func validateThingType(thingType string) (error) {
+    switch thingType {
+    case model.THING_TYPE_DEVICE, model.THING_TYPE_SENSOR, model.THING_TYPE_SWITCH:
+        return nil
+    }
+    return fmt.Errorf("Unknown thing type %s", thingType)
+}
+
+func isThingSortable(name string) bool {
+    for _, field := range thingSortableFields {
+        if field == name {
+            return true
+        }
+    }
+    return false
+}
+
+// Convert value of thing attribute to type used for storage, numbers
+// decoded from JSON (float64) are accepted for integer attributes
+func convertThingField(name string, value interface{}) (interface{}, error) {
+    kind, ok := thingUpdatableFields[name]
+    if !ok {
+        return nil, fmt.Errorf("Attribute %s cannot be updated", name)
+    }
+
+    switch kind {
+    case fieldString:
+        if v, ok := value.(string); ok {
+            return v, nil
+        }
+    case fieldBool:
+        if v, ok := value.(bool); ok {
+            return v, nil
+        }
+    case fieldInt:
+        switch v := value.(type) {
+        case int:
+            return int32(v), nil
+        case int32:
+            return v, nil
+        case int64:
+            return int32(v), nil
+        case float64:
+            if v == float64(int32(v)) {
+                return int32(v), nil
+            }
+        }
+    case fieldObjectId:
+        switch v := value.(type) {
+        case primitive.ObjectID:
+            return v, nil
+        case string:
+            if v == "" {
+                return primitive.NilObjectID, nil
+            }
+            id, err := primitive.ObjectIDFromHex(v)
+            if err == nil {
+                return id, nil
+            }
+        }
+    case fieldStringList:
+        switch v := value.(type) {
+        case []string:
+            return v, nil
+        case []interface{}:
+            result := []string{}
+            for _, item := range v {
+                str, ok := item.(string)
+                if !ok {
+                    return nil, fmt.Errorf("Invalid value of attribute %s", name)
+                }
+                result = append(result, str)
+            }
+            return result, nil
+        }
+    case fieldPublishPolicies:
+        if policies, ok := convertPublishPolicies(value); ok {
+            return policies, nil
+        }
+    case fieldSinkIntervals:
+        if intervals, ok := convertSinkIntervals(value); ok {
+            return intervals, nil
+        }
+    }
+
+    return nil, fmt.Errorf("Invalid value of attribute %s", name)
+}
+
+// Convert publish policies decoded from JSON (map of objects) or given
+// directly, nil removes all policies
+func convertPublishPolicies(value interface{}) (map[string]model.PublishPolicy, bool) {
+    result := make(map[string]model.PublishPolicy)
+
+    switch v := value.(type) {
+    case nil:
+        return result, true
+    case map[string]model.PublishPolicy:
+        for class, policy := range v {
+            result[class] = policy
+        }
+    case map[string]interface{}:
+        for class, item := range v {
+            fields, ok := item.(map[string]interface{})
+            if !ok {
+                return nil, false
+            }
+            policy := model.PublishPolicy{}
+            if qos, ok := fields["qos"]; ok {
+                q, ok := qos.(float64)
+                if !ok || q != float64(byte(q)) {
+                    return nil, false
+                }
+                policy.Qos = byte(q)
+            }
+            if retain, ok := fields["retain"]; ok {
+                if policy.Retain, ok = retain.(bool); !ok {
+                    return nil, false
+                }
+            }
+            result[class] = policy
+        }
+    default:
+        return nil, false
+    }
+
+    for class, policy := range result {
+        if !IsPublishClass(class) || policy.Qos > 2 {
+            return nil, false
+        }
+    }
+
+    return result, true
+}
+
+// Convert intervals of sinks decoded from JSON (map of numbers) or given
+// directly, nil removes all intervals, intervals cannot be negative
+func convertSinkIntervals(value interface{}) (map[string]int32, bool) {
+    result := make(map[string]int32)
+
+    switch v := value.(type) {
+    case nil:
+        return result, true
+    case map[string]int32:
+        for sink, interval := range v {
+            result[sink] = interval
+        }
+    case map[string]interface{}:
+        for sink, item := range v {
+            interval, ok := item.(float64)
+            if !ok || interval != float64(int32(interval)) {
+                return nil, false
+            }
+            result[sink] = int32(interval)
+        }
+    default:
+        return nil, false
+    }
+
+    for _, interval := range result {
+        if interval < 0 {
+            return nil, false
+        }
+    }
+
+    return result, true
+}
+
+func (t *Things) SetParent(ctx *AuthContext, id primitive.ObjectID, id_parent primitive.ObjectID) (error) {
     t.Log.Debugf("Setting thing <%v>, setting parent to <%s>", id.Hex(), id_parent.Hex())
 
-    _, err := t.Get(id)
+    err := t.authorize(ctx, id)
+    if IsForbidden(err) {
+        return err
+    }
     if err != nil {
         t.Log.Errorf("Thing %s not found", id.Hex())
         return errors.New("Child thing not found when setting new parent")
     }
 
-    _, err = t.Get(id_parent)
+    parent, err := t.Get(ctx, id_parent)
+    if IsForbidden(err) {
+        return err
+    }
     if err != nil {
         t.Log.Errorf("Thing %s not found", id_parent.Hex())
         return errors.New("Parent thing not found when setting new parent for thing")
     }
 
-    _, err = t.Db.Collection("things").UpdateOne(context.TODO(), bson.M{"_id": id}, bson.M{"$set": bson.M{"parent_id": id_parent}})
+    if err := t.checkParentCycle(id, parent); err != nil {
+        return err
+    }
+
+    err = t.Repo.SetFields(id, map[string]interface{}{"parent_id": id_parent})
     if err != nil {
         t.Log.Errorf("Thing %s cannot be updated (%v)", id.Hex(), err)
         return errors.New("Error while updating thing parent")
     }
+    t.emitChanged(id)
 
     return nil
 }
 
-func (t *Things) SetAvailabilityTopic(id primitive.ObjectID, topic string) (error) {
+func (t *Things) SetAvailabilityTopic(ctx *AuthContext, id primitive.ObjectID, topic string) (error) {
     t.Log.Debugf("Setting thing <%s>, setting avalibility topic to <%s>", id.Hex(), topic)
 
-    _, err := t.Db.Collection("things").UpdateOne(context.TODO(), bson.M{"_id": id}, bson.M{"$set": bson.M{"availability_topic": topic}})
+    if err := t.authorize(ctx, id); err != nil {
+        return err
+    }
+
+    err := t.Repo.SetFields(id, map[string]interface{}{"availability_topic": topic})
     if err != nil {
         t.Log.Errorf("Thing %s cannot be updated (%v)", id.Hex(), err)
         return errors.New("Error while updating thing attributes")
     }
+    t.emitChanged(id)
 
     return nil
 }
 
-func (t *Things) SetAvailabilityYesNo(id primitive.ObjectID, yes, no string) (error) {
+func (t *Things) SetAvailabilityYesNo(ctx *AuthContext, id primitive.ObjectID, yes, no string) (error) {
     t.Log.Debugf("Setting thing <%s>, setting avalibility topic values to <%s> and <%s>", id.Hex(), yes, no)
 
-    _, err := t.Db.Collection("things").UpdateOne(context.TODO(), bson.M{"_id": id}, bson.M{"$set": bson.M{"availability_yes": yes, "availability_no": no}})
+    if err := t.authorize(ctx, id); err != nil {
+        return err
+    }
+
+    err := t.Repo.SetFields(id, map[string]interface{}{"availability_yes": yes, "availability_no": no})
     if err != nil {
         t.Log.Errorf("Thing %s cannot be updated (%v)", id.Hex(), err)
         return errors.New("Error while updating thing attributes")
     }
+    t.emitChanged(id)
 
     return nil
 }
 
-func (t *Things) SetTelemetry(id primitive.ObjectID, telemetry string) (error) {
+// Set availability of the thing, event is emitted only if availability
+// really changed
+func (t *Things) SetAvailable(ctx *AuthContext, id primitive.ObjectID, available bool) (error) {
+    t.Log.Debugf("Setting thing <%s> availability to <%v>", id.Hex(), available)
+
+    if err := t.authorize(ctx, id); err != nil {
+        return err
+    }
+
+    _, err := t.setAvailable(id, available)
+    return err
+}
+
+// Set availability of thing without authorization, true is returned if
+// availability was changed
+func (t *Things) setAvailable(id primitive.ObjectID, available bool) (bool, error) {
+    now := int32(time.Now().Unix())
+
+    modified, err := t.Repo.SetAvailable(id, available, now)
+    if err != nil {
+        t.Log.Errorf("Thing %s cannot be updated (%v)", id.Hex(), err)
+        return false, errors.New("Error while updating thing attributes")
+    }
+
+    if modified {
+        value := VALUE_NO
+        if available {
+            value = VALUE_YES
+        }
+        t.Events.Emit(&Event{Type: EVENT_AVAILABILITY_CHANGED, ThingId: id, Time: now, Value: value})
+    }
+
+    return modified, nil
+}
+
+func (t *Things) SetTelemetry(ctx *AuthContext, id primitive.ObjectID, telemetry string) (error) {
     t.Log.Debugf("Setting thing <%s> telemetry", id.Hex())
 
-    _, err := t.Db.Collection("things").UpdateOne(context.TODO(), bson.M{"_id": id}, bson.M{"$set": bson.M{"telemetry": telemetry}})
+    if err := t.authorize(ctx, id); err != nil {
+        return err
+    }
+
+    err := t.Repo.SetFields(id, map[string]interface{}{"telemetry": telemetry})
     if err != nil {
         t.Log.Errorf("Thing %s cannot be updated (%v)", id.Hex(), err)
         return errors.New("Error while updating thing attributes")
@@ -191,65 +800,54 @@ func (t *Things) SetTelemetry(id primitive.ObjectID, telemetry string) (error) {
     return nil
 }
 
-func (t *Things) SetLocationMqttTopic(id primitive.ObjectID, topic string) (error) {
+func (t *Things) SetLocationMqttTopic(ctx *AuthContext, id primitive.ObjectID, topic string) (error) {
     t.Log.Debugf("Setting thing <%s>, setting location topic to <%s>", id.Hex(), topic)
 
-    _, err := t.Db.Collection("things").UpdateOne(context.TODO(), bson.M{"_id": id}, bson.M{"$set": bson.M{"loc_mqtt_topic": topic}})
+    if err := t.authorize(ctx, id); err != nil {
+        return err
+    }
+
+    err := t.Repo.SetFields(id, map[string]interface{}{"loc_mqtt_topic": topic})
     if err != nil {
         t.Log.Errorf("Thing %s cannot be updated (%v)", id.Hex(), err)
         return errors.New("Error while updating thing attributes")
     }
+    t.emitChanged(id)
 
     return nil
 }
 
-func (t *Things) SetLocationMqttValues(id primitive.ObjectID, lat, lng, sat, ts string) (error) {
+func (t *Things) SetLocationMqttValues(ctx *AuthContext, id primitive.ObjectID, lat, lng, sat, ts string) (error) {
     t.Log.Debugf("Setting thing <%s>, setting location mqtt params topic to <%s>, <%s>, <%s>, <%s>", id.Hex(), lat, lng, sat, ts)
 
-    params := bson.M{
+    if err := t.authorize(ctx, id); err != nil {
+        return err
+    }
+
+    params := map[string]interface{}{
         "loc_mqtt_lat_value": lat,
         "loc_mqtt_lng_value": lng,
         "loc_mqtt_sat_value": sat,
         "loc_mqtt_ts_value": ts,
     }
-    _, err := t.Db.Collection("things").UpdateOne(context.TODO(), bson.M{"_id": id}, bson.M{"$set": params})
+    err := t.Repo.SetFields(id, params)
     if err != nil {
         t.Log.Errorf("Thing %s cannot be updated (%v)", id.Hex(), err)
         return errors.New("Error while updating thing attributes")
     }
+    t.emitChanged(id)
 
     return nil
 }
 
-func (t *Things) SetLocation(id primitive.ObjectID, lat, lng float64, sat, ts int32) (error) {
+func (t *Things) SetLocation(ctx *AuthContext, id primitive.ObjectID, lat, lng float64, sat, ts int32) (error) {
     t.Log.Debugf("Setting thing <%s> location", id.Hex())
 
-    _, err := t.Db.Collection("things").UpdateOne(
-        context.TODO(),
-        bson.M{
-            "_id": id,
-            "$or": []interface{}{
-                bson.M{
-                    "loc_ts": bson.M{
-                        "$exists": false,
-                    },
-                },
-                bson.M{
-                    "loc_ts": bson.M{
-                        "$lte": ts,
-                    },
-                },
-            },
-        },
-        bson.M{
-            "$set": bson.M{
-                "loc_lat": lat,
-                "loc_lng": lng,
-                "loc_sat": sat,
-                "loc_ts": ts,
-            },
-        },
-    )
+    if err := t.authorize(ctx, id); err != nil {
+        return err
+    }
+
+    err := t.Repo.SetLocation(id, lat, lng, sat, ts)
 
     if err != nil {
         t.Log.Errorf("Thing %s cannot be updated (%v)", id.Hex(), err)
@@ -259,34 +857,76 @@ func (t *Things) SetLocation(id primitive.ObjectID, lat, lng float64, sat, ts in
     return nil
 }
 
-func (t *Things) SetSensorMeasurementTopic(id primitive.ObjectID, topic string) (error) {
+func (t *Things) SetSensorMeasurementTopic(ctx *AuthContext, id primitive.ObjectID, topic string) (error) {
     t.Log.Debugf("Setting thing <%s> sensor measurement topic to <%s>", id.Hex(), topic)
 
-    _, err := t.Db.Collection("things").UpdateOne(context.TODO(), bson.M{"_id": id}, bson.M{"$set": bson.M{"sensor.measurement_topic": topic}})
+    if err := t.authorize(ctx, id); err != nil {
+        return err
+    }
+
+    err := t.Repo.SetFields(id, map[string]interface{}{"sensor.measurement_topic": topic})
     if err != nil {
         t.Log.Errorf("Thing %s cannot be updated (%v)", id.Hex(), err)
         return errors.New("Error while updating thing attributes")
     }
+    t.emitChanged(id)
 
     return nil
 }
 
-func (t *Things) SetSensorClass(id primitive.ObjectID, class string) (error) {
+func (t *Things) SetSensorClass(ctx *AuthContext, id primitive.ObjectID, class string) (error) {
     t.Log.Debugf("Setting thing <%s> sensor class to <%s>", id.Hex(), class)
 
-    _, err := t.Db.Collection("things").UpdateOne(context.TODO(), bson.M{"_id": id}, bson.M{"$set": bson.M{"sensor.class": class}})
+    if err := t.authorize(ctx, id); err != nil {
+        return err
+    }
+
+    err := t.Repo.SetFields(id, map[string]interface{}{"sensor.class": class})
     if err != nil {
         t.Log.Errorf("Thing %s cannot be updated (%v)", id.Hex(), err)
         return errors.New("Error while updating thing attributes")
     }
+    t.emitChanged(id)
 
     return nil
 }
 
-func (t *Things) SetSensorValue(id primitive.ObjectID, value string) (error) {
+func (t *Things) SetSensorValue(ctx *AuthContext, id primitive.ObjectID, value string) (error) {
     t.Log.Debugf("Setting thing <%s> sensor value to <%s>", id, value)
 
-    _, err := t.Db.Collection("things").UpdateOne(context.TODO(), bson.M{"_id": id}, bson.M{"$set": bson.M{"sensor.value": value}})
+    if err := t.authorize(ctx, id); err != nil {
+        return err
+    }
+
+    update := map[string]interface{}{
+        "sensor.value": value,
+        "sensor.measurement_last": int32(time.Now().Unix()),
+        "sensor.stale": false,
+    }
+
+    err := t.Repo.SetFields(id, update)
+    if err != nil {
+        t.Log.Errorf("Thing %s cannot be updated (%v)", id.Hex(), err)
+        return errors.New("Error while updating thing attributes")
+    }
+
+    return nil
+}
+
+// Flag sensor value as stale, value is cleared if requested
+func (t *Things) SetSensorStale(ctx *AuthContext, id primitive.ObjectID, clear bool) (error) {
+    t.Log.Debugf("Setting thing <%s> sensor value as stale", id.Hex())
+
+    if err := t.authorize(ctx, id); err != nil {
+        return err
+    }
+
+    update := map[string]interface{}{"sensor.stale": true}
+    if clear {
+        update["sensor.value"] = ""
+    }
+
+    err := t.Repo.SetFields(id, update)
     if err != nil {
         t.Log.Errorf("Thing %s cannot be updated (%v)", id.Hex(), err)
         return errors.New("Error while updating thing attributes")
@@ -295,10 +935,59 @@ func (t *Things) SetSensorValue(id primitive.ObjectID, value string) (error) {
     return nil
 }
 
-func (t *Things) SetSwitchState(id primitive.ObjectID, value bool) (error) {
+// Get sensors of the org with measurement older than their validity
+func (t *Things) GetStaleSensors(ctx *AuthContext, orgId primitive.ObjectID) ([]*model.Thing, error) {
+    t.Log.Debugf("Get stale sensors of org <%s>", orgId.Hex())
+
+    if !ctx.IsOrgMember(orgId) {
+        return nil, NewForbiddenError("Sensors of org %s cannot be accessed", orgId.Hex())
+    }
+
+    return t.getStaleSensors(&ThingFilter{OrgIds: []primitive.ObjectID{orgId}})
+}
+
+func (t *Things) getStaleSensors(filter *ThingFilter) ([]*model.Thing, error) {
+    filter.Type = model.THING_TYPE_SENSOR
+    filter.HasValidity = true
+
+    sensors, err := t.GetFiltered(NewSystemContext(), filter)
+    if err != nil {
+        return nil, err
+    }
+
+    now := int32(time.Now().Unix())
+
+    var result []*model.Thing
+    for _, sensor := range sensors {
+        if sensor.Sensor.IsStale(now) {
+            result = append(result, sensor)
+        }
+    }
+
+    return result, nil
+}
+
+func (t *Things) SetSwitchState(ctx *AuthContext, id primitive.ObjectID, value bool) (error) {
     t.Log.Debugf("Setting thing <%s> switch value to <%v>", id, value)
 
-    _, err := t.Db.Collection("things").UpdateOne(context.TODO(), bson.M{"_id": id}, bson.M{"$set": bson.M{"switch.state": value}})
+    if err := t.authorize(ctx, id); err != nil {
+        return err
+    }
+
+    update := map[string]interface{}{
+        "switch.state": value,
+        "switch.reported_state": value,
+        "switch.reported_ts": int32(time.Now().Unix()),
+    }
+
+    err := t.Repo.SetFields(id, update)
+    if err != nil {
+        t.Log.Errorf("Thing %s cannot be updated (%v)", id.Hex(), err)
+        return errors.New("Error while updating thing attributes")
+    }
+
+    // switch is in sync if reported state matches desired state
+    err = t.Repo.ConfirmSwitchState(id, value)
     if err != nil {
         t.Log.Errorf("Thing %s cannot be updated (%v)", id.Hex(), err)
         return errors.New("Error while updating thing attributes")
@@ -307,16 +996,92 @@ func (t *Things) SetSwitchState(id primitive.ObjectID, value bool) (error) {
     return nil
 }
 
-func (t *Things) TouchThing(id primitive.ObjectID) (error) {
-    t.Log.Debugf("Touch thing <%s>", id.Hex())
+func (t *Things) SetSwitchDesiredState(ctx *AuthContext, id primitive.ObjectID, value bool) (error) {
+    t.Log.Debugf("Setting thing <%s> switch desired value to <%v>", id, value)
 
-    _, err := t.Db.Collection("things").UpdateOne(context.TODO(), bson.M{"_id": id}, bson.M{"$set": bson.M{"last_seen": int32(time.Now().Unix())}})
+    if err := t.authorize(ctx, id); err != nil {
+        return err
+    }
+
+    update := map[string]interface{}{
+        "switch.desired_state": value,
+        "switch.desired_ts": int32(time.Now().Unix()),
+        "switch.sync_status": model.SWITCH_SYNC_PENDING,
+        "switch.sync_retries": 0,
+    }
+
+    err := t.Repo.SetFields(id, update)
+    if err != nil {
+        t.Log.Errorf("Thing %s cannot be updated (%v)", id.Hex(), err)
+        return errors.New("Error while updating thing attributes")
+    }
+
+    return nil
+}
+
+func (t *Things) SetSwitchRetry(ctx *AuthContext, id primitive.ObjectID) (error) {
+    t.Log.Debugf("Setting thing <%s> switch command retry", id)
+
+    if err := t.authorize(ctx, id); err != nil {
+        return err
+    }
+
+    err := t.Repo.IncSwitchSyncRetries(id, int32(time.Now().Unix()))
     if err != nil {
-        e := fmt.Errorf("Thing <%s> cannot be touched (%v)", id.Hex(), err)
+        t.Log.Errorf("Thing %s cannot be updated (%v)", id.Hex(), err)
+        return errors.New("Error while updating thing attributes")
+    }
+
+    return nil
+}
+
+func (t *Things) SetSwitchSyncStatus(ctx *AuthContext, id primitive.ObjectID, status string) (error) {
+    t.Log.Debugf("Setting thing <%s> switch sync status to <%s>", id, status)
+
+    if err := t.authorize(ctx, id); err != nil {
+        return err
+    }
+
+    err := t.Repo.SetFields(id, map[string]interface{}{"switch.sync_status": status})
+    if err != nil {
+        t.Log.Errorf("Thing %s cannot be updated (%v)", id.Hex(), err)
+        return errors.New("Error while updating thing attributes")
+    }
+
+    return nil
+}
+
+func (t *Things) TouchThing(ctx *AuthContext, id primitive.ObjectID) (error) {
+    thing, err := t.Get(ctx, id)
+    if err != nil {
+        return err
+    }
+    return t.touchThing(ctx, thing)
+}
+
+// Update last seen time of thing, things without availability topic don't
+// report availability, they are available whenever they are seen (see
+// Watchdog)
+func (t *Things) touchThing(ctx *AuthContext, thing *model.Thing) (error) {
+    t.Log.Debugf("Touch thing <%s>", thing.Id.Hex())
+
+    if err := t.authorize(ctx, thing.Id); err != nil {
+        return err
+    }
+
+    err := t.Repo.SetFields(thing.Id, map[string]interface{}{"last_seen": int32(time.Now().Unix())})
+    if err != nil {
+        e := fmt.Errorf("Thing <%s> cannot be touched (%v)", thing.Id.Hex(), err)
         t.Log.Errorf(e.Error())
         return e
     }
 
+    if thing.AvailabilityTopic == "" {
+        if _, err := t.setAvailable(thing.Id, true); err != nil {
+            return err
+        }
+    }
+
     return nil
 }
 
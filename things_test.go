@@ -2,7 +2,9 @@ package piot_test
 
 import (
     "testing"
+    "time"
     "github.com/mnezerka/go-piot"
+    "github.com/mnezerka/go-piot/model"
     "github.com/mnezerka/go-piot/test"
     "go.mongodb.org/mongo-driver/bson/primitive"
 )
@@ -10,11 +12,12 @@ import (
 func TestGetExistingThing(t *testing.T) {
     db := test.GetDb(t)
     test.CleanDb(t, db)
-    things := piot.NewThings(test.GetDb(t), test.GetLogger(t))
+    ctx := test.GetContext(t)
+    things := piot.NewThings(test.GetLogger(t), test.GetDb(t))
 
     id := test.CreateThing(t, db, "thing1")
 
-    thing, err := things.Get(id)
+    thing, err := things.Get(ctx, id)
     test.Ok(t, err)
     test.Assert(t, thing.Name == "thing1", "Wrong thing name")
 }
@@ -23,36 +26,40 @@ func TestGetExistingThing(t *testing.T) {
 func TestGetUnknownThing(t *testing.T) {
     db := test.GetDb(t)
     test.CleanDb(t, db)
-    things := piot.NewThings(test.GetDb(t), test.GetLogger(t))
+    ctx := test.GetContext(t)
+    things := piot.NewThings(test.GetLogger(t), test.GetDb(t))
 
     id := primitive.NewObjectID()
 
-    _, err := things.Get(id)
+    _, err := things.Get(ctx, id)
     test.Assert(t, err != nil, "Thing shall not be found")
 }
 
 func TestFindUnknownThing(t *testing.T) {
     db := test.GetDb(t)
     test.CleanDb(t, db)
-    things := piot.NewThings(test.GetDb(t), test.GetLogger(t))
-    _, err := things.Find("xx")
+    ctx := test.GetContext(t)
+    things := piot.NewThings(test.GetLogger(t), test.GetDb(t))
+    _, err := things.Find(ctx, "xx")
     test.Assert(t, err != nil, "Thing shall not be found")
 }
 
 func TestFindExistingThing(t *testing.T) {
     db := test.GetDb(t)
     test.CleanDb(t, db)
+    ctx := test.GetContext(t)
     test.CreateThing(t, db, "thing1")
-    things := piot.NewThings(test.GetDb(t), test.GetLogger(t))
-    _, err := things.Find("thing1")
+    things := piot.NewThings(test.GetLogger(t), test.GetDb(t))
+    _, err := things.Find(ctx, "thing1")
     test.Ok(t, err)
 }
 
 func TestRegisterThing(t *testing.T) {
     db := test.GetDb(t)
     test.CleanDb(t, db)
-    things := piot.NewThings(test.GetDb(t), test.GetLogger(t))
-    thing, err := things.RegisterPiot("thing1", "sensor")
+    ctx := test.GetContext(t)
+    things := piot.NewThings(test.GetLogger(t), test.GetDb(t))
+    thing, err := things.RegisterPiot(ctx, "thing1", "sensor")
     test.Ok(t, err)
     test.Equals(t, "thing1", thing.PiotId)
     test.Assert(t, thing.Name == "thing1", "Wrong thing name")
@@ -62,6 +69,7 @@ func TestRegisterThing(t *testing.T) {
 func TestSetParent(t *testing.T) {
     db := test.GetDb(t)
     test.CleanDb(t, db)
+    ctx := test.GetContext(t)
 
     const THING_NAME_PARENT = "parent"
     id_parent := test.CreateThing(t, db, THING_NAME_PARENT)
@@ -69,12 +77,12 @@ func TestSetParent(t *testing.T) {
     const THING_NAME_CHILD = "child"
     id_child := test.CreateThing(t, db, THING_NAME_CHILD)
 
-    things := piot.NewThings(test.GetDb(t), test.GetLogger(t))
+    things := piot.NewThings(test.GetLogger(t), test.GetDb(t))
 
-    err := things.SetParent(id_child, id_parent)
+    err := things.SetParent(ctx, id_child, id_parent)
     test.Ok(t, err)
 
-    thing, err := things.Get(id_child)
+    thing, err := things.Get(ctx, id_child)
     test.Ok(t, err)
     test.Equals(t, THING_NAME_CHILD, thing.Name)
     test.Equals(t, id_parent, thing.ParentId)
@@ -87,16 +95,17 @@ func TestSetParent(t *testing.T) {
 func TestTouchThing(t *testing.T) {
     db := test.GetDb(t)
     test.CleanDb(t, db)
+    ctx := test.GetContext(t)
 
     const THING_NAME = "parent"
     id := test.CreateThing(t, db, THING_NAME)
 
-    things := piot.NewThings(test.GetDb(t), test.GetLogger(t))
+    things := piot.NewThings(test.GetLogger(t), test.GetDb(t))
 
-    err := things.TouchThing(id)
+    err := things.TouchThing(ctx, id)
     test.Ok(t, err)
 
-    thing, err := things.Get(id)
+    thing, err := things.Get(ctx, id)
     test.Ok(t, err)
     test.Equals(t, THING_NAME, thing.Name)
     // TODO check date
@@ -106,14 +115,15 @@ func TestSetAvailabilityAttributes(t *testing.T) {
     const THING_NAME = "thing2"
     db := test.GetDb(t)
     test.CleanDb(t, db)
+    ctx := test.GetContext(t)
     thingId := test.CreateThing(t, db, THING_NAME)
-    things := piot.NewThings(test.GetDb(t), test.GetLogger(t))
-    err := things.SetAvailabilityTopic(thingId, "available")
+    things := piot.NewThings(test.GetLogger(t), test.GetDb(t))
+    err := things.SetAvailabilityTopic(ctx, thingId, "available")
     test.Ok(t, err)
-    err = things.SetAvailabilityYesNo(thingId, "yes", "no")
+    err = things.SetAvailabilityYesNo(ctx, thingId, "yes", "no")
     test.Ok(t, err)
 
-    thing, err := things.Find(THING_NAME)
+    thing, err := things.Find(ctx, THING_NAME)
     test.Ok(t, err)
     test.Equals(t, THING_NAME, thing.Name)
     test.Equals(t, "available", thing.AvailabilityTopic)
@@ -125,16 +135,17 @@ func TestSetLocationAttributes(t *testing.T) {
     const THING_NAME = "thing2"
     db := test.GetDb(t)
     test.CleanDb(t, db)
+    ctx := test.GetContext(t)
     thingId := test.CreateThing(t, db, THING_NAME)
-    things := piot.NewThings(test.GetDb(t), test.GetLogger(t))
+    things := piot.NewThings(test.GetLogger(t), test.GetDb(t))
 
-    err := things.SetLocationMqttTopic(thingId, "loctopic")
+    err := things.SetLocationMqttTopic(ctx, thingId, "loctopic")
     test.Ok(t, err)
 
-    err = things.SetLocationMqttValues(thingId, "latval", "lngval", "satval", "tsval")
+    err = things.SetLocationMqttValues(ctx, thingId, "latval", "lngval", "satval", "tsval")
     test.Ok(t, err)
 
-    thing, err := things.Find(THING_NAME)
+    thing, err := things.Find(ctx, THING_NAME)
     test.Ok(t, err)
     test.Equals(t, THING_NAME, thing.Name)
     test.Equals(t, "loctopic", thing.LocationMqttTopic)
@@ -148,13 +159,14 @@ func TestSetLocation(t *testing.T) {
     const THING_NAME = "thing2"
     db := test.GetDb(t)
     test.CleanDb(t, db)
+    ctx := test.GetContext(t)
     thingId := test.CreateThing(t, db, THING_NAME)
-    things := piot.NewThings(test.GetDb(t), test.GetLogger(t))
+    things := piot.NewThings(test.GetLogger(t), test.GetDb(t))
 
-    err := things.SetLocation(thingId, 23.12, 56.33333, 4, 0)
+    err := things.SetLocation(ctx, thingId, 23.12, 56.33333, 4, 0)
     test.Ok(t, err)
 
-    thing, err := things.Find(THING_NAME)
+    thing, err := things.Find(ctx, THING_NAME)
     test.Ok(t, err)
     test.Equals(t, THING_NAME, thing.Name)
     test.Equals(t, 23.12, thing.LocationLatitude)
@@ -162,19 +174,19 @@ func TestSetLocation(t *testing.T) {
     test.Equals(t, int32(4), thing.LocationSatelites)
 
     // check that current value is overwritten by more recent measurement
-    err = things.SetLocation(thingId, 1.1, 2.2, 1, 1000)
+    err = things.SetLocation(ctx, thingId, 1.1, 2.2, 1, 1000)
     test.Ok(t, err)
 
-    thing, err = things.Find(THING_NAME)
+    thing, err = things.Find(ctx, THING_NAME)
     test.Ok(t, err)
     test.Equals(t, THING_NAME, thing.Name)
     test.Equals(t, 1.1, thing.LocationLatitude)
 
     // check that current value is not overwritten by old measurement
-    err = things.SetLocation(thingId, 9.10, 10.11, 1, 900)
+    err = things.SetLocation(ctx, thingId, 9.10, 10.11, 1, 900)
     test.Ok(t, err)
 
-    thing, err = things.Find(THING_NAME)
+    thing, err = things.Find(ctx, THING_NAME)
     test.Ok(t, err)
     test.Equals(t, THING_NAME, thing.Name)
     test.Equals(t, 1.1, thing.LocationLatitude)
@@ -184,17 +196,372 @@ func TestSetSensorAttributes(t *testing.T) {
     const THING_NAME = "thing2"
     db := test.GetDb(t)
     test.CleanDb(t, db)
+    ctx := test.GetContext(t)
     thingId := test.CreateThing(t, db, THING_NAME)
-    things := piot.NewThings(test.GetDb(t), test.GetLogger(t))
-    err := things.SetSensorMeasurementTopic(thingId, "value")
+    things := piot.NewThings(test.GetLogger(t), test.GetDb(t))
+    err := things.SetSensorMeasurementTopic(ctx, thingId, "value")
     test.Ok(t, err)
 
-    err = things.SetSensorClass(thingId, "temperature")
+    err = things.SetSensorClass(ctx, thingId, "temperature")
     test.Ok(t, err)
 
-    thing, err := things.Find(THING_NAME)
+    thing, err := things.Find(ctx, THING_NAME)
     test.Ok(t, err)
     test.Equals(t, THING_NAME, thing.Name)
     test.Equals(t, "value", thing.Sensor.MeasurementTopic)
     test.Equals(t, "temperature", thing.Sensor.Class)
 }
+
+func TestSetSensorValue(t *testing.T) {
+    const THING_NAME = "thing2"
+    db := test.GetDb(t)
+    test.CleanDb(t, db)
+    ctx := test.GetContext(t)
+    thingId := test.CreateThing(t, db, THING_NAME)
+    things := piot.NewThings(test.GetLogger(t), test.GetDb(t))
+
+    err := things.SetSensorValue(ctx, thingId, "23")
+    test.Ok(t, err)
+
+    thing, err := things.Get(ctx, thingId)
+    test.Ok(t, err)
+    test.Equals(t, "23", thing.Sensor.Value)
+    test.Equals(t, int32(time.Now().Unix() / 60), thing.Sensor.MeasurementLast / 60)
+    test.Equals(t, false, thing.Sensor.Stale)
+}
+
+func TestGetStaleSensors(t *testing.T) {
+    db := test.GetDb(t)
+    test.CleanDb(t, db)
+    ctx := test.GetContext(t)
+    things := piot.NewThings(test.GetLogger(t), test.GetDb(t))
+    now := int32(time.Now().Unix())
+
+    orgId := test.CreateOrg(t, db, "org1")
+
+    // valid measurement
+    id1 := test.CreateThing(t, db, "sensor1")
+    test.SetSensorValidity(t, db, id1, 60, now - 10)
+    test.AddOrgThing(t, db, orgId, "sensor1")
+
+    // stale measurement
+    id2 := test.CreateThing(t, db, "sensor2")
+    test.SetSensorValidity(t, db, id2, 60, now - 100)
+    test.AddOrgThing(t, db, orgId, "sensor2")
+
+    // old measurement, but no validity
+    id3 := test.CreateThing(t, db, "sensor3")
+    test.SetSensorValidity(t, db, id3, 0, now - 100)
+    test.AddOrgThing(t, db, orgId, "sensor3")
+
+    // stale measurement of sensor from different org
+    id4 := test.CreateThing(t, db, "sensor4")
+    test.SetSensorValidity(t, db, id4, 60, now - 100)
+
+    sensors, err := things.GetStaleSensors(ctx, orgId)
+    test.Ok(t, err)
+    test.Equals(t, 1, len(sensors))
+    test.Equals(t, id2, sensors[0].Id)
+}
+
+func TestCreateThing(t *testing.T) {
+    db := test.GetDb(t)
+    test.CleanDb(t, db)
+    ctx := test.GetContext(t)
+    things := piot.NewThings(test.GetLogger(t), db)
+
+    thing, err := things.Create(ctx, &model.Thing{Name: "thing1", Type: model.THING_TYPE_SENSOR})
+    test.Ok(t, err)
+    test.Assert(t, thing.Id != primitive.NilObjectID, "Thing id not assigned")
+    test.Assert(t, thing.Created > 0, "Creation time not set")
+
+    stored, err := things.Get(ctx, thing.Id)
+    test.Ok(t, err)
+    test.Equals(t, "thing1", stored.Name)
+    test.Equals(t, model.THING_TYPE_SENSOR, stored.Type)
+
+    // name has to be unique
+    _, err = things.Create(ctx, &model.Thing{Name: "thing1", Type: model.THING_TYPE_SENSOR})
+    test.Assert(t, err != nil, "Thing with duplicate name shall not be created")
+
+    // type has to be known
+    _, err = things.Create(ctx, &model.Thing{Name: "thing2", Type: "xx"})
+    test.Assert(t, err != nil, "Thing of unknown type shall not be created")
+
+    // name is mandatory
+    _, err = things.Create(ctx, &model.Thing{Type: model.THING_TYPE_DEVICE})
+    test.Assert(t, err != nil, "Thing without name shall not be created")
+}
+
+func TestUpdateThing(t *testing.T) {
+    db := test.GetDb(t)
+    test.CleanDb(t, db)
+    ctx := test.GetContext(t)
+    things := piot.NewThings(test.GetLogger(t), db)
+
+    id := test.CreateThing(t, db, "thing1")
+    parentId := test.CreateThing(t, db, "parent")
+    test.CreateThing(t, db, "thing2")
+
+    // values as decoded from JSON
+    thing, err := things.Update(ctx, id, map[string]interface{}{
+        "alias": "alias1",
+        "enabled": true,
+        "last_seen_interval": float64(60),
+        "parent_id": parentId.Hex(),
+        "sensor.class": model.THING_CLASS_TEMPERATURE,
+        "sink_intervals": map[string]interface{}{model.SINK_POSTGRESDB: float64(60)},
+    })
+    test.Ok(t, err)
+    test.Equals(t, "thing1", thing.Name)
+    test.Equals(t, int32(60), thing.GetSinkInterval(model.SINK_POSTGRESDB))
+    test.Equals(t, int32(0), thing.GetSinkInterval(model.SINK_MYSQLDB))
+    test.Equals(t, "alias1", thing.Alias)
+    test.Equals(t, true, thing.Enabled)
+    test.Equals(t, int32(60), thing.LastSeenInterval)
+    test.Equals(t, parentId, thing.ParentId)
+    test.Equals(t, model.THING_CLASS_TEMPERATURE, thing.Sensor.Class)
+
+    // runtime state cannot be updated
+    _, err = things.Update(ctx, id, map[string]interface{}{"last_seen": float64(10)})
+    test.Assert(t, err != nil, "Attribute last_seen shall not be updatable")
+
+    // invalid values
+    _, err = things.Update(ctx, id, map[string]interface{}{"enabled": "yes"})
+    test.Assert(t, err != nil, "Attribute of wrong type shall not be accepted")
+    _, err = things.Update(ctx, id, map[string]interface{}{"last_seen_interval": float64(-1)})
+    test.Assert(t, err != nil, "Negative interval shall not be accepted")
+    _, err = things.Update(ctx, id, map[string]interface{}{"sink_intervals": map[string]interface{}{model.SINK_POSTGRESDB: float64(-1)}})
+    test.Assert(t, err != nil, "Negative storage interval shall not be accepted")
+    _, err = things.Update(ctx, id, map[string]interface{}{"name": "thing2"})
+    test.Assert(t, err != nil, "Duplicate name shall not be accepted")
+    _, err = things.Update(ctx, id, map[string]interface{}{"parent_id": id.Hex()})
+    test.Assert(t, err != nil, "Thing shall not be parent of itself")
+
+    // failed updates are not applied partially
+    thing, err = things.Get(ctx, id)
+    test.Ok(t, err)
+    test.Equals(t, true, thing.Enabled)
+    test.Equals(t, int32(60), thing.LastSeenInterval)
+}
+
+func TestDeleteThing(t *testing.T) {
+    db := test.GetDb(t)
+    test.CleanDb(t, db)
+    ctx := test.GetContext(t)
+    things := piot.NewThings(test.GetLogger(t), db)
+
+    rootId := test.CreateThing(t, db, "root")
+    parentId := test.CreateThing(t, db, "parent")
+    childId := test.CreateThing(t, db, "child")
+    test.Ok(t, things.SetParent(ctx, parentId, rootId))
+    test.Ok(t, things.SetParent(ctx, childId, parentId))
+
+    // children are re-assigned to parent of deleted thing
+    test.Ok(t, things.Delete(ctx, parentId, false))
+    _, err := things.Get(ctx, parentId)
+    test.Assert(t, err != nil, "Thing shall be deleted")
+    child, err := things.Get(ctx, childId)
+    test.Ok(t, err)
+    test.Equals(t, rootId, child.ParentId)
+
+    // children are deleted together with parent
+    test.Ok(t, things.Delete(ctx, rootId, true))
+    _, err = things.Get(ctx, rootId)
+    test.Assert(t, err != nil, "Thing shall be deleted")
+    _, err = things.Get(ctx, childId)
+    test.Assert(t, err != nil, "Child thing shall be deleted")
+
+    err = things.Delete(ctx, rootId, true)
+    test.Assert(t, err != nil, "Unknown thing shall not be deleted")
+}
+
+// Nothing is deleted if any thing of the subtree cannot be modified
+func TestDeleteThingForeignChild(t *testing.T) {
+    db := test.GetDb(t)
+    test.CleanDb(t, db)
+    things := piot.NewThings(test.GetLogger(t), db)
+
+    orgId := test.CreateOrg(t, db, "org1")
+    foreignOrgId := test.CreateOrg(t, db, "org2")
+    rootId := test.CreateThing(t, db, "root")
+    test.AddOrgThing(t, db, orgId, "root")
+    childId := test.CreateThing(t, db, "child")
+    test.AddOrgThing(t, db, orgId, "child")
+    foreignId := test.CreateThing(t, db, "foreign")
+    test.AddOrgThing(t, db, foreignOrgId, "foreign")
+    test.Ok(t, db.Things.SetFields(childId, map[string]interface{}{"parent_id": rootId}))
+    test.Ok(t, db.Things.SetFields(foreignId, map[string]interface{}{"parent_id": rootId}))
+
+    ctx := piot.NewAuthContext(&model.User{Id: primitive.NewObjectID(), Orgs: []model.Org{{Id: orgId}}})
+    ctx.OrgRoles[orgId] = model.ORG_ROLE_EDITOR
+
+    err := things.Delete(ctx, rootId, true)
+    test.Assert(t, piot.IsForbidden(err), "Subtree with foreign thing shall not be deleted")
+    for _, id := range []primitive.ObjectID{rootId, childId, foreignId} {
+        _, err = db.Things.Get(id)
+        test.Ok(t, err)
+    }
+}
+
+// Thing cannot be assigned to parent which is its descendant
+func TestThingParentCycle(t *testing.T) {
+    db := test.GetDb(t)
+    test.CleanDb(t, db)
+    ctx := test.GetContext(t)
+    things := piot.NewThings(test.GetLogger(t), db)
+
+    aId := test.CreateThing(t, db, "a")
+    bId := test.CreateThing(t, db, "b")
+    cId := test.CreateThing(t, db, "c")
+    test.Ok(t, things.SetParent(ctx, bId, aId))
+    test.Ok(t, things.SetParent(ctx, cId, bId))
+
+    _, err := things.Update(ctx, aId, map[string]interface{}{"parent_id": bId.Hex()})
+    test.Assert(t, err != nil, "Child shall not be parent of its parent")
+    _, err = things.Update(ctx, aId, map[string]interface{}{"parent_id": cId.Hex()})
+    test.Assert(t, err != nil, "Descendant shall not be parent of its ancestor")
+    err = things.SetParent(ctx, aId, cId)
+    test.Assert(t, err != nil, "Descendant shall not be parent of its ancestor")
+    err = things.SetParent(ctx, aId, aId)
+    test.Assert(t, err != nil, "Thing shall not be parent of itself")
+
+    thing, err := things.Get(ctx, aId)
+    test.Ok(t, err)
+    test.Equals(t, primitive.NilObjectID, thing.ParentId)
+
+    // moving thing to other branch is fine
+    _, err = things.Update(ctx, cId, map[string]interface{}{"parent_id": aId.Hex()})
+    test.Ok(t, err)
+    _, err = things.Update(ctx, bId, map[string]interface{}{"parent_id": cId.Hex()})
+    test.Ok(t, err)
+}
+
+func TestListThings(t *testing.T) {
+    db := test.GetDb(t)
+    test.CleanDb(t, db)
+    ctx := test.GetContext(t)
+    things := piot.NewThings(test.GetLogger(t), db)
+
+    orgId := test.CreateOrg(t, db, "org1")
+    for _, name := range []string{"sensor3", "sensor1", "Sensor2", "device1"} {
+        test.CreateThing(t, db, name)
+        test.AddOrgThing(t, db, orgId, name)
+    }
+    test.CreateThing(t, db, "sensor4")
+
+    list, err := things.List(ctx, orgId, "sensor", piot.Page{}, "")
+    test.Ok(t, err)
+    test.Equals(t, int64(3), list.Total)
+    test.Equals(t, 3, len(list.Things))
+
+    list, err = things.List(ctx, orgId, "", piot.Page{Offset: 1, Limit: 2}, "-name")
+    test.Ok(t, err)
+    test.Equals(t, int64(4), list.Total)
+    test.Equals(t, 2, len(list.Things))
+    test.Equals(t, "sensor1", list.Things[0].Name)
+    test.Equals(t, "device1", list.Things[1].Name)
+
+    list, err = things.List(ctx, primitive.NilObjectID, "SENSOR", piot.Page{}, "name")
+    test.Ok(t, err)
+    test.Equals(t, int64(4), list.Total)
+
+    _, err = things.List(ctx, orgId, "", piot.Page{}, "telemetry")
+    test.Assert(t, err != nil, "Sorting by unknown attribute shall fail")
+}
+
+func TestThingsAuthorization(t *testing.T) {
+    db := test.GetDb(t)
+    test.CleanDb(t, db)
+    things := piot.NewThings(test.GetLogger(t), db)
+
+    orgId := test.CreateOrg(t, db, "org1")
+    foreignOrgId := test.CreateOrg(t, db, "org2")
+    id := test.CreateThing(t, db, "thing1")
+    test.AddOrgThing(t, db, orgId, "thing1")
+    foreignId := test.CreateThing(t, db, "thing2")
+    test.AddOrgThing(t, db, foreignOrgId, "thing2")
+    test.CreateThing(t, db, "thing3")
+
+    ctx := piot.NewAuthContext(&model.User{Id: primitive.NewObjectID(), Orgs: []model.Org{{Id: orgId}}})
+    ctx.OrgRoles[orgId] = model.ORG_ROLE_EDITOR
+
+    // things of own org
+    _, err := things.Get(ctx, id)
+    test.Ok(t, err)
+    test.Ok(t, things.SetSensorClass(ctx, id, model.THING_CLASS_TEMPERATURE))
+
+    // things of foreign org
+    _, err = things.Get(ctx, foreignId)
+    test.Assert(t, piot.IsForbidden(err), "Thing of foreign org shall not be accessible")
+    err = things.SetSensorClass(ctx, foreignId, model.THING_CLASS_TEMPERATURE)
+    test.Assert(t, piot.IsForbidden(err), "Thing of foreign org shall not be modified")
+    _, err = things.Update(ctx, id, map[string]interface{}{"org_id": foreignOrgId.Hex()})
+    test.Assert(t, piot.IsForbidden(err), "Thing shall not be moved to foreign org")
+    err = things.Delete(ctx, foreignId, false)
+    test.Assert(t, piot.IsForbidden(err), "Thing of foreign org shall not be deleted")
+    _, err = things.List(ctx, foreignOrgId, "", piot.Page{}, "")
+    test.Assert(t, piot.IsForbidden(err), "Things of foreign org shall not be listed")
+    _, err = things.Create(ctx, &model.Thing{Name: "thing4", Type: model.THING_TYPE_DEVICE})
+    test.Assert(t, piot.IsForbidden(err), "Thing without org shall not be created")
+
+    // queries are restricted to own orgs
+    list, err := things.List(ctx, primitive.NilObjectID, "", piot.Page{}, "")
+    test.Ok(t, err)
+    test.Equals(t, int64(1), list.Total)
+    result, err := things.GetFiltered(ctx, &piot.ThingFilter{})
+    test.Ok(t, err)
+    test.Equals(t, 1, len(result))
+
+    // context without user has no access
+    _, err = things.Get(piot.NewAuthContext(nil), id)
+    test.Assert(t, piot.IsForbidden(err), "Anonymous context shall have no access")
+
+    // admin and system have access to all things
+    list, err = things.List(piot.NewAuthContext(&model.User{IsAdmin: true}), primitive.NilObjectID, "", piot.Page{}, "")
+    test.Ok(t, err)
+    test.Equals(t, int64(3), list.Total)
+    result, err = things.GetFiltered(piot.NewSystemContext(), &piot.ThingFilter{})
+    test.Ok(t, err)
+    test.Equals(t, 3, len(result))
+}
+
+func TestThingsViewerRole(t *testing.T) {
+    db := test.GetDb(t)
+    test.CleanDb(t, db)
+    things := piot.NewThings(test.GetLogger(t), db)
+
+    orgId := test.CreateOrg(t, db, "org1")
+    id := test.CreateThing(t, db, "thing1")
+    test.AddOrgThing(t, db, orgId, "thing1")
+
+    ctx := piot.NewAuthContext(&model.User{Id: primitive.NewObjectID()})
+    ctx.OrgRoles[orgId] = model.ORG_ROLE_VIEWER
+
+    // viewer can read things
+    _, err := things.Get(ctx, id)
+    test.Ok(t, err)
+    list, err := things.List(ctx, orgId, "", piot.Page{}, "")
+    test.Ok(t, err)
+    test.Equals(t, int64(1), list.Total)
+
+    // but cannot modify them
+    err = things.SetSensorMeasurementTopic(ctx, id, "topic")
+    test.Assert(t, piot.IsForbidden(err), "Viewer shall not change topics")
+    _, err = things.Update(ctx, id, map[string]interface{}{"store_influxdb": true})
+    test.Assert(t, piot.IsForbidden(err), "Viewer shall not change storage flags")
+    err = things.SetSwitchDesiredState(ctx, id, true)
+    test.Assert(t, piot.IsForbidden(err), "Viewer shall not change switch state")
+    err = things.Delete(ctx, id, false)
+    test.Assert(t, piot.IsForbidden(err), "Viewer shall not delete things")
+
+    ctx.OrgRoles[orgId] = model.ORG_ROLE_EDITOR
+    test.Ok(t, things.SetSensorMeasurementTopic(ctx, id, "topic"))
+
+    // membership taken from user orgs gives viewer role only
+    ctx = piot.NewAuthContext(&model.User{Id: primitive.NewObjectID(), Orgs: []model.Org{{Id: orgId}}})
+    _, err = things.Get(ctx, id)
+    test.Ok(t, err)
+    _, err = things.Update(ctx, id, map[string]interface{}{"alias": "alias"})
+    test.Assert(t, piot.IsForbidden(err), "Viewer shall not update things")
+}
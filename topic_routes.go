@@ -0,0 +1,177 @@
+package piot
+
+import (
+    "sync"
+    "time"
+    "github.com/op/go-logging"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "github.com/mnezerka/go-piot/model"
+)
+
+// roles of things subscribed to topic
+const ROUTE_AVAILABILITY = "availability"
+const ROUTE_TELEMETRY = "telemetry"
+const ROUTE_LOCATION = "location"
+const ROUTE_MEASUREMENT = "measurement"
+const ROUTE_SWITCH_STATE = "switch_state"
+
+type topicRoute struct {
+    topic string
+    role string
+}
+
+// index of single org
+type orgRoutes struct {
+    things map[topicRoute][]*model.Thing
+    built time.Time
+}
+
+// Index of things by topics they are subscribed to. Index of org is built
+// on first lookup by single query and dropped whenever configuration of any
+// thing changes (see EVENT_THING_CHANGED), so lookups for incoming
+// messages don't hit database. Changes done outside of the process (other
+// instance or direct database access) are visible after ttl expires
+type TopicRoutes struct {
+    log *logging.Logger
+    things *Things
+
+    mutex sync.RWMutex
+    orgs map[primitive.ObjectID]*orgRoutes
+
+    // index of org older than ttl is rebuilt, 0 means no expiration
+    ttl time.Duration
+
+    // incremented on each invalidation, index built from data fetched
+    // before invalidation is not stored
+    generation int64
+}
+
+func NewTopicRoutes(log *logging.Logger, things *Things, ttl time.Duration) *TopicRoutes {
+    r := &TopicRoutes{log: log, things: things, ttl: ttl}
+    r.orgs = make(map[primitive.ObjectID]*orgRoutes)
+
+    things.Events.Subscribe(func(event *Event) {
+        if event.Type == EVENT_THING_CHANGED {
+            r.Invalidate()
+        }
+    })
+
+    return r
+}
+
+// Set expiration of index, it applies to indexes of orgs built before
+// the change too
+func (r *TopicRoutes) SetTtl(ttl time.Duration) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    r.ttl = ttl
+}
+
+// roles of things in order used by LookupTopic
+var topicRouteRoles = []string{ROUTE_AVAILABILITY, ROUTE_TELEMETRY, ROUTE_LOCATION, ROUTE_MEASUREMENT, ROUTE_SWITCH_STATE}
+
+// Get things of the org subscribed to topic in given role. Things are
+// returned as they were when index was built, so only configuration
+// attributes are valid (runtime state like switch state is not), returned
+// records are shared and must not be modified
+func (r *TopicRoutes) Lookup(orgId primitive.ObjectID, topic, role string) ([]*model.Thing, error) {
+    if topic == "" {
+        return nil, nil
+    }
+
+    routes, err := r.get(orgId)
+    if err != nil {
+        return nil, err
+    }
+
+    return routes.things[topicRoute{topic, role}], nil
+}
+
+// Get things of the org subscribed to topic in any role, see Lookup
+func (r *TopicRoutes) LookupTopic(orgId primitive.ObjectID, topic string) ([]*model.Thing, error) {
+    if topic == "" {
+        return nil, nil
+    }
+
+    routes, err := r.get(orgId)
+    if err != nil {
+        return nil, err
+    }
+
+    var result []*model.Thing
+    for _, role := range topicRouteRoles {
+        result = append(result, routes.things[topicRoute{topic, role}]...)
+    }
+
+    return result, nil
+}
+
+// Get index of org, index is built if it doesn't exist or expired
+func (r *TopicRoutes) get(orgId primitive.ObjectID) (*orgRoutes, error) {
+    r.mutex.RLock()
+    routes, ok := r.orgs[orgId]
+    if ok && r.ttl > 0 && time.Since(routes.built) > r.ttl {
+        ok = false
+    }
+    generation := r.generation
+    r.mutex.RUnlock()
+
+    if !ok {
+        var err error
+        routes, err = r.build(orgId)
+        if err != nil {
+            return nil, err
+        }
+
+        r.mutex.Lock()
+        if r.generation == generation {
+            r.orgs[orgId] = routes
+        }
+        r.mutex.Unlock()
+    }
+
+    return routes, nil
+}
+
+// Drop index of all orgs
+func (r *TopicRoutes) Invalidate() {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+
+    r.orgs = make(map[primitive.ObjectID]*orgRoutes)
+    r.generation++
+}
+
+func (r *TopicRoutes) build(orgId primitive.ObjectID) (*orgRoutes, error) {
+    r.log.Debugf("Building topic routes of org <%s>", orgId.Hex())
+
+    built := time.Now()
+
+    things, err := r.things.GetFiltered(NewSystemContext(), &ThingFilter{OrgIds: []primitive.ObjectID{orgId}})
+    if err != nil {
+        return nil, err
+    }
+
+    routes := &orgRoutes{things: make(map[topicRoute][]*model.Thing), built: built}
+    add := func(thing *model.Thing, topic, role string) {
+        if topic != "" {
+            key := topicRoute{topic, role}
+            routes.things[key] = append(routes.things[key], thing)
+        }
+    }
+
+    for _, thing := range things {
+        switch thing.Type {
+        case model.THING_TYPE_DEVICE:
+            add(thing, thing.AvailabilityTopic, ROUTE_AVAILABILITY)
+            add(thing, thing.TelemetryTopic, ROUTE_TELEMETRY)
+            add(thing, thing.LocationMqttTopic, ROUTE_LOCATION)
+        case model.THING_TYPE_SENSOR:
+            add(thing, thing.Sensor.MeasurementTopic, ROUTE_MEASUREMENT)
+        case model.THING_TYPE_SWITCH:
+            add(thing, thing.Switch.StateTopic, ROUTE_SWITCH_STATE)
+        }
+    }
+
+    return routes, nil
+}
@@ -0,0 +1,111 @@
+package piot_test
+
+import (
+    "testing"
+    "time"
+    "github.com/mnezerka/go-piot"
+    "github.com/mnezerka/go-piot/test"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestTopicRoutes(t *testing.T) {
+    const SENSOR = "sensor"
+    const ORG = "org"
+
+    db := test.GetDb(t)
+    log := test.GetLogger(t)
+    test.CleanDb(t, db)
+    ctx := test.GetContext(t)
+    things := test.GetThings(t, log, db)
+    routes := piot.NewTopicRoutes(log, things, 0)
+
+    sensorId := test.CreateThing(t, db, SENSOR)
+    orgId := test.CreateOrg(t, db, ORG)
+    test.AddOrgThing(t, db, orgId, SENSOR)
+
+    lookup := func(orgId primitive.ObjectID, topic, role string) ([]primitive.ObjectID, error) {
+        routed, err := routes.Lookup(orgId, topic, role)
+        var ids []primitive.ObjectID
+        for _, thing := range routed {
+            ids = append(ids, thing.Id)
+        }
+        return ids, err
+    }
+
+    ids, err := lookup(orgId, "value", piot.ROUTE_MEASUREMENT)
+    test.Ok(t, err)
+    test.Equals(t, []primitive.ObjectID{sensorId}, ids)
+
+    // topic in any role
+    routed, err := routes.LookupTopic(orgId, "value")
+    test.Ok(t, err)
+    test.Equals(t, 1, len(routed))
+    test.Equals(t, sensorId, routed[0].Id)
+
+    // topic of other role or org
+    ids, err = lookup(orgId, "value", piot.ROUTE_AVAILABILITY)
+    test.Ok(t, err)
+    test.Equals(t, 0, len(ids))
+    ids, err = lookup(primitive.NewObjectID(), "value", piot.ROUTE_MEASUREMENT)
+    test.Ok(t, err)
+    test.Equals(t, 0, len(ids))
+
+    // update of thing invalidates routes
+    _, err = things.Update(ctx, sensorId, map[string]interface{}{"sensor.measurement_topic": "temperature"})
+    test.Ok(t, err)
+    ids, err = lookup(orgId, "value", piot.ROUTE_MEASUREMENT)
+    test.Ok(t, err)
+    test.Equals(t, 0, len(ids))
+    ids, err = lookup(orgId, "temperature", piot.ROUTE_MEASUREMENT)
+    test.Ok(t, err)
+    test.Equals(t, []primitive.ObjectID{sensorId}, ids)
+
+    // changes done directly in database are visible after invalidation
+    test.SetSensorMeasurementTopic(t, db, sensorId, "pressure")
+    ids, err = lookup(orgId, "pressure", piot.ROUTE_MEASUREMENT)
+    test.Ok(t, err)
+    test.Equals(t, 0, len(ids))
+
+    routes.Invalidate()
+    ids, err = lookup(orgId, "pressure", piot.ROUTE_MEASUREMENT)
+    test.Ok(t, err)
+    test.Equals(t, []primitive.ObjectID{sensorId}, ids)
+
+    // deletion of thing invalidates routes
+    test.Ok(t, things.Delete(ctx, sensorId, false))
+    ids, err = lookup(orgId, "pressure", piot.ROUTE_MEASUREMENT)
+    test.Ok(t, err)
+    test.Equals(t, 0, len(ids))
+}
+
+func TestTopicRoutesTtl(t *testing.T) {
+    const SENSOR = "sensor"
+    const ORG = "org"
+
+    db := test.GetDb(t)
+    log := test.GetLogger(t)
+    test.CleanDb(t, db)
+    things := test.GetThings(t, log, db)
+    routes := piot.NewTopicRoutes(log, things, 10 * time.Millisecond)
+
+    sensorId := test.CreateThing(t, db, SENSOR)
+    orgId := test.CreateOrg(t, db, ORG)
+    test.AddOrgThing(t, db, orgId, SENSOR)
+
+    routed, err := routes.Lookup(orgId, "value", piot.ROUTE_MEASUREMENT)
+    test.Ok(t, err)
+    test.Equals(t, 1, len(routed))
+    test.Equals(t, sensorId, routed[0].Id)
+
+    // changes done directly in database are visible after ttl expires
+    test.SetSensorMeasurementTopic(t, db, sensorId, "pressure")
+    routed, err = routes.Lookup(orgId, "pressure", piot.ROUTE_MEASUREMENT)
+    test.Ok(t, err)
+    test.Equals(t, 0, len(routed))
+
+    time.Sleep(20 * time.Millisecond)
+    routed, err = routes.Lookup(orgId, "pressure", piot.ROUTE_MEASUREMENT)
+    test.Ok(t, err)
+    test.Equals(t, 1, len(routed))
+    test.Equals(t, "pressure", routed[0].Sensor.MeasurementTopic)
+}
@@ -1,10 +1,8 @@
 package piot
 
 import (
-    "context"
+    "errors"
     "github.com/op/go-logging"
-    "go.mongodb.org/mongo-driver/mongo"
-    "go.mongodb.org/mongo-driver/bson"
     "go.mongodb.org/mongo-driver/bson/primitive"
     "github.com/mnezerka/go-piot/model"
     //"piot-server/model"
@@ -12,19 +10,36 @@ import (
 
 type Users struct {
     log *logging.Logger
-    db *mongo.Database
+    repos *Repositories
 }
 
-func NewUsers(log *logging.Logger, db *mongo.Database) *Users{
-    return &Users{log: log, db: db}
+func NewUsers(log *logging.Logger, repos *Repositories) *Users{
+    return &Users{log: log, repos: repos}
+}
+
+func (t *Users) Get(id primitive.ObjectID) (*model.User, error) {
+    t.log.Debugf("Get user: %s", id.Hex())
+
+    user, err := t.repos.Users.Get(id)
+    if err != nil {
+        t.log.Errorf("Users service error: %v", err)
+        return nil, err
+    }
+
+    // fetch user orgs
+    orgs, err := t.FindUserOrgs(user.Id)
+    if err != nil {
+        t.log.Errorf("Users service error: fetching user orgs failed (%v)", err)
+        return nil, err
+    }
+    user.Orgs = orgs
+    return user, nil
 }
 
 func (t *Users) FindByEmail(email string) (*model.User, error) {
     t.log.Debugf("Get user by email: %s", email)
 
-    var user model.User
-
-    err := t.db.Collection("users").FindOne(context.TODO(), bson.M{"email": email}).Decode(&user)
+    user, err := t.repos.Users.GetByEmail(email)
     if err != nil {
         t.log.Errorf("Users service error: %v", err)
         return nil, err
@@ -39,7 +54,7 @@ func (t *Users) FindByEmail(email string) (*model.User, error) {
         return nil, err
     }
     user.Orgs = orgs
-    return &user, nil
+    return user, nil
 }
 
 func (t *Users) FindUserOrgs(id primitive.ObjectID) ([]model.Org, error) {
@@ -47,55 +62,71 @@ func (t *Users) FindUserOrgs(id primitive.ObjectID) ([]model.Org, error) {
 
     t.log.Debugf("Querying orgs for user: %s", id.Hex())
 
-    collection := t.db.Collection("orgusers")
-
-    // filter orusers to current (single) user
-    stage_match := bson.M{"$match": bson.M{"user_id": id}}
-
-    // find orgs details
-    stage_lookup := bson.M{"$lookup": bson.M{"from": "orgs", "localField": "org_id", "foreignField": "_id", "as": "orgs"}}
-
-    // expand orgs
-    stage_unwind := bson.M{"$unwind": "$orgs"}
-
-    // replace root
-    stage_new_root := bson.M{"$replaceWith": "$orgs"}
-
-    pipeline := []bson.M{stage_match, stage_lookup, stage_unwind, stage_new_root}
-
-    cur, err := collection.Aggregate(context.TODO(), pipeline)
+    // filter orgusers to current (single) user
+    orgUsers, err := t.repos.OrgUsers.FindByUser(id)
     if err != nil {
         t.log.Errorf("Error while querying user orgs: %v", err)
         return result, err
     }
-    defer cur.Close(context.TODO())
 
-    for cur.Next(context.TODO()) {
-        var org model.Org
-        if err := cur.Decode(&org); err != nil {
+    // find orgs details, assignments to deleted orgs are ignored
+    for _, orgUser := range orgUsers {
+        org, err := t.repos.Orgs.Get(orgUser.OrgId)
+        if err == ErrNotFound {
+            continue
+        }
+        if err != nil {
             t.log.Errorf("Error while querying user orgs: %v", err)
             return result, err
         }
-        result = append(result, org)
+        result = append(result, *org)
     }
 
-    if err := cur.Err(); err != nil {
+    return result, nil
+}
+
+// Create context of the user with org membership fetched from database
+func (t *Users) GetAuthContext(user *model.User) (*AuthContext, error) {
+    orgUsers, err := t.repos.OrgUsers.FindByUser(user.Id)
+    if err != nil {
         t.log.Errorf("Error while querying user orgs: %v", err)
-        return result, err
+        return nil, err
     }
 
-    return result, nil
+    ctx := NewAuthContext(user)
+    ctx.OrgRoles = make(map[primitive.ObjectID]string)
+    for _, orgUser := range orgUsers {
+        ctx.OrgRoles[orgUser.OrgId] = orgUser.GetRole()
+    }
+
+    return ctx, nil
 }
 
-func (t *Users) SetActiveOrg(id primitive.ObjectID, orgId primitive.ObjectID) (error) {
-    t.Log.Debugf("Setting user <%s> active org to to <%s>", id.Hex(), orgId.Hex())
+// Set active org of the user, users can change only their own active org and
+// only to org they are members of (admins are not restricted)
+func (t *Users) SetActiveOrg(ctx *AuthContext, id primitive.ObjectID, orgId primitive.ObjectID) (error) {
+    t.log.Debugf("Setting user <%s> active org to to <%s>", id.Hex(), orgId.Hex())
+
+    if !ctx.IsUnrestricted() {
+        if ctx.User == nil || ctx.User.Id != id {
+            return NewForbiddenError("Active org of user %s cannot be changed", id.Hex())
+        }
+
+        _, err := t.repos.OrgUsers.Get(orgId, id)
+        if err == ErrNotFound {
+            return NewForbiddenError("User %s is not member of org %s", id.Hex(), orgId.Hex())
+        }
+        if err != nil {
+            t.log.Errorf("Error while querying user orgs: %v", err)
+            return errors.New("Error while updating user active org")
+        }
+    }
 
-    _, err := t.Db.Collection("users").UpdateOne(context.Background(), bson.M{"_id": id}, bson.M{"$set": bson.M{"active_org_id": orgId}})
+    err := t.repos.Users.SetFields(id, map[string]interface{}{"active_org_id": orgId})
     if err != nil {
-        t.Log.Errorf("User %s cannot be updated (%v)", id.Hex(), err)
+        t.log.Errorf("User %s cannot be updated (%v)", id.Hex(), err)
         return errors.New("Error while updating user active org")
     }
 
     return nil
 }
-
@@ -3,6 +3,7 @@ package piot_test
 import (
     "testing"
     "github.com/mnezerka/go-piot"
+    "github.com/mnezerka/go-piot/model"
     "github.com/mnezerka/go-piot/test"
 )
 
@@ -32,3 +33,30 @@ func TestFindUserByExistingEmail(t *testing.T) {
     test.Equals(t, 1, len(user.Orgs))
     test.Equals(t, "testorg", user.Orgs[0].Name)
 }
+
+func TestSetActiveOrg(t *testing.T) {
+    db := test.GetDb(t)
+    log := test.GetLogger(t)
+    users := piot.NewUsers(log, db)
+
+    test.CleanDb(t, db)
+    userId := test.CreateUser(t, db, "test1@com", "pass")
+    orgId := test.CreateOrg(t, db, "testorg")
+    foreignOrgId := test.CreateOrg(t, db, "foreignorg")
+    test.AddOrgUser(t, db, orgId, userId)
+
+    user, err := users.FindByEmail("test1@com")
+    test.Ok(t, err)
+    ctx, err := users.GetAuthContext(user)
+    test.Ok(t, err)
+    test.Assert(t, ctx.IsOrgMember(orgId), "User shall be member of org")
+    test.Assert(t, !ctx.IsOrgMember(foreignOrgId), "User shall not be member of foreign org")
+
+    test.Ok(t, users.SetActiveOrg(ctx, userId, orgId))
+
+    err = users.SetActiveOrg(ctx, userId, foreignOrgId)
+    test.Assert(t, piot.IsForbidden(err), "Foreign org shall not be activated")
+
+    // admin is not restricted
+    test.Ok(t, users.SetActiveOrg(piot.NewAuthContext(&model.User{IsAdmin: true}), userId, foreignOrgId))
+}
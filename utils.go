@@ -4,6 +4,7 @@ import (
     "fmt"
     "strconv"
     "reflect"
+    "time"
     "golang.org/x/crypto/bcrypt"
 )
 
@@ -12,6 +13,16 @@ func GetPasswordHash(pwd string) (string, error) {
     return string(hash), err
 }
 
+// Get start of interval (in seconds) the time falls into, intervals are
+// aligned to unix epoch
+func GetIntervalStart(at time.Time, interval int32) time.Time {
+    ts := at.Unix()
+    if interval > 0 {
+        ts = ts - (ts % int64(interval))
+    }
+    return time.Unix(ts, 0)
+}
+
 func PrimitiveToString(value interface{}) (string, error) {
     var output string
 
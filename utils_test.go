@@ -2,6 +2,7 @@ package piot_test
 
 import (
     "testing"
+    "time"
     "github.com/mnezerka/go-piot"
     "github.com/mnezerka/go-piot/test"
 )
@@ -28,3 +29,11 @@ func TestPrimitiveToString(t *testing.T) {
     test.Ok(t, err)
     test.Equals(t, "true", str)
 }
+
+func TestGetIntervalStart(t *testing.T) {
+    at := time.Unix(1000, 500)
+
+    test.Equals(t, int64(1000), piot.GetIntervalStart(at, 0).Unix())
+    test.Equals(t, int64(960), piot.GetIntervalStart(at, 60).Unix())
+    test.Equals(t, int64(1000), piot.GetIntervalStart(at, 10).Unix())
+}
@@ -0,0 +1,157 @@
+package piot
+
+import (
+    "time"
+    "github.com/op/go-logging"
+    "github.com/mnezerka/go-piot/model"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// thing was not seen for longer than allowed by its LastSeenInterval
+const EVENT_OFFLINE = "offline"
+
+// handling of sensor values older than sensor validity
+const STALE_SENSORS_IGNORE = ""
+const STALE_SENSORS_FLAG = "flag"
+const STALE_SENSORS_CLEAR = "clear"
+
+// Watchdog marks things which were not seen within their LastSeenInterval
+// as unavailable. Children of such things (see ParentId) are marked
+// unavailable too. Things without availability topic become available
+// again when they are seen (see Things.TouchThing). Optionally, sensor
+// values older than sensor validity are flagged or cleared (see
+// SetStaleSensorsPolicy)
+type Watchdog struct {
+    log *logging.Logger
+    things *Things
+    mqtt IMqtt
+    staleSensorsPolicy string
+    quit chan struct{}
+}
+
+func NewWatchdog(log *logging.Logger, things *Things, mqtt IMqtt) *Watchdog {
+    return &Watchdog{log: log, things: things, mqtt: mqtt}
+}
+
+// Set handling of stale sensor values, see STALE_SENSORS_* constants
+func (w *Watchdog) SetStaleSensorsPolicy(policy string) {
+    w.staleSensorsPolicy = policy
+}
+
+// Start periodic checks in background
+func (w *Watchdog) Start(interval time.Duration) {
+    w.log.Infof("Starting watchdog (interval %v)", interval)
+
+    w.quit = make(chan struct{})
+    ticker := time.NewTicker(interval)
+
+    go func(quit chan struct{}) {
+        for {
+            select {
+            case <-ticker.C:
+                w.Check()
+                w.CheckSensors()
+            case <-quit:
+                ticker.Stop()
+                return
+            }
+        }
+    }(w.quit)
+}
+
+// Stop periodic checks
+func (w *Watchdog) Stop() {
+    if w.quit != nil {
+        w.log.Infof("Stopping watchdog")
+        close(w.quit)
+        w.quit = nil
+    }
+}
+
+// Check all available things with configured last seen interval
+func (w *Watchdog) Check() {
+    w.log.Debugf("Watchdog is checking things last seen time")
+
+    ctx := NewSystemContext()
+
+    available := true
+    things, err := w.things.GetFiltered(ctx, &ThingFilter{Available: &available, HasLastSeenInterval: true})
+    if err != nil {
+        w.log.Errorf("Watchdog failed to fetch things: %s", err.Error())
+        return
+    }
+
+    now := int32(time.Now().Unix())
+    visited := make(map[primitive.ObjectID]bool)
+
+    for _, thing := range things {
+        if thing.LastSeen + thing.LastSeenInterval < now {
+            w.log.Infof("Thing %s was not seen for %d seconds, going offline", thing.Name, now - thing.LastSeen)
+            w.setOffline(ctx, thing, now, visited)
+        }
+    }
+}
+
+func (w *Watchdog) setOffline(ctx *AuthContext, thing *model.Thing, now int32, visited map[primitive.ObjectID]bool) {
+
+    // protection against cycles in parent - child relations
+    if visited[thing.Id] {
+        return
+    }
+    visited[thing.Id] = true
+
+    changed, err := w.things.setAvailable(thing.Id, false)
+    if err != nil {
+        w.log.Errorf("Watchdog error: %s", err.Error())
+        return
+    }
+
+    // thing could go offline since it was fetched (e.g. by availability
+    // message), it is reported by the one who changed it then
+    if changed {
+        // things not assigned to org have no mqtt topics
+        if thing.OrgId != primitive.NilObjectID {
+            if err := w.mqtt.PushThingData(thing, TOPIC_AVAILABLE, VALUE_NO); err != nil {
+                w.log.Errorf("Watchdog error: %s", err.Error())
+            }
+        }
+
+        w.things.Events.Emit(&Event{Type: EVENT_OFFLINE, ThingId: thing.Id, Time: now, Value: VALUE_NO})
+    }
+
+    available := true
+    children, err := w.things.GetFiltered(ctx, &ThingFilter{ParentId: &thing.Id, Available: &available})
+    if err != nil {
+        w.log.Errorf("Watchdog failed to fetch children of thing %s: %s", thing.Name, err.Error())
+        return
+    }
+
+    for _, child := range children {
+        w.setOffline(ctx, child, now, visited)
+    }
+}
+
+// Flag or clear sensor values which are older than sensor validity
+func (w *Watchdog) CheckSensors() {
+    if w.staleSensorsPolicy == STALE_SENSORS_IGNORE {
+        return
+    }
+
+    w.log.Debugf("Watchdog is checking validity of sensor values")
+
+    ctx := NewSystemContext()
+
+    stale := false
+    sensors, err := w.things.getStaleSensors(&ThingFilter{Stale: &stale})
+    if err != nil {
+        w.log.Errorf("Watchdog failed to fetch stale sensors: %s", err.Error())
+        return
+    }
+
+    for _, sensor := range sensors {
+        w.log.Infof("Value of sensor %s is stale (%s)", sensor.Name, w.staleSensorsPolicy)
+        if err := w.things.SetSensorStale(ctx, sensor.Id, w.staleSensorsPolicy == STALE_SENSORS_CLEAR); err != nil {
+            w.log.Errorf("Watchdog error: %s", err.Error())
+        }
+    }
+}
@@ -0,0 +1,170 @@
+package piot_test
+
+import (
+    "testing"
+    "time"
+    "github.com/mnezerka/go-piot"
+    "github.com/mnezerka/go-piot/test"
+)
+
+func TestWatchdogOffline(t *testing.T) {
+    const DEVICE = "device1"
+    const SENSOR = "sensor1"
+    const ORG = "org1"
+
+    log := test.GetLogger(t)
+    db := test.GetDb(t)
+    things := test.GetThings(t, log, db)
+    mqtt := test.GetMqtt(t, log)
+    watchdog := piot.NewWatchdog(log, things, mqtt)
+
+    var events []*piot.Event
+    things.Events.Subscribe(func(event *piot.Event) {
+        if event.Type == piot.EVENT_OFFLINE {
+            events = append(events, event)
+        }
+    })
+
+    test.CleanDb(t, db)
+    ctx := test.GetContext(t)
+    deviceId := test.CreateDevice(t, db, DEVICE)
+    sensorId := test.CreateThing(t, db, SENSOR)
+    orgId := test.CreateOrg(t, db, ORG)
+    test.AddOrgThing(t, db, orgId, DEVICE)
+    test.AddOrgThing(t, db, orgId, SENSOR)
+    test.Ok(t, things.SetParent(ctx, sensorId, deviceId))
+    test.Ok(t, things.SetAvailable(ctx, deviceId, true))
+    test.Ok(t, things.SetAvailable(ctx, sensorId, true))
+
+    // device was seen recently
+    now := int32(time.Now().Unix())
+    test.SetThingLastSeen(t, db, deviceId, now, 60)
+
+    watchdog.Check()
+
+    thing, err := things.Get(ctx, deviceId)
+    test.Ok(t, err)
+    test.Equals(t, true, thing.Available)
+    test.Equals(t, 0, len(mqtt.Calls))
+    test.Equals(t, 0, len(events))
+
+    // device was not seen for too long
+    test.SetThingLastSeen(t, db, deviceId, now - 61, 60)
+
+    watchdog.Check()
+
+    thing, err = things.Get(ctx, deviceId)
+    test.Ok(t, err)
+    test.Equals(t, false, thing.Available)
+
+    // child of the device is unavailable too
+    thing, err = things.Get(ctx, sensorId)
+    test.Ok(t, err)
+    test.Equals(t, false, thing.Available)
+
+    test.Equals(t, 2, len(mqtt.Calls))
+    test.Equals(t, "available", mqtt.Calls[0].Topic)
+    test.Equals(t, "no", mqtt.Calls[0].Value)
+    test.Equals(t, DEVICE, mqtt.Calls[0].Thing.Name)
+    test.Equals(t, SENSOR, mqtt.Calls[1].Thing.Name)
+
+    test.Equals(t, 2, len(events))
+    test.Equals(t, deviceId, events[0].ThingId)
+    test.Equals(t, sensorId, events[1].ThingId)
+
+    // unavailable things are not processed again
+    watchdog.Check()
+    test.Equals(t, 2, len(mqtt.Calls))
+    test.Equals(t, 2, len(events))
+}
+
+// Things without availability topic are available again when they are seen
+func TestWatchdogOnlineAgain(t *testing.T) {
+    const DEVICE = "device1"
+
+    log := test.GetLogger(t)
+    db := test.GetDb(t)
+    things := test.GetThings(t, log, db)
+    mqtt := test.GetMqtt(t, log)
+    watchdog := piot.NewWatchdog(log, things, mqtt)
+
+    var events []*piot.Event
+    things.Events.Subscribe(func(event *piot.Event) {
+        if event.Type == piot.EVENT_OFFLINE {
+            events = append(events, event)
+        }
+    })
+
+    test.CleanDb(t, db)
+    ctx := test.GetContext(t)
+    deviceId := test.CreateDevice(t, db, DEVICE)
+    test.Ok(t, things.SetAvailable(ctx, deviceId, true))
+
+    now := int32(time.Now().Unix())
+    test.SetThingLastSeen(t, db, deviceId, now - 61, 60)
+    watchdog.Check()
+    test.Equals(t, 1, len(events))
+
+    // message from device
+    test.Ok(t, things.TouchThing(ctx, deviceId))
+    thing, err := things.Get(ctx, deviceId)
+    test.Ok(t, err)
+    test.Equals(t, true, thing.Available)
+
+    // device is watched again
+    test.SetThingLastSeen(t, db, deviceId, now - 61, 60)
+    watchdog.Check()
+    test.Equals(t, 2, len(events))
+
+    // availability of things with availability topic is set by availability
+    // messages only
+    test.Ok(t, things.SetAvailabilityTopic(ctx, deviceId, "available"))
+    test.Ok(t, things.TouchThing(ctx, deviceId))
+    thing, err = things.Get(ctx, deviceId)
+    test.Ok(t, err)
+    test.Equals(t, false, thing.Available)
+}
+
+func TestWatchdogStaleSensors(t *testing.T) {
+    log := test.GetLogger(t)
+    db := test.GetDb(t)
+    things := test.GetThings(t, log, db)
+    mqtt := test.GetMqtt(t, log)
+    watchdog := piot.NewWatchdog(log, things, mqtt)
+    now := int32(time.Now().Unix())
+
+    test.CleanDb(t, db)
+    ctx := test.GetContext(t)
+    id1 := test.CreateThing(t, db, "sensor1")
+    test.Ok(t, things.SetSensorValue(ctx, id1, "10"))
+    test.SetSensorValidity(t, db, id1, 60, now - 100)
+    id2 := test.CreateThing(t, db, "sensor2")
+    test.Ok(t, things.SetSensorValue(ctx, id2, "20"))
+    test.SetSensorValidity(t, db, id2, 60, now - 10)
+
+    // stale values are ignored by default
+    watchdog.CheckSensors()
+    thing, err := things.Get(ctx, id1)
+    test.Ok(t, err)
+    test.Equals(t, false, thing.Sensor.Stale)
+
+    // stale values are flagged
+    watchdog.SetStaleSensorsPolicy(piot.STALE_SENSORS_FLAG)
+    watchdog.CheckSensors()
+    thing, err = things.Get(ctx, id1)
+    test.Ok(t, err)
+    test.Equals(t, true, thing.Sensor.Stale)
+    test.Equals(t, "10", thing.Sensor.Value)
+    thing, err = things.Get(ctx, id2)
+    test.Ok(t, err)
+    test.Equals(t, false, thing.Sensor.Stale)
+
+    // stale values are cleared
+    test.SetSensorValidity(t, db, id2, 60, now - 100)
+    watchdog.SetStaleSensorsPolicy(piot.STALE_SENSORS_CLEAR)
+    watchdog.CheckSensors()
+    thing, err = things.Get(ctx, id2)
+    test.Ok(t, err)
+    test.Equals(t, true, thing.Sensor.Stale)
+    test.Equals(t, "", thing.Sensor.Value)
+}
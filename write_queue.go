@@ -0,0 +1,319 @@
+package piot
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "path/filepath"
+    "sync"
+    "time"
+    "github.com/op/go-logging"
+    "github.com/mnezerka/go-piot/config"
+    "github.com/mnezerka/go-piot/model"
+)
+
+// types of queued writes
+const (
+    queueMeasurement = "measurement"
+    queueSwitchState = "switch"
+    queueLocation = "location"
+    queueTelemetry = "telemetry"
+)
+
+// Error returned if queue is given InfluxDB posting through InfluxDbWriter,
+// writer acknowledges rows before they are delivered, so they would be
+// removed from queue too early
+var ErrWriteQueueBufferedInfluxDb = errors.New("Write queue cannot deliver to InfluxDB buffered by InfluxDbWriter")
+
+// Write to storage as stored in queue
+type queueRecord struct {
+    Type string `json:"type"`
+    Thing *model.Thing `json:"thing"`
+    Value string `json:"value,omitempty"`
+    Time time.Time `json:"time"`
+    Lat float64 `json:"lat,omitempty"`
+    Lng float64 `json:"lng,omitempty"`
+    Sat int32 `json:"sat,omitempty"`
+    Ts int32 `json:"ts,omitempty"`
+}
+
+// Durable queue of writes to storages (InfluxDB, MySQL). Every write is
+// appended to on-disk log and then delivered to storage by background loop
+// (see Start), so writers never wait for storage. Writes which cannot be
+// delivered (e.g. storage is down) stay in the log and are replayed in order
+// when storage recovers or after restart, so each write is delivered at
+// least once. Each storage has its own log and loop, so outage of one
+// storage doesn't block the other one
+type WriteQueue struct {
+    log *logging.Logger
+    params *config.Parameters
+    influxDb IInfluxDb
+    mysqlDb IMysqlDb
+    influxDbLog *segmentLog
+    mysqlDbLog *segmentLog
+
+    // wake up delivery loops when new write is appended
+    influxDbWakeup chan bool
+    mysqlDbWakeup chan bool
+
+    quit chan bool
+    wg sync.WaitGroup
+}
+
+// Open queue stored in directory given by WriteQueueDir parameter, writes
+// left in queue from previous run are delivered by Replay (or by loops
+// started by Start). InfluxDB has to post data directly, rows buffered by
+// InfluxDbWriter are reported as delivered before they reach the server
+func NewWriteQueue(log *logging.Logger, params *config.Parameters, influxDb IInfluxDb, mysqlDb IMysqlDb) (*WriteQueue, error) {
+    if params.WriteQueueDir == "" {
+        return nil, errors.New("Write queue directory is not configured")
+    }
+
+    if db, ok := influxDb.(*InfluxDb); ok {
+        if _, ok := db.httpClient.(*InfluxDbWriter); ok {
+            return nil, ErrWriteQueueBufferedInfluxDb
+        }
+    }
+
+    log.Infof("Opening write queue in %s", params.WriteQueueDir)
+
+    q := &WriteQueue{
+        log: log,
+        params: params,
+        influxDb: influxDb,
+        mysqlDb: mysqlDb,
+        influxDbWakeup: make(chan bool, 1),
+        mysqlDbWakeup: make(chan bool, 1),
+    }
+
+    var err error
+    q.influxDbLog, err = openSegmentLog(log, filepath.Join(params.WriteQueueDir, "influxdb"), params.WriteQueueSegmentSize)
+    if err != nil {
+        return nil, fmt.Errorf("Write queue cannot be opened (%v)", err)
+    }
+    q.mysqlDbLog, err = openSegmentLog(log, filepath.Join(params.WriteQueueDir, "mysqldb"), params.WriteQueueSegmentSize)
+    if err != nil {
+        q.influxDbLog.Close()
+        return nil, fmt.Errorf("Write queue cannot be opened (%v)", err)
+    }
+
+    return q, nil
+}
+
+// Get InfluxDB storage writing through the queue
+func (q *WriteQueue) InfluxDb() IInfluxDb {
+    return &queuedInfluxDb{q: q}
+}
+
+// Get MySQL storage writing through the queue
+func (q *WriteQueue) MysqlDb() IMysqlDb {
+    return &queuedMysqlDb{q: q}
+}
+
+// Start delivery loops, queued writes are delivered as soon as they are
+// appended, undelivered writes are replayed periodically (see
+// WriteQueueReplayInterval parameter)
+func (q *WriteQueue) Start() {
+    q.log.Infof("Starting write queue delivery with replay interval %v", q.params.WriteQueueReplayInterval)
+
+    q.quit = make(chan bool)
+
+    q.wg.Add(2)
+    go q.run(q.quit, q.influxDbWakeup, q.influxDbLog, q.deliverInfluxDb)
+    go q.run(q.quit, q.mysqlDbWakeup, q.mysqlDbLog, q.deliverMysqlDb)
+}
+
+// Stop delivery loops, writes being delivered are completed
+func (q *WriteQueue) Stop() {
+    if q.quit != nil {
+        q.log.Infof("Stopping write queue delivery")
+        close(q.quit)
+        q.wg.Wait()
+        q.quit = nil
+    }
+}
+
+// Close queue files
+func (q *WriteQueue) Close() {
+    q.Stop()
+    q.influxDbLog.Close()
+    q.mysqlDbLog.Close()
+}
+
+// Deliver all queued writes, delivery to each storage stops on first failure
+func (q *WriteQueue) Replay() {
+    q.replay(q.influxDbLog, q.deliverInfluxDb)
+    q.replay(q.mysqlDbLog, q.deliverMysqlDb)
+}
+
+// Get number of writes waiting for delivery to InfluxDB and MySQL
+func (q *WriteQueue) Pending() (uint64, uint64) {
+    return q.influxDbLog.Pending(), q.mysqlDbLog.Pending()
+}
+
+func (q *WriteQueue) run(quit chan bool, wakeup chan bool, log *segmentLog, deliver func(*queueRecord) error) {
+    defer q.wg.Done()
+
+    ticker := time.NewTicker(q.params.WriteQueueReplayInterval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-wakeup:
+            q.replay(log, deliver)
+        case <-ticker.C:
+            q.replay(log, deliver)
+        case <-quit:
+            return
+        }
+    }
+}
+
+func (q *WriteQueue) append(log *segmentLog, wakeup chan bool, record *queueRecord) (error) {
+    data, err := json.Marshal(record)
+    if err != nil {
+        return err
+    }
+
+    if _, err := log.Append(data); err != nil {
+        q.log.Errorf("Write of thing %s cannot be queued (%v)", record.Thing.Id.Hex(), err)
+        return err
+    }
+
+    // write is safe in queue, it is delivered by loop
+    select {
+    case wakeup <- true:
+    default:
+        // loop is already woken up
+    }
+
+    return nil
+}
+
+func (q *WriteQueue) replay(log *segmentLog, deliver func(*queueRecord) error) {
+    count, err := log.Replay(func(data []byte) error {
+        var record queueRecord
+        if err := json.Unmarshal(data, &record); err != nil {
+            // record cannot be delivered ever, skip it
+            q.log.Errorf("Dropping invalid record from write queue (%v)", err)
+            return nil
+        }
+        return deliver(&record)
+    })
+
+    if err != nil {
+        q.log.Warningf("Delivery of queued writes interrupted after %d writes (%v)", count, err)
+    } else if count > 0 {
+        q.log.Debugf("Delivered %d queued writes", count)
+    }
+}
+
+func (q *WriteQueue) deliverInfluxDb(record *queueRecord) (error) {
+    switch record.Type {
+    case queueMeasurement:
+        return q.influxDb.PostMeasurement(record.Thing, record.Value, record.Time)
+    case queueSwitchState:
+        return q.influxDb.PostSwitchState(record.Thing, record.Value, record.Time)
+    case queueLocation:
+        return q.influxDb.PostLocation(record.Thing, record.Lat, record.Lng, record.Sat, record.Ts)
+    }
+
+    q.log.Errorf("Dropping queued write of unknown type %s", record.Type)
+    return nil
+}
+
+func (q *WriteQueue) deliverMysqlDb(record *queueRecord) (error) {
+    switch record.Type {
+    case queueMeasurement:
+        return q.mysqlDb.StoreMeasurement(record.Thing, record.Value, record.Time)
+    case queueSwitchState:
+        return q.mysqlDb.StoreSwitchState(record.Thing, record.Value, record.Time)
+    case queueLocation:
+        return q.mysqlDb.StoreLocation(record.Thing, record.Lat, record.Lng, record.Sat, record.Ts)
+    case queueTelemetry:
+        return q.mysqlDb.StoreTelemetry(record.Thing, record.Value, record.Time)
+    }
+
+    q.log.Errorf("Dropping queued write of unknown type %s", record.Type)
+    return nil
+}
+
+///////////////////////////////////////// storages writing through queue
+
+type queuedInfluxDb struct {
+    q *WriteQueue
+}
+
+func (db *queuedInfluxDb) PostMeasurement(thing *model.Thing, value string, ts time.Time) error {
+    return db.q.append(db.q.influxDbLog, db.q.influxDbWakeup, &queueRecord{Type: queueMeasurement, Thing: thing, Value: value, Time: ts})
+}
+
+func (db *queuedInfluxDb) PostSwitchState(thing *model.Thing, value string, ts time.Time) error {
+    return db.q.append(db.q.influxDbLog, db.q.influxDbWakeup, &queueRecord{Type: queueSwitchState, Thing: thing, Value: value, Time: ts})
+}
+
+func (db *queuedInfluxDb) PostLocation(thing *model.Thing, lat, lng float64, sat, ts int32) error {
+    record := &queueRecord{Type: queueLocation, Thing: thing, Time: time.Now(), Lat: lat, Lng: lng, Sat: sat, Ts: ts}
+    return db.q.append(db.q.influxDbLog, db.q.influxDbWakeup, record)
+}
+
+// History is read from storage directly, writes waiting in queue are not
+// included
+func (db *queuedInfluxDb) GetSensorValues(thing *model.Thing, from, to time.Time) ([]model.HistoryValue, error) {
+    if source, ok := db.q.influxDb.(HistorySource); ok {
+        return source.GetSensorValues(thing, from, to)
+    }
+    return nil, ErrNoHistorySource
+}
+
+func (db *queuedInfluxDb) GetSwitchStates(thing *model.Thing, from, to time.Time) ([]model.HistoryValue, error) {
+    if source, ok := db.q.influxDb.(HistorySource); ok {
+        return source.GetSwitchStates(thing, from, to)
+    }
+    return nil, ErrNoHistorySource
+}
+
+type queuedMysqlDb struct {
+    q *WriteQueue
+}
+
+func (db *queuedMysqlDb) Open() error {
+    return db.q.mysqlDb.Open()
+}
+
+func (db *queuedMysqlDb) Close() {
+    db.q.mysqlDb.Close()
+}
+
+func (db *queuedMysqlDb) StoreMeasurement(thing *model.Thing, value string, ts time.Time) error {
+    return db.q.append(db.q.mysqlDbLog, db.q.mysqlDbWakeup, &queueRecord{Type: queueMeasurement, Thing: thing, Value: value, Time: ts})
+}
+
+func (db *queuedMysqlDb) StoreSwitchState(thing *model.Thing, value string, ts time.Time) error {
+    return db.q.append(db.q.mysqlDbLog, db.q.mysqlDbWakeup, &queueRecord{Type: queueSwitchState, Thing: thing, Value: value, Time: ts})
+}
+
+func (db *queuedMysqlDb) StoreLocation(thing *model.Thing, lat, lng float64, sat, ts int32) error {
+    record := &queueRecord{Type: queueLocation, Thing: thing, Time: time.Now(), Lat: lat, Lng: lng, Sat: sat, Ts: ts}
+    return db.q.append(db.q.mysqlDbLog, db.q.mysqlDbWakeup, record)
+}
+
+func (db *queuedMysqlDb) StoreTelemetry(thing *model.Thing, telemetry string, ts time.Time) error {
+    return db.q.append(db.q.mysqlDbLog, db.q.mysqlDbWakeup, &queueRecord{Type: queueTelemetry, Thing: thing, Value: telemetry, Time: ts})
+}
+
+// History is read from storage directly, writes waiting in queue are not
+// included
+func (db *queuedMysqlDb) GetSensorValues(thing *model.Thing, from, to time.Time) ([]model.HistoryValue, error) {
+    if source, ok := db.q.mysqlDb.(HistorySource); ok {
+        return source.GetSensorValues(thing, from, to)
+    }
+    return nil, ErrNoHistorySource
+}
+
+func (db *queuedMysqlDb) GetSwitchStates(thing *model.Thing, from, to time.Time) ([]model.HistoryValue, error) {
+    if source, ok := db.q.mysqlDb.(HistorySource); ok {
+        return source.GetSwitchStates(thing, from, to)
+    }
+    return nil, ErrNoHistorySource
+}
@@ -0,0 +1,209 @@
+package piot_test
+
+import (
+    "errors"
+    "io/ioutil"
+    "os"
+    "testing"
+    "time"
+    "github.com/mnezerka/go-piot"
+    "github.com/mnezerka/go-piot/config"
+    "github.com/mnezerka/go-piot/model"
+    "github.com/mnezerka/go-piot/test"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func getWriteQueueDir(t *testing.T) string {
+    dir, err := ioutil.TempDir("", "piot-queue")
+    test.Ok(t, err)
+    return dir
+}
+
+func getWriteQueueParams(dir string, segmentSize int64) *config.Parameters {
+    params := test.GetConfig()
+    params.WriteQueueDir = dir
+    params.WriteQueueSegmentSize = segmentSize
+    params.WriteQueueReplayInterval = time.Hour
+    return params
+}
+
+func TestWriteQueueDelivery(t *testing.T) {
+    dir := getWriteQueueDir(t)
+    defer os.RemoveAll(dir)
+    log := test.GetLogger(t)
+    influxDb := test.GetInfluxDb(t, log)
+    mysqlDb := test.GetMysqlDb(t, log)
+
+    queue, err := piot.NewWriteQueue(log, getWriteQueueParams(dir, 1024), influxDb, mysqlDb)
+    test.Ok(t, err)
+    defer queue.Close()
+
+    thing := &model.Thing{Id: primitive.NewObjectID(), Name: "sensor1", Type: model.THING_TYPE_SENSOR}
+    ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+    test.Ok(t, queue.InfluxDb().PostMeasurement(thing, "23", ts))
+    test.Ok(t, queue.MysqlDb().StoreMeasurement(thing, "24", ts))
+
+    // writes are only queued, delivery is done by loops or on request
+    test.Equals(t, 0, len(influxDb.Calls))
+    queue.Replay()
+
+    test.Equals(t, 1, len(influxDb.Calls))
+    test.Equals(t, "23", influxDb.Calls[0].Value)
+    test.Equals(t, thing.Id, influxDb.Calls[0].Thing.Id)
+    test.Assert(t, ts.Equal(influxDb.Calls[0].Time), "Time of write shall be preserved")
+    test.Equals(t, 1, len(mysqlDb.Calls))
+    test.Equals(t, "24", mysqlDb.Calls[0].Value)
+
+    test.Ok(t, queue.MysqlDb().StoreLocation(thing, 1.5, 2.5, 3, int32(ts.Unix())))
+    test.Ok(t, queue.MysqlDb().StoreTelemetry(thing, "telemetry", ts))
+    queue.Replay()
+    test.Equals(t, 3, len(mysqlDb.Calls))
+    test.Contains(t, mysqlDb.Calls[1].Value, "lat:1.5")
+    test.Assert(t, ts.Equal(mysqlDb.Calls[1].Time), "Time of location shall be preserved")
+    test.Equals(t, "telemetry", mysqlDb.Calls[2].Value)
+    test.Assert(t, ts.Equal(mysqlDb.Calls[2].Time), "Time of write shall be preserved")
+
+    pendingInfluxDb, pendingMysqlDb := queue.Pending()
+    test.Equals(t, uint64(0), pendingInfluxDb)
+    test.Equals(t, uint64(0), pendingMysqlDb)
+}
+
+func TestWriteQueueOutage(t *testing.T) {
+    dir := getWriteQueueDir(t)
+    defer os.RemoveAll(dir)
+    log := test.GetLogger(t)
+    influxDb := test.GetInfluxDb(t, log)
+    mysqlDb := test.GetMysqlDb(t, log)
+
+    // small segments to get writes spread over several segments
+    queue, err := piot.NewWriteQueue(log, getWriteQueueParams(dir, 100), influxDb, mysqlDb)
+    test.Ok(t, err)
+
+    thing := &model.Thing{Id: primitive.NewObjectID(), Name: "switch1", Type: model.THING_TYPE_SWITCH}
+
+    influxDb.Err = errors.New("connection refused")
+    test.Ok(t, queue.InfluxDb().PostSwitchState(thing, "1", time.Now()))
+    test.Ok(t, queue.InfluxDb().PostSwitchState(thing, "0", time.Now()))
+    test.Ok(t, queue.InfluxDb().PostLocation(thing, 1.5, 2.5, 3, 4))
+    test.Ok(t, queue.MysqlDb().StoreSwitchState(thing, "1", time.Now()))
+    queue.Replay()
+
+    // outage of influxdb doesn't block mysql
+    test.Equals(t, 0, len(influxDb.Calls))
+    test.Equals(t, 1, len(mysqlDb.Calls))
+    pendingInfluxDb, _ := queue.Pending()
+    test.Equals(t, uint64(3), pendingInfluxDb)
+
+    // queued writes survive restart
+    queue.Close()
+    queue, err = piot.NewWriteQueue(log, getWriteQueueParams(dir, 100), influxDb, mysqlDb)
+    test.Ok(t, err)
+    defer queue.Close()
+    pendingInfluxDb, _ = queue.Pending()
+    test.Equals(t, uint64(3), pendingInfluxDb)
+
+    // writes are delivered in order when storage recovers
+    influxDb.Err = nil
+    queue.Replay()
+    test.Equals(t, 3, len(influxDb.Calls))
+    test.Equals(t, "1", influxDb.Calls[0].Value)
+    test.Equals(t, "0", influxDb.Calls[1].Value)
+    test.Contains(t, influxDb.Calls[2].Value, "lat:1.5")
+    test.Equals(t, 1, len(mysqlDb.Calls))
+
+    pendingInfluxDb, _ = queue.Pending()
+    test.Equals(t, uint64(0), pendingInfluxDb)
+
+    // delivered segments are removed, only segment being written is kept
+    segments, err := ioutil.ReadDir(dir + "/influxdb")
+    test.Ok(t, err)
+    test.Equals(t, 2, len(segments))
+
+    // delivered writes are not replayed again
+    test.Ok(t, queue.InfluxDb().PostSwitchState(thing, "1", time.Now()))
+    queue.Replay()
+    test.Equals(t, 4, len(influxDb.Calls))
+}
+
+func TestWriteQueueIncompleteRecord(t *testing.T) {
+    dir := getWriteQueueDir(t)
+    defer os.RemoveAll(dir)
+    log := test.GetLogger(t)
+    influxDb := test.GetInfluxDb(t, log)
+    mysqlDb := test.GetMysqlDb(t, log)
+
+    queue, err := piot.NewWriteQueue(log, getWriteQueueParams(dir, 1024), influxDb, mysqlDb)
+    test.Ok(t, err)
+
+    thing := &model.Thing{Id: primitive.NewObjectID(), Name: "sensor1", Type: model.THING_TYPE_SENSOR}
+
+    mysqlDb.Err = errors.New("connection refused")
+    test.Ok(t, queue.MysqlDb().StoreMeasurement(thing, "1", time.Now()))
+    queue.Replay()
+    queue.Close()
+
+    // simulate crash in the middle of write
+    segments, err := ioutil.ReadDir(dir + "/mysqldb")
+    test.Ok(t, err)
+    f, err := os.OpenFile(dir + "/mysqldb/" + segments[0].Name(), os.O_WRONLY | os.O_APPEND, 0644)
+    test.Ok(t, err)
+    _, err = f.WriteString("2 {\"type\":\"meas")
+    test.Ok(t, err)
+    f.Close()
+
+    queue, err = piot.NewWriteQueue(log, getWriteQueueParams(dir, 1024), influxDb, mysqlDb)
+    test.Ok(t, err)
+    defer queue.Close()
+
+    mysqlDb.Err = nil
+    test.Ok(t, queue.MysqlDb().StoreMeasurement(thing, "2", time.Now()))
+    queue.Replay()
+    test.Equals(t, 2, len(mysqlDb.Calls))
+    test.Equals(t, "1", mysqlDb.Calls[0].Value)
+    test.Equals(t, "2", mysqlDb.Calls[1].Value)
+}
+
+// Writes are delivered by loops in background
+func TestWriteQueueStart(t *testing.T) {
+    dir := getWriteQueueDir(t)
+    defer os.RemoveAll(dir)
+    log := test.GetLogger(t)
+    influxDb := test.GetInfluxDb(t, log)
+    mysqlDb := test.GetMysqlDb(t, log)
+
+    queue, err := piot.NewWriteQueue(log, getWriteQueueParams(dir, 1024), influxDb, mysqlDb)
+    test.Ok(t, err)
+    queue.Start()
+
+    thing := &model.Thing{Id: primitive.NewObjectID(), Name: "sensor1", Type: model.THING_TYPE_SENSOR}
+    test.Ok(t, queue.InfluxDb().PostMeasurement(thing, "23", time.Now()))
+    test.Ok(t, queue.MysqlDb().StoreMeasurement(thing, "24", time.Now()))
+
+    for i := 0; i < 100; i++ {
+        pendingInfluxDb, pendingMysqlDb := queue.Pending()
+        if pendingInfluxDb == 0 && pendingMysqlDb == 0 {
+            break
+        }
+        time.Sleep(time.Millisecond)
+    }
+
+    queue.Close()
+    test.Equals(t, 1, len(influxDb.Calls))
+    test.Equals(t, 1, len(mysqlDb.Calls))
+}
+
+// Rows buffered by InfluxDbWriter would be removed from queue before they
+// are delivered
+func TestWriteQueueBufferedInfluxDb(t *testing.T) {
+    dir := getWriteQueueDir(t)
+    defer os.RemoveAll(dir)
+    log := test.GetLogger(t)
+    params := getWriteQueueParams(dir, 1024)
+
+    writer := piot.NewInfluxDbWriter(log, test.GetHttpClient(t, log), params)
+    influxDb := piot.NewInfluxDb(log, test.GetOrgs(t, log, test.GetDb(t)), writer, "http://uri", "user", "pass")
+
+    _, err := piot.NewWriteQueue(log, params, influxDb, test.GetMysqlDb(t, log))
+    test.Equals(t, piot.ErrWriteQueueBufferedInfluxDb, err)
+}